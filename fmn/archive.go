@@ -0,0 +1,175 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"yanmifeakeju/fmn/copyfs"
+)
+
+// archiveOptions holds the settings for the archive subcommand.
+type archiveOptions struct {
+	include []string // only archive files whose name matches one of these globs
+	exclude []string // skip files and directories whose name matches one of these globs
+	level   int      // gzip compression level
+}
+
+// archive walks sourceDir and writes every regular file to a gzip file with
+// the same relative path plus ".gz" under archiveDir. The gzip header records
+// the original name, modification time and permissions, which is what restore
+// relies on. Each file archived is reported on stdio's stderr.
+func archive(stdio *IO, sourceDir, archiveDir string, opts archiveOptions) error {
+	if d, err := os.Stat(sourceDir); err != nil || !d.IsDir() {
+		if err != nil {
+			return copyfs.NewFileError("open source directory", sourceDir, err)
+		}
+		return &copyfs.FileError{Op: "open source directory", Path: sourceDir, Err: copyfs.ErrNotDirectory}
+	}
+
+	// Fail on a bad level or pattern up front rather than on the first file.
+	if _, err := gzip.NewWriterLevel(io.Discard, opts.level); err != nil {
+		return err
+	}
+	if err := checkPatterns(slices.Concat(opts.include, opts.exclude)); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return copyfs.NewFileError("create archive directory", archiveDir, err)
+	}
+
+	// The archive directory may live inside the source; never archive it.
+	absArchive, err := filepath.Abs(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(sourceDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return copyfs.NewFileError("read", path, err)
+		}
+
+		if d.IsDir() {
+			if absPath, err := filepath.Abs(path); err == nil && absPath == absArchive {
+				return filepath.SkipDir
+			}
+			if path != sourceDir && copyfs.MatchesAny(d.Name(), opts.exclude) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Only regular files can be archived
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if copyfs.MatchesAny(d.Name(), opts.exclude) {
+			return nil
+		}
+		if len(opts.include) > 0 && !copyfs.MatchesAny(d.Name(), opts.include) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(archiveDir, relPath+".gz")
+
+		info, err := d.Info()
+		if err != nil {
+			return copyfs.NewFileError("stat", path, err)
+		}
+
+		if err := archiveFile(path, dest, info, opts.level); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(stdio.Err, "Archived: %s\n", dest)
+		return nil
+	})
+}
+
+// archiveFile compresses the file at src into dest, recording the original
+// name, modification time and permissions in the gzip header.
+func archiveFile(src, dest string, info os.FileInfo, level int) error {
+	sf, err := os.Open(src)
+	if err != nil {
+		return copyfs.NewFileError("open", src, err)
+	}
+	defer sf.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return copyfs.NewFileError("create directory", filepath.Dir(dest), err)
+	}
+
+	df, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return copyfs.NewFileError("create", dest, err)
+	}
+	defer df.Close()
+
+	zw, err := gzip.NewWriterLevel(df, level)
+	if err != nil {
+		return err
+	}
+	zw.Name = info.Name()
+	zw.ModTime = info.ModTime()
+	zw.Extra = modeExtra(info.Mode())
+
+	if _, err := io.Copy(zw, sf); err != nil {
+		return copyfs.NewFileError("archive", src, err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return copyfs.NewFileError("write", dest, err)
+	}
+	if err := df.Close(); err != nil {
+		return copyfs.NewFileError("write", dest, err)
+	}
+	return nil
+}
+
+// modeExtraID identifies the subfield of the gzip extra field in which
+// archive records a file's permission bits, as four little-endian bytes.
+var modeExtraID = [2]byte{'F', 'M'}
+
+// modeExtra returns a gzip extra field recording the permissions of mode.
+func modeExtra(mode os.FileMode) []byte {
+	extra := []byte{modeExtraID[0], modeExtraID[1], 4, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(extra[4:], uint32(mode.Perm()))
+	return extra
+}
+
+// extraMode returns the permissions modeExtra recorded in the gzip extra
+// field extra, if it has them. Subfields written by other tools are skipped.
+func extraMode(extra []byte) (os.FileMode, bool) {
+	for len(extra) >= 4 {
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+size {
+			break
+		}
+		if extra[0] == modeExtraID[0] && extra[1] == modeExtraID[1] && size == 4 {
+			return os.FileMode(binary.LittleEndian.Uint32(extra[4:8])).Perm(), true
+		}
+		extra = extra[4+size:]
+	}
+	return 0, false
+}
+
+// checkPatterns rejects a malformed glob pattern up front, rather than
+// letting it silently match nothing.
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
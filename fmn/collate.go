@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+
+	"yanmifeakeju/fmn/copyfs"
+)
+
+// nameOrder returns the comparison used to sort names. By default it applies
+// Unicode collation for locale (the root collation when locale is empty), so
+// "é" sorts next to "e" rather than after "z". byteOrder selects plain byte
+// comparison instead, for scripts that need an order independent of locale.
+func nameOrder(locale string, byteOrder bool) (func(a, b string) int, error) {
+	if byteOrder {
+		return strings.Compare, nil
+	}
+
+	tag := language.Und
+	if locale != "" {
+		var err error
+		if tag, err = language.Parse(locale); err != nil {
+			return nil, copyfs.NewUsageError("invalid locale '%s'", locale)
+		}
+	}
+	c := collate.New(tag)
+
+	// A Collator keeps scratch buffers, and ls -R sorts directories from
+	// several goroutines at once
+	var mu sync.Mutex
+	return func(a, b string) int {
+		mu.Lock()
+		n := c.CompareString(a, b)
+		mu.Unlock()
+		if n != 0 {
+			return n
+		}
+		return strings.Compare(a, b) // keep the order stable for names that collate equal
+	}, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"yanmifeakeju/fmn/copyfs"
+)
+
+// defaultConfigName is the file in the user's home directory that supplies
+// default flag values when -config is not given.
+const defaultConfigName = ".fmnrc"
+
+// globalSection is the config section whose values apply to every
+// subcommand that has a flag of the same name.
+const globalSection = "global"
+
+// config holds default flag values by subcommand, read from a JSON file such
+// as
+//
+//	{"global": {"v": 1}, "cp": {"f": true, "exclude": ["*.tmp"]}, "ls": {"R": true}}
+//
+// Each section maps flag names (without dashes) to values, so a flag only
+// changes the subcommand it is listed under. Array values are applied element
+// by element, for flags that may repeat.
+type config struct {
+	path     string // file the values were read from, for error messages
+	sections map[string]configSection
+}
+
+// configSection maps the flag names of one section of the config to their
+// values.
+type configSection map[string]json.RawMessage
+
+// loadConfig reads the config file at path. When path is empty the default
+// ~/.fmnrc is used, and a missing default file yields an empty config rather
+// than an error.
+func loadConfig(path string) (config, error) {
+	explicit := path != ""
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return config{}, nil // No home directory, so no default config
+		}
+		path = filepath.Join(home, defaultConfigName)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return config{}, nil
+		}
+		return config{}, fmt.Errorf("cannot read config '%s': %w", path, err)
+	}
+
+	cfg := config{path: path}
+	if err := json.Unmarshal(data, &cfg.sections); err != nil {
+		return config{}, copyfs.NewUsageError("invalid config '%s': %v", path, err)
+	}
+	for name := range cfg.sections {
+		if _, ok := findSubcommand(name); !ok && name != globalSection {
+			return config{}, copyfs.NewUsageError("invalid config '%s': unknown section '%s'", path, name)
+		}
+	}
+	return cfg, nil
+}
+
+// apply sets every flag in fs that has a value in the global section or in
+// the section of the subcommand fs belongs to, which wins over the global
+// one. Global keys that don't name a flag in fs are ignored, but those of
+// the subcommand's own section must. It runs after the command line is
+// parsed, and leaves alone the flags given there, along with their aliases,
+// so counting and repeatable flags don't add the config values to the
+// command line's.
+func (c config) apply(fs *flag.FlagSet) error {
+	var given []flag.Value
+	fs.Visit(func(f *flag.Flag) { given = append(given, f.Value) })
+
+	values := make(map[string]json.RawMessage)
+	for name, raw := range c.sections[globalSection] {
+		if fs.Lookup(name) != nil {
+			values[name] = raw
+		}
+	}
+	for name, raw := range c.sections[fs.Name()] {
+		if fs.Lookup(name) == nil {
+			return copyfs.NewUsageError("config '%s': '%s' has no flag '%s'", c.path, fs.Name(), name)
+		}
+		values[name] = raw
+	}
+
+	for name, raw := range values {
+		f := fs.Lookup(name)
+		if slices.ContainsFunc(given, func(v flag.Value) bool { return sameTarget(v, f.Value) }) {
+			continue
+		}
+
+		args, err := configValues(raw)
+		if err != nil {
+			return copyfs.NewUsageError("config '%s': invalid value for '%s': %v", c.path, name, err)
+		}
+		for _, v := range args {
+			if err := fs.Set(name, v); err != nil {
+				return copyfs.NewUsageError("config '%s': invalid value for '%s': %v", c.path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues converts a raw JSON value into the string form flag.Set expects.
+func configValues(raw json.RawMessage) ([]string, error) {
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		var values []string
+		for _, item := range list {
+			v, err := configValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v...)
+		}
+		return values, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []string{s}, nil
+	}
+
+	var scalar any
+	if err := json.Unmarshal(raw, &scalar); err != nil {
+		return nil, err
+	}
+	switch scalar.(type) {
+	case bool, float64:
+		return []string{strings.TrimSpace(string(raw))}, nil
+	}
+	return nil, fmt.Errorf("unsupported value %s", raw)
+}
+
+// sameTarget reports whether the flag values a and b set the same variable,
+// as aliases such as -k and -continue, or -v and -vv, do.
+func sameTarget(a, b flag.Value) bool {
+	if va, ok := a.(verboseFlag); ok {
+		vb, ok := b.(verboseFlag)
+		return ok && va.level == vb.level
+	}
+	return reflect.TypeOf(a).Comparable() && a == b
+}
@@ -0,0 +1,204 @@
+package copyfs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// checksumCacheName is the file in the destination directory that keeps
+// the checksums computed by cp -verify and -skip-identical between runs.
+const checksumCacheName = ".fmn-checksums"
+
+// isChecksumCache reports whether d is a checksum cache. Its paths and
+// times describe the tree it sits in, so directory walks leave it out
+// rather than copy it into another tree.
+func isChecksumCache(d fs.DirEntry) bool {
+	return !d.IsDir() && d.Name() == checksumCacheName
+}
+
+// checksumAlgo is the hash -verify, -skip-identical and -dedup compare with.
+const checksumAlgo = "sha256"
+
+// checksumEntry is the checksum of a file as it was when hashed.
+type checksumEntry struct {
+	size    int64
+	modTime int64 // UnixNano
+	sum     string
+}
+
+// checksumCache maps absolute paths to checksums. An entry is only trusted
+// while the file keeps the size and modification time it had when hashed,
+// so files that changed are hashed again. A nil *checksumCache caches
+// nothing and always hashes.
+type checksumCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]checksumEntry
+	dirty   bool
+}
+
+// loadChecksumCache reads the cache in the destination directory dir. A
+// missing cache starts empty; unreadable lines are dropped.
+func loadChecksumCache(fsys ReadFS, dir string) (*checksumCache, error) {
+	c := &checksumCache{path: filepath.Join(dir, checksumCacheName), entries: make(map[string]checksumEntry)}
+	f, err := fsys.Open(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, NewFileError("open checksum cache", c.path, err)
+	}
+	defer f.Close()
+
+	// Each line is "<sum> <size> <mtime> <path>"; the path may hold spaces
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		size, err1 := strconv.ParseInt(fields[1], 10, 64)
+		modTime, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		c.entries[fields[3]] = checksumEntry{size: size, modTime: modTime, sum: fields[0]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, NewFileError("read checksum cache", c.path, err)
+	}
+	return c, nil
+}
+
+// save writes the cache back if it changed.
+func (c *checksumCache) save(fsys WriteFS) error {
+	if c == nil || !c.dirty {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, err := fsys.Create(c.path)
+	if err != nil {
+		return NewFileError("write checksum cache", c.path, err)
+	}
+	w := bufio.NewWriter(f)
+	for path, e := range c.entries {
+		fmt.Fprintf(w, "%s %d %d %s\n", e.sum, e.size, e.modTime, path)
+	}
+	if err := errors.Join(w.Flush(), f.Close()); err != nil {
+		return NewFileError("write checksum cache", c.path, err)
+	}
+	return nil
+}
+
+// cacheKey is the absolute form of path, so entries survive a change of
+// working directory.
+func cacheKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// hash returns the checksum of the file at path, described by info, from
+// the cache if the file is unchanged and by reading it otherwise.
+func (c *checksumCache) hash(fsys ReadFS, path string, info os.FileInfo) (string, error) {
+	if c != nil {
+		c.mu.Lock()
+		e, ok := c.entries[cacheKey(path)]
+		c.mu.Unlock()
+		if ok && e.size == info.Size() && e.modTime == info.ModTime().UnixNano() {
+			return e.sum, nil
+		}
+	}
+
+	sum, err := HashFile(fsys, path, checksumAlgo)
+	if err != nil {
+		return "", err
+	}
+	c.set(path, info, sum)
+	return sum, nil
+}
+
+// set records the checksum of the file at path, described by info.
+func (c *checksumCache) set(path string, info os.FileInfo, sum string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[cacheKey(path)] = checksumEntry{size: info.Size(), modTime: info.ModTime().UnixNano(), sum: sum}
+	c.dirty = true
+}
+
+// forget drops the checksum recorded for path.
+func (c *checksumCache) forget(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, cacheKey(path))
+	c.dirty = true
+}
+
+// isIdentical reports whether the existing destination file at dst, for
+// -skip-identical, already holds the content of src. Only regular files of
+// the same size are hashed.
+func isIdentical(opts Options, src, dst string, srcInfo, dstInfo os.FileInfo) (bool, error) {
+	if !opts.SkipIdentical || dstInfo == nil || !dstInfo.Mode().IsRegular() || !srcInfo.Mode().IsRegular() ||
+		srcInfo.Size() != dstInfo.Size() {
+		return false, nil
+	}
+	srcSum, err := opts.checksums.hash(opts.filesystem(), src, srcInfo)
+	if err != nil {
+		return false, err
+	}
+	dstSum, err := opts.checksums.hash(opts.destination(), dst, dstInfo)
+	if err != nil {
+		return false, err
+	}
+	if srcSum != dstSum {
+		return false, nil
+	}
+	debugf(opts, "skipping '%s': identical to '%s'", src, dst)
+	opts.Skips.Add(SkipIdentical, dst)
+	opts.Stats.skip()
+	return true, nil
+}
+
+// verifyCopy checks, for -verify, that the file written at dst reads back
+// with the checksum sum computed while copying from src, and records both
+// in the cache. The destination is only read when the cache has no digest
+// for its size and time. A copy that does not match is removed, so a
+// corrupt file is never left looking like a good one.
+func verifyCopy(opts Options, src, dst string, srcInfo os.FileInfo, sum string) error {
+	dstInfo, err := statDest(opts, dst)
+	if err != nil {
+		return NewFileError("stat", dst, err)
+	}
+	dstSum, err := opts.checksums.hash(opts.destination(), dst, dstInfo)
+	if err != nil {
+		return err
+	}
+	if dstSum != sum {
+		opts.checksums.forget(dst)
+		err := &FileError{Op: "verify", Path: dst, Err: errChecksumMismatch}
+		if rmErr := opts.destination().Remove(dst); rmErr != nil {
+			return errors.Join(err, NewFileError("remove corrupt copy", dst, rmErr))
+		}
+		return err
+	}
+	debugf(opts, "verified '%s' (%s %s)", dst, checksumAlgo, sum)
+
+	opts.checksums.set(src, srcInfo, sum)
+	return nil
+}
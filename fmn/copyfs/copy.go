@@ -0,0 +1,969 @@
+package copyfs
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"yanmifeakeju/fmn/internal/ctxio"
+	"yanmifeakeju/fmn/internal/prompt"
+	"yanmifeakeju/fmn/internal/status"
+)
+
+// Copy copies the sources in paths, all but the last, to the destination that
+// is last, like cp. It validates the destination, then iterates through the
+// source paths, calling copySource for each one. It collects and returns any
+// errors that occur.
+func Copy(opts Options, paths []string) error {
+	if len(paths) < 2 {
+		return NewUsageError("copy requires a source and a destination")
+	}
+	if opts.NoClobber && opts.Force {
+		return NewUsageError("-n and -f cannot be combined")
+	}
+	lastIndex := len(paths) - 1
+	dest := paths[lastIndex]
+	sources := paths[:lastIndex]
+	if dest == "" {
+		return NewUsageError("the destination cannot be empty")
+	}
+	opts.start()
+
+	// "-" copies from stdin or to stdout
+	if dest == StdioPath || slices.Contains(sources, StdioPath) {
+		if len(sources) > 1 {
+			return NewUsageError("'-' cannot be combined with other sources")
+		}
+		return copyStream(opts, sources[0], dest)
+	}
+
+	// Sources stat-ed while preparing the destination are not stat-ed again
+	srcInfos := make([]os.FileInfo, len(sources))
+	destInfo, err := statDest(opts, dest)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if destInfo, err = createDestination(opts, sources, srcInfos, dest); err != nil {
+			return err
+		}
+	case err != nil:
+		return NewFileError("stat destination", dest, err)
+	}
+
+	if len(sources) > 1 && (destInfo == nil || !destInfo.IsDir()) {
+		return &FileError{Op: "copy multiple sources to", Path: dest, Err: ErrNotDirectory}
+	}
+
+	if opts.CheckPerms {
+		return checkPermissions(opts, sources, dest, destInfo)
+	}
+
+	// Checksums are cached next to the copies, so unchanged files are not
+	// hashed again on the next run
+	if (opts.Verify || opts.SkipIdentical) && opts.checksums == nil {
+		cacheDir := dest
+		if destInfo == nil || !destInfo.IsDir() {
+			cacheDir = filepath.Dir(dest)
+		}
+		cache, err := loadChecksumCache(opts.destination(), cacheDir)
+		if err != nil {
+			return err
+		}
+		opts.checksums = cache
+		if !opts.DryRun && !opts.PrintScript {
+			defer func() {
+				if err := cache.save(opts.destination()); err != nil {
+					opts.Log.Println(err)
+				}
+			}()
+		}
+	}
+
+	var errs []error
+	for i, src := range sources {
+		if err := opts.context().Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		err := copySource(opts, src, srcInfos[i], dest, destInfo)
+		if errors.Is(err, errQuit) {
+			break // the user stopped here; what was copied is kept
+		}
+		if err != nil {
+			errs = append(errs, err)
+			if opts.journal != nil {
+				break // it is all going to be undone
+			}
+		}
+	}
+
+	// A transactional copy keeps everything or nothing
+	if opts.journal != nil {
+		if len(errs) == 0 {
+			return opts.journal.commit(opts)
+		}
+		err := errors.Join(errs...)
+		if rollbackErr := opts.journal.rollback(opts); rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+		opts.Log.Println("copy failed; all changes were rolled back")
+		return err
+	}
+
+	// Some sources were copied, so report the failures as a partial success.
+	if len(errs) > 0 && len(errs) < len(sources) {
+		return &PartialError{Err: errors.Join(errs...)}
+	}
+	return errors.Join(errs...)
+}
+
+// createDestination prepares a destination that does not exist, as long as
+// one of the sources does, and returns its info. A single source is copied
+// to dest as its new name: a file needs only the directory above dest, and
+// the returned info is nil, while a directory is created as dest itself.
+// Otherwise, or when dest ends in a separator, dest is a directory to copy
+// into, which only -parents creates; -parents also creates missing parents.
+// The info of the source found is stored in srcInfos, at its index.
+func createDestination(opts Options, sources []string, srcInfos []os.FileInfo, dest string) (os.FileInfo, error) {
+	var src string
+	var srcInfo os.FileInfo
+	var errs []error
+	for i, path := range sources {
+		info, err := stat(opts, path)
+		if err == nil {
+			src, srcInfo = path, info
+			srcInfos[i] = info
+			break
+		}
+		errs = append(errs, NewFileError("stat source", path, err))
+	}
+	if srcInfo == nil {
+		return nil, errors.Join(errs...)
+	}
+
+	if srcInfo.IsDir() && !opts.Recursive {
+		return nil, &FileError{Op: "copy", Path: sources[0], Err: ErrOmitDirectory}
+	}
+	if srcInfo.IsDir() {
+		// Catch a copy into its own subdirectory before creating that
+		if err := checkNotInside(opts, src, dest); err != nil {
+			return nil, err
+		}
+	}
+
+	asName := len(sources) == 1 && !os.IsPathSeparator(dest[len(dest)-1])
+	if !asName && !opts.Parents {
+		return nil, &FileError{Op: "stat destination", Path: dest, Err: errNoDestination}
+	}
+
+	// A file needs only the directory above dest, which must exist without -parents
+	if asName && !srcInfo.IsDir() {
+		parent := filepath.Dir(dest)
+		_, err := statDest(opts, parent)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && opts.Parents:
+			return nil, createDir(parent, opts)
+		case errors.Is(err, fs.ErrNotExist):
+			return nil, &FileError{Op: "stat destination", Path: parent, Err: errNoDestination}
+		case err != nil:
+			return nil, NewFileError("stat destination", parent, err)
+		}
+		return nil, nil
+	}
+
+	if !opts.Parents {
+		parent := filepath.Dir(dest)
+		if _, err := statDest(opts, parent); errors.Is(err, fs.ErrNotExist) {
+			return nil, &FileError{Op: "stat destination", Path: parent, Err: errNoDestination}
+		} else if err != nil {
+			return nil, NewFileError("stat destination", parent, err)
+		}
+	}
+	if err := createDir(dest, opts); err != nil {
+		return nil, err
+	}
+	return newDir(filepath.Base(dest)), nil
+}
+
+// newDir describes a destination directory created by the copy, or that a
+// dry run would have created, so the rest of the copy can go on without
+// stat-ing it again.
+type newDir string
+
+func (d newDir) Name() string       { return string(d) }
+func (d newDir) Size() int64        { return 0 }
+func (d newDir) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
+func (d newDir) ModTime() time.Time { return time.Time{} }
+func (d newDir) IsDir() bool        { return true }
+func (d newDir) Sys() any           { return nil }
+
+// copySource handles the logic for copying a single source path (which can be
+// a file or a directory) to the destination. srcInfo describes src if it was
+// already stat-ed, and is nil otherwise.
+func copySource(opts Options, src string, srcInfo os.FileInfo, dest string, destInfo os.FileInfo) error {
+	if srcInfo == nil {
+		info, err := stat(opts, src)
+		if err != nil {
+			return NewFileError("stat source", src, err)
+		}
+		srcInfo = info
+	}
+
+	if srcInfo.IsDir() {
+		return copyDirectory(opts, src, srcInfo, dest, destInfo)
+	}
+	return copySingleFile(opts, src, dest, srcInfo, destInfo)
+}
+
+// copyDirectory handles the logic for recursively copying a directory.
+// srcInfo describes src, following a symlink to it.
+// Paths matched by .fmnignore files in the tree are skipped, unless the
+// copy is a move that has to take everything.
+func copyDirectory(opts Options, src string, srcInfo os.FileInfo, dest string, destInfo os.FileInfo) error {
+	if !opts.Recursive {
+		return &FileError{Op: "copy", Path: src, Err: ErrOmitDirectory}
+	}
+
+	if destInfo == nil || !destInfo.IsDir() {
+		return &FileError{Op: "copy directory into", Path: dest, Err: ErrNotDirectory}
+	}
+	if err := checkNotInside(opts, src, dest); err != nil {
+		return err
+	}
+
+	// Under -L a symlink can lead back to a directory already being copied
+	if opts.FollowSymlinks {
+		if slices.ContainsFunc(opts.linkedDirs, func(d os.FileInfo) bool { return IsSameFile(d, srcInfo) }) {
+			return &FileError{Op: "copy", Path: src, Err: errSymlinkLoop}
+		}
+		opts.linkedDirs = append(opts.linkedDirs[:len(opts.linkedDirs):len(opts.linkedDirs)], srcInfo)
+	}
+
+	fsys := opts.filesystem()
+	var ignore *IgnoreMatcher
+	if !opts.Everything {
+		ignore = NewIgnoreMatcher(fsys)
+	}
+
+	// A permission error on one entry, or with -k any error, is logged and
+	// skipped so the rest of the tree is still copied; the failures are
+	// returned together at the end.
+	var skipped []error
+	skipOnError := func(path string, d os.DirEntry, err error) error {
+		if d == nil || err == nil || err == filepath.SkipDir || errors.Is(err, errQuit) {
+			return err
+		}
+		switch {
+		case errors.Is(err, fs.ErrPermission):
+			opts.Skips.Add(SkipDenied, path)
+		case opts.KeepGoing:
+			opts.Skips.Add(SkipFailed, path)
+		default:
+			return err
+		}
+		opts.Log.Println(err)
+		skipped = append(skipped, err)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	// With -x, directories on another device than the root are mount points
+	// of other filesystems and are skipped
+	onOtherFS := func(path string, d os.DirEntry) bool { return false }
+	if opts.OneFileSystem {
+		if rootDev, ok := fileDevice(srcInfo); ok {
+			onOtherFS = func(path string, d os.DirEntry) bool {
+				if !d.IsDir() || path == src {
+					return false
+				}
+				info, err := d.Info()
+				if err != nil {
+					return false // reported when the directory is copied
+				}
+				dev, ok := fileDevice(info)
+				return ok && dev != rootDev
+			}
+		} else {
+			opts.Log.Printf("warning: no device IDs for '%s'; -x has no effect", src)
+		}
+	}
+
+	// With -depth, directories at the deepest level copied are created but
+	// not entered, so nothing below them is created at the destination
+	atDepthLimit := func(path string) bool {
+		if opts.MaxDepth == 0 || path == src {
+			return false
+		}
+		rel, err := filepath.Rel(src, path)
+		return err == nil && strings.Count(rel, string(filepath.Separator))+1 >= opts.MaxDepth
+	}
+
+	// Walk the source directory, from srcInfo so a symlink to it is followed
+	err := walkDirFrom(fsys, src, srcInfo, func(path string, d os.DirEntry, err error) error {
+		if err := opts.context().Err(); err != nil {
+			return err
+		}
+		if err == nil && onOtherFS(path, d) {
+			debugf(opts, "skipping '%s': on another filesystem", path)
+			opts.Skips.Add(SkipOtherFS, path)
+			return filepath.SkipDir
+		}
+		err = skipOnError(path, d, copyEntry(opts, src, dest, path, d, err, ignore))
+		if err == nil && d.IsDir() && atDepthLimit(path) {
+			debugf(opts, "not descending into '%s': at the -depth limit", path)
+			return filepath.SkipDir
+		}
+		return err
+	})
+	if err != nil || len(skipped) == 0 {
+		return err
+	}
+	return &EntryErrors{Path: src, Count: len(skipped), Err: errors.Join(skipped...)}
+}
+
+// outsideSizeRange reports whether the file at path is skipped for being
+// smaller than -min-size or larger than -max-size, recording the skip. Only
+// regular files have a size to filter on.
+func outsideSizeRange(opts Options, path string, info os.FileInfo) bool {
+	size := info.Size()
+	if !info.Mode().IsRegular() || size >= opts.MinSize && (opts.MaxSize == 0 || size <= opts.MaxSize) {
+		return false
+	}
+	debugf(opts, "skipping '%s': %d bytes is outside the size range", path, size)
+	opts.Skips.Add(SkipSize, path)
+	opts.Stats.skip()
+	return true
+}
+
+// outsideTimeRange reports whether the file at path is skipped for being
+// modified before -newer or after -older, recording the skip.
+func outsideTimeRange(opts Options, path string, info os.FileInfo) bool {
+	mtime := info.ModTime()
+	if info.IsDir() || (opts.Newer.IsZero() || mtime.After(opts.Newer)) && (opts.Older.IsZero() || mtime.Before(opts.Older)) {
+		return false
+	}
+	debugf(opts, "skipping '%s': modified %s, outside the time range", path, opts.TimeFormat.Format(mtime))
+	opts.Skips.Add(SkipTime, path)
+	opts.Stats.skip()
+	return true
+}
+
+// checkNotInside rejects copying the directory src to dest inside it, where
+// the walk would keep finding the copies it had just made. Paths on a
+// separate destination filesystem never overlap the source.
+func checkNotInside(opts Options, src, dest string) error {
+	if opts.DestFS != nil || !isWithin(src, dest) {
+		return nil
+	}
+	return &FileError{Op: "copy", Path: src, Err: fmt.Errorf("%w '%s'", errIntoItself, dest)}
+}
+
+// copyEntry copies one entry of the tree being walked by copyDirectory.
+func copyEntry(opts Options, src, dest, path string, d os.DirEntry, err error, ignore *IgnoreMatcher) error {
+	if err != nil {
+		return NewFileError("read", path, err) // Propagate errors from WalkDir itself
+	}
+	if isChecksumCache(d) {
+		debugf(opts, "skipping '%s': checksum cache", path)
+		return nil
+	}
+
+	// Skip names matching -exclude; the root itself was asked for by name
+	if path != src && MatchesAny(d.Name(), opts.Exclude) {
+		debugf(opts, "skipping '%s': matched -exclude", path)
+		opts.Skips.Add(SkipExcluded, path)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	// Skip anything listed in a .fmnignore, and pick up the rules of each directory entered
+	if ignore.Ignored(path, d.IsDir()) {
+		debugf(opts, "skipping '%s': matched %s", path, ignoreFileName)
+		opts.Skips.Add(SkipIgnored, path)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	if d.IsDir() {
+		if err := ignore.Load(path); err != nil {
+			return err
+		}
+	}
+
+	// Determine the corresponding path in the destination
+	relPath, err := filepath.Rel(src, path)
+	if err != nil {
+		return err
+	}
+	targetPath := filepath.Join(dest, relPath)
+
+	// Nothing to do for the source directory itself
+	if path == src {
+		return nil
+	}
+
+	// Check if we should proceed
+	targetInfo, statErr := statDest(opts, targetPath)
+	if statErr != nil && !os.IsNotExist(statErr) {
+		return NewFileError("stat target", targetPath, statErr)
+	}
+
+	// Files are compared with what they would overwrite, as what a symlink
+	// points to under -L
+	var fileInfo os.FileInfo
+	if !d.IsDir() {
+		if fileInfo, err = d.Info(); err != nil {
+			return NewFileError("stat source", path, err)
+		}
+		if d.Type()&fs.ModeSymlink != 0 && opts.FollowSymlinks {
+			if fileInfo, err = stat(opts, path); err != nil {
+				return NewFileError("follow symlink", path, err)
+			}
+		}
+		if outsideSizeRange(opts, path, fileInfo) || outsideTimeRange(opts, path, fileInfo) {
+			return nil
+		}
+		if same, err := isIdentical(opts, path, targetPath, fileInfo, targetInfo); err != nil || same {
+			return err
+		}
+	}
+
+	should, err := shouldOverwrite(targetPath, targetInfo, fileInfo, opts)
+	if err != nil {
+		return err
+	}
+	if !should {
+		// If we skip a directory, we must use SkipDir to prevent walking its contents.
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil // Skip file
+	}
+
+	// Perform the copy action
+	if d.IsDir() {
+		return createDir(targetPath, opts)
+	}
+
+	if fileInfo.IsDir() {
+		return copyLinkedDir(opts, path, targetPath, fileInfo)
+	}
+	if _, err := trashFile(opts, targetPath, relPath, targetInfo); err != nil {
+		return err
+	}
+	if _, err := backupFile(opts, targetPath, targetInfo); err != nil {
+		return err
+	}
+	return copySrcToDest(path, targetPath, fileInfo, opts)
+}
+
+// copySingleFile handles the logic for copying a single file to a destination.
+// A nil destInfo means dest does not exist yet and is the copy's new name.
+func copySingleFile(opts Options, src, dest string, srcInfo, destInfo os.FileInfo) error {
+	if outsideSizeRange(opts, src, srcInfo) || outsideTimeRange(opts, src, srcInfo) {
+		return nil
+	}
+
+	// Determine the final destination path.
+	finalDest := dest
+	if destInfo != nil && destInfo.IsDir() {
+		finalDest = filepath.Join(dest, filepath.Base(src))
+	}
+
+	// Stat the destination once; the self-copy and overwrite checks share it.
+	// Without -L a symlink there is looked at itself rather than followed.
+	finalDestInfo, statErr := lstatDest(opts, finalDest)
+	if statErr != nil && !os.IsNotExist(statErr) {
+		return NewFileError("stat destination", finalDest, statErr)
+	}
+
+	// Check for self-copy. This catches hard links and a source that is a
+	// symlink to the destination; a destination symlink is replaced below.
+	if IsSameFile(srcInfo, finalDestInfo) {
+		return &FileError{Op: "copy", Path: src, Err: errSameFile}
+	}
+
+	if same, err := isIdentical(opts, src, finalDest, srcInfo, finalDestInfo); err != nil || same {
+		return err
+	}
+
+	// Check if we should overwrite the destination.
+	should, err := shouldOverwrite(finalDest, finalDestInfo, srcInfo, opts)
+	if err != nil {
+		return err
+	}
+	if !should {
+		return nil // Skip file as requested.
+	}
+
+	// With -trash or -b the file being overwritten is moved out of the way first
+	moved, err := trashFile(opts, finalDest, filepath.Base(finalDest), finalDestInfo)
+	if err == nil && !moved {
+		moved, err = backupFile(opts, finalDest, finalDestInfo)
+	}
+	if err != nil {
+		return err
+	}
+	if moved {
+		finalDestInfo = nil
+	}
+
+	// Replace a symlink rather than writing through it, which could
+	// truncate the very file being copied.
+	// A transactional copy backs it up instead, like any file it replaces.
+	if finalDestInfo != nil && finalDestInfo.Mode()&os.ModeSymlink != 0 && !opts.DryRun && opts.journal == nil {
+		if opts.PrintScript {
+			fmt.Fprintf(opts.Stdout, "rm -f -- %s\n", ShellQuote(finalDest))
+		} else if err := opts.destination().Remove(finalDest); err != nil {
+			return NewFileError("replace symlink", finalDest, err)
+		}
+	}
+
+	// Perform the actual copy.
+	return copySrcToDest(src, finalDest, srcInfo, opts)
+}
+
+// StdioPath is the operand that stands for stdin as a source and stdout as
+// a destination.
+const StdioPath = "-"
+
+// copyStream copies src to dest when either one is "-", so fmn can sit in a
+// pipeline. A stream has no mode or times to preserve, so those steps are
+// skipped. A file written from stdin still goes through the overwrite checks;
+// it needs a file name, as stdin has none to put in a directory.
+func copyStream(opts Options, src, dest string) error {
+	if opts.PrintScript {
+		return NewUsageError("-print-script cannot copy from stdin or to stdout")
+	}
+	if src == StdioPath && opts.Interactive {
+		return NewUsageError("cannot combine -i with a source on stdin") // the prompt would read the data
+	}
+	if opts.DryRun {
+		fmt.Fprintf(opts.Stdout, "would copy '%s' -> '%s'\n", src, dest)
+		return nil
+	}
+
+	var r io.Reader = opts.Stdin
+	if src != StdioPath {
+		info, err := stat(opts, src)
+		if err != nil {
+			return NewFileError("stat source", src, err)
+		}
+		if info.IsDir() {
+			return &FileError{Op: "copy", Path: src, Err: errNotStreamable}
+		}
+		f, err := opts.filesystem().Open(src)
+		if err != nil {
+			return newCopyError("open", src, dest, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var w io.Writer = opts.Stdout
+	var file io.WriteCloser // the destination file, unless it is stdout
+	if dest != StdioPath {
+		info, err := lstatDest(opts, dest)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return NewFileError("stat destination", dest, err)
+		}
+		if info != nil && info.IsDir() {
+			return &FileError{Op: "copy stdin into", Path: dest, Err: errNotStreamable}
+		}
+		if should, err := shouldOverwrite(dest, info, nil, opts); err != nil || !should {
+			return err
+		}
+		if file, err = opts.destination().Create(dest); err != nil {
+			return newCopyError("create", src, dest, err)
+		}
+		w = file
+	}
+
+	status.Begin(src)
+	n, err := copyData(opts.context(), w, r, 0, opts.BufferSize)
+	if err != nil {
+		if file != nil {
+			file.Close()
+			discardCanceled(opts, dest, err)
+		}
+		return newCopyError("copy", src, dest, err)
+	}
+	status.Done(n)
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return NewFileError("write", dest, err)
+		}
+	}
+	if opts.Verbose >= VerboseFiles && dest != StdioPath {
+		fmt.Fprintf(opts.Stdout, "'%s' -> '%s'\n", src, dest)
+	}
+	return nil
+}
+
+// copySrcToDest performs the actual file copy operation with permission and timestamp preservation.
+func copySrcToDest(src, dst string, srcInfo os.FileInfo, opts Options) error {
+	// A symlink in a source tree is recreated rather than followed, where
+	// both sides support it; otherwise what it points to is copied
+	if srcInfo.Mode()&os.ModeSymlink != 0 {
+		if linked, err := copySymlink(opts, src, dst); err != nil || linked {
+			if linked {
+				opts.Stats.file(0)
+			}
+			return err
+		}
+		var err error
+		if srcInfo, err = stat(opts, src); err != nil {
+			return NewFileError("follow symlink", src, err)
+		}
+	}
+	if opts.PrintScript {
+		fmt.Fprintf(opts.Stdout, "cp -p -- %s %s\n", ShellQuote(src), ShellQuote(dst))
+		return nil
+	}
+	if opts.DryRun {
+		fmt.Fprintf(opts.Stdout, "would copy '%s' -> '%s'\n", src, dst)
+		opts.Stats.file(srcInfo.Size())
+		return nil
+	}
+	if err := opts.journal.prepare(opts, dst); err != nil {
+		return err
+	}
+	if linked, err := linkHardLinked(opts, src, dst, srcInfo); err != nil || linked {
+		if linked {
+			opts.Stats.file(0) // no data was copied
+		}
+		return err
+	}
+	if linked, err := linkDuplicate(opts, src, dst, srcInfo); err != nil || linked {
+		if linked {
+			opts.Stats.file(0)
+		}
+		return err
+	}
+
+	status.Begin(src)
+	srcFile, err := opts.filesystem().Open(src)
+	if err != nil {
+		return newCopyError("open", src, dst, err)
+	}
+	defer srcFile.Close()
+
+	fsys := opts.destination()
+	destFile, err := fsys.Create(dst)
+	if err != nil {
+		return newCopyError("create", src, dst, err)
+	}
+
+	var w io.Writer = destFile
+	var sparse *sparseWriter
+	if f, ok := useSparse(opts, destFile, srcInfo); ok {
+		sparse = &sparseWriter{f: f}
+		w = sparse
+	}
+	var progress *progressWriter
+	if opts.Progress != nil && srcInfo.Size() >= opts.ProgressMin {
+		progress = &progressWriter{w: w, path: src, total: srcInfo.Size(), fn: opts.Progress}
+		opts.Progress(src, 0, progress.total)
+		w = progress
+	}
+	var sum hash.Hash
+	if opts.dups != nil || opts.Verify {
+		sum, _ = NewHash(checksumAlgo)
+		w = io.MultiWriter(w, sum)
+	}
+
+	cloned, err := tryReflink(opts, destFile, srcFile)
+	if err != nil {
+		destFile.Close()
+		return newCopyError("clone", src, dst, err)
+	}
+	var n int64
+	if cloned {
+		// The data is shared, but -verify and -dedup still need its checksum
+		n = srcInfo.Size()
+		if sum != nil {
+			_, err = io.Copy(sum, ctxio.NewReader(opts.context(), srcFile))
+		}
+		if progress != nil {
+			progress.copied = n
+		}
+		debugf(opts, "cloned '%s'", src)
+	} else {
+		n, err = copyData(opts.context(), w, srcFile, srcInfo.Size(), opts.BufferSize)
+	}
+	if err != nil {
+		destFile.Close()
+		discardCanceled(opts, dst, err)
+		return newCopyError("copy", src, dst, err)
+	}
+	if sparse != nil {
+		if err := sparse.finish(); err != nil {
+			destFile.Close()
+			return NewFileError("write", dst, err)
+		}
+	}
+	status.Done(n)
+	opts.Stats.file(n)
+	if progress != nil {
+		progress.done()
+	}
+	// Remote destinations may only finish writing on Close, so check it
+	if err := destFile.Close(); err != nil {
+		return NewFileError("write", dst, err)
+	}
+
+	// Use the passed srcInfo for ownership, permissions and timestamps. The
+	// owner goes first, as changing it can clear the setuid and setgid bits,
+	// and extended attributes before the mode, which can make dst read-only.
+	preserveOwner(opts, dst, srcInfo)
+	preserveXattrs(opts, src, dst)
+	if err := fsys.Chmod(dst, srcInfo.Mode()); err != nil {
+		return NewFileError("set mode of", dst, err)
+	}
+
+	if err := fsys.Chtimes(dst, srcInfo.ModTime(), srcInfo.ModTime()); err != nil {
+		return NewFileError("set times of", dst, err)
+	}
+	if sum != nil {
+		digest := hex.EncodeToString(sum.Sum(nil))
+		if opts.Verify {
+			if err := verifyCopy(opts, src, dst, srcInfo, digest); err != nil {
+				return err
+			}
+		}
+		if opts.dups != nil {
+			opts.dups.add(n, digest, dst)
+		}
+	}
+	opts.links.add(srcInfo, dst)
+
+	switch {
+	case opts.Verbose >= VerboseDebug:
+		fmt.Fprintf(opts.Stdout, "'%s' -> '%s' (%d bytes, modified %s)\n", src, dst, n, opts.TimeFormat.Format(srcInfo.ModTime()))
+	case opts.Verbose >= VerboseFiles:
+		fmt.Fprintf(opts.Stdout, "'%s' -> '%s'\n", src, dst)
+	}
+
+	return nil
+}
+
+// Bounds of the buffer copyData sizes to the file being copied.
+const (
+	minCopyBuffer = 4 << 10
+	maxCopyBuffer = 1 << 20
+)
+
+// copyBufferSize returns the buffer size for copying size bytes: the size of
+// the file itself, kept between minCopyBuffer and maxCopyBuffer, so small
+// files don't allocate more than they need and big ones take fewer system
+// calls. A positive override (-buffer) is used as it is.
+func copyBufferSize(size int64, override int) int {
+	if override > 0 {
+		return override
+	}
+	return int(min(max(size, minCopyBuffer), maxCopyBuffer))
+}
+
+// copyChunk is how much a dst reading from src itself copies between checks
+// for cancellation.
+const copyChunk = 8 << 20
+
+// copyData copies src to dst with a buffer sized by copyBufferSize. A dst
+// that can read from src itself, such as an OS file using copy_file_range
+// or an sftp file writing concurrently, is left to do so unless -buffer
+// asked for a specific size. Once ctx is canceled the copy stops with its
+// error.
+func copyData(ctx context.Context, dst io.Writer, src io.Reader, size int64, override int) (int64, error) {
+	if _, ok := dst.(io.ReaderFrom); ok && override == 0 {
+		// io.CopyN keeps the fast path, as it only limits src
+		var n int64
+		for {
+			if err := ctx.Err(); err != nil {
+				return n, err
+			}
+			m, err := io.CopyN(dst, src, copyChunk)
+			n += m
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	buf := make([]byte, copyBufferSize(size, override))
+	// Hide ReadFrom and WriteTo so io.CopyBuffer really uses buf
+	return io.CopyBuffer(struct{ io.Writer }{dst}, ctxio.NewReader(ctx, src), buf)
+}
+
+// discardCanceled removes the partly written copy at dst when err is the
+// copy being canceled, so an interrupted run leaves no half-written files.
+func discardCanceled(opts Options, dst string, err error) {
+	if !errors.Is(err, context.Canceled) {
+		return
+	}
+	if rmErr := opts.destination().Remove(dst); rmErr != nil {
+		opts.Log.Println(NewFileError("remove partial copy", dst, rmErr))
+	}
+}
+
+// createDir creates a directory with appropriate permissions.
+func createDir(path string, opts Options) error {
+	if opts.PrintScript {
+		fmt.Fprintf(opts.Stdout, "mkdir -p -- %s\n", ShellQuote(path))
+		return nil
+	}
+	if opts.DryRun {
+		fmt.Fprintf(opts.Stdout, "would create directory '%s'\n", path)
+		opts.Stats.dir()
+		return nil
+	}
+	if err := opts.journal.prepare(opts, path); err != nil {
+		return err
+	}
+
+	if err := opts.destination().MkdirAll(path, 0755); err != nil {
+		return NewFileError("create directory", path, err)
+	}
+	opts.Stats.dir()
+	return nil
+}
+
+// copySession holds what a copy or move learns while it runs, unlike the
+// Options, which are fixed before it starts.
+type copySession struct {
+	mu           sync.Mutex
+	overwriteAll bool // "all" was answered at an overwrite prompt
+}
+
+// overwritingAll reports whether every remaining file is to be overwritten
+// without asking.
+func (s *copySession) overwritingAll() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.overwriteAll
+}
+
+// setOverwriteAll records an "all" answer for the rest of the session.
+func (s *copySession) setOverwriteAll() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overwriteAll = true
+}
+
+// confirmOverwrite asks the user for confirmation before overwriting a file. Besides
+// yes and no, "a" overwrites this file and all later ones without asking,
+// and "q" stops the whole operation with errQuit. The capital letter in the
+// hint is the answer used for an empty line, no unless -prompt-default says
+// otherwise.
+func confirmOverwrite(opts Options, dst string) (bool, error) {
+	if opts.session.overwritingAll() {
+		return true, nil
+	}
+	hint := "y/N/a/q"
+	if opts.Prompt.Answer {
+		hint = "Y/n/a/q"
+	}
+	question := fmt.Sprintf("overwrite '%s'? [%s]: ", dst, hint)
+	response, ok := prompt.Answer(question, opts.Stdin, opts.Stderr, opts.Prompt)
+	if !ok {
+		return opts.Prompt.Answer, nil
+	}
+	switch response {
+	case "y", "yes":
+		return true, nil
+	case "a", "all":
+		opts.session.setOverwriteAll()
+		return true, nil
+	case "q", "quit":
+		return false, errQuit
+	default:
+		return false, nil
+	}
+}
+
+// shouldOverwrite determines if a file or directory at targetPath should be overwritten
+// by the source described by srcInfo, which is nil for a directory.
+// It returns a boolean indicating if the operation should proceed and an error
+// if the operation should be aborted due to a file conflict.
+func shouldOverwrite(targetPath string, targetInfo, srcInfo os.FileInfo, opts Options) (bool, error) {
+	// If the target path doesn't exist, we can proceed.
+	if targetInfo == nil {
+		return true, nil
+	}
+
+	// If the target is a directory, we don't need to "overwrite" it.
+	// The recursive copy logic will handle creating files/subdirectories inside it.
+	if targetInfo.IsDir() {
+		return true, nil
+	}
+
+	// At this point, the target is a file that already exists.
+	// With -n it is never replaced, and that is not an error.
+	if opts.NoClobber {
+		debugf(opts, "skipping '%s': already exists", targetPath)
+		opts.Skips.Add(SkipExists, targetPath)
+		opts.Stats.skip()
+		return false, nil
+	}
+
+	// With -u it is only replaced by a newer source, and that without asking
+	// for -f; -i still prompts first.
+	if opts.Update && srcInfo != nil {
+		if !targetInfo.ModTime().Before(srcInfo.ModTime()) {
+			debugf(opts, "skipping '%s': not older than the source", targetPath)
+			opts.Skips.Add(SkipNotNewer, targetPath)
+			opts.Stats.skip()
+			return false, nil
+		}
+		if !opts.Interactive {
+			return true, nil
+		}
+	}
+
+	// We need to decide whether to overwrite it based on the options.
+	if opts.Force {
+		// Force flag is set, so we overwrite.
+		return true, nil
+	}
+
+	if opts.Interactive {
+		// Interactive flag is set, so we ask the user.
+		yes, err := confirmOverwrite(opts, targetPath)
+		if err != nil {
+			return false, err // User quit.
+		}
+		if yes {
+			return true, nil // User said yes, or all.
+		}
+		// User said no; skip the file, but it's not an error.
+		debugf(opts, "skipping '%s': overwrite declined", targetPath)
+		opts.Skips.Add(SkipDeclined, targetPath)
+		opts.Stats.skip()
+		return false, nil
+	}
+
+	// Default behavior: file exists, and no -f or -i is provided.
+	// This is an error condition.
+	return false, &FileError{Op: "overwrite", Path: targetPath, Err: ErrExists}
+}
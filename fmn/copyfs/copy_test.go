@@ -0,0 +1,1988 @@
+package copyfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"yanmifeakeju/fmn/internal/status"
+	"yanmifeakeju/fmn/internal/testfs"
+)
+
+// TestCopy is a table-driven test for the copy functionality, covering various
+// scenarios including force and interactive modes.
+func TestCopy(t *testing.T) {
+	testCases := []struct {
+		name            string
+		opts            Options
+		setup           func(t *testing.T) (srcPaths []string, destPath string)
+		userInput       string // For interactive tests
+		wantErr         bool
+		wantErrContains string
+		wantContent     map[string]string // map[filepath]content
+		wantNoContent   []string          // list of filepaths that should NOT exist
+	}{
+		// --- Success Cases ---
+		{
+			name: "Copy single file to directory",
+			opts: Options{},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file1.txt", Content: "test content"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				return srcFiles, destDir
+			},
+			wantErr: false,
+			wantContent: map[string]string{
+				"file1.txt": "test content",
+			},
+		},
+		{
+			name: "Copy multiple files to directory",
+			opts: Options{},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file1.txt", Content: "content1"},
+					{Filename: "file2.txt", Content: "content2"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				return srcFiles, destDir
+			},
+			wantErr: false,
+			wantContent: map[string]string{
+				"file1.txt": "content1",
+				"file2.txt": "content2",
+			},
+		},
+		{
+			name: "Recursive copy",
+			opts: Options{Recursive: true},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				srcDir, _ := testfs.SetupDir(t, []testfs.File{
+					{Path: "src", Filename: "root.txt", Content: "root"},
+					{Path: "src/subdir", Filename: "sub.txt", Content: "sub"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				return []string{filepath.Join(srcDir, "src")}, destDir
+			},
+			wantErr: false,
+			wantContent: map[string]string{
+				"root.txt":       "root",
+				"subdir/sub.txt": "sub",
+			},
+		},
+		{
+			name: "Recursive copy honours .fmnignore",
+			opts: Options{Recursive: true},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				srcDir, _ := testfs.SetupDir(t, []testfs.File{
+					{Path: "src", Filename: ".fmnignore", Content: "*.tmp\nbuild/\n"},
+					{Path: "src", Filename: "keep.txt", Content: "keep"},
+					{Path: "src", Filename: "scratch.tmp", Content: "tmp"},
+					{Path: "src/build", Filename: "out.bin", Content: "bin"},
+					{Path: "src/sub", Filename: ".fmnignore", Content: "!important.tmp\n"},
+					{Path: "src/sub", Filename: "important.tmp", Content: "important"},
+					{Path: "src/sub", Filename: "other.tmp", Content: "other"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				return []string{filepath.Join(srcDir, "src")}, destDir
+			},
+			wantErr: false,
+			wantContent: map[string]string{
+				"keep.txt":          "keep",
+				".fmnignore":        "*.tmp\nbuild/\n",
+				"sub/important.tmp": "important",
+			},
+			wantNoContent: []string{"scratch.tmp", "build", "sub/other.tmp"},
+		},
+		// --- Overwrite Logic ---
+		{
+			name: "Overwrite with force",
+			opts: Options{Force: true},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file.txt", Content: "new content"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file.txt", Content: "old content"},
+				})
+				return srcFiles, destDir
+			},
+			wantErr: false,
+			wantContent: map[string]string{
+				"file.txt": "new content",
+			},
+		},
+		{
+			name: "Overwrite interactive - yes",
+			opts: Options{Interactive: true},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file.txt", Content: "new content"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file.txt", Content: "old content"},
+				})
+				return srcFiles, destDir
+			},
+			userInput: "y",
+			wantErr:   false,
+			wantContent: map[string]string{
+				"file.txt": "new content",
+			},
+		},
+		{
+			name: "Overwrite interactive - no",
+			opts: Options{Interactive: true},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file.txt", Content: "new content"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file.txt", Content: "old content"},
+				})
+				return srcFiles, destDir
+			},
+			userInput: "n",
+			wantErr:   false,
+			wantContent: map[string]string{
+				"file.txt": "old content",
+			},
+		},
+		// --- Error Cases ---
+		{
+			name: "Fail on overwrite by default",
+			opts: Options{},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file.txt", Content: "new content"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file.txt", Content: "old content"},
+				})
+				return srcFiles, destDir
+			},
+			wantErr:         true,
+			wantErrContains: "already exists",
+			wantContent: map[string]string{
+				"file.txt": "old content",
+			},
+		},
+		{
+			name: "Source does not exist",
+			opts: Options{},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				return []string{"nonexistent.txt"}, destDir
+			},
+			wantErr:         true,
+			wantErrContains: "cannot stat source",
+		},
+		{
+			name: "Copy directory without recursive flag",
+			opts: Options{},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				srcDir, _ := testfs.SetupDir(t, []testfs.File{
+					{Path: "src", Filename: "file.txt", Content: "content"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				return []string{filepath.Join(srcDir, "src")}, destDir
+			},
+			wantErr:         true,
+			wantErrContains: "omitting directory",
+		},
+		{
+			name: "Multiple files to non-directory destination",
+			opts: Options{},
+			setup: func(t *testing.T) (srcPaths []string, destPath string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{
+					{Filename: "file1.txt", Content: "content1"},
+					{Filename: "file2.txt", Content: "content2"},
+				})
+				_, destFile := testfs.SetupDir(t, []testfs.File{
+					{Filename: "dest.txt", Content: "existing"},
+				})
+				return srcFiles, destFile[0]
+			},
+			wantErr:         true,
+			wantErrContains: "not a directory",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Setup ---
+			var inBuf, outBuf bytes.Buffer
+			if tc.userInput != "" {
+				inBuf.WriteString(tc.userInput + "\n")
+			}
+			opts := tc.opts
+			opts.Stdin, opts.Stdout, opts.Stderr = &inBuf, &outBuf, &outBuf
+
+			srcPaths, destPath := tc.setup(t)
+			args := append(srcPaths, destPath)
+
+			// --- Execute ---
+			err := Copy(opts, args)
+
+			// --- Assert ---
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, but got nil")
+				} else if tc.wantErrContains != "" && !strings.Contains(err.Error(), tc.wantErrContains) {
+					t.Errorf("expected error to contain %q, got %q", tc.wantErrContains, err.Error())
+				}
+			} else if err != nil {
+				t.Errorf("did not expect an error, but got: %v", err)
+			}
+
+			// Verify content of files that should exist
+			for file, expectedContent := range tc.wantContent {
+				fullPath := filepath.Join(destPath, file)
+				content, err := os.ReadFile(fullPath)
+				if err != nil {
+					t.Errorf("could not read expected file '%s': %v", fullPath, err)
+					continue
+				}
+				if string(content) != expectedContent {
+					t.Errorf("content mismatch for '%s': got %q, want %q", file, string(content), expectedContent)
+				}
+			}
+
+			// Verify files that should NOT exist
+			for _, file := range tc.wantNoContent {
+				fullPath := filepath.Join(destPath, file)
+				if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+					t.Errorf("file '%s' should not exist, but it does", fullPath)
+				}
+			}
+		})
+	}
+}
+
+// TestCopySameFile checks self-copy detection with hard links and symlinks.
+func TestCopySameFile(t *testing.T) {
+	testCases := []struct {
+		name        string
+		link        func(src, dst string) error
+		linkToSrc   bool // the link at dst points at src rather than the other way round
+		dereference bool
+		wantErrIs   error
+	}{
+		{name: "Hard link", link: os.Link, wantErrIs: errSameFile},
+		{name: "Destination symlink to source is replaced", link: os.Symlink},
+		{name: "Destination symlink followed with -L", link: os.Symlink, dereference: true, wantErrIs: errSameFile},
+		{name: "Source symlink to destination", link: os.Symlink, linkToSrc: true, wantErrIs: errSameFile},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "content"}})
+			src, dst := srcFiles[0], filepath.Join(t.TempDir(), "file.txt")
+			if tc.linkToSrc {
+				// The source is a link to a real file at the destination
+				if err := os.Rename(src, dst); err != nil {
+					t.Fatal(err)
+				}
+				if err := tc.link(dst, src); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := tc.link(src, dst); err != nil {
+				t.Fatal(err)
+			}
+
+			err := Copy(Options{Force: true, Dereference: tc.dereference}, []string{src, dst})
+			if tc.wantErrIs != nil {
+				if !errors.Is(err, tc.wantErrIs) {
+					t.Fatalf("expected %v, got %v", tc.wantErrIs, err)
+				}
+			} else if err != nil {
+				t.Fatalf("did not expect an error, but got: %v", err)
+			}
+
+			// Whatever happened, no content may be lost
+			for _, path := range []string{src, dst} {
+				if content, err := os.ReadFile(path); err != nil || string(content) != "content" {
+					t.Errorf("%s: got %q (err: %v), want %q", path, content, err, "content")
+				}
+			}
+			if tc.wantErrIs == nil {
+				if info, err := os.Lstat(dst); err != nil || info.Mode()&os.ModeSymlink != 0 {
+					t.Errorf("expected %s to be replaced by a regular file", dst)
+				}
+			}
+		})
+	}
+}
+
+// TestCopyBackup checks that -b renames overwritten files with the -S
+// suffix, replacing an older backup, for single files and whole trees.
+func TestCopyBackup(t *testing.T) {
+	srcDir, srcFiles := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "new a"},
+		{Path: "sub", Filename: "b.txt", Content: "new b"},
+	})
+	destDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "old a"},
+		{Filename: "a.txt~", Content: "older a"},
+		{Path: "sub", Filename: "b.txt", Content: "old b"},
+	})
+
+	opts := Options{Force: true, Backup: true, Suffix: "~"}
+	if err := Copy(opts, []string{srcFiles[0], destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	opts.Recursive, opts.Suffix = true, ".bak"
+	if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+
+	for rel, want := range map[string]string{
+		"a.txt":         "new a",
+		"a.txt~":        "old a",
+		"a.txt.bak":     "new a", // from the recursive copy
+		"sub/b.txt":     "new b",
+		"sub/b.txt.bak": "old b",
+	} {
+		path := filepath.Join(destDir, filepath.FromSlash(rel))
+		if content, err := os.ReadFile(path); err != nil || string(content) != want {
+			t.Errorf("%s: got %q (err: %v), want %q", rel, content, err, want)
+		}
+	}
+}
+
+// TestCopyStdio checks that "-" copies from stdin and to stdout.
+func TestCopyStdio(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "from-stdin.txt")
+	if err := Copy(Options{Stdin: strings.NewReader("piped data"), Stdout: io.Discard, Stderr: io.Discard}, []string{"-", dest}); err != nil {
+		t.Fatalf("copy from stdin failed: %v", err)
+	}
+	if got, err := os.ReadFile(dest); err != nil || string(got) != "piped data" {
+		t.Errorf("got %q (err: %v), want %q", got, err, "piped data")
+	}
+
+	var outBuf bytes.Buffer
+	if err := Copy(Options{Verbose: VerboseDebug, Stdout: &outBuf, Stderr: io.Discard}, []string{dest, "-"}); err != nil {
+		t.Fatalf("copy to stdout failed: %v", err)
+	}
+	if outBuf.String() != "piped data" {
+		t.Errorf("got %q on stdout, want only the data", outBuf.String())
+	}
+
+	// Streams have no name to put in a directory, and still respect -f
+	for _, args := range [][]string{{"-", dir}, {"-", dest}, {dir, "-"}} {
+		if err := Copy(Options{Stdin: strings.NewReader("more"), Stdout: io.Discard, Stderr: io.Discard}, args); err == nil {
+			t.Errorf("copy %v: expected an error", args)
+		}
+	}
+}
+
+// crossDeviceFS is the local filesystem with renames failing as they do
+// between devices.
+type crossDeviceFS struct{ OSFS }
+
+func (crossDeviceFS) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errCrossDevice}
+}
+
+// TestMove checks that mv renames, copies and removes across devices
+// without leaving ignored files behind, and refuses to move onto itself.
+func TestMove(t *testing.T) {
+	var outBuf bytes.Buffer
+
+	srcDir, srcFiles := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "a"},
+		{Filename: ".fmnignore", Content: "*.log\n"},
+		{Path: "sub", Filename: "b.log", Content: "b"},
+	})
+	destDir := t.TempDir()
+
+	renamed := filepath.Join(destDir, "renamed.txt")
+	if err := Move(Options{DryRun: true, Stdout: &outBuf, Stderr: io.Discard}, []string{srcFiles[0], renamed}); err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if !strings.Contains(outBuf.String(), "would move") {
+		t.Errorf("dry run printed %q, want a 'would move' line", outBuf.String())
+	}
+	if _, err := os.Stat(renamed); !os.IsNotExist(err) {
+		t.Errorf("dry run moved the file")
+	}
+
+	if err := Move(Options{Stdout: &outBuf, Stderr: io.Discard}, []string{srcFiles[0], renamed}); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	if got, err := os.ReadFile(renamed); err != nil || string(got) != "a" {
+		t.Errorf("renamed file: got %q (err: %v), want %q", got, err, "a")
+	}
+	if _, err := os.Stat(srcFiles[0]); !os.IsNotExist(err) {
+		t.Errorf("source still exists after the move")
+	}
+
+	if err := Move(Options{Stdout: &outBuf, Stderr: io.Discard}, []string{renamed, renamed}); !errors.Is(err, errSameFile) {
+		t.Errorf("expected errSameFile moving a file onto itself, got %v", err)
+	}
+
+	if err := Move(Options{FS: crossDeviceFS{}, Stdout: &outBuf, Stderr: io.Discard}, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("move across devices failed: %v", err)
+	}
+	moved := filepath.Join(destDir, filepath.Base(srcDir))
+	if got, err := os.ReadFile(filepath.Join(moved, "sub", "b.log")); err != nil || string(got) != "b" {
+		t.Errorf("ignored file: got %q (err: %v), want %q", got, err, "b")
+	}
+	if _, err := os.Stat(srcDir); !os.IsNotExist(err) {
+		t.Errorf("source directory still exists after the move")
+	}
+}
+
+// TestCopyToNewName checks that a single source is copied to a destination
+// that does not exist as its new name, while several sources still need an
+// existing directory.
+func TestCopyToNewName(t *testing.T) {
+	srcDir, srcFiles := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "a"},
+		{Path: "sub", Filename: "b.txt", Content: "b"},
+	})
+	destDir := t.TempDir()
+
+	newFile := filepath.Join(destDir, "renamed.txt")
+	if err := Copy(Options{}, []string{srcFiles[0], newFile}); err != nil {
+		t.Fatalf("copy to a new file name failed: %v", err)
+	}
+	newDir := filepath.Join(destDir, "renamed")
+	if err := Copy(Options{Recursive: true}, []string{srcDir, newDir}); err != nil {
+		t.Fatalf("copy to a new directory name failed: %v", err)
+	}
+	for path, want := range map[string]string{
+		newFile:                               "a",
+		filepath.Join(newDir, "a.txt"):        "a",
+		filepath.Join(newDir, "sub", "b.txt"): "b",
+	} {
+		if got, err := os.ReadFile(path); err != nil || string(got) != want {
+			t.Errorf("%s: got %q (err: %v), want %q", path, got, err, want)
+		}
+	}
+
+	if err := Copy(Options{}, append(srcFiles, filepath.Join(destDir, "missing"))); !errors.Is(err, errNoDestination) {
+		t.Errorf("expected errNoDestination for several sources, got %v", err)
+	}
+}
+
+// TestCopyParents checks that -parents creates a missing destination
+// directory, keeps a new file name as a name, and is suggested without it.
+func TestCopyParents(t *testing.T) {
+	_, srcFiles := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "a"},
+		{Filename: "b.txt", Content: "b"},
+	})
+	destDir := t.TempDir()
+
+	missing := filepath.Join(destDir, "new", "a.txt")
+	if err := Copy(Options{}, []string{srcFiles[0], missing}); !errors.Is(err, errNoDestination) {
+		t.Errorf("expected errNoDestination without -parents, got %v", err)
+	}
+
+	opts := Options{Parents: true}
+	into := filepath.Join(destDir, "one", "two")
+	if err := Copy(opts, append(srcFiles, into)); err != nil {
+		t.Fatalf("copy into a new directory failed: %v", err)
+	}
+	renamed := filepath.Join(destDir, "three", "c.txt")
+	if err := Copy(opts, []string{srcFiles[0], renamed}); err != nil {
+		t.Fatalf("copy to a new name failed: %v", err)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(into, "a.txt"): "a",
+		filepath.Join(into, "b.txt"): "b",
+		renamed:                      "a",
+	} {
+		if got, err := os.ReadFile(path); err != nil || string(got) != want {
+			t.Errorf("%s: got %q (err: %v), want %q", path, got, err, want)
+		}
+	}
+
+	// Nothing is created when no source exists
+	empty := filepath.Join(destDir, "empty")
+	if err := Copy(opts, []string{filepath.Join(destDir, "missing.txt"), empty + string(filepath.Separator)}); err == nil {
+		t.Error("expected an error for a missing source")
+	}
+	if _, err := os.Stat(empty); !os.IsNotExist(err) {
+		t.Errorf("destination was created for a missing source")
+	}
+}
+
+// TestCopyKeepGoing checks that one failing entry stops a recursive copy by
+// default, and that -k copies the rest and returns the failure at the end.
+func TestCopyKeepGoing(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Path: "sub", Filename: "a.txt", Content: "a"},
+		{Filename: "z.txt", Content: "z"},
+	})
+
+	for _, keepGoing := range []bool{false, true} {
+		// A file where the source has a directory cannot be overwritten
+		destDir, _ := testfs.SetupDir(t, []testfs.File{{Filename: "sub", Content: "file"}})
+		opts := Options{Recursive: true, KeepGoing: keepGoing, Skips: &SkipReport{}}
+		err := Copy(opts, []string{srcDir, destDir})
+		if !errors.Is(err, ErrExists) {
+			t.Errorf("keepGoing=%v: expected ErrExists, got %v", keepGoing, err)
+		}
+
+		_, statErr := os.Stat(filepath.Join(destDir, "z.txt"))
+		if copied := statErr == nil; copied != keepGoing {
+			t.Errorf("keepGoing=%v: z.txt copied = %v", keepGoing, copied)
+		}
+		if keepGoing && len(opts.Skips.paths[SkipFailed]) != 1 {
+			t.Errorf("expected one failed path, got %v", opts.Skips.paths[SkipFailed])
+		}
+	}
+}
+
+// cancelFS cancels a context as soon as a file opened through it is read.
+type cancelFS struct {
+	OSFS
+	cancel context.CancelFunc
+}
+
+func (f cancelFS) Open(name string) (fs.File, error) {
+	file, err := f.OSFS.Open(name)
+	return cancelFile{file, f.cancel}, err
+}
+
+type cancelFile struct {
+	fs.File
+	cancel context.CancelFunc
+}
+
+func (f cancelFile) Read(p []byte) (int, error) {
+	f.cancel()
+	return f.File.Read(p)
+}
+
+// TestCopyCancel checks that a canceled copy stops with context.Canceled and
+// leaves no partly written file behind.
+func TestCopyCancel(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: strings.Repeat("a", 64<<10)},
+		{Path: "sub", Filename: "b.txt", Content: "b"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	destDir := t.TempDir()
+	err := Copy(Options{Recursive: true, Context: ctx}, []string{srcDir, filepath.Join(destDir, "copy")})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "copy", "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a file was copied after the copy was canceled")
+	}
+
+	// Canceled while the data is being copied
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	dest := filepath.Join(destDir, "a.txt")
+	opts := Options{Context: ctx, FS: cancelFS{cancel: cancel}, BufferSize: 4096}
+	if err := Copy(opts, []string{filepath.Join(srcDir, "a.txt"), dest}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("the partly written copy was left behind")
+	}
+}
+
+// TestCopyNoClobber checks that -n skips existing files without an error,
+// and cannot be combined with -f.
+func TestCopyNoClobber(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "exists.txt", Content: "new"},
+		{Filename: "added.txt", Content: "new"},
+	})
+	destDir, _ := testfs.SetupDir(t, []testfs.File{{Filename: "exists.txt", Content: "old"}})
+
+	opts := Options{Recursive: true, NoClobber: true, Skips: &SkipReport{}}
+	if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	for name, want := range map[string]string{"exists.txt": "old", "added.txt": "new"} {
+		if got, err := os.ReadFile(filepath.Join(destDir, name)); err != nil || string(got) != want {
+			t.Errorf("%s: got %q (err: %v), want %q", name, got, err, want)
+		}
+	}
+	if got := opts.Skips.paths[SkipExists]; len(got) != 1 {
+		t.Errorf("expected one skipped path, got %v", got)
+	}
+
+	opts.Force = true
+	var usageErr *UsageError
+	if err := Copy(opts, []string{srcDir, destDir}); !errors.As(err, &usageErr) {
+		t.Errorf("expected a usage error for -n with -f, got %v", err)
+	}
+}
+
+// TestCopyDepth checks that -depth stops a recursive copy at the given
+// level, without creating the directories below it.
+func TestCopyDepth(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "top.txt"},
+		{Path: "one", Filename: "a.txt"},
+		{Path: filepath.Join("one", "two"), Filename: "b.txt"},
+		{Path: filepath.Join("one", "two", "three"), Filename: "c.txt"},
+	})
+
+	testCases := []struct {
+		depth int // as given to -depth
+		want  []string
+		skip  []string
+	}{
+		{0, []string{"top.txt", "one"}, []string{"one/a.txt", "one/two"}},
+		{1, []string{"one/a.txt", "one/two"}, []string{"one/two/b.txt", "one/two/three"}},
+		{-1, []string{"one/two/three/c.txt"}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprint(tc.depth), func(t *testing.T) {
+			destDir := t.TempDir()
+			opts := Options{Recursive: true, MaxDepth: tc.depth + 1}
+			if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+				t.Fatalf("copy failed: %v", err)
+			}
+			for _, rel := range tc.want {
+				if _, err := os.Lstat(filepath.Join(destDir, filepath.FromSlash(rel))); err != nil {
+					t.Errorf("expected %s to be copied: %v", rel, err)
+				}
+			}
+			for _, rel := range tc.skip {
+				if _, err := os.Lstat(filepath.Join(destDir, filepath.FromSlash(rel))); err == nil {
+					t.Errorf("expected %s not to be created", rel)
+				}
+			}
+		})
+	}
+}
+
+// TestCopyUpdate checks that -u replaces only destination files older than
+// their source, without needing -f, and that -i only asks about those.
+func TestCopyUpdate(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "stale.txt", Content: "new"},
+		{Filename: "fresh.txt", Content: "new"},
+		{Filename: "added.txt", Content: "new"},
+	})
+	now := time.Now()
+	setup := func() string {
+		destDir, _ := testfs.SetupDir(t, []testfs.File{
+			{Filename: "stale.txt", Content: "old"},
+			{Filename: "fresh.txt", Content: "old"},
+		})
+		for name, mtime := range map[string]time.Time{"stale.txt": now.Add(-time.Hour), "fresh.txt": now.Add(time.Hour)} {
+			if err := os.Chtimes(filepath.Join(destDir, name), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return destDir
+	}
+	check := func(destDir string, want map[string]string) {
+		t.Helper()
+		for name, content := range want {
+			if got, err := os.ReadFile(filepath.Join(destDir, name)); err != nil || string(got) != content {
+				t.Errorf("%s: got %q (err: %v), want %q", name, got, err, content)
+			}
+		}
+	}
+
+	destDir := setup()
+	if err := Copy(Options{Recursive: true, Update: true}, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	check(destDir, map[string]string{"stale.txt": "new", "fresh.txt": "old", "added.txt": "new"})
+
+	var errBuf bytes.Buffer
+	destDir = setup()
+	if err := Copy(Options{Recursive: true, Update: true, Interactive: true, Stdin: strings.NewReader("n\n"), Stdout: io.Discard, Stderr: &errBuf}, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	check(destDir, map[string]string{"stale.txt": "old", "fresh.txt": "old", "added.txt": "new"})
+	if n := strings.Count(errBuf.String(), "overwrite"); n != 1 || !strings.Contains(errBuf.String(), "stale.txt") {
+		t.Errorf("expected a single prompt for stale.txt, got %q", errBuf.String())
+	}
+}
+
+// TestCopyIntoOwnSubdirectory checks that a directory cannot be copied into
+// a directory below it, existing or not, and that nothing is written.
+func TestCopyIntoOwnSubdirectory(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "file.txt", Content: "content"},
+		{Path: "sub"},
+	})
+
+	for _, dest := range []string{filepath.Join(srcDir, "sub"), filepath.Join(srcDir, "new")} {
+		err := Copy(Options{Recursive: true}, []string{srcDir, dest})
+		if !errors.Is(err, errIntoItself) {
+			t.Errorf("copy to %s: expected errIntoItself, got %v", dest, err)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Join(srcDir, "sub"))
+	if len(entries) > 0 {
+		t.Errorf("expected nothing to be copied, found %d entries", len(entries))
+	}
+	if _, err := os.Stat(filepath.Join(srcDir, "new")); !os.IsNotExist(err) {
+		t.Errorf("expected the missing destination not to be created")
+	}
+}
+
+// TestCopyOneFileSystemNoDevice checks that -x warns and copies everything
+// when the source filesystem has no device IDs to compare.
+func TestCopyOneFileSystemNoDevice(t *testing.T) {
+	mapFS := fstest.MapFS{
+		"src/a.txt":     {Data: []byte("a")},
+		"src/mnt/b.txt": {Data: []byte("b")},
+	}
+	destDir := t.TempDir()
+	var errBuf bytes.Buffer
+	opts := Options{Recursive: true, OneFileSystem: true, FS: IOFS{mapFS}, DestFS: OSFS{}}
+	opts.Stdout, opts.Stderr = io.Discard, &errBuf
+	if err := Copy(opts, []string{"src", destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if !strings.Contains(errBuf.String(), "-x has no effect") {
+		t.Errorf("expected a warning, got %q", errBuf.String())
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "mnt", "b.txt")); err != nil {
+		t.Errorf("expected everything to be copied: %v", err)
+	}
+}
+
+// TestCopyPromptAllQuit checks the "a" and "q" answers to the overwrite
+// Prompt: all overwrites the rest without asking, quit stops cleanly.
+func TestCopyPromptAllQuit(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "new"},
+		{Filename: "b.txt", Content: "new"},
+		{Filename: "c.txt", Content: "new"},
+	})
+
+	testCases := []struct {
+		name        string
+		stdin       string
+		want        string // contents of a.txt, b.txt and c.txt after the copy
+		wantPrompts int
+	}{
+		{"All", "n\na\n", "old new new", 2},
+		{"Quit", "y\nq\n", "new old old", 2},
+		{"Default is no", "\n\n\n", "old old old", 3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			destDir, _ := testfs.SetupDir(t, []testfs.File{
+				{Filename: "a.txt", Content: "old"},
+				{Filename: "b.txt", Content: "old"},
+				{Filename: "c.txt", Content: "old"},
+			})
+			var errBuf bytes.Buffer
+			opts := Options{Recursive: true, Interactive: true}
+			opts.Stdin, opts.Stdout, opts.Stderr = strings.NewReader(tc.stdin), io.Discard, &errBuf
+
+			if err := Copy(opts, []string{srcDir + string(filepath.Separator) + ".", destDir}); err != nil {
+				t.Fatalf("did not expect an error, but got: %v", err)
+			}
+			var got []string
+			for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+				content, _ := os.ReadFile(filepath.Join(destDir, name))
+				got = append(got, string(content))
+			}
+			if strings.Join(got, " ") != tc.want {
+				t.Errorf("got %q, want %q", strings.Join(got, " "), tc.want)
+			}
+			if n := strings.Count(errBuf.String(), "[y/N/a/q]"); n != tc.wantPrompts {
+				t.Errorf("expected %d prompts, got %q", tc.wantPrompts, errBuf.String())
+			}
+		})
+	}
+}
+
+// TestCopyUnreadableSubdirectory checks that a recursive copy skips a
+// chmod-0000 subdirectory, copies everything else and reports the failure.
+func TestCopyUnreadableSubdirectory(t *testing.T) {
+	testfs.SkipIfRoot(t)
+
+	var errBuf bytes.Buffer
+
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Path: "locked", Filename: "hidden.txt", Content: "hidden"},
+		{Path: "open", Filename: "file.txt", Content: "content"},
+	})
+	locked := filepath.Join(srcDir, "locked")
+	if err := os.Chmod(locked, 0000); err != nil {
+		t.Fatalf("Failed to change permissions: %v", err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0755) })
+	destDir, _ := testfs.SetupDir(t, []testfs.File{})
+
+	err := Copy(Options{Recursive: true, Stdout: io.Discard, Stderr: &errBuf}, []string{srcDir, destDir})
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected a permission error, got %v", err)
+	}
+	if !strings.Contains(errBuf.String(), locked) {
+		t.Errorf("expected error log to name %s, got:\n%s", locked, errBuf.String())
+	}
+	if content, err := os.ReadFile(filepath.Join(destDir, "open", "file.txt")); err != nil || string(content) != "content" {
+		t.Errorf("expected the readable subdirectory to be copied, got %q (err: %v)", content, err)
+	}
+}
+
+// TestCheckPerms checks that -check-perms reports every unreadable source
+// and unwritable destination directory without copying anything.
+func TestCheckPerms(t *testing.T) {
+	testfs.SkipIfRoot(t)
+
+	var errBuf bytes.Buffer
+
+	srcDir, files := testfs.SetupDir(t, []testfs.File{
+		{Filename: "secret.txt", Content: "secret"},
+		{Path: "locked", Filename: "hidden.txt", Content: "hidden"},
+		{Path: "shared", Filename: "file.txt", Content: "content"},
+	})
+	destDir, _ := testfs.SetupDir(t, []testfs.File{{Path: "shared"}})
+	locked := filepath.Join(srcDir, "locked")
+	shared := filepath.Join(destDir, "shared")
+	for path, mode := range map[string]os.FileMode{files[0]: 0000, locked: 0000, shared: 0555} {
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatalf("Failed to change permissions: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		os.Chmod(locked, 0755)
+		os.Chmod(shared, 0755)
+	})
+
+	opts := Options{Recursive: true, CheckPerms: true, Stdout: io.Discard, Stderr: &errBuf}
+	err := Copy(opts, []string{srcDir, destDir})
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected a permission error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "3 problems") {
+		t.Errorf("expected 3 problems, got %v", err)
+	}
+	for _, path := range []string{files[0], locked, shared} {
+		if !strings.Contains(errBuf.String(), "'"+path+"'") {
+			t.Errorf("expected error log to name %s, got:\n%s", path, errBuf.String())
+		}
+	}
+	if entries, _ := os.ReadDir(destDir); len(entries) != 1 {
+		t.Errorf("expected nothing to be copied, found %d entries", len(entries))
+	}
+
+	// With the problems fixed the check passes and still copies nothing
+	for _, path := range []string{files[0], locked, shared} {
+		os.Chmod(path, 0755)
+	}
+	if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+		t.Errorf("expected the check to pass, got %v", err)
+	}
+	if entries, _ := os.ReadDir(destDir); len(entries) != 1 {
+		t.Errorf("expected nothing to be copied, found %d entries", len(entries))
+	}
+}
+
+// exdevFS is the real filesystem with every hard link crossing devices.
+type exdevFS struct {
+	OSFS
+}
+
+func (exdevFS) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errCrossDevice}
+}
+
+// TestCopyDedup checks that -dedup hard-links files whose content was already
+// copied, and falls back to copying when links would cross devices.
+func TestCopyDedup(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "same"},
+		{Filename: "b.txt", Content: "same"},
+		{Filename: "c.txt", Content: "diff"},
+		{Path: "sub", Filename: "d.txt", Content: "same"},
+	})
+
+	testCases := []struct {
+		name       string
+		fsys       WriteFS
+		wantLinked bool
+		wantWarn   bool
+	}{
+		{"Same device", OSFS{}, true, false},
+		{"Cross device", exdevFS{}, false, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var errBuf bytes.Buffer
+			destDir, _ := testfs.SetupDir(t, []testfs.File{})
+
+			opts := Options{Recursive: true, Dedup: true, FS: tc.fsys}
+			opts.Stdout, opts.Stderr = io.Discard, &errBuf
+			if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+				t.Fatalf("copy failed: %v", err)
+			}
+
+			infos := make(map[string]os.FileInfo)
+			for name, want := range map[string]string{"a.txt": "same", "b.txt": "same", "c.txt": "diff", "sub/d.txt": "same"} {
+				path := filepath.Join(destDir, name)
+				if content, err := os.ReadFile(path); err != nil || string(content) != want {
+					t.Errorf("%s: got %q (err: %v), want %q", name, content, err, want)
+				}
+				infos[name], _ = os.Stat(path)
+			}
+			if got := os.SameFile(infos["a.txt"], infos["b.txt"]) && os.SameFile(infos["a.txt"], infos["sub/d.txt"]); got != tc.wantLinked {
+				t.Errorf("duplicates linked: got %v, want %v", got, tc.wantLinked)
+			}
+			if os.SameFile(infos["a.txt"], infos["c.txt"]) {
+				t.Error("files with different content were linked")
+			}
+			if got := strings.Count(errBuf.String(), "across devices"); got != map[bool]int{true: 1}[tc.wantWarn] {
+				t.Errorf("got %d cross-device warnings, log:\n%s", got, errBuf.String())
+			}
+		})
+	}
+}
+
+// TestCopySymlinks checks that symlinks in a copied tree are recreated as
+// symlinks by default, and that -L copies what they point to and stops at a
+// link leading back into the tree.
+func TestCopySymlinks(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "alpha"},
+		{Path: "sub", Filename: "b.txt", Content: "bravo"},
+	})
+	for link, target := range map[string]string{"link.txt": "a.txt", "linkdir": "sub"} {
+		if err := os.Symlink(target, filepath.Join(srcDir, link)); err != nil {
+			t.Skipf("cannot create symlink: %v", err)
+		}
+	}
+
+	destDir := t.TempDir()
+	if err := Copy(Options{Recursive: true}, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	for link, want := range map[string]string{"link.txt": "a.txt", "linkdir": "sub"} {
+		if got, err := os.Readlink(filepath.Join(destDir, link)); err != nil || got != want {
+			t.Errorf("%s: got link to %q (err: %v), want %q", link, got, err, want)
+		}
+	}
+
+	destDir = t.TempDir()
+	if err := Copy(Options{Recursive: true, FollowSymlinks: true}, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy -L failed: %v", err)
+	}
+	for rel, want := range map[string]string{"link.txt": "alpha", "linkdir/b.txt": "bravo"} {
+		path := filepath.Join(destDir, filepath.FromSlash(rel))
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			t.Errorf("%s: expected a regular file (err: %v)", rel, err)
+			continue
+		}
+		if content, _ := os.ReadFile(path); string(content) != want {
+			t.Errorf("%s: got %q, want %q", rel, content, want)
+		}
+	}
+
+	if err := os.Symlink("..", filepath.Join(srcDir, "sub", "up")); err != nil {
+		t.Fatal(err)
+	}
+	err := Copy(Options{Recursive: true, FollowSymlinks: true}, []string{srcDir, t.TempDir()})
+	if !errors.Is(err, errSymlinkLoop) {
+		t.Errorf("expected a symlink loop error, got %v", err)
+	}
+}
+
+// TestCopyTrash checks that -trash keeps overwritten files under their
+// relative paths, and that the copy aborts when they cannot be moved there.
+func TestCopyTrash(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "new a"},
+		{Path: "sub", Filename: "b.txt", Content: "new b"},
+	})
+	destDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "old a"},
+		{Path: "sub", Filename: "b.txt", Content: "old b"},
+	})
+	trash := filepath.Join(t.TempDir(), "trash")
+
+	opts := Options{Recursive: true, Force: true, Trash: trash}
+	for range 2 {
+		if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+			t.Fatalf("copy failed: %v", err)
+		}
+	}
+
+	for path, want := range map[string]string{
+		filepath.Join(destDir, "a.txt"):        "new a",
+		filepath.Join(destDir, "sub", "b.txt"): "new b",
+		filepath.Join(trash, "a.txt"):          "old a",
+		filepath.Join(trash, "sub", "b.txt"):   "old b",
+		filepath.Join(trash, "a.txt.1"):        "new a", // from the second run
+	} {
+		if content, err := os.ReadFile(path); err != nil || string(content) != want {
+			t.Errorf("%s: got %q (err: %v), want %q", path, content, err, want)
+		}
+	}
+
+	// A trash directory that cannot be created stops the copy
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts.Trash = filepath.Join(notDir, "trash")
+	if err := os.WriteFile(filepath.Join(destDir, "a.txt"), []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := Copy(opts, []string{filepath.Join(srcDir, "a.txt"), destDir})
+	if err == nil || !strings.Contains(err.Error(), "trash") {
+		t.Errorf("expected a trash error, got %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(destDir, "a.txt")); string(content) != "kept" {
+		t.Errorf("expected the destination to be left alone, got %q", content)
+	}
+}
+
+// TestCopyTransactional checks that -transactional undoes a failed copy,
+// restoring overwritten files, and leaves no backups behind after success.
+func TestCopyTransactional(t *testing.T) {
+
+	srcDir, files := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "new a"},
+		{Path: "sub", Filename: "b.txt", Content: "new b"},
+		{Filename: "z.txt", Content: "new z"},
+	})
+
+	testCases := []struct {
+		name    string
+		fail    map[string]error
+		wantErr bool
+		want    map[string]string // destination contents after the copy
+	}{
+		{
+			name:    "Failure rolls back",
+			fail:    map[string]error{"open " + files[2]: syscall.EIO},
+			wantErr: true,
+			want:    map[string]string{"a.txt": "old a", "keep.txt": "keep"},
+		},
+		{
+			name: "Success keeps everything",
+			want: map[string]string{"a.txt": "new a", "keep.txt": "keep", "sub/": "", "sub/b.txt": "new b", "z.txt": "new z"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			destDir, _ := testfs.SetupDir(t, []testfs.File{
+				{Filename: "a.txt", Content: "old a"},
+				{Filename: "keep.txt", Content: "keep"},
+			})
+
+			opts := Options{Recursive: true, Force: true, Transactional: true, FS: testfs.FaultFS{FS: OSFS{}, Fail: tc.fail}, Stdout: io.Discard, Stderr: io.Discard}
+			err := Copy(opts, []string{srcDir, destDir})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+
+			got := make(map[string]string)
+			filepath.WalkDir(destDir, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || path == destDir {
+					return err
+				}
+				rel, _ := filepath.Rel(destDir, path)
+				if d.IsDir() {
+					got[filepath.ToSlash(rel)+"/"] = ""
+					return nil
+				}
+				content, _ := os.ReadFile(path)
+				got[filepath.ToSlash(rel)] = string(content)
+				return nil
+			})
+			if !maps.Equal(got, tc.want) {
+				t.Errorf("got destination %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestCopyTransactionalRollback checks that a rollback also removes the
+// parents -parents created, and restores the older backups -b replaced.
+func TestCopyTransactionalRollback(t *testing.T) {
+
+	_, files := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "new a"},
+		{Filename: "z.txt", Content: "new z"},
+	})
+	failZ := map[string]error{"open " + files[1]: syscall.EIO}
+
+	testCases := []struct {
+		name    string
+		opts    Options
+		dest    string // relative to the destination directory
+		wantErr bool
+		want    map[string]string // destination contents after the copy
+	}{
+		{
+			name:    "Created parents are removed",
+			opts:    Options{Parents: true, FS: testfs.FaultFS{FS: OSFS{}, Fail: failZ}},
+			dest:    filepath.Join("x", "y") + string(filepath.Separator),
+			wantErr: true,
+			want:    map[string]string{"a.txt": "old a", "a.txt~": "older a"},
+		},
+		{
+			name:    "Replaced backups are restored",
+			opts:    Options{Backup: true, Suffix: "~", FS: testfs.FaultFS{FS: OSFS{}, Fail: failZ}},
+			wantErr: true,
+			want:    map[string]string{"a.txt": "old a", "a.txt~": "older a"},
+		},
+		{
+			name: "Backups are replaced on success",
+			opts: Options{Backup: true, Suffix: "~"},
+			want: map[string]string{"a.txt": "new a", "a.txt~": "old a", "z.txt": "new z"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			destDir, _ := testfs.SetupDir(t, []testfs.File{
+				{Filename: "a.txt", Content: "old a"},
+				{Filename: "a.txt~", Content: "older a"},
+			})
+
+			opts := tc.opts
+			opts.Force, opts.Transactional, opts.Stdout, opts.Stderr = true, true, io.Discard, io.Discard
+			err := Copy(opts, []string{files[0], files[1], filepath.Join(destDir, tc.dest)})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+
+			got := make(map[string]string)
+			filepath.WalkDir(destDir, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || path == destDir {
+					return err
+				}
+				rel, _ := filepath.Rel(destDir, path)
+				if d.IsDir() {
+					got[filepath.ToSlash(rel)+"/"] = ""
+					return nil
+				}
+				content, _ := os.ReadFile(path)
+				got[filepath.ToSlash(rel)] = string(content)
+				return nil
+			})
+			if !maps.Equal(got, tc.want) {
+				t.Errorf("got destination %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// openCountFS counts the files opened through it.
+type openCountFS struct {
+	OSFS
+	opens *atomic.Int64
+}
+
+func (f openCountFS) Open(name string) (fs.File, error) {
+	f.opens.Add(1)
+	return f.OSFS.Open(name)
+}
+
+// flipFS corrupts the first byte of every file created through it.
+type flipFS struct {
+	OSFS
+}
+
+func (f flipFS) Create(name string) (io.WriteCloser, error) {
+	file, err := f.OSFS.Create(name)
+	return &flipWriter{WriteCloser: file}, err
+}
+
+type flipWriter struct {
+	io.WriteCloser
+	done bool
+}
+
+func (w *flipWriter) Write(p []byte) (int, error) {
+	if !w.done && len(p) > 0 {
+		w.done = true
+		p = append([]byte{p[0] ^ 1}, p[1:]...)
+	}
+	return w.WriteCloser.Write(p)
+}
+
+// TestCopyChecksums checks -verify and -skip-identical, and that checksums
+// cached by one run spare the next one from reading unchanged files.
+func TestCopyChecksums(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "alpha"},
+		{Path: "sub", Filename: "b.txt", Content: "bravo"},
+	})
+	destDir := t.TempDir()
+
+	// A corrupted copy fails verification
+	err := Copy(Options{Recursive: true, Verify: true, DestFS: flipFS{}}, []string{srcDir, destDir})
+	if !errors.Is(err, errChecksumMismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "a.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the corrupt copy to be removed, got %v", err)
+	}
+
+	// A good copy verifies and caches both sides
+	if err := Copy(Options{Recursive: true, Force: true, Verify: true}, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("verified copy failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, checksumCacheName)); err != nil {
+		t.Fatalf("expected a checksum cache: %v", err)
+	}
+
+	// Verifying again trusts the digests cached for the unchanged copies
+	var destOpens atomic.Int64
+	opts := Options{Recursive: true, Force: true, Verify: true, DestFS: openCountFS{opens: &destOpens}}
+	if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("verified copy failed: %v", err)
+	}
+	if got := destOpens.Load(); got != 1 { // the cache
+		t.Errorf("expected no copies read back, got %d opens", got)
+	}
+
+	// The cache belongs to its tree and is not copied out of it
+	again := filepath.Join(t.TempDir(), "again")
+	if err := Copy(Options{Recursive: true}, []string{destDir, again}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(again, checksumCacheName)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the checksum cache to be left behind, got %v", err)
+	}
+
+	// Unchanged files are skipped without opening either side
+	var opens atomic.Int64
+	skips := &SkipReport{}
+	opts = Options{Recursive: true, SkipIdentical: true, Skips: skips, FS: openCountFS{opens: &opens}}
+	if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if got := len(skips.paths[SkipIdentical]); got != 2 {
+		t.Errorf("expected 2 identical files skipped, got %d", got)
+	}
+	if got := opens.Load(); got != 3 { // the two .fmnignore lookups and the cache
+		t.Errorf("expected no files hashed, got %d opens", got)
+	}
+
+	// A changed file is hashed again, found to differ and overwritten
+	if err := os.WriteFile(filepath.Join(srcDir, "a.txt"), []byte("ALPHA"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts.Force, opts.Skips = true, &SkipReport{}
+	if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(destDir, "a.txt")); string(content) != "ALPHA" {
+		t.Errorf("expected the changed file to be copied, got %q", content)
+	}
+}
+
+// statCountFS counts the Stat and Lstat calls made through it.
+type statCountFS struct {
+	OSFS
+	stats *atomic.Int64
+}
+
+func (f statCountFS) Stat(name string) (fs.FileInfo, error) {
+	f.stats.Add(1)
+	return f.OSFS.Stat(name)
+}
+
+func (f statCountFS) Lstat(name string) (fs.FileInfo, error) {
+	f.stats.Add(1)
+	return f.OSFS.Lstat(name)
+}
+
+// BenchmarkCopySmallFiles copies thousands of small files one by one and
+// reports the stat calls needed per file.
+func BenchmarkCopySmallFiles(b *testing.B) {
+	const numFiles = 2000
+
+	srcDir := b.TempDir()
+	sources := make([]string, numFiles)
+	for i := range sources {
+		sources[i] = filepath.Join(srcDir, fmt.Sprintf("file%04d.txt", i))
+		if err := os.WriteFile(sources[i], []byte("content"), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	destDir := b.TempDir()
+
+	var stats atomic.Int64
+	opts := Options{Force: true, FS: statCountFS{stats: &stats}}
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := Copy(opts, append(sources[:numFiles:numFiles], destDir)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(stats.Load())/float64(b.N*numFiles), "stats/file")
+}
+
+// TestCopyBufferSize checks the buffer sizes picked for copies.
+func TestCopyBufferSize(t *testing.T) {
+	testCases := []struct {
+		size     int64
+		override int
+		want     int
+	}{
+		{0, 0, minCopyBuffer},
+		{100, 0, minCopyBuffer},
+		{64 << 10, 0, 64 << 10},
+		{1 << 30, 0, maxCopyBuffer},
+		{1 << 30, 8192, 8192},
+		{100, 1 << 20, 1 << 20},
+	}
+	for _, tc := range testCases {
+		if got := copyBufferSize(tc.size, tc.override); got != tc.want {
+			t.Errorf("copyBufferSize(%d, %d) = %d, want %d", tc.size, tc.override, got, tc.want)
+		}
+	}
+}
+
+// BenchmarkCopyData copies small, medium and large files through a writer
+// without ReadFrom, as for a remote destination or -progress, comparing the
+// old fixed 32 KiB buffer with the adaptive one. "kernel" is the direct OS
+// file path copyData leaves to io.Copy.
+func BenchmarkCopyData(b *testing.B) {
+	dir := b.TempDir()
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"small", 512},
+		{"medium", 256 << 10},
+		{"large", 32 << 20},
+	}
+	for _, sz := range sizes {
+		src := filepath.Join(dir, sz.name)
+		if err := os.WriteFile(src, bytes.Repeat([]byte("x"), sz.size), 0644); err != nil {
+			b.Fatal(err)
+		}
+
+		for _, mode := range []string{"fixed", "adaptive", "kernel"} {
+			b.Run(sz.name+"/"+mode, func(b *testing.B) {
+				b.SetBytes(int64(sz.size))
+				b.ReportAllocs()
+				for b.Loop() {
+					in, err := os.Open(src)
+					if err != nil {
+						b.Fatal(err)
+					}
+					out, err := os.Create(filepath.Join(dir, "out"))
+					if err != nil {
+						b.Fatal(err)
+					}
+					switch mode {
+					case "fixed":
+						_, err = copyData(context.Background(), struct{ io.Writer }{out}, in, int64(sz.size), 32<<10)
+					case "adaptive":
+						_, err = copyData(context.Background(), struct{ io.Writer }{out}, in, int64(sz.size), 0)
+					case "kernel":
+						_, err = copyData(context.Background(), out, in, int64(sz.size), 0)
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					in.Close()
+					out.Close()
+				}
+			})
+		}
+	}
+}
+
+// TestJobStatusReport checks that the SIGUSR1 report names the file a copy
+// worked on last.
+func TestJobStatusReport(t *testing.T) {
+	srcDir, files := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: strings.Repeat("a", 3000)},
+		{Filename: "b.txt", Content: strings.Repeat("b", 1000)},
+	})
+	if err := Copy(Options{Recursive: true}, []string{srcDir, t.TempDir()}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	status.Report(&buf)
+	if got := buf.String(); !strings.HasSuffix(got, ", current '"+files[1]+"'\n") {
+		t.Errorf("unexpected report %q", got)
+	}
+}
+
+// TestCopyStatsOnce checks, through the -vv trace, that a copy to a new
+// destination stats each path only once.
+func TestCopyStatsOnce(t *testing.T) {
+	srcDir, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "content"}})
+	destDir, _ := testfs.SetupDir(t, []testfs.File{})
+
+	testCases := []struct {
+		name string
+		opts Options
+		args []string
+	}{
+		{"File to a new name", Options{}, []string{srcFiles[0], filepath.Join(destDir, "renamed.txt")}},
+		{"Directory to a new name", Options{Recursive: true}, []string{srcDir, filepath.Join(destDir, "tree")}},
+		{"File under -parents", Options{Parents: true}, []string{srcFiles[0], filepath.Join(destDir, "a", "b") + string(filepath.Separator)}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var errBuf bytes.Buffer
+			opts := tc.opts
+			opts.Verbose = VerboseDebug
+			opts.Stdout, opts.Stderr = io.Discard, &errBuf
+			if err := Copy(opts, tc.args); err != nil {
+				t.Fatalf("copy failed: %v", err)
+			}
+			seen := map[string]bool{}
+			for _, line := range strings.Split(errBuf.String(), "\n") {
+				if !strings.HasPrefix(line, "stat '") {
+					continue
+				}
+				if seen[line] {
+					t.Errorf("%s more than once:\n%s", line, errBuf.String())
+				}
+				seen[line] = true
+			}
+		})
+	}
+}
+
+// TestCopyProgress checks that the progress callback starts at zero, grows
+// every progressInterval bytes and ends at the file size for every file.
+func TestCopyProgress(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "big.bin", Content: strings.Repeat("x", 3*progressInterval+17)},
+		{Filename: "empty.txt"},
+	})
+	destDir, _ := testfs.SetupDir(t, []testfs.File{})
+
+	var mu sync.Mutex
+	calls := make(map[string][]int64)
+	totals := make(map[string]int64)
+	opts := Options{Recursive: true, Progress: func(path string, copied, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[filepath.Base(path)] = append(calls[filepath.Base(path)], copied)
+		totals[filepath.Base(path)] = total
+	}}
+	if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+
+	size := int64(3*progressInterval + 17)
+	want := map[string][]int64{
+		"big.bin":   {0, progressInterval, 2 * progressInterval, 3 * progressInterval, size},
+		"empty.txt": {0, 0},
+	}
+	for name, w := range want {
+		if !slices.Equal(calls[name], w) {
+			t.Errorf("%s: got progress %v, want %v", name, calls[name], w)
+		}
+	}
+	if totals["big.bin"] != size {
+		t.Errorf("got total %d, want %d", totals["big.bin"], size)
+	}
+}
+
+// TestReflink checks how each -reflink mode handles a file that cannot be
+// cloned, and that a cloned or copied file has the source's content.
+func TestReflink(t *testing.T) {
+	src, err := fstest.MapFS{"f": {Data: []byte("data")}}.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for mode, wantErr := range map[string]bool{ReflinkAuto: false, ReflinkAlways: true, ReflinkNever: false} {
+		cloned, err := tryReflink(Options{Reflink: mode}, &bytes.Buffer{}, src)
+		if cloned || (err != nil) != wantErr {
+			t.Errorf("%s: got cloned %v, err %v", mode, cloned, err)
+		}
+	}
+
+	_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "f.txt", Content: "content"}})
+	for _, mode := range []string{ReflinkAuto, ReflinkAlways} {
+		destDir := t.TempDir()
+		err := Copy(Options{Reflink: mode}, []string{srcFiles[0], destDir})
+		if mode == ReflinkAlways && err != nil {
+			if !strings.Contains(err.Error(), "cannot clone") {
+				t.Errorf("expected a clone error, got %v", err)
+			}
+			continue // the temporary directory cannot clone
+		}
+		if err != nil {
+			t.Fatalf("%s: copy failed: %v", mode, err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(destDir, "f.txt")); string(got) != "content" {
+			t.Errorf("%s: got %q", mode, got)
+		}
+	}
+}
+
+// TestProgressPrinter checks the bar drawn by cp -progress, and that files
+// below -progress-min get none.
+func TestProgressPrinter(t *testing.T) {
+	var errBuf bytes.Buffer
+
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "big.bin", Content: strings.Repeat("x", 2*progressInterval)},
+		{Filename: "small.txt", Content: "tiny"},
+	})
+	opts := Options{Recursive: true, Progress: NewProgressPrinter(&errBuf), ProgressMin: progressInterval}
+	if err := Copy(opts, []string{srcDir, t.TempDir()}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(errBuf.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one finished bar, got %q", errBuf.String())
+	}
+	last := lines[0][strings.LastIndex(lines[0], "\r")+1:]
+	for _, want := range []string{"big.bin [", "] 100% 2.0M/2.0M ", "/s"} {
+		if !strings.Contains(last, want) {
+			t.Errorf("expected %q in %q", want, last)
+		}
+	}
+	if strings.Contains(errBuf.String(), "small.txt") {
+		t.Errorf("expected no bar for a file below -progress-min, got %q", errBuf.String())
+	}
+}
+
+// TestCopySummary checks the counts behind the summary cp -v prints, with
+// existing files left alone counted as skipped.
+func TestCopySummary(t *testing.T) {
+
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: strings.Repeat("a", 1500)},
+		{Filename: "kept.txt", Content: "new"},
+		{Path: filepath.Join("sub", "deeper"), Filename: "b.txt", Content: "bb"},
+	})
+	destDir, _ := testfs.SetupDir(t, []testfs.File{{Filename: "kept.txt", Content: "old"}})
+
+	testCases := []struct {
+		name   string
+		dryRun bool
+		want   string
+	}{
+		{"Dry run", true, "would copy 2 files, 2 directories, 1.5 kB, 1 skipped\n"},
+		{"Copy", false, "2 files, 2 directories, 1.5 kB copied, 1 skipped\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := Options{Recursive: true, NoClobber: true, DryRun: tc.dryRun, Stats: &Stats{}, Stdout: io.Discard, Stderr: io.Discard}
+			if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+				t.Fatalf("copy failed: %v", err)
+			}
+			var outBuf bytes.Buffer
+			opts.Stats.Print(&outBuf, tc.dryRun)
+			if outBuf.String() != tc.want {
+				t.Errorf("got %q, want %q", outBuf.String(), tc.want)
+			}
+		})
+	}
+}
+
+// TestCopySummarySingular checks that the summary uses the singular for a
+// count of one.
+func TestCopySummarySingular(t *testing.T) {
+	stats := &Stats{}
+	stats.file(10)
+	stats.dir()
+	var outBuf bytes.Buffer
+	stats.Print(&outBuf, false)
+	if want := "1 file, 1 directory, 10 B copied, 0 skipped\n"; outBuf.String() != want {
+		t.Errorf("got %q, want %q", outBuf.String(), want)
+	}
+}
+
+// TestCopyVerbosity checks what each verbosity level prints during a copy.
+func TestCopyVerbosity(t *testing.T) {
+	testCases := []struct {
+		name                  string
+		verbose               int
+		wantOutputContains    []string
+		wantOutputNotContains []string
+		wantDebug             bool // stat traces on stderr
+	}{
+		{
+			name:                  "Quiet",
+			verbose:               0,
+			wantOutputNotContains: []string{"->"},
+		},
+		{
+			name:                  "Files",
+			verbose:               VerboseFiles,
+			wantOutputContains:    []string{"file1.txt' -> '"},
+			wantOutputNotContains: []string{"bytes"},
+		},
+		{
+			name:                  "Debug",
+			verbose:               VerboseDebug,
+			wantOutputContains:    []string{"file1.txt' -> '", "(12 bytes, modified "},
+			wantOutputNotContains: []string{"stat '"},
+			wantDebug:             true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var outBuf, errBuf bytes.Buffer
+
+			_, srcFiles := testfs.SetupDir(t, []testfs.File{
+				{Filename: "file1.txt", Content: "test content"},
+			})
+			destDir, _ := testfs.SetupDir(t, []testfs.File{})
+
+			opts := Options{Verbose: tc.verbose, Stdout: &outBuf, Stderr: &errBuf}
+			if err := Copy(opts, append(srcFiles, destDir)); err != nil {
+				t.Fatalf("did not expect an error, but got: %v", err)
+			}
+			if got := strings.Contains(errBuf.String(), "stat '"); got != tc.wantDebug {
+				t.Errorf("stat traces on stderr: got %v, want %v. Stderr:\n%s", got, tc.wantDebug, errBuf.String())
+			}
+
+			output := outBuf.String()
+			for _, want := range tc.wantOutputContains {
+				if !strings.Contains(output, want) {
+					t.Errorf("expected output to contain %q, but it did not. Got:\n%s", want, output)
+				}
+			}
+			for _, notWant := range tc.wantOutputNotContains {
+				if strings.Contains(output, notWant) {
+					t.Errorf("expected output to NOT contain %q, but it did. Got:\n%s", notWant, output)
+				}
+			}
+		})
+	}
+}
+
+// TestCopySizeFilter checks that -min-size and -max-size skip files outside
+// the range, counting them as skipped, and never skip directories.
+func TestCopySizeFilter(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "small.txt", Content: "x"},
+		{Path: "sub", Filename: "medium.txt", Content: strings.Repeat("x", 100)},
+		{Filename: "large.txt", Content: strings.Repeat("x", 2000)},
+	})
+	destDir := t.TempDir()
+
+	opts := Options{Recursive: true, MinSize: 10, MaxSize: 1000, Stats: &Stats{}, Skips: &SkipReport{}}
+	opts.Stdout, opts.Stderr = io.Discard, io.Discard
+	if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	for rel, want := range map[string]bool{"small.txt": false, "sub/medium.txt": true, "large.txt": false} {
+		_, err := os.Stat(filepath.Join(destDir, filepath.FromSlash(rel)))
+		if copied := err == nil; copied != want {
+			t.Errorf("%s copied: got %v, want %v", rel, copied, want)
+		}
+	}
+	if n := len(opts.Skips.paths[SkipSize]); n != 2 {
+		t.Errorf("expected 2 files skipped for their size, got %d", n)
+	}
+	var outBuf bytes.Buffer
+	opts.Stats.Print(&outBuf, false)
+	if !strings.Contains(outBuf.String(), "2 skipped") {
+		t.Errorf("expected the summary to count 2 skipped files, got %q", outBuf.String())
+	}
+
+	// A single file source is filtered too
+	singleDest := t.TempDir()
+	err := Copy(Options{MinSize: 10}, []string{filepath.Join(srcDir, "small.txt"), singleDest})
+	if entries, _ := os.ReadDir(singleDest); err != nil || len(entries) > 0 {
+		t.Errorf("expected the small file to be skipped without error, got %d entries (err: %v)", len(entries), err)
+	}
+}
+
+// TestCopyTimeFilter checks that Newer and Older skip files modified outside
+// the range.
+func TestCopyTimeFilter(t *testing.T) {
+	srcDir, files := testfs.SetupDir(t, []testfs.File{
+		{Filename: "old.txt"},
+		{Filename: "mid.txt"},
+		{Filename: "new.txt"},
+		{Path: "sub", Filename: "ref.txt"},
+	})
+	base := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	for i, path := range files {
+		mtime := base.Add(time.Duration(i) * 24 * time.Hour)
+		if i == 3 {
+			mtime = base.Add(36 * time.Hour) // between mid.txt and new.txt
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newer := base.Add(6 * time.Hour)
+	older := base.Add(36 * time.Hour)
+
+	destDir := t.TempDir()
+	opts := Options{Recursive: true, Newer: newer, Older: older, Skips: &SkipReport{}}
+	if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	for rel, want := range map[string]bool{"old.txt": false, "mid.txt": true, "new.txt": false, "sub": true} {
+		_, err := os.Stat(filepath.Join(destDir, rel))
+		if copied := err == nil; copied != want {
+			t.Errorf("%s copied: got %v, want %v", rel, copied, want)
+		}
+	}
+	if n := len(opts.Skips.paths[SkipTime]); n != 3 {
+		t.Errorf("expected 3 files skipped for their time, got %v", opts.Skips.paths[SkipTime])
+	}
+}
+
+// TestShellQuote checks that quoted strings survive a POSIX shell intact.
+func TestShellQuote(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{"plain.txt", "'plain.txt'"},
+		{"with space", "'with space'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME `x` *", "'$HOME `x` *'"},
+	}
+
+	for _, tc := range testCases {
+		if got := ShellQuote(tc.in); got != tc.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+// TestCopyPrintScript runs the script printed by cp -print-script and checks
+// that it copies files with awkward names without touching anything itself.
+func TestCopyPrintScript(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to run the script")
+	}
+
+	var outBuf bytes.Buffer
+
+	names := []string{"it's here.txt", "-dash", "$(echo pwned)", "new\nline"}
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Path: "sub dir", Filename: names[0], Content: "0"},
+		{Filename: names[1], Content: "1"},
+		{Filename: names[2], Content: "2"},
+		{Filename: names[3], Content: "3"},
+	})
+	destDir := filepath.Join(t.TempDir(), "dest")
+	if err := os.Mkdir(destDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Copy(Options{Recursive: true, PrintScript: true, Stdout: &outBuf, Stderr: io.Discard}, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
+	if entries, _ := os.ReadDir(destDir); len(entries) > 0 {
+		t.Fatalf("expected nothing to be copied, found %d entries", len(entries))
+	}
+
+	if out, err := exec.Command(sh, "-c", outBuf.String()).CombinedOutput(); err != nil {
+		t.Fatalf("script failed: %v\n%s\nscript:\n%s", err, out, outBuf.String())
+	}
+	for i, path := range []string{
+		filepath.Join(destDir, "sub dir", names[0]),
+		filepath.Join(destDir, names[1]),
+		filepath.Join(destDir, names[2]),
+		filepath.Join(destDir, names[3]),
+	} {
+		if content, err := os.ReadFile(path); err != nil || string(content) != strconv.Itoa(i) {
+			t.Errorf("%q: got %q (err: %v)", path, content, err)
+		}
+	}
+}
+
+// TestFileErrors checks that failures can be inspected with errors.As and
+// errors.Is to find the operation, path and reason.
+func TestFileErrors(t *testing.T) {
+	testCases := []struct {
+		name      string
+		setup     func(t *testing.T) (args []string, wantPath string)
+		wantOp    string
+		wantErrIs error
+	}{
+		{
+			name: "Missing source",
+			setup: func(t *testing.T) ([]string, string) {
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				return []string{"nonexistent.txt", destDir}, "nonexistent.txt"
+			},
+			wantOp:    "stat source",
+			wantErrIs: fs.ErrNotExist,
+		},
+		{
+			name: "Existing target",
+			setup: func(t *testing.T) ([]string, string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt"}})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt"}})
+				return []string{srcFiles[0], destDir}, filepath.Join(destDir, "file.txt")
+			},
+			wantOp:    "overwrite",
+			wantErrIs: ErrExists,
+		},
+		{
+			name: "Directory without -r",
+			setup: func(t *testing.T) ([]string, string) {
+				srcDir, _ := testfs.SetupDir(t, []testfs.File{{Path: "src", Filename: "file.txt"}})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				src := filepath.Join(srcDir, "src")
+				return []string{src, destDir}, src
+			},
+			wantOp:    "copy",
+			wantErrIs: ErrOmitDirectory,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			args, wantPath := tc.setup(t)
+			err := Copy(Options{Stdout: io.Discard, Stderr: io.Discard}, args)
+
+			var fileErr *FileError
+			if !errors.As(err, &fileErr) {
+				t.Fatalf("expected a *FileError, got %T: %v", err, err)
+			}
+			if fileErr.Op != tc.wantOp || fileErr.Path != wantPath {
+				t.Errorf("got op %q path %q, want op %q path %q", fileErr.Op, fileErr.Path, tc.wantOp, wantPath)
+			}
+			if !errors.Is(err, tc.wantErrIs) {
+				t.Errorf("expected error to wrap %v, got %v", tc.wantErrIs, err)
+			}
+			if strings.Count(err.Error(), wantPath) != 1 {
+				t.Errorf("expected the path once in %q", err.Error())
+			}
+		})
+	}
+}
+
+// TestCopyErrorsNameBothEnds checks that a failure to open, create or copy
+// a file names both the source and the destination.
+func TestCopyErrorsNameBothEnds(t *testing.T) {
+	for _, op := range []string{"open", "create"} {
+		t.Run(op, func(t *testing.T) {
+			_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "content"}})
+			dst := filepath.Join(t.TempDir(), "copy.txt")
+			failing := map[string]string{"open": srcFiles[0], "create": dst}[op]
+			fsys := testfs.FaultFS{FS: OSFS{}, Fail: map[string]error{op + " " + failing: fs.ErrPermission}}
+
+			err := Copy(Options{FS: fsys, Stdout: io.Discard, Stderr: io.Discard}, []string{srcFiles[0], dst})
+			var fileErr *FileError
+			if !errors.As(err, &fileErr) {
+				t.Fatalf("expected a *FileError, got %T: %v", err, err)
+			}
+			if fileErr.Op != op || fileErr.Path != srcFiles[0] || fileErr.Dest != dst {
+				t.Errorf("got op %q path %q dest %q, want %q %q %q", fileErr.Op, fileErr.Path, fileErr.Dest, op, srcFiles[0], dst)
+			}
+			if !errors.Is(err, fs.ErrPermission) {
+				t.Errorf("expected error to wrap %v, got %v", fs.ErrPermission, err)
+			}
+			if want := fmt.Sprintf("cannot %s '%s' -> '%s': %v", op, srcFiles[0], dst, fs.ErrPermission); err.Error() != want {
+				t.Errorf("got %q, want %q", err.Error(), want)
+			}
+		})
+	}
+
+	// A read that fails part way names the copy being made
+	_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "content"}})
+	dst := filepath.Join(t.TempDir(), "copy.txt")
+	fsys := testfs.FaultFS{FS: OSFS{}, CorruptRead: map[string]bool{srcFiles[0]: true}}
+	err := Copy(Options{FS: fsys, Stdout: io.Discard, Stderr: io.Discard}, []string{srcFiles[0], dst})
+	var fileErr *FileError
+	if !errors.As(err, &fileErr) || fileErr.Op != "copy" || fileErr.Dest != dst {
+		t.Errorf("expected a copy error naming '%s', got %v", dst, err)
+	}
+}
+
+// TestIgnoreMatcher checks .fmnignore pattern semantics.
+func TestIgnoreMatcher(t *testing.T) {
+	root, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: ".fmnignore", Content: "# comment\n\n*.log\n!keep.log\ncache/\ndocs/*.md\n"},
+		{Path: "sub", Filename: ".fmnignore", Content: "*.txt\n"},
+	})
+
+	m := NewIgnoreMatcher(OSFS{})
+	for _, dir := range []string{root, filepath.Join(root, "sub")} {
+		if err := m.Load(dir); err != nil {
+			t.Fatalf("Failed to load ignore file: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"app.log", false, true},
+		{"keep.log", false, false},
+		{"deep/nested/app.log", false, true},
+		{"cache", true, true},
+		{"cache", false, false}, // "cache/" only matches directories
+		{"docs/readme.md", false, true},
+		{"other/readme.md", false, false},
+		{"notes.txt", false, false}, // the sub rules don't apply outside sub
+		{"sub/notes.txt", false, true},
+		{"main.go", false, false},
+	}
+
+	for _, tc := range testCases {
+		path := filepath.Join(root, filepath.FromSlash(tc.path))
+		if got := m.Ignored(path, tc.isDir); got != tc.want {
+			t.Errorf("ignored(%q, dir=%v) = %v, want %v", tc.path, tc.isDir, got, tc.want)
+		}
+	}
+
+	bad, _ := testfs.SetupDir(t, []testfs.File{{Filename: ".fmnignore", Content: "[a-\n"}})
+	if err := NewIgnoreMatcher(OSFS{}).Load(bad); err == nil {
+		t.Errorf("expected an error for a malformed pattern")
+	}
+}
+
+// TestSamePath checks path equality, which ignores case only on Windows.
+func TestSamePath(t *testing.T) {
+	windows := runtime.GOOS == "windows"
+
+	testCases := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"Identical", "dir/file.txt", "dir/file.txt", true},
+		{"Unclean", "dir/./file.txt", "dir/file.txt", true},
+		{"Different", "dir/a.txt", "dir/b.txt", false},
+		{"Different case", "Dir/File.txt", "dir/file.txt", windows},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := SamePath(tc.a, tc.b); got != tc.want {
+				t.Errorf("samePath(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+			}
+		})
+	}
+}
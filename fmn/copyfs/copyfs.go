@@ -0,0 +1,154 @@
+// Package copyfs implements the copy and move operations behind fmn cp and
+// fmn mv, along with the filesystem, error and prompt helpers the rest of
+// fmn shares with them. Copy and Move take their flags as an Options value,
+// so programs can embed them without going through the command line.
+package copyfs
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"yanmifeakeju/fmn/internal/prompt"
+	"yanmifeakeju/fmn/internal/timefmt"
+)
+
+// Options holds the configuration of a copy or move. The zero value copies
+// single files on the real filesystem, reading prompts from stdin and writing
+// to stdout and stderr.
+type Options struct {
+	Everything    bool // copy files a .fmnignore lists too, as a move must
+	Parents       bool // create a missing destination directory
+	KeepGoing     bool // copy the rest of a tree past entries that fail
+	Recursive     bool
+	OneFileSystem bool // don't descend into directories on other devices (-x)
+	MaxDepth      int  // levels copied below a source directory, its children being 1; 0 is unlimited (-depth)
+	Force         bool
+	Interactive   bool
+	NoClobber     bool   // never replace existing files, and don't fail on them (-n)
+	Update        bool   // only replace files older than their source (-u)
+	Backup        bool   // rename files before overwriting them (-b)
+	Suffix        string // appended to the name of a backup (-S)
+	Verbose       int    // VerboseFiles or VerboseDebug; 0 is quiet
+	DryRun        bool
+	PrintScript   bool // print the equivalent shell commands instead of acting
+	CheckPerms    bool // only check that the copy would have the permissions it needs
+	Prompt        prompt.Options
+	TimeFormat    timefmt.Layout // how verbose output prints timestamps
+	Progress      ProgressFunc   // reports the progress of each file copied; may be nil
+	ProgressMin   int64          // smallest file progress is reported for
+	BufferSize    int            // copy buffer size in bytes; 0 sizes it to each file
+	Sparse        string         // when copies keep holes: SparseAuto, SparseAlways or SparseNever
+	Reflink       string         // when copies share blocks: ReflinkAuto, ReflinkAlways or ReflinkNever
+	Dedup         bool           // hard-link files whose content was already copied (-dedup)
+	HardLinks     bool           // recreate hard links between source files (-H)
+	Transactional bool           // undo every change if any part of the copy fails
+	Trash         string         // directory overwritten files are moved to; "" deletes them
+	Preserve      bool           // give copies the owner and group of their source (-p)
+	Xattrs        bool           // copy extended attributes along with the data
+	Stats         *Stats         // counts what was copied for the -v summary; nil otherwise
+	Skips         *SkipReport    // records skipped files when -report-skips is set; nil otherwise
+
+	// Checksum options
+	Verify        bool // re-read each copy and compare checksums
+	SkipIdentical bool // leave destination files with the source's content alone
+
+	// Follow symlinks instead of treating them as files of their own
+	Dereference bool
+	// Copy what symlinks in a source tree point to rather than recreating
+	// them as symlinks (cp -L)
+	FollowSymlinks bool
+
+	// Copy only files of at least MinSize bytes and, unless it is 0, at most
+	// MaxSize (-min-size, -max-size); directories are never filtered
+	MinSize, MaxSize int64
+	// Copy only files modified after Newer and before Older, where set
+	// (-newer, -older); directories are never filtered
+	Newer, Older time.Time
+
+	// Skip entries whose name matches one of these globs (-exclude)
+	Exclude []string
+
+	// Filesystem the operation runs against; nil means the real OS
+	FS WriteFS
+	// Filesystem copies are written to; nil means FS
+	DestFS WriteFS
+
+	// Cancels the operation, as Ctrl-C does; nil never cancels
+	Context context.Context
+
+	// Streams prompts are read from and output is written to, and the logger
+	// for error messages; nil means os.Stdin, os.Stdout, os.Stderr and a
+	// logger on Stderr
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Log    *log.Logger
+
+	// State kept for the length of one Copy or Move
+	dups       *dedupIndex    // under Dedup
+	links      *linkIndex     // under HardLinks
+	journal    *copyJournal   // under Transactional
+	session    *copySession   // answers that hold for the rest of the run, like "all"
+	checksums  *checksumCache // checksums kept between runs; nil hashes every time
+	linkedDirs []os.FileInfo  // directories being copied under -L, to catch loops
+}
+
+// Verbosity levels for Options.Verbose.
+const (
+	VerboseFiles = 1 // print one line per copied file
+	VerboseDebug = 2 // additionally print byte counts, skip reasons and stat calls
+)
+
+// start fills in the defaults for the streams and sets up the state of a
+// new run.
+func (o *Options) start() {
+	if o.Stdin == nil {
+		o.Stdin = os.Stdin
+	}
+	if o.Stdout == nil {
+		o.Stdout = os.Stdout
+	}
+	if o.Stderr == nil {
+		o.Stderr = os.Stderr
+	}
+	if o.Log == nil {
+		o.Log = log.New(o.Stderr, "fmn: ", 0)
+	}
+	o.session = &copySession{}
+	if o.Dedup {
+		o.dups = &dedupIndex{}
+	}
+	if o.HardLinks {
+		o.links = &linkIndex{}
+	}
+	if o.Transactional {
+		o.journal = &copyJournal{}
+	}
+}
+
+// filesystem returns the filesystem o operates on.
+func (o Options) filesystem() WriteFS {
+	if o.FS == nil {
+		return OSFS{}
+	}
+	return o.FS
+}
+
+// destination returns the filesystem copies are written to.
+func (o Options) destination() WriteFS {
+	if o.DestFS == nil {
+		return o.filesystem()
+	}
+	return o.DestFS
+}
+
+// context returns the context o runs under.
+func (o Options) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
+}
@@ -0,0 +1,15 @@
+//go:build !plan9
+
+package copyfs
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isCrossDevice reports whether err is a rename or hard link that failed
+// because source and destination are on different devices, so the data has
+// to be copied instead.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
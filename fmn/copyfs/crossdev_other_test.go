@@ -0,0 +1,8 @@
+//go:build !plan9
+
+package copyfs
+
+import "syscall"
+
+// errCrossDevice is how a rename or hard link between devices fails.
+var errCrossDevice error = syscall.EXDEV
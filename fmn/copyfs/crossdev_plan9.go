@@ -0,0 +1,15 @@
+package copyfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// isCrossDevice reports whether err is a rename or hard link that cannot be
+// done in place, so the data has to be copied instead. Plan 9 has no EXDEV:
+// a rename only changes a name within its directory, failing with
+// os.ErrInvalid otherwise, and hard links are not supported at all.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, os.ErrInvalid) || errors.Is(err, syscall.EPLAN9)
+}
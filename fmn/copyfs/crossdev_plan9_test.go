@@ -0,0 +1,7 @@
+package copyfs
+
+import "os"
+
+// errCrossDevice is how a rename out of its directory fails on Plan 9, which
+// has no EXDEV.
+var errCrossDevice error = os.ErrInvalid
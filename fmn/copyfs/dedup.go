@@ -0,0 +1,107 @@
+package copyfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// linker is implemented by destination filesystems that can hard-link.
+type linker interface {
+	Link(oldname, newname string) error
+}
+
+// dedupIndex remembers the content of the files a copy has written, so
+// cp -dedup can hard-link later files with the same content instead of
+// copying them again. A source is only hashed up front when a file of the
+// same size has already been written; written files are hashed as they are
+// copied.
+type dedupIndex struct {
+	mu     sync.Mutex
+	sizes  map[int64]bool
+	sums   map[string]string // content hash -> destination path
+	warned bool              // the cross-device warning was printed
+}
+
+// hasSize reports whether a file of size bytes was written.
+func (d *dedupIndex) hasSize(size int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sizes[size]
+}
+
+// lookup returns the destination file written with content hash sum.
+func (d *dedupIndex) lookup(sum string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path, ok := d.sums[sum]
+	return path, ok
+}
+
+// add records that the file at path was written with size bytes hashing to sum.
+func (d *dedupIndex) add(size int64, sum, path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sizes == nil {
+		d.sizes = make(map[int64]bool)
+		d.sums = make(map[string]string)
+	}
+	d.sizes[size] = true
+	if _, ok := d.sums[sum]; !ok {
+		d.sums[sum] = path
+	}
+}
+
+// warnOnce reports whether the cross-device warning still has to be printed.
+func (d *dedupIndex) warnOnce() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	warn := !d.warned
+	d.warned = true
+	return warn
+}
+
+// linkDuplicate hard-links dst to a file already written by the copy if src
+// has the same content, and reports whether it did. A link shares the mode
+// and times of the file it points to. Destinations that cannot hard-link,
+// or a link that would cross devices, fall back to a normal copy.
+func linkDuplicate(opts Options, src, dst string, srcInfo os.FileInfo) (bool, error) {
+	if opts.dups == nil || srcInfo.Size() == 0 || !opts.dups.hasSize(srcInfo.Size()) {
+		return false, nil
+	}
+	fsys := opts.destination()
+	l, ok := fsys.(linker)
+	if !ok {
+		return false, nil
+	}
+
+	sum, err := HashFile(opts.filesystem(), src, checksumAlgo)
+	if err != nil {
+		return false, err
+	}
+	existing, ok := opts.dups.lookup(sum)
+	if !ok {
+		return false, nil
+	}
+
+	// The overwrite checks already passed, so replace whatever is there
+	if err := fsys.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, NewFileError("replace", dst, err)
+	}
+	if err := l.Link(existing, dst); err != nil {
+		if isCrossDevice(err) {
+			if opts.dups.warnOnce() {
+				opts.Log.Printf("warning: cannot hard-link '%s' to '%s' across devices; copying duplicates instead", dst, existing)
+			}
+			return false, nil
+		}
+		return false, NewFileError("link", dst, err)
+	}
+
+	if opts.Verbose >= VerboseFiles {
+		fmt.Fprintf(opts.Stdout, "'%s' -> '%s' (linked to '%s')\n", src, dst, existing)
+	}
+	return true, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package copyfs
+
+import "os"
+
+// fileDevice reports no device; outside Unix, -x has nothing to compare,
+// so copyDirectory warns and never skips a directory.
+func fileDevice(info os.FileInfo) (uint64, bool) { return 0, false }
+
+// hardLinkKey reports no key; outside Unix, -H finds no hard links and
+// copies every file.
+func hardLinkKey(info os.FileInfo) (fileKey, bool) { return fileKey{}, false }
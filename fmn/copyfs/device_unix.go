@@ -0,0 +1,27 @@
+//go:build unix
+
+package copyfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileDevice returns the ID of the device holding the file described by info.
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// hardLinkKey returns the key identifying the file described by info among
+// its hard links, or false if it has no other links.
+func hardLinkKey(info os.FileInfo) (fileKey, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || uint64(st.Nlink) < 2 {
+		return fileKey{}, false
+	}
+	return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
@@ -0,0 +1,70 @@
+//go:build unix
+
+package copyfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"yanmifeakeju/fmn/internal/testfs"
+)
+
+// mountFS is the real filesystem with the directories in mounts reported as
+// being on another device, like mount points.
+type mountFS struct {
+	OSFS
+	mounts map[string]bool
+}
+
+func (f mountFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := f.OSFS.ReadDir(name)
+	for i, entry := range entries {
+		if f.mounts[filepath.Join(name, entry.Name())] {
+			info, _ := entry.Info()
+			st := *info.Sys().(*syscall.Stat_t)
+			st.Dev++
+			entries[i] = fs.FileInfoToDirEntry(mountInfo{info, &st})
+		}
+	}
+	return entries, err
+}
+
+// mountInfo is a FileInfo with a replaced Sys.
+type mountInfo struct {
+	os.FileInfo
+	st *syscall.Stat_t
+}
+
+func (i mountInfo) Sys() any { return i.st }
+
+// TestCopyOneFileSystem checks that -x skips directories on another device.
+func TestCopyOneFileSystem(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Path: "local", Filename: "a.txt", Content: "local"},
+		{Path: "mnt", Filename: "b.txt", Content: "mounted"},
+	})
+	fsys := mountFS{mounts: map[string]bool{filepath.Join(srcDir, "mnt"): true}}
+
+	for _, oneFS := range []bool{false, true} {
+		destDir := t.TempDir()
+		skips := &SkipReport{}
+		opts := Options{Recursive: true, OneFileSystem: oneFS, Skips: skips, FS: fsys}
+		if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+			t.Fatalf("copy failed: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(destDir, "local", "a.txt")); err != nil {
+			t.Errorf("-x=%v: expected the local directory to be copied: %v", oneFS, err)
+		}
+		_, err := os.Stat(filepath.Join(destDir, "mnt"))
+		if copied := err == nil; copied == oneFS {
+			t.Errorf("-x=%v: mount point copied: %v", oneFS, copied)
+		}
+		if oneFS && len(skips.paths[SkipOtherFS]) != 1 {
+			t.Errorf("expected the mount point to be reported as skipped, got %v", skips.paths)
+		}
+	}
+}
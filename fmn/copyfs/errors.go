@@ -0,0 +1,111 @@
+package copyfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// FileError records the operation and path behind a failure so callers can
+// inspect it with errors.As, e.g. to report the path in JSON error output.
+type FileError struct {
+	Op   string // what was being done, e.g. "stat source"
+	Path string
+	Dest string // where Path was being copied to, for failures of the copy itself
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	if e.Dest != "" {
+		return fmt.Sprintf("cannot %s '%s' -> '%s': %v", e.Op, e.Path, e.Dest, e.Err)
+	}
+	return fmt.Sprintf("cannot %s '%s': %v", e.Op, e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error { return e.Err }
+
+// NewFileError wraps err with the operation and path. A *fs.PathError for the
+// same path is unwrapped first so the path isn't repeated in the message.
+func NewFileError(op, path string, err error) error {
+	if pathErr, ok := err.(*fs.PathError); ok && pathErr.Path == path {
+		err = pathErr.Err
+	}
+	return &FileError{Op: op, Path: path, Err: err}
+}
+
+// newCopyError is NewFileError for a failure while copying src to dst, which
+// names both. A *fs.PathError for either path is unwrapped first.
+func newCopyError(op, src, dst string, err error) error {
+	if pathErr, ok := err.(*fs.PathError); ok && (pathErr.Path == src || pathErr.Path == dst) {
+		err = pathErr.Err
+	}
+	return &FileError{Op: op, Path: src, Dest: dst, Err: err}
+}
+
+// Reasons carried by FileErrors that don't come from the operating system.
+var (
+	ErrNotDirectory     = errors.New("not a directory")
+	ErrOmitDirectory    = errors.New("omitting directory (use -r for recursive)")
+	errSameFile         = errors.New("source and destination are the same file")
+	ErrExists           = errors.New("already exists (use -f to force or -i for interactive)")
+	errReadOnly         = errors.New("read-only filesystem")
+	errChecksumMismatch = errors.New("copy does not match the source checksum")
+	errNotStreamable    = errors.New("directories cannot be copied from stdin or to stdout")
+	errNoDestination    = errors.New("no such directory (use -parents to create it)")
+	errIntoItself       = errors.New("into its own subdirectory")
+)
+
+// errQuit stops a copy or move when the user answers "q" at a prompt. It is
+// not a failure: what was done before is kept and fmn exits successfully.
+var errQuit = errors.New("quit at the prompt")
+
+// UsageError marks an error caused by a bad invocation rather than by the
+// filesystem.
+type UsageError struct {
+	msg string
+}
+
+func (e *UsageError) Error() string { return e.msg }
+
+// NewUsageError formats a UsageError.
+func NewUsageError(format string, args ...any) error {
+	return &UsageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// PartialError wraps the failures of an operation that still succeeded for
+// some of its paths.
+type PartialError struct {
+	Err error
+}
+
+func (e *PartialError) Error() string { return e.Err.Error() }
+
+func (e *PartialError) Unwrap() error { return e.Err }
+
+// EntryErrors sums up the per-entry failures of a recursive operation that
+// carried on past them. Each failure was logged when it happened, so the
+// message only counts them; errors.Is and errors.As still see every one.
+type EntryErrors struct {
+	Path  string // root of the recursive operation
+	Count int
+	Err   error // errors.Join of the failures
+}
+
+func (e *EntryErrors) Error() string {
+	return fmt.Sprintf("%d entries under '%s' could not be processed", e.Count, e.Path)
+}
+
+func (e *EntryErrors) Unwrap() error { return e.Err }
+
+// permissionErrors sums up the problems found by cp -check-perms. Each was
+// logged when it was found, so the message only counts them.
+type permissionErrors struct {
+	Count int
+	Err   error // errors.Join of the problems
+}
+
+func (e *permissionErrors) Error() string {
+	return fmt.Sprintf("permission check found %d problems", e.Count)
+}
+
+func (e *permissionErrors) Unwrap() error { return e.Err }
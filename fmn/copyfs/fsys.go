@@ -0,0 +1,151 @@
+package copyfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReadFS is the read side of the filesystem that list and copy work on. Its
+// methods mirror the os functions of the same name, so tests can substitute
+// an implementation that injects failures without touching real files.
+type ReadFS interface {
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Open(name string) (fs.File, error)
+}
+
+// WriteFS adds the operations copy performs on the destination.
+type WriteFS interface {
+	ReadFS
+	Create(name string) (io.WriteCloser, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	Remove(name string) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// OSFS is the real operating system filesystem, the default for every command.
+type OSFS struct{}
+
+func (OSFS) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (OSFS) Lstat(name string) (fs.FileInfo, error)     { return os.Lstat(name) }
+func (OSFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+func (OSFS) Open(name string) (fs.File, error)          { return os.Open(name) }
+func (OSFS) Create(name string) (io.WriteCloser, error) { return os.Create(name) }
+func (OSFS) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+func (OSFS) Remove(name string) error                  { return os.Remove(name) }
+func (OSFS) Chmod(name string, mode fs.FileMode) error { return os.Chmod(name, mode) }
+func (OSFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+func (OSFS) Link(oldname, newname string) error    { return os.Link(oldname, newname) }
+func (OSFS) Rename(oldpath, newpath string) error  { return os.Rename(oldpath, newpath) }
+func (OSFS) Readlink(name string) (string, error)  { return os.Readlink(name) }
+func (OSFS) Chown(name string, uid, gid int) error { return os.Chown(name, uid, gid) }
+func (OSFS) Symlink(oldname, newname string) error { return os.Symlink(oldname, newname) }
+
+// IOFS adapts an io/fs filesystem, such as the contents of a zip archive or
+// an fstest.MapFS, so the list and copy code can read from it. Paths are
+// converted to the unrooted slash form io/fs expects. It is read-only: every
+// write fails with errReadOnly.
+type IOFS struct {
+	FS fs.FS
+}
+
+// name converts a path built with filepath into an io/fs name.
+func (f IOFS) name(p string) string {
+	p = strings.TrimPrefix(path.Clean(filepath.ToSlash(p)), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+func (f IOFS) Stat(name string) (fs.FileInfo, error) { return fs.Stat(f.FS, f.name(name)) }
+
+// Lstat is Stat; io/fs has no portable way to look at a symlink itself.
+func (f IOFS) Lstat(name string) (fs.FileInfo, error)     { return fs.Stat(f.FS, f.name(name)) }
+func (f IOFS) ReadDir(name string) ([]fs.DirEntry, error) { return fs.ReadDir(f.FS, f.name(name)) }
+func (f IOFS) Open(name string) (fs.File, error)          { return f.FS.Open(f.name(name)) }
+
+func (f IOFS) Create(name string) (io.WriteCloser, error) {
+	return nil, &fs.PathError{Op: "create", Path: name, Err: errReadOnly}
+}
+func (f IOFS) MkdirAll(path string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: path, Err: errReadOnly}
+}
+func (f IOFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: errReadOnly}
+}
+func (f IOFS) Chmod(name string, mode fs.FileMode) error {
+	return &fs.PathError{Op: "chmod", Path: name, Err: errReadOnly}
+}
+func (f IOFS) Chtimes(name string, atime, mtime time.Time) error {
+	return &fs.PathError{Op: "chtimes", Path: name, Err: errReadOnly}
+}
+
+// WalkDir is filepath.WalkDir over a ReadFS: it walks the tree rooted at root
+// in lexical order, calling fn for each file or directory, with the same
+// SkipDir/SkipAll semantics.
+func WalkDir(fsys ReadFS, root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+		if err == filepath.SkipDir || err == filepath.SkipAll {
+			return nil
+		}
+		return err
+	}
+	return walkDirFrom(fsys, root, info, fn)
+}
+
+// walkDirFrom is WalkDir with the info of root already known. Given the info
+// of what a symlink at root points to, it walks that directory.
+func walkDirFrom(fsys ReadFS, root string, info fs.FileInfo, fn fs.WalkDirFunc) error {
+	err := walkDirEntry(fsys, root, fs.FileInfoToDirEntry(info), fn)
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkDirEntry recursively descends path, calling fn.
+func walkDirEntry(fsys ReadFS, path string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+		if err == filepath.SkipDir && d.IsDir() {
+			// Successfully skipped directory.
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		// Second call, to report the ReadDir error.
+		err = fn(path, d, err)
+		if err != nil {
+			if err == filepath.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if err := walkDirEntry(fsys, filepath.Join(path, entry.Name()), entry, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package copyfs
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+)
+
+// hashAlgorithms maps the names accepted by -algo to their constructors.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// NewHash returns a fresh hash for the named algorithm.
+func NewHash(algo string) (hash.Hash, error) {
+	newFunc, ok := hashAlgorithms[algo]
+	if !ok {
+		names := make([]string, 0, len(hashAlgorithms))
+		for name := range hashAlgorithms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, NewUsageError("unknown hash algorithm '%s' (use %s)", algo, strings.Join(names, ", "))
+	}
+	return newFunc(), nil
+}
+
+// HashFile returns the hex digest of the file at path.
+func HashFile(fsys ReadFS, path, algo string) (string, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", NewFileError("open", path, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", NewFileError("read", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
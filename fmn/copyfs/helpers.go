@@ -0,0 +1,55 @@
+package copyfs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// debugf prints a diagnostic line to stderr when running at debug verbosity
+// (-vv), so it stays out of data copied to stdout.
+func debugf(opts Options, format string, args ...any) {
+	if opts.Verbose >= VerboseDebug {
+		fmt.Fprintf(opts.Stderr, format+"\n", args...)
+	}
+}
+
+// stat stats path on the filesystem of opts, tracing the call at debug verbosity.
+func stat(opts Options, path string) (os.FileInfo, error) {
+	debugf(opts, "stat '%s'", path)
+	return opts.filesystem().Stat(path)
+}
+
+// statDest is like stat but on the filesystem copies are written to.
+func statDest(opts Options, path string) (os.FileInfo, error) {
+	debugf(opts, "stat '%s'", path)
+	return opts.destination().Stat(path)
+}
+
+// lstatDest is like statDest but does not follow a final symlink, unless the
+// copy was asked to dereference symlinks (-L).
+func lstatDest(opts Options, path string) (os.FileInfo, error) {
+	if opts.Dereference {
+		return statDest(opts, path)
+	}
+	debugf(opts, "lstat '%s'", path)
+	return opts.destination().Lstat(path)
+}
+
+// IsSameFile reports whether two already-obtained infos describe the same
+// filesystem object. Infos from Lstat compare symlinks as themselves, so a
+// link and its target differ while hard links match. A nil info (a path that
+// does not exist) is never the same.
+func IsSameFile(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return os.SameFile(a, b)
+}
+
+// ShellQuote quotes s for a POSIX shell. Everything goes inside single
+// quotes; an embedded single quote ends the quoting, is escaped with a
+// backslash, and the quoting starts again.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
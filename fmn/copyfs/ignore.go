@@ -0,0 +1,116 @@
+package copyfs
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is the ignore file honoured by recursive operations.
+const ignoreFileName = ".fmnignore"
+
+// ignoreRule is one pattern line of an ignore file.
+type ignoreRule struct {
+	dir     string // directory holding the ignore file; the rule only applies below it
+	pattern string // glob with filepath.Match semantics
+	negate  bool   // a leading "!" re-includes paths matched by earlier rules
+	dirOnly bool   // a trailing "/" restricts the rule to directories
+}
+
+// IgnoreMatcher decides which paths a recursive walk skips. Rules come from
+// the .fmnignore in the root and in every directory the walk enters. As in
+// .gitignore, the last matching rule wins. Patterns without a "/" match the
+// base name; patterns with one match the path relative to the ignore file.
+// A nil *IgnoreMatcher ignores nothing.
+type IgnoreMatcher struct {
+	fsys  ReadFS
+	rules []ignoreRule
+}
+
+// NewIgnoreMatcher returns a matcher with no rules loaded yet.
+func NewIgnoreMatcher(fsys ReadFS) *IgnoreMatcher {
+	return &IgnoreMatcher{fsys: fsys}
+}
+
+// Load reads the ignore file in dir, if there is one. The walk calls it for
+// each directory before descending into it.
+func (m *IgnoreMatcher) Load(dir string) error {
+	if m == nil {
+		return nil
+	}
+	f, err := m.fsys.Open(filepath.Join(dir, ignoreFileName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return NewFileError("read", filepath.Join(dir, ignoreFileName), err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		rule.pattern = filepath.FromSlash(strings.TrimPrefix(line, "/"))
+
+		if _, err := filepath.Match(rule.pattern, ""); err != nil {
+			return NewFileError("parse", filepath.Join(dir, ignoreFileName), err)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return NewFileError("read", filepath.Join(dir, ignoreFileName), err)
+	}
+	return nil
+}
+
+// Ignored reports whether path should be skipped.
+func (m *IgnoreMatcher) Ignored(path string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		rel, err := filepath.Rel(rule.dir, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue // path is not below the rule's directory
+		}
+
+		name := filepath.Base(path)
+		if strings.ContainsRune(rule.pattern, filepath.Separator) {
+			name = rel
+		}
+		if ok, _ := filepath.Match(rule.pattern, name); ok {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// MatchesAny reports whether name matches any of the glob patterns.
+func MatchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
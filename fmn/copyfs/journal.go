@@ -0,0 +1,146 @@
+package copyfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Kinds of change recorded in a copyJournal.
+const (
+	journalCreated = iota // a file or directory that did not exist
+	journalBackup         // an existing file renamed aside before being replaced
+	journalMoved          // an existing file moved into the -trash directory
+)
+
+// journalEntry is one change made by a transactional copy.
+type journalEntry struct {
+	kind int
+	path string // the destination path changed
+	old  string // where the previous file was put, for backups and moves
+}
+
+// copyJournal records the changes a cp -transactional run makes to the
+// destination, in order, so they can all be undone if the copy fails. It
+// lives in memory for a single run: files being replaced are renamed aside
+// in their own directory rather than deleted, and only removed once the
+// whole copy has succeeded.
+type copyJournal struct {
+	mu      sync.Mutex
+	entries []journalEntry
+	created map[string]bool // paths with a journalCreated entry
+}
+
+func (j *copyJournal) record(e journalEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, e)
+}
+
+// recordCreated records paths as created, outermost first, skipping any
+// already recorded by another worker, so each is removed only once and
+// after everything put inside it.
+func (j *copyJournal) recordCreated(paths []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.created == nil {
+		j.created = make(map[string]bool)
+	}
+	for _, path := range slices.Backward(paths) {
+		if !j.created[path] {
+			j.created[path] = true
+			j.entries = append(j.entries, journalEntry{kind: journalCreated, path: path})
+		}
+	}
+}
+
+// prepare is called before the copy writes path. A file already there is
+// renamed aside so rollback can put it back; otherwise path is recorded as
+// created so rollback can remove it, along with the missing directories
+// above it, which creating it makes too.
+func (j *copyJournal) prepare(opts Options, path string) error {
+	if j == nil {
+		return nil
+	}
+	fsys := opts.destination()
+	info, err := fsys.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		missing := []string{path}
+		for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if _, err := fsys.Lstat(dir); !errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			missing = append(missing, dir)
+		}
+		j.recordCreated(missing)
+		return nil
+	}
+	if err != nil {
+		return NewFileError("stat destination", path, err)
+	}
+	if info.IsDir() {
+		return nil // merged into, not replaced
+	}
+
+	r, ok := fsys.(renamer)
+	if !ok {
+		return NewFileError("back up", path, errNoRename)
+	}
+	backup := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.fmn-backup-%d", filepath.Base(path), os.Getpid()))
+	if err := r.Rename(path, backup); err != nil {
+		return NewFileError("back up", path, err)
+	}
+	j.record(journalEntry{kind: journalBackup, path: path, old: backup})
+	return nil
+}
+
+// moved records that path was moved to trash.
+func (j *copyJournal) moved(path, trash string) {
+	if j != nil {
+		j.record(journalEntry{kind: journalMoved, path: path, old: trash})
+	}
+}
+
+// commit removes the backups once the copy has succeeded.
+func (j *copyJournal) commit(opts Options) error {
+	var errs []error
+	for _, e := range j.entries {
+		if e.kind == journalBackup {
+			if err := opts.destination().Remove(e.old); err != nil {
+				errs = append(errs, NewFileError("remove backup", e.old, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rollback undoes the recorded changes, newest first, so files are removed
+// before the directories created to hold them. It carries on past failures
+// and returns them all.
+func (j *copyJournal) rollback(opts Options) error {
+	fsys := opts.destination()
+	var errs []error
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		e := j.entries[i]
+		err := fsys.Remove(e.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		if err == nil && e.kind != journalCreated {
+			var info os.FileInfo
+			if info, err = fsys.Lstat(e.old); err == nil {
+				err = moveFile(fsys, e.old, e.path, info)
+			}
+		}
+		if err != nil {
+			errs = append(errs, NewFileError("roll back", e.path, err))
+			continue
+		}
+		debugf(opts, "rolled back '%s'", e.path)
+	}
+	return errors.Join(errs...)
+}
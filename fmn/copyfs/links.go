@@ -0,0 +1,83 @@
+package copyfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// fileKey identifies a file by its device and inode, which all hard links
+// to the file share.
+type fileKey struct {
+	dev, ino uint64
+}
+
+// linkIndex remembers where a copy wrote each source file that has other
+// hard links, so cp -H can link the other names to that copy instead of
+// copying the data again.
+type linkIndex struct {
+	mu    sync.Mutex
+	paths map[fileKey]string // source file -> destination it was copied to
+}
+
+// copyOf returns the destination the file described by info was copied to.
+func (x *linkIndex) copyOf(info os.FileInfo) (string, bool) {
+	key, ok := hardLinkKey(info)
+	if x == nil || !ok {
+		return "", false
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	path, ok := x.paths[key]
+	return path, ok
+}
+
+// add records that the file described by info was copied to path.
+func (x *linkIndex) add(info os.FileInfo, path string) {
+	key, ok := hardLinkKey(info)
+	if x == nil || !ok {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.paths == nil {
+		x.paths = make(map[fileKey]string)
+	}
+	if _, ok := x.paths[key]; !ok {
+		x.paths[key] = path
+	}
+}
+
+// linkHardLinked hard-links dst to the copy of another link to the same
+// source file, if one was written, and reports whether it did. Destinations
+// that cannot hard-link, or a link that would cross devices, fall back to a
+// normal copy.
+func linkHardLinked(opts Options, src, dst string, srcInfo os.FileInfo) (bool, error) {
+	existing, ok := opts.links.copyOf(srcInfo)
+	if !ok {
+		return false, nil
+	}
+	fsys := opts.destination()
+	l, ok := fsys.(linker)
+	if !ok {
+		return false, nil
+	}
+
+	// The overwrite checks already passed, so replace whatever is there
+	if err := fsys.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, NewFileError("replace", dst, err)
+	}
+	if err := l.Link(existing, dst); err != nil {
+		if isCrossDevice(err) {
+			return false, nil
+		}
+		return false, NewFileError("link", dst, err)
+	}
+
+	if opts.Verbose >= VerboseFiles {
+		fmt.Fprintf(opts.Stdout, "'%s' -> '%s' (linked to '%s')\n", src, dst, existing)
+	}
+	return true, nil
+}
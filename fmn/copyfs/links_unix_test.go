@@ -0,0 +1,49 @@
+//go:build unix
+
+package copyfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"yanmifeakeju/fmn/internal/testfs"
+)
+
+// TestCopyHardLinks checks that -H links copies of hard-linked sources to
+// each other, and that without it each link gets its own copy.
+func TestCopyHardLinks(t *testing.T) {
+	srcDir, files := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "shared"},
+		{Filename: "c.txt", Content: "shared"},
+	})
+	if err := os.Link(files[0], filepath.Join(srcDir, "b.txt")); err != nil {
+		t.Skipf("cannot create hard link: %v", err)
+	}
+
+	for _, preserve := range []bool{false, true} {
+		destDir := t.TempDir()
+		opts := Options{Recursive: true}
+		if preserve {
+			opts.HardLinks = true
+		}
+		if err := Copy(opts, []string{srcDir, destDir}); err != nil {
+			t.Fatalf("copy failed: %v", err)
+		}
+
+		infos := make(map[string]os.FileInfo)
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			path := filepath.Join(destDir, name)
+			if content, err := os.ReadFile(path); err != nil || string(content) != "shared" {
+				t.Errorf("-H=%v: %s: got %q (err: %v)", preserve, name, content, err)
+			}
+			infos[name], _ = os.Stat(path)
+		}
+		if linked := os.SameFile(infos["a.txt"], infos["b.txt"]); linked != preserve {
+			t.Errorf("-H=%v: a.txt and b.txt linked = %v", preserve, linked)
+		}
+		if os.SameFile(infos["a.txt"], infos["c.txt"]) {
+			t.Errorf("-H=%v: a file with the same content but no link was linked", preserve)
+		}
+	}
+}
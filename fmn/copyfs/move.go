@@ -0,0 +1,155 @@
+package copyfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Move moves the sources in paths, all but the last, to the destination
+// that is last, like mv. Each is renamed where the destination
+// filesystem can, which is instant and keeps everything about the file.
+// Across devices, or to a remote destination, the source is copied, with
+// the copy's overwrite checks, and only removed once the whole copy has
+// succeeded, so a failure never loses data.
+func Move(opts Options, paths []string) error {
+	if len(paths) < 2 {
+		return NewUsageError("move requires a source and a destination")
+	}
+	if opts.NoClobber && opts.Force {
+		return NewUsageError("-n and -f cannot be combined")
+	}
+	lastIndex := len(paths) - 1
+	dest := paths[lastIndex]
+	sources := paths[:lastIndex]
+	if dest == "" {
+		return NewUsageError("the destination cannot be empty")
+	}
+	opts.start()
+
+	destInfo, err := statDest(opts, dest)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return NewFileError("stat destination", dest, err)
+	}
+	if len(sources) > 1 && (destInfo == nil || !destInfo.IsDir()) {
+		return &FileError{Op: "move multiple sources to", Path: dest, Err: ErrNotDirectory}
+	}
+
+	var errs []error
+	for _, src := range sources {
+		finalDest := dest
+		if destInfo != nil && destInfo.IsDir() {
+			finalDest = filepath.Join(dest, filepath.Base(src))
+		}
+		err := moveSource(opts, src, finalDest)
+		if errors.Is(err, errQuit) {
+			break // the user stopped here; what was moved stays moved
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 && len(errs) < len(sources) {
+		return &PartialError{Err: errors.Join(errs...)}
+	}
+	return errors.Join(errs...)
+}
+
+// moveSource moves src to dst, the final path it will have.
+func moveSource(opts Options, src, dst string) error {
+	// A symlink is moved as itself, not what it points to
+	srcInfo, err := opts.filesystem().Lstat(src)
+	if err != nil {
+		return NewFileError("stat source", src, err)
+	}
+	dstInfo, err := lstatDest(opts, dst)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return NewFileError("stat destination", dst, err)
+	}
+	if SamePath(src, dst) || IsSameFile(srcInfo, dstInfo) {
+		return &FileError{Op: "move", Path: src, Err: errSameFile}
+	}
+	if srcInfo.IsDir() && dstInfo != nil && !dstInfo.IsDir() {
+		return &FileError{Op: "move directory onto", Path: dst, Err: ErrNotDirectory}
+	}
+	var fileInfo os.FileInfo
+	if !srcInfo.IsDir() {
+		fileInfo = srcInfo
+	}
+	should, err := shouldOverwrite(dst, dstInfo, fileInfo, opts)
+	if err != nil || !should {
+		return err
+	}
+
+	if opts.PrintScript {
+		fmt.Fprintf(opts.Stdout, "mv -- %s %s\n", ShellQuote(src), ShellQuote(dst))
+		return nil
+	}
+	if opts.DryRun {
+		fmt.Fprintf(opts.Stdout, "would move '%s' -> '%s'\n", src, dst)
+		return nil
+	}
+
+	// Only a filesystem that holds both sides can rename between them
+	if r, ok := opts.filesystem().(renamer); ok && opts.DestFS == nil {
+		err := r.Rename(src, dst)
+		if err == nil {
+			if opts.Verbose >= VerboseFiles {
+				fmt.Fprintf(opts.Stdout, "renamed '%s' -> '%s'\n", src, dst)
+			}
+			return nil
+		}
+		if !isCrossDevice(err) {
+			return NewFileError("move", src, err)
+		}
+		debugf(opts, "'%s' is on another device; copying it", src)
+	}
+
+	// Copy and remove. The checks above already allowed the overwrite, and
+	// nothing may be left out of a copy whose source is then removed.
+	opts.Recursive, opts.Everything = true, true
+	opts.Force, opts.Interactive, opts.NoClobber, opts.Update = true, false, false, false
+	if srcInfo.IsDir() {
+		if err := createDir(dst, opts); err != nil {
+			return err
+		}
+		err = copyDirectory(opts, src, srcInfo, dst, srcInfo)
+	} else {
+		err = copySrcToDest(src, dst, srcInfo, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if err := removeTree(opts.filesystem(), src); err != nil {
+		return NewFileError("remove moved source", src, err)
+	}
+	if opts.Verbose >= VerboseFiles {
+		fmt.Fprintf(opts.Stdout, "removed '%s'\n", src)
+	}
+	return nil
+}
+
+// removeTree removes path and, for a directory, everything below it,
+// deepest first.
+func removeTree(fsys WriteFS, path string) error {
+	var paths []string
+	err := WalkDir(fsys, path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := fsys.Remove(paths[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package copyfs
+
+import "os"
+
+// chowner is implemented by destination filesystems that can change the
+// owner of a file.
+type chowner interface {
+	Chown(name string, uid, gid int) error
+}
+
+// preserveOwner gives dst, under cp -p, the owner and group of the source
+// described by srcInfo. Only root can give files away, so a failure is
+// logged as a warning and the copy carries on with the file owned by the
+// user running it. Sources without Unix ownership are left alone.
+func preserveOwner(opts Options, dst string, srcInfo os.FileInfo) {
+	if !opts.Preserve {
+		return
+	}
+	uid, gid, ok := fileOwner(srcInfo)
+	if !ok {
+		return
+	}
+	c, ok := opts.destination().(chowner)
+	if !ok {
+		return
+	}
+	if err := c.Chown(dst, uid, gid); err != nil {
+		opts.Log.Printf("warning: cannot preserve owner of '%s': %v", dst, err)
+	}
+}
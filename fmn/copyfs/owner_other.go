@@ -0,0 +1,9 @@
+//go:build !unix
+
+package copyfs
+
+import "os"
+
+// fileOwner reports no owner; outside Unix files have no uid and gid for
+// cp -p to preserve.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) { return 0, 0, false }
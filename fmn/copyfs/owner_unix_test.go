@@ -0,0 +1,62 @@
+//go:build unix
+
+package copyfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"yanmifeakeju/fmn/internal/testfs"
+)
+
+// noChownFS is the real filesystem where changing owners is not permitted,
+// as for an unprivileged user.
+type noChownFS struct{ OSFS }
+
+func (noChownFS) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+}
+
+// TestCopyPreserveOwner checks that cp -p copies the owner and group, and
+// that a copy it is not permitted to give away still succeeds with a warning.
+func TestCopyPreserveOwner(t *testing.T) {
+	var errBuf bytes.Buffer
+
+	_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "owned.txt", Content: "data"}})
+	src := srcFiles[0]
+
+	destDir := t.TempDir()
+	opts := Options{Preserve: true, FS: noChownFS{}, Stdout: io.Discard, Stderr: &errBuf}
+	if err := Copy(opts, []string{src, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "owned.txt")); err != nil {
+		t.Errorf("expected the file to be copied: %v", err)
+	}
+	if !strings.Contains(errBuf.String(), "warning: cannot preserve owner") {
+		t.Errorf("expected a warning, got %q", errBuf.String())
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("giving a file away needs root")
+	}
+	if err := os.Chown(src, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	destDir = t.TempDir()
+	if err := Copy(Options{Preserve: true}, []string{src, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(destDir, "owned.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid, _ := fileOwner(info); uid != 65534 || gid != 65534 {
+		t.Errorf("got owner %d:%d, want 65534:65534", uid, gid)
+	}
+}
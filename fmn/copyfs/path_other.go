@@ -0,0 +1,25 @@
+//go:build !windows
+
+package copyfs
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// SamePath reports whether a and b name the same path.
+func SamePath(a, b string) bool {
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+// isWithin reports whether path is dir or somewhere below it, comparing
+// cleaned absolute paths.
+func isWithin(dir, path string) bool {
+	absDir, errDir := filepath.Abs(dir)
+	absPath, errPath := filepath.Abs(path)
+	if errDir != nil || errPath != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
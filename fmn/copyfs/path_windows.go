@@ -0,0 +1,24 @@
+package copyfs
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// SamePath reports whether a and b name the same path. Windows filesystems
+// are case-insensitive, so case is ignored.
+func SamePath(a, b string) bool {
+	return strings.EqualFold(filepath.Clean(a), filepath.Clean(b))
+}
+
+// isWithin reports whether path is dir or somewhere below it, comparing
+// cleaned absolute paths. As with SamePath, case is ignored.
+func isWithin(dir, path string) bool {
+	absDir, errDir := filepath.Abs(dir)
+	absPath, errPath := filepath.Abs(path)
+	if errDir != nil || errPath != nil {
+		return false
+	}
+	rel, err := filepath.Rel(strings.ToLower(absDir), strings.ToLower(absPath))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
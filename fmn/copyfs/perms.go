@@ -0,0 +1,148 @@
+package copyfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// checkPermissions implements cp -check-perms. Instead of copying, it walks
+// the sources opening every file and directory the copy would read, and
+// creates and removes a probe file in every existing directory the copy
+// would write into. No data is transferred. Each permission problem is
+// logged as it is found and all of them are returned together at the end.
+func checkPermissions(opts Options, sources []string, dest string, destInfo os.FileInfo) error {
+	var problems []error
+	check := func(err error) error {
+		if err == nil || !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+		opts.Log.Println(err)
+		problems = append(problems, err)
+		return nil
+	}
+
+	// Files are written into the destination directory, or next to a
+	// destination file that is overwritten or created
+	destDir := dest
+	if destInfo == nil || !destInfo.IsDir() {
+		destDir = filepath.Dir(dest)
+	}
+	if err := check(probeWritable(opts, destDir)); err != nil {
+		return err
+	}
+
+	for _, src := range sources {
+		srcInfo, err := stat(opts, src)
+		if err != nil {
+			if err := check(NewFileError("stat source", src, err)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !srcInfo.IsDir() {
+			if err := check(probeReadable(opts, src)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !opts.Recursive {
+			return &FileError{Op: "copy", Path: src, Err: ErrOmitDirectory}
+		}
+
+		ignore := NewIgnoreMatcher(opts.filesystem())
+		err = WalkDir(opts.filesystem(), src, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				err = check(NewFileError("read", path, err))
+				if err == nil && d != nil && d.IsDir() {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if isChecksumCache(d) {
+				return nil
+			}
+			if ignore.Ignored(path, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.IsDir() {
+				return check(probeReadable(opts, path))
+			}
+			// An unreadable directory fails as soon as its ignore file is
+			// looked for, so report the directory and skip it
+			if err := ignore.Load(path); err != nil {
+				if errors.Is(err, fs.ErrPermission) {
+					err = &FileError{Op: "read", Path: path, Err: fs.ErrPermission}
+				}
+				if err := check(err); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+
+			// An existing target directory must accept new files; one the
+			// copy creates itself will. The root maps to dest, checked above.
+			if path == src {
+				return nil
+			}
+			relPath, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(dest, relPath)
+			if info, err := statDest(opts, target); err == nil && info.IsDir() {
+				return check(probeWritable(opts, target))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(problems) > 0 {
+		return &permissionErrors{Count: len(problems), Err: errors.Join(problems...)}
+	}
+	if opts.Verbose >= VerboseFiles {
+		fmt.Fprintln(opts.Stderr, "permission check passed")
+	}
+	return nil
+}
+
+// probeReadable opens the source file at path and closes it again.
+func probeReadable(opts Options, path string) error {
+	debugf(opts, "open '%s'", path)
+	f, err := opts.filesystem().Open(path)
+	if err != nil {
+		return NewFileError("read", path, err)
+	}
+	f.Close()
+	return nil
+}
+
+// probeWritable creates and removes an empty file in the destination
+// directory dir, which is the only portable way to know a write would work.
+func probeWritable(opts Options, dir string) error {
+	probe := filepath.Join(dir, fmt.Sprintf(".fmn-check-perms-%d", os.Getpid()))
+	debugf(opts, "create '%s'", probe)
+	fsys := opts.destination()
+	f, err := fsys.Create(probe)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err // name the directory, not the probe
+		}
+		return &FileError{Op: "write to", Path: dir, Err: err}
+	}
+	f.Close()
+	if err := fsys.Remove(probe); err != nil {
+		return NewFileError("remove", probe, err)
+	}
+	return nil
+}
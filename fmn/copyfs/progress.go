@@ -0,0 +1,94 @@
+package copyfs
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"yanmifeakeju/fmn/internal/humanize"
+	"yanmifeakeju/fmn/internal/status"
+)
+
+// progressInterval is how many bytes a copy writes between progress calls.
+const progressInterval = 1 << 20
+
+// ProgressFunc is called while a file is copied with the bytes copied so
+// far and the size of the source. It is called once with copied 0 before
+// any data is written and once with the final count when the file is done.
+// Copies may run concurrently, so it must be safe to call from several
+// goroutines.
+type ProgressFunc func(path string, copied, total int64)
+
+// progressWriter counts the bytes written through it and reports them to fn
+// every progressInterval bytes.
+type progressWriter struct {
+	w        io.Writer
+	path     string
+	total    int64
+	fn       ProgressFunc
+	copied   int64
+	reported int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.copied += int64(n)
+	if p.copied-p.reported >= progressInterval {
+		p.reported = p.copied
+		p.fn(p.path, p.copied, p.total)
+	}
+	return n, err
+}
+
+// done reports the final count, unless it was the last one reported.
+func (p *progressWriter) done() {
+	if p.copied != p.reported || p.copied == 0 {
+		p.fn(p.path, p.copied, p.total)
+	}
+}
+
+// progressBarWidth is the number of cells in the bar cp -progress draws.
+const progressBarWidth = 30
+
+// DefaultProgressMin is the size below which cp -progress draws no bar, as
+// small files are copied before one would be seen.
+const DefaultProgressMin = 16 << 20
+
+// NewProgressPrinter returns the ProgressFunc behind cp -progress. It redraws
+// a bar for the file on w, stderr for cp, with the bytes copied and the throughput
+// since the file started, and ends the line once the file is complete. Each
+// redraw is a single write, so concurrent copies never interleave within one.
+func NewProgressPrinter(w io.Writer) ProgressFunc {
+	var mu sync.Mutex
+	started := make(map[string]time.Time)
+
+	return func(path string, copied, total int64) {
+		mu.Lock()
+		start, ok := started[path]
+		if !ok {
+			start = time.Now()
+			started[path] = start
+		}
+		if copied >= total {
+			delete(started, path)
+		}
+		mu.Unlock()
+
+		percent := int64(100)
+		if total > 0 {
+			percent = min(copied*100/total, 100)
+		}
+		filled := int(percent) * progressBarWidth / 100
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+
+		end := ""
+		if copied >= total {
+			end = "\n"
+		}
+		fmt.Fprintf(w, "\r%s [%s] %3d%% %s/%s %s%s", filepath.Base(path), bar, percent,
+			humanize.Size(copied), humanize.Size(total), status.Rate(copied, time.Since(start)), end)
+	}
+}
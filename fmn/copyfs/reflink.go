@@ -0,0 +1,34 @@
+package copyfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// Modes accepted by cp -reflink.
+const (
+	ReflinkAuto   = "auto"   // clone where the filesystem can, copy otherwise
+	ReflinkAlways = "always" // clone or fail
+	ReflinkNever  = "never"  // always copy the data
+)
+
+// errNoReflink is the reason a file cannot be cloned on a platform or
+// filesystem without copy-on-write support.
+var errNoReflink = errors.New("reflinks are not supported here")
+
+// tryReflink clones src into the newly created dst, sharing its blocks
+// copy-on-write so the copy is near-instant, as on Btrfs and XFS. Under
+// -reflink auto a file that cannot be cloned, because the filesystem lacks
+// support or the two are on different devices, is left to a normal copy;
+// under always that is an error. tryReflink reports whether it cloned.
+func tryReflink(opts Options, dst io.Writer, src fs.File) (bool, error) {
+	if opts.Reflink == ReflinkNever {
+		return false, nil
+	}
+	err := cloneFile(dst, src)
+	if err != nil && opts.Reflink == ReflinkAlways {
+		return false, err
+	}
+	return err == nil, nil
+}
@@ -0,0 +1,19 @@
+package copyfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile shares the blocks of src with dst through the FICLONE ioctl.
+func cloneFile(dst io.Writer, src fs.File) error {
+	d, ok1 := dst.(*os.File)
+	s, ok2 := src.(*os.File)
+	if !ok1 || !ok2 {
+		return errNoReflink
+	}
+	return unix.IoctlFileClone(int(d.Fd()), int(s.Fd()))
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package copyfs
+
+import (
+	"io"
+	"io/fs"
+)
+
+// cloneFile cannot clone outside Linux.
+func cloneFile(dst io.Writer, src fs.File) error { return errNoReflink }
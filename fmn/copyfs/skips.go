@@ -0,0 +1,83 @@
+package copyfs
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+// Reasons a path can be skipped, as shown by -report-skips.
+const (
+	SkipDeclined   = "overwrite declined"
+	SkipIgnored    = "matched " + ignoreFileName
+	SkipExcluded   = "matched -exclude"
+	SkipSize       = "outside -min-size and -max-size"
+	SkipTime       = "outside -newer and -older"
+	SkipDenied     = "permission denied"
+	SkipNotArchive = "not an archive"
+	SkipEntryType  = "unsupported tar entry type"
+	SkipOtherFS    = "on another filesystem"
+	SkipIdentical  = "identical to the source"
+	SkipNotNewer   = "not older than the source"
+	SkipExists     = "already exists"
+	SkipFailed     = "failed to copy"
+	SkipCorrupt    = "could not be restored"
+)
+
+// SkipReport collects the paths an operation skipped, grouped by reason, so
+// they can be summed up at the end. A nil *SkipReport records nothing, which
+// lets the copy and restore code call Add unconditionally.
+type SkipReport struct {
+	mu      sync.Mutex
+	reasons []string // in order of first occurrence
+	paths   map[string][]string
+}
+
+// Add records that path was skipped for reason.
+func (r *SkipReport) Add(reason, path string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.paths == nil {
+		r.paths = make(map[string][]string)
+	}
+	if _, ok := r.paths[reason]; !ok {
+		r.reasons = append(r.reasons, reason)
+	}
+	r.paths[reason] = append(r.paths[reason], path)
+}
+
+// Print writes the skipped paths to w, one group per reason.
+func (r *SkipReport) Print(w io.Writer) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.reasons) == 0 {
+		fmt.Fprintln(w, "No files were skipped.")
+		return
+	}
+	fmt.Fprintln(w, "Skipped files:")
+	for _, reason := range r.reasons {
+		fmt.Fprintf(w, "  %s (%d):\n", reason, len(r.paths[reason]))
+		for _, path := range r.paths[reason] {
+			fmt.Fprintf(w, "    %s\n", path)
+		}
+	}
+}
+
+// Paths returns the paths skipped for reason, in the order they were added.
+func (r *SkipReport) Paths(reason string) []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.paths[reason])
+}
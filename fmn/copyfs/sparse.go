@@ -0,0 +1,82 @@
+package copyfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Modes accepted by cp -sparse.
+const (
+	SparseAuto   = "auto"   // keep the holes of sources that have some
+	SparseAlways = "always" // turn every zero block into a hole
+	SparseNever  = "never"  // write zeros out in full
+)
+
+// sparseBlock is the size of the zero runs a sparse copy skips over rather
+// than writes, the block size of most filesystems.
+const sparseBlock = 4 << 10
+
+var zeroBlock [sparseBlock]byte
+
+// sparseFile is a destination file a sparse copy can leave holes in.
+type sparseFile interface {
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// useSparse reports whether the copy of the source described by info into
+// dst should leave holes for its zero blocks, which takes a destination
+// that can seek.
+func useSparse(opts Options, dst io.Writer, info os.FileInfo) (sparseFile, bool) {
+	f, ok := dst.(sparseFile)
+	if !ok {
+		return nil, false
+	}
+	switch opts.Sparse {
+	case SparseAlways:
+		return f, true
+	case SparseNever:
+		return nil, false
+	default:
+		return f, isSparse(info)
+	}
+}
+
+// sparseWriter writes to f, seeking over blocks of zeros instead of writing
+// them so the filesystem leaves holes. Blocks are aligned to the start of
+// the file, which is where the holes of the source are.
+type sparseWriter struct {
+	f      sparseFile
+	offset int64 // bytes written or skipped
+	holes  bool  // a block was skipped
+}
+
+func (s *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), sparseBlock-int(s.offset%sparseBlock))
+		block := p[:n]
+		if bytes.Equal(block, zeroBlock[:n]) {
+			if _, err := s.f.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+			s.holes = true
+		} else if _, err := s.f.Write(block); err != nil {
+			return written, err
+		}
+		s.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// finish sets the size of the file, which a hole at its end leaves short.
+func (s *sparseWriter) finish() error {
+	if !s.holes {
+		return nil
+	}
+	return s.f.Truncate(s.offset)
+}
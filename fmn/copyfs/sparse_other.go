@@ -0,0 +1,9 @@
+//go:build !unix
+
+package copyfs
+
+import "os"
+
+// isSparse reports no holes; outside Unix the allocated size of a file is
+// not known, so -sparse auto copies it in full.
+func isSparse(info os.FileInfo) bool { return false }
@@ -0,0 +1,15 @@
+//go:build unix
+
+package copyfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// isSparse reports whether the file described by info has holes: fewer
+// 512-byte blocks allocated than its size needs.
+func isSparse(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int64(st.Blocks)*512 < st.Size
+}
@@ -0,0 +1,70 @@
+//go:build unix
+
+package copyfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestCopySparse checks that -sparse keeps the apparent size and content of
+// a file while allocating fewer blocks for its holes.
+func TestCopySparse(t *testing.T) {
+	const size = 8 << 20
+	src := filepath.Join(t.TempDir(), "sparse.img")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{0, size / 2} {
+		if _, err := f.WriteAt([]byte("data"), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSparse(srcInfo) {
+		t.Skip("the temporary directory does not support sparse files")
+	}
+	want, _ := os.ReadFile(src)
+
+	for _, tc := range []struct {
+		mode       string
+		wantSparse bool
+	}{
+		{SparseAuto, true},
+		{SparseAlways, true},
+		{SparseNever, false},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			destDir := t.TempDir()
+			if err := Copy(Options{Sparse: tc.mode}, []string{src, destDir}); err != nil {
+				t.Fatalf("copy failed: %v", err)
+			}
+			dst := filepath.Join(destDir, "sparse.img")
+			info, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != size {
+				t.Errorf("got size %d, want %d", info.Size(), size)
+			}
+			if got, _ := os.ReadFile(dst); !bytes.Equal(got, want) {
+				t.Errorf("copied content differs from the source")
+			}
+			blocks := info.Sys().(*syscall.Stat_t).Blocks
+			if isSparse(info) != tc.wantSparse {
+				t.Errorf("got %d blocks allocated for %d bytes, want sparse %v", blocks, size, tc.wantSparse)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package copyfs
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"yanmifeakeju/fmn/internal/humanize"
+)
+
+// countOf formats n with the singular or plural form of a noun: "1 file",
+// "3 files".
+func countOf(n int64, singular, plural string) string {
+	if n == 1 {
+		return "1 " + singular
+	}
+	return fmt.Sprintf("%d %s", n, plural)
+}
+
+// Stats counts what a copy did, for the summary cp -v prints at the
+// end. Its counters are updated from any goroutine. A nil *Stats counts
+// nothing.
+type Stats struct {
+	files   atomic.Int64
+	dirs    atomic.Int64
+	bytes   atomic.Int64
+	skipped atomic.Int64 // existing files left alone
+}
+
+// file records a file copied with n bytes of data.
+func (s *Stats) file(n int64) {
+	if s != nil {
+		s.files.Add(1)
+		s.bytes.Add(n)
+	}
+}
+
+// dir records a directory created.
+func (s *Stats) dir() {
+	if s != nil {
+		s.dirs.Add(1)
+	}
+}
+
+// skip records an existing file that was not overwritten.
+func (s *Stats) skip() {
+	if s != nil {
+		s.skipped.Add(1)
+	}
+}
+
+// Print writes the summary line to w, e.g. "3 files, 2 directories,
+// 12.4 MB copied, 1 skipped", or what a dry run would have copied.
+func (s *Stats) Print(w io.Writer, dryRun bool) {
+	if s == nil {
+		return
+	}
+	counts := fmt.Sprintf("%s, %s, %s", countOf(s.files.Load(), "file", "files"),
+		countOf(s.dirs.Load(), "directory", "directories"), humanize.Bytes(float64(s.bytes.Load())))
+	line := counts + " copied"
+	if dryRun {
+		line = "would copy " + counts
+	}
+	fmt.Fprintf(w, "%s, %d skipped\n", line, s.skipped.Load())
+}
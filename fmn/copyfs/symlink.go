@@ -0,0 +1,80 @@
+package copyfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// errSymlinkLoop is the reason a symlink followed by cp -L is not copied:
+// it leads back to a directory that is already being copied.
+var errSymlinkLoop = errors.New("symlink leads back to a directory being copied")
+
+// readlinker is implemented by source filesystems that can read symlinks.
+type readlinker interface {
+	Readlink(name string) (string, error)
+}
+
+// symlinker is implemented by destination filesystems that can create symlinks.
+type symlinker interface {
+	Symlink(oldname, newname string) error
+}
+
+// copySymlink recreates the symlink at src as dst, pointing at the same
+// target, rather than copying what it points to. The target is copied as it
+// is, so a relative link still resolves relative to its new directory. It
+// reports whether it made the link: when the source cannot read symlinks or
+// the destination cannot hold them, such as object storage, the caller
+// copies the target's content instead.
+func copySymlink(opts Options, src, dst string) (bool, error) {
+	rl, ok := opts.filesystem().(readlinker)
+	if !ok {
+		return false, nil
+	}
+	fsys := opts.destination()
+	sl, ok := fsys.(symlinker)
+	if !ok {
+		debugf(opts, "copying '%s' as a file: the destination has no symlinks", src)
+		return false, nil
+	}
+
+	target, err := rl.Readlink(src)
+	if err != nil {
+		return false, NewFileError("read symlink", src, err)
+	}
+	if opts.PrintScript {
+		fmt.Fprintf(opts.Stdout, "ln -sfn -- %s %s\n", ShellQuote(target), ShellQuote(dst))
+		return true, nil
+	}
+	if opts.DryRun {
+		fmt.Fprintf(opts.Stdout, "would link '%s' -> '%s'\n", dst, target)
+		return true, nil
+	}
+	if err := opts.journal.prepare(opts, dst); err != nil {
+		return false, err
+	}
+
+	// The overwrite checks already passed, so replace whatever is there
+	if err := fsys.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, NewFileError("replace", dst, err)
+	}
+	if err := sl.Symlink(target, dst); err != nil {
+		return false, NewFileError("create symlink", dst, err)
+	}
+	if opts.Verbose >= VerboseFiles {
+		fmt.Fprintf(opts.Stdout, "'%s' -> '%s' (symlink to '%s')\n", src, dst, target)
+	}
+	return true, nil
+}
+
+// copyLinkedDir copies, under -L, the directory that the symlink at path
+// points to, described by info, as a real directory at target.
+func copyLinkedDir(opts Options, path, target string, info os.FileInfo) error {
+	if err := createDir(target, opts); err != nil {
+		return err
+	}
+	// target may not exist in a dry run; all copyDirectory needs to know
+	// is that it is a directory
+	return copyDirectory(opts, path, info, target, info)
+}
@@ -0,0 +1,138 @@
+package copyfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// errNoRename is the reason a file cannot be moved on a destination
+// filesystem without renames, such as object storage.
+var errNoRename = errors.New("the destination does not support moving files")
+
+// renamer is implemented by destination filesystems that can move files.
+type renamer interface {
+	Rename(oldpath, newpath string) error
+}
+
+// trashFile moves the existing file at path into the -trash directory
+// before the copy overwrites it. rel is path relative to the destination
+// root, and is kept under the trash directory so the file can be put back.
+// An earlier file trashed under the same name is kept too: the new one gets
+// a numbered suffix. Any failure is returned so the caller aborts instead of
+// destroying the file. Directories are never trashed, as they are merged
+// into rather than replaced. trashFile reports whether path was moved.
+func trashFile(opts Options, path, rel string, info os.FileInfo) (bool, error) {
+	if opts.Trash == "" || info == nil || info.IsDir() {
+		return false, nil
+	}
+
+	fsys := opts.destination()
+	target := filepath.Join(opts.Trash, rel)
+	for i := 1; ; i++ {
+		_, err := fsys.Lstat(target)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return false, NewFileError("stat trash", target, err)
+		}
+		target = fmt.Sprintf("%s.%d", filepath.Join(opts.Trash, rel), i)
+	}
+
+	if opts.PrintScript {
+		fmt.Fprintf(opts.Stdout, "mkdir -p -- %s\n", ShellQuote(filepath.Dir(target)))
+		fmt.Fprintf(opts.Stdout, "mv -- %s %s\n", ShellQuote(path), ShellQuote(target))
+		return true, nil
+	}
+	if opts.DryRun {
+		fmt.Fprintf(opts.Stdout, "would move '%s' to trash '%s'\n", path, target)
+		return true, nil
+	}
+
+	if err := fsys.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return false, NewFileError("create trash directory", filepath.Dir(target), err)
+	}
+	if err := moveFile(fsys, path, target, info); err != nil {
+		return false, NewFileError("move to trash", path, err)
+	}
+	opts.journal.moved(path, target)
+	debugf(opts, "moved '%s' to trash '%s'", path, target)
+	return true, nil
+}
+
+// backupFile renames the existing file at path to its name with the -S
+// suffix, "name~" by default, before the copy overwrites it, like cp -b. An
+// older backup of the same name is replaced by the new one; under
+// -transactional it is put aside first, so a rollback can restore it.
+// Directories are merged into rather than replaced, so they are never backed
+// up. backupFile reports whether path was moved.
+func backupFile(opts Options, path string, info os.FileInfo) (bool, error) {
+	if !opts.Backup || info == nil || info.IsDir() {
+		return false, nil
+	}
+
+	backup := path + opts.Suffix
+	if opts.PrintScript {
+		fmt.Fprintf(opts.Stdout, "mv -f -- %s %s\n", ShellQuote(path), ShellQuote(backup))
+		return true, nil
+	}
+	if opts.DryRun {
+		fmt.Fprintf(opts.Stdout, "would back up '%s' to '%s'\n", path, backup)
+		return true, nil
+	}
+
+	r, ok := opts.destination().(renamer)
+	if !ok {
+		return false, NewFileError("back up", path, errNoRename)
+	}
+	if err := opts.journal.prepare(opts, backup); err != nil {
+		return false, err
+	}
+	if err := r.Rename(path, backup); err != nil {
+		return false, NewFileError("back up", path, err)
+	}
+	opts.journal.moved(path, backup)
+	debugf(opts, "backed up '%s' to '%s'", path, backup)
+	return true, nil
+}
+
+// moveFile renames oldpath to newpath, copying and removing the file when
+// the two are on different devices.
+func moveFile(fsys WriteFS, oldpath, newpath string, info os.FileInfo) error {
+	r, ok := fsys.(renamer)
+	if !ok {
+		return errNoRename
+	}
+	err := r.Rename(oldpath, newpath)
+	if !isCrossDevice(err) || !info.Mode().IsRegular() {
+		return err
+	}
+
+	src, err := fsys.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fsys.Create(newpath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := fsys.Chmod(newpath, info.Mode()); err != nil {
+		return err
+	}
+	if err := fsys.Chtimes(newpath, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return fsys.Remove(oldpath)
+}
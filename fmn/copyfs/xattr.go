@@ -0,0 +1,28 @@
+package copyfs
+
+// preserveXattrs copies the extended attributes of src to dst under
+// cp -xattrs. Both must be on the local filesystem. Attributes depend on
+// the filesystem and on privileges (trusted.* needs root, for one), so one
+// that cannot be read or set is logged as a warning and the rest are still
+// copied.
+func preserveXattrs(opts Options, src, dst string) {
+	if !opts.Xattrs {
+		return
+	}
+	_, srcLocal := opts.filesystem().(OSFS)
+	_, dstLocal := opts.destination().(OSFS)
+	if !srcLocal || !dstLocal {
+		return
+	}
+
+	names, err := listXattrs(src)
+	if err != nil {
+		opts.Log.Printf("warning: cannot read extended attributes of '%s': %v", src, err)
+		return
+	}
+	for _, name := range names {
+		if err := copyXattr(src, dst, name); err != nil {
+			opts.Log.Printf("warning: cannot copy extended attribute %s of '%s': %v", name, src, err)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package copyfs
+
+// listXattrs reports no attributes; only Linux and macOS support copying
+// them with cp -xattrs.
+func listXattrs(path string) ([]string, error) { return nil, nil }
+
+// copyXattr is never called, as listXattrs returns no names.
+func copyXattr(src, dst, name string) error { return nil }
@@ -0,0 +1,45 @@
+//go:build linux || darwin
+
+package copyfs
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs returns the names of the extended attributes of the file at path.
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// copyXattr copies the extended attribute name from the file at src to the
+// one at dst.
+func copyXattr(src, dst, name string) error {
+	size, err := unix.Getxattr(src, name, nil)
+	if err != nil {
+		return err
+	}
+	value := make([]byte, size)
+	size, err = unix.Getxattr(src, name, value)
+	if err != nil {
+		return err
+	}
+	return unix.Setxattr(dst, name, value[:size], 0)
+}
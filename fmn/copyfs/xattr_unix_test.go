@@ -0,0 +1,50 @@
+//go:build linux || darwin
+
+package copyfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"yanmifeakeju/fmn/internal/testfs"
+)
+
+// TestCopyXattrs checks that -xattrs copies extended attributes, and that
+// they are dropped without it.
+func TestCopyXattrs(t *testing.T) {
+	_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "a.txt", Content: "a"}})
+	const name, value = "user.fmn.test", "kept"
+	if err := unix.Setxattr(srcFiles[0], name, []byte(value), 0); err != nil {
+		t.Skipf("the temporary directory does not support extended attributes: %v", err)
+	}
+
+	for _, xattrs := range []bool{false, true} {
+		dst := filepath.Join(t.TempDir(), "a.txt")
+		if err := Copy(Options{Xattrs: xattrs}, []string{srcFiles[0], dst}); err != nil {
+			t.Fatalf("copy failed: %v", err)
+		}
+
+		buf := make([]byte, 64)
+		n, err := unix.Getxattr(dst, name, buf)
+		switch {
+		case xattrs && (err != nil || string(buf[:n]) != value):
+			t.Errorf("got %q (err: %v), want %q", buf[:n], err, value)
+		case !xattrs && err == nil:
+			t.Errorf("attribute copied without -xattrs")
+		}
+	}
+
+	// A source that is not there to read from only warns
+	var errBuf bytes.Buffer
+	opts := Options{Xattrs: true, Stderr: &errBuf}
+	opts.start()
+	preserveXattrs(opts, filepath.Join(t.TempDir(), "missing"), os.DevNull)
+	if !strings.Contains(errBuf.String(), "warning: cannot read extended attributes") {
+		t.Errorf("expected a warning, got %q", errBuf.String())
+	}
+}
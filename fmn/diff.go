@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"yanmifeakeju/fmn/copyfs"
+)
+
+// treeDiff is the result of comparing two directory trees. Paths are
+// relative to the roots; a directory missing on one side is reported once
+// rather than with all of its contents.
+type treeDiff struct {
+	OnlyA     []string `json:"only_in_a"`
+	OnlyB     []string `json:"only_in_b"`
+	Differ    []string `json:"differ"`
+	Identical int      `json:"identical"`
+}
+
+// errTreesDiffer is returned by diff so scripts can rely on the exit code.
+var errTreesDiffer = errors.New("trees differ")
+
+// diffDirectories compares the trees at a and b and prints the differences to
+// stdio grouped by kind, followed by a summary line, or as JSON.
+func diffDirectories(stdio *IO, a, b string, asJSON bool) error {
+	d, err := diffTrees(copyfs.OSFS{}, a, b)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(stdio.Out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	} else {
+		printTreeDiff(stdio.Out, a, b, d)
+	}
+
+	if len(d.OnlyA)+len(d.OnlyB)+len(d.Differ) > 0 {
+		return errTreesDiffer
+	}
+	return nil
+}
+
+// diffTrees walks both trees and classifies every path. Files present on
+// both sides are compared by size first and by content only if needed.
+func diffTrees(fsys copyfs.ReadFS, a, b string) (treeDiff, error) {
+	d := treeDiff{OnlyA: []string{}, OnlyB: []string{}, Differ: []string{}}
+
+	entriesA, err := treeEntries(fsys, a)
+	if err != nil {
+		return d, err
+	}
+	entriesB, err := treeEntries(fsys, b)
+	if err != nil {
+		return d, err
+	}
+
+	d.OnlyA = onlyIn(entriesA, entriesB)
+	d.OnlyB = onlyIn(entriesB, entriesA)
+
+	for _, rel := range sortedKeys(entriesA) {
+		typeA := entriesA[rel]
+		typeB, ok := entriesB[rel]
+		if !ok {
+			continue
+		}
+
+		switch {
+		case typeA != typeB:
+			d.Differ = append(d.Differ, rel)
+		case typeA.IsDir():
+			// Directories are compared through their contents
+		default:
+			same, err := sameContent(fsys, filepath.Join(a, rel), filepath.Join(b, rel))
+			if err != nil {
+				return d, err
+			}
+			if same {
+				d.Identical++
+			} else {
+				d.Differ = append(d.Differ, rel)
+			}
+		}
+	}
+	return d, nil
+}
+
+// treeEntries maps every path below root, relative to it, to its type.
+func treeEntries(fsys copyfs.ReadFS, root string) (map[string]fs.FileMode, error) {
+	entries := make(map[string]fs.FileMode)
+	err := copyfs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return copyfs.NewFileError("read", path, err)
+		}
+		if path == root {
+			if !d.IsDir() {
+				return &copyfs.FileError{Op: "compare", Path: root, Err: copyfs.ErrNotDirectory}
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entries[rel] = d.Type()
+		return nil
+	})
+	return entries, err
+}
+
+// onlyIn returns the paths in from that are missing in other, skipping the
+// contents of directories that are missing as a whole.
+func onlyIn(from, other map[string]fs.FileMode) []string {
+	paths := []string{}
+	var missingDir string
+	for _, rel := range sortedKeys(from) {
+		if missingDir != "" && strings.HasPrefix(rel, missingDir+string(filepath.Separator)) {
+			continue
+		}
+		if _, ok := other[rel]; ok {
+			continue
+		}
+		paths = append(paths, rel)
+		if from[rel].IsDir() {
+			missingDir = rel
+		}
+	}
+	return paths
+}
+
+// sortedKeys returns the keys of m in lexical order.
+func sortedKeys(m map[string]fs.FileMode) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printTreeDiff writes d to w grouped by kind with a summary line.
+func printTreeDiff(w io.Writer, a, b string, d treeDiff) {
+	groups := []struct {
+		title string
+		paths []string
+	}{
+		{fmt.Sprintf("Only in %s:", a), d.OnlyA},
+		{fmt.Sprintf("Only in %s:", b), d.OnlyB},
+		{"Differ:", d.Differ},
+	}
+	for _, g := range groups {
+		if len(g.paths) == 0 {
+			continue
+		}
+		fmt.Fprintln(w, g.title)
+		for _, p := range g.paths {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "%d only in %s, %d only in %s, %d differ, %d identical\n",
+		len(d.OnlyA), a, len(d.OnlyB), b, len(d.Differ), d.Identical)
+}
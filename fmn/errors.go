@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+
+	"yanmifeakeju/fmn/copyfs"
+)
+
+// Reasons carried by FileErrors that don't come from the operating system.
+var (
+	errNoMatch          = errors.New("no matches for pattern")
+	errUnsafePath       = errors.New("entry path leaves the destination directory")
+	errSidecarMismatch  = errors.New("restored data does not match the " + sidecarExt + " checksum")
+	errMalformedSidecar = errors.New("not a SHA-256 checksum")
+)
+
+// Exit codes returned by fmn. They are listed in the usage message so scripts
+// can tell a bad invocation from a runtime failure.
+const (
+	exitOK         = 0 // everything succeeded
+	exitError      = 1 // general error
+	exitPartial    = 1 // some paths were processed, others failed: a minor problem, as for ls and cp
+	exitUsage      = 2 // bad flags or arguments
+	exitPermission = 4 // a permission error stopped the operation
+)
+
+// exitCode maps an error returned by a subcommand to the process exit code.
+// An operation that got past its failures is a partial success even when
+// they were permission errors; only one that a permission error stopped
+// exits with exitPermission.
+func exitCode(err error) int {
+	var usageErr *copyfs.UsageError
+	var partialErr *copyfs.PartialError
+	var entryErrs *copyfs.EntryErrors
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.As(err, &partialErr), errors.As(err, &entryErrs):
+		return exitPartial
+	case errors.Is(err, fs.ErrPermission):
+		return exitPermission
+	default:
+		return exitError
+	}
+}
+
+// errorPath returns the path an error refers to, or "" if it carries none.
+func errorPath(err error) string {
+	var fileErr *copyfs.FileError
+	if errors.As(err, &fileErr) {
+		return fileErr.Path
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Path
+	}
+	return ""
+}
+
+// errorDest returns where the path of a failed copy was being copied to, or
+// "" if the error is not about one.
+func errorDest(err error) string {
+	var fileErr *copyfs.FileError
+	if errors.As(err, &fileErr) {
+		return fileErr.Dest
+	}
+	return ""
+}
+
+// Error output formats selected with -error-format.
+const (
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+)
+
+// reportError writes err to stdio's stderr, either as the usual "fmn: ..."
+// line or as a single JSON object for tools that embed fmn.
+func reportError(stdio *IO, err error, format string, code int) {
+	if format != errorFormatJSON {
+		stdio.Log.Println(err)
+		return
+	}
+
+	json.NewEncoder(stdio.Err).Encode(struct {
+		Error string `json:"error"`
+		Path  string `json:"path"`
+		Dest  string `json:"dest,omitempty"`
+		Code  int    `json:"code"`
+	}{err.Error(), errorPath(err), errorDest(err), code})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"yanmifeakeju/fmn/copyfs"
+)
+
+// findOptions holds the predicates for fmn find. A path is printed only if
+// it matches all of the predicates that are set.
+type findOptions struct {
+	name      string        // glob matched against the base name
+	fileType  string        // "f" for files, "d" for directories, "" for both
+	newerThan time.Duration // modified within this long ago; 0 disables the check
+	null      bool          // separate results with NUL instead of newline
+}
+
+// findFiles walks each root and prints the paths that match opts to stdio,
+// one per line (or NUL-terminated with opts.null) so they can be piped into cp.
+// Unreadable directories are reported and skipped, as are paths listed in
+// .fmnignore files.
+func findFiles(stdio *IO, roots []string, opts findOptions) error {
+	if _, err := filepath.Match(opts.name, ""); err != nil {
+		return copyfs.NewUsageError("invalid pattern '%s': %v", opts.name, err)
+	}
+
+	cutoff := time.Now().Add(-opts.newerThan)
+	separator := "\n"
+	if opts.null {
+		separator = "\x00"
+	}
+
+	var failed bool
+	var found int
+	for _, root := range roots {
+		ignore := copyfs.NewIgnoreMatcher(copyfs.OSFS{})
+
+		copyfs.WalkDir(copyfs.OSFS{}, root, func(path string, d fs.DirEntry, err error) error {
+			// Skip anything listed in a .fmnignore, and pick up the rules of each directory entered
+			if err == nil && ignore.Ignored(path, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if err == nil && d.IsDir() {
+				err = ignore.Load(path)
+			}
+
+			if err == nil {
+				var ok bool
+				ok, err = matchFind(path, d, opts, cutoff)
+				if ok {
+					fmt.Fprint(stdio.Out, path, separator)
+					found++
+				}
+			}
+			if err != nil {
+				// Report and keep going past unreadable paths, like find(1).
+				stdio.Log.Println(copyfs.NewFileError("read", path, err))
+				failed = true
+			}
+			return nil
+		})
+	}
+
+	if failed {
+		err := errors.New("some paths could not be read")
+		if found > 0 {
+			return &copyfs.PartialError{Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// matchFind reports whether the entry at path satisfies every predicate.
+func matchFind(path string, d fs.DirEntry, opts findOptions, cutoff time.Time) (bool, error) {
+	switch opts.fileType {
+	case "f":
+		if !d.Type().IsRegular() {
+			return false, nil
+		}
+	case "d":
+		if !d.IsDir() {
+			return false, nil
+		}
+	}
+
+	if opts.name != "" {
+		if ok, _ := filepath.Match(opts.name, filepath.Base(path)); !ok {
+			return false, nil
+		}
+	}
+
+	if opts.newerThan > 0 {
+		info, err := d.Info()
+		if err != nil {
+			return false, err
+		}
+		if !info.ModTime().After(cutoff) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
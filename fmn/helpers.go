@@ -1,29 +1,231 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"yanmifeakeju/fmn/copyfs"
+	"yanmifeakeju/fmn/internal/prompt"
 )
 
-// printPath outputs a file or directory path to the console.
-func printPath(path string) error {
-	_, err := fmt.Fprintln(console.Out, path)
+// printPath writes a file or directory path on a line of its own to w.
+func printPath(w io.Writer, path string) error {
+	_, err := fmt.Fprintln(w, path)
 	return err
 }
 
-// isSameFile checks if two paths refer to the same underlying file.
-func isSameFile(a, b string) (bool, error) {
-	infoA, err := os.Stat(a)
+// globMeta holds the characters that make an argument a glob pattern.
+const globMeta = "*?["
+
+// expandGlobs replaces the arguments holding glob metacharacters with the
+// paths they match, in order, for shells that leave patterns unexpanded such
+// as cmd.exe, or patterns that were quoted. An argument that exists as
+// written is kept, so a file really named "a[1]" can still be given. Only
+// local paths on the real filesystem, where fsys is nil, are expanded; a
+// pattern that matches nothing is an error. Each expansion is traced to
+// debug, unless it is nil.
+func expandGlobs(fsys copyfs.ReadFS, debug io.Writer, paths []string) ([]string, error) {
+	if fsys != nil {
+		return paths, nil
+	}
+
+	expanded := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if _, remote := parseRemote(path); remote || !strings.ContainsAny(path, globMeta) {
+			expanded = append(expanded, path)
+			continue
+		}
+		if _, err := os.Lstat(path); err == nil {
+			expanded = append(expanded, path)
+			continue
+		}
+
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, copyfs.NewFileError("expand", path, err)
+		}
+		if len(matches) == 0 {
+			return nil, &copyfs.FileError{Op: "expand", Path: path, Err: errNoMatch}
+		}
+		if debug != nil {
+			fmt.Fprintf(debug, "expanded '%s' to %d paths\n", path, len(matches))
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+// parseSize parses a byte count written as humanSize prints it: a number,
+// optionally with a fraction, followed by an optional K, M, G, T, P or E
+// (base 1024) and an optional B, e.g. 512, 1.5K or 2MB.
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	scale := 1.0
+	if num != "" {
+		if i := strings.IndexByte("KMGTPE", num[len(num)-1]); i >= 0 {
+			scale = math.Pow(1024, float64(i+1))
+			num = num[:len(num)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(num, 64)
+	if err != nil || value < 0 || value*scale >= math.MaxInt64 {
+		return 0, errors.New("use a byte count like 512, 1.5K or 2M")
+	}
+	return int64(value * scale), nil
+}
+
+// printScriptHeader starts the output of -print-script on w.
+func printScriptHeader(w io.Writer) {
+	fmt.Fprintln(w, "#!/bin/sh")
+	fmt.Fprintln(w, "set -e")
+}
+
+// readSourceList reads the paths listed in the file at path ("-" for in).
+// With nul unset entries are separated by newlines, and blank lines and lines
+// starting with "#" are ignored. With nul set entries are separated by NUL
+// bytes and taken verbatim, so names may contain newlines; only empty
+// entries are ignored.
+func readSourceList(in io.Reader, path string, nul bool) ([]string, error) {
+	r := in
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, copyfs.NewFileError("open source list", path, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var sources []string
+	scanner := bufio.NewScanner(r)
+	if nul {
+		scanner.Split(scanNul)
+	}
+	for scanner.Scan() {
+		if nul {
+			if entry := scanner.Text(); entry != "" {
+				sources = append(sources, entry)
+			}
+			continue
+		}
+
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sources = append(sources, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, copyfs.NewFileError("read source list", path, err)
+	}
+	return sources, nil
+}
+
+// scanNul is a bufio.SplitFunc that splits its input at NUL bytes.
+func scanNul(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// sameContent reports whether the files at a and b hold the same bytes. Sizes
+// are compared first so most differing files are never read.
+func sameContent(fsys copyfs.ReadFS, a, b string) (bool, error) {
+	infoA, err := fsys.Stat(a)
+	if err != nil {
+		return false, copyfs.NewFileError("stat", a, err)
+	}
+	infoB, err := fsys.Stat(b)
 	if err != nil {
-		return false, err
+		return false, copyfs.NewFileError("stat", b, err)
 	}
-	infoB, err := os.Stat(b)
+	if infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	fa, err := fsys.Open(a)
+	if err != nil {
+		return false, copyfs.NewFileError("open", a, err)
+	}
+	defer fa.Close()
+	fb, err := fsys.Open(b)
+	if err != nil {
+		return false, copyfs.NewFileError("open", b, err)
+	}
+	defer fb.Close()
+
+	same, err := sameData(fa, fb)
 	if err != nil {
-		// If the destination doesn't exist, it can't be the same file.
-		if os.IsNotExist(err) {
+		return false, copyfs.NewFileError("compare", b, err)
+	}
+	return same, nil
+}
+
+// sameData reports whether a and b yield the same bytes, ending at the same
+// point. It stops reading at the first difference.
+func sameData(a, b io.Reader) (bool, error) {
+	bufA := make([]byte, 32*1024)
+	bufB := make([]byte, 32*1024)
+	for {
+		n, errA := io.ReadFull(a, bufA)
+		m, errB := io.ReadFull(b, bufB[:n])
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return false, errB
+		}
+		if m != n || !bytes.Equal(bufA[:n], bufB[:n]) {
 			return false, nil
 		}
-		return false, err
+		switch errA {
+		case nil:
+			continue
+		case io.EOF, io.ErrUnexpectedEOF:
+			// b must end where a does
+			extra, err := b.Read(bufB[:1])
+			if err != nil && err != io.EOF {
+				return false, err
+			}
+			return extra == 0, nil
+		default:
+			return false, errA
+		}
+	}
+}
+
+// askConfirmation prints question and reports whether the user answered yes.
+func askConfirmation(stdio *IO, question string, opts prompt.Options) bool {
+	return prompt.Ask(question, stdio.In, stdio.Err, opts)
+}
+
+// syncWriter serializes writes to an underlying writer, so lines written by
+// concurrent goroutines come out whole instead of interleaved.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newSyncWriter wraps w, unless it is already a syncWriter.
+func newSyncWriter(w io.Writer) io.Writer {
+	if sw, ok := w.(*syncWriter); ok {
+		return sw
 	}
-	return os.SameFile(infoA, infoB), nil
+	return &syncWriter{w: w}
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
 }
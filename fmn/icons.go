@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Icons shown by ls -icons, by file type.
+const (
+	iconDirectory  = "📁"
+	iconSymlink    = "🔗"
+	iconSpecial    = "⚙️"
+	iconExecutable = "🚀"
+	iconFile       = "📄"
+)
+
+// extensionIcons maps lowercase file extensions to the icon of their kind.
+var extensionIcons = map[string]string{
+	// Archives
+	".gz": "📦", ".tgz": "📦", ".zip": "📦", ".tar": "📦", ".xz": "📦", ".zst": "📦", ".bz2": "📦", ".7z": "📦", ".rar": "📦",
+	// Images
+	".png": "🖼️", ".jpg": "🖼️", ".jpeg": "🖼️", ".gif": "🖼️", ".svg": "🖼️", ".webp": "🖼️", ".bmp": "🖼️", ".ico": "🖼️",
+	// Audio and video
+	".mp3": "🎵", ".flac": "🎵", ".wav": "🎵", ".ogg": "🎵",
+	".mp4": "🎬", ".mkv": "🎬", ".mov": "🎬", ".webm": "🎬", ".avi": "🎬",
+	// Source code
+	".go": "💻", ".c": "💻", ".h": "💻", ".rs": "💻", ".py": "💻", ".js": "💻", ".ts": "💻", ".java": "💻", ".rb": "💻", ".sh": "💻",
+	// Documents and text
+	".md": "📝", ".txt": "📝", ".log": "📝", ".pdf": "📕", ".doc": "📝", ".docx": "📝",
+	// Configuration and data
+	".json": "🔧", ".yaml": "🔧", ".yml": "🔧", ".toml": "🔧", ".ini": "🔧", ".xml": "🔧", ".csv": "📊",
+}
+
+// fileIcon returns the icon for a listed entry, chosen by its type and, for
+// regular files, by its extension.
+func fileIcon(d fs.DirEntry) string {
+	switch {
+	case d.IsDir():
+		return iconDirectory
+	case d.Type()&fs.ModeSymlink != 0:
+		return iconSymlink
+	case !d.Type().IsRegular():
+		return iconSpecial
+	}
+
+	if icon, ok := extensionIcons[strings.ToLower(filepath.Ext(d.Name()))]; ok {
+		return icon
+	}
+	if info, err := d.Info(); err == nil && info.Mode()&0111 != 0 {
+		return iconExecutable
+	}
+	return iconFile
+}
+
+// isTerminal reports whether w is a terminal. Icons are only shown there,
+// since pipes and files are usually read by programs.
+func isTerminal(w io.Writer) bool {
+	if sw, ok := w.(*syncWriter); ok {
+		w = sw.w
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
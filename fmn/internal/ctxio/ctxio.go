@@ -0,0 +1,27 @@
+// Package ctxio makes long copies stop when their context is canceled.
+package ctxio
+
+import (
+	"context"
+	"io"
+)
+
+// reader is an io.Reader that fails with ctx's error once ctx is canceled,
+// so a copy through it stops at the next read.
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// NewReader returns a reader of r that fails with ctx's error once ctx is
+// canceled.
+func NewReader(ctx context.Context, r io.Reader) io.Reader {
+	return reader{ctx, r}
+}
+
+func (c reader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
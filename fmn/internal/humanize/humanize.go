@@ -0,0 +1,41 @@
+// Package humanize formats byte counts for people to read.
+package humanize
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Size formats a byte count with base-1024 units like ls -h: 1.2K, 34M,
+// 5.6G. Sizes below 10 units keep one decimal; smaller than 1024 bytes they
+// are printed as plain bytes with no suffix.
+func Size(n int64) string {
+	if n < 1024 {
+		return strconv.FormatInt(n, 10)
+	}
+	value := float64(n)
+	for _, unit := range "KMGTPE" {
+		value /= 1024
+		switch {
+		case value < 9.95:
+			return fmt.Sprintf("%.1f%c", value, unit)
+		case value < 1023.5 || unit == 'E':
+			return fmt.Sprintf("%.0f%c", value, unit)
+		}
+	}
+	panic("unreachable")
+}
+
+// Bytes formats a byte count with decimal units: 512 B, 12.4 MB.
+func Bytes(n float64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1f GB", n/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1f MB", n/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1f kB", n/1e3)
+	default:
+		return fmt.Sprintf("%.0f B", n)
+	}
+}
@@ -0,0 +1,27 @@
+package humanize
+
+import "testing"
+
+// TestSize checks the base-1024 sizes printed under -h.
+func TestSize(t *testing.T) {
+	testCases := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0"},
+		{1023, "1023"},
+		{1024, "1.0K"},
+		{1229, "1.2K"},
+		{10 * 1024, "10K"},
+		{1023 * 1024, "1023K"},
+		{1024*1024 - 1, "1.0M"},
+		{3565158, "3.4M"},
+		{6012954214, "5.6G"},
+		{1 << 62, "4.0E"},
+	}
+	for _, tc := range testCases {
+		if got := Size(tc.n); got != tc.want {
+			t.Errorf("Size(%d) = %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Package prompt asks the yes/no questions fmn puts before overwriting or
+// deleting files.
+package prompt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options controls what a prompt does when nobody answers it.
+type Options struct {
+	Timeout time.Duration // how long to wait for an answer; 0 waits forever
+	Answer  bool          // answer used on timeout, end of input or an empty line
+}
+
+// prompting serializes prompts, so concurrent workers ask one question at
+// a time and each answer goes to the question it was typed for.
+var prompting sync.Mutex
+
+// Ask prints question to w and reports whether the answer read from reader
+// was yes. The question goes to stderr in fmn, so it never mixes with data on
+// stdout.
+func Ask(question string, reader io.Reader, w io.Writer, opts Options) bool {
+	response, ok := Answer(question, reader, w, opts)
+	if !ok {
+		return opts.Answer
+	}
+	return response == "y" || response == "yes"
+}
+
+// Answer prints question to w and returns the answer read from reader,
+// trimmed and lowercased. It returns false when the default answer applies
+// instead: on timeout, at end of input or for an empty line.
+func Answer(question string, reader io.Reader, w io.Writer, opts Options) (string, bool) {
+	prompting.Lock()
+	defer prompting.Unlock()
+	fmt.Fprint(w, question)
+
+	var timeout <-chan time.Time
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case line, ok := <-answersFrom(reader):
+		response := strings.ToLower(strings.TrimSpace(line))
+		return response, ok && response != ""
+	case <-timeout:
+		fmt.Fprintln(w)
+		return "", false
+	}
+}
+
+// answers holds the line reader for the current prompt input. Lines are read
+// on their own goroutine so a prompt can give up after a timeout, and the
+// line that eventually arrives is kept for the next prompt instead of lost.
+var answers struct {
+	sync.Mutex
+	reader io.Reader
+	lines  chan string
+}
+
+// answersFrom returns a channel of lines read from reader, closed at EOF.
+func answersFrom(reader io.Reader) <-chan string {
+	answers.Lock()
+	defer answers.Unlock()
+
+	if answers.lines == nil || answers.reader != reader {
+		lines := make(chan string)
+		go func() {
+			defer close(lines)
+			scanner := bufio.NewScanner(reader)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}()
+		answers.reader, answers.lines = reader, lines
+	}
+	return answers.lines
+}
@@ -0,0 +1,66 @@
+package prompt
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPromptTimeout checks the default answer used when a prompt times out
+// or its input ends.
+func TestPromptTimeout(t *testing.T) {
+	testCases := []struct {
+		name   string
+		reader func() io.Reader
+		opts   Options
+		want   bool
+	}{
+		{
+			name:   "Timeout uses default overwrite",
+			reader: func() io.Reader { r, _ := io.Pipe(); return r },
+			opts:   Options{Timeout: 10 * time.Millisecond, Answer: true},
+			want:   true,
+		},
+		{
+			name:   "Timeout uses default skip",
+			reader: func() io.Reader { r, _ := io.Pipe(); return r },
+			opts:   Options{Timeout: 10 * time.Millisecond},
+			want:   false,
+		},
+		{
+			name:   "EOF uses default",
+			reader: func() io.Reader { return strings.NewReader("") },
+			opts:   Options{Answer: true},
+			want:   true,
+		},
+		{
+			name:   "Explicit answer beats default",
+			reader: func() io.Reader { return strings.NewReader("n\n") },
+			opts:   Options{Timeout: time.Second, Answer: true},
+			want:   false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Ask("overwrite? ", tc.reader(), io.Discard, tc.opts); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("Late answer goes to the next prompt", func(t *testing.T) {
+		r, w := io.Pipe()
+		defer w.Close()
+		opts := Options{Timeout: 10 * time.Millisecond}
+
+		if Ask("first? ", r, io.Discard, opts) {
+			t.Errorf("expected the first prompt to time out with the default")
+		}
+		go io.WriteString(w, "y\n")
+		if !Ask("second? ", r, io.Discard, Options{Timeout: time.Second}) {
+			t.Errorf("expected the second prompt to receive the late answer")
+		}
+	})
+}
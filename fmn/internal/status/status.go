@@ -0,0 +1,50 @@
+// Package status tracks a running copy or restore for the one-line report
+// printed on SIGUSR1, like dd does.
+package status
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"yanmifeakeju/fmn/internal/humanize"
+)
+
+// job holds the counters of a run. They are updated from any goroutine.
+type job struct {
+	start   time.Time
+	files   atomic.Int64
+	bytes   atomic.Int64
+	current atomic.Value // string: the file being worked on
+}
+
+// current is the progress of the current run.
+var current = &job{start: time.Now()}
+
+// Begin records that work on the file at path started.
+func Begin(path string) {
+	current.current.Store(path)
+}
+
+// Done records that a file of n bytes was finished.
+func Done(n int64) {
+	current.files.Add(1)
+	current.bytes.Add(n)
+}
+
+// Report writes a snapshot of the counters to w.
+func Report(w io.Writer) {
+	elapsed := time.Since(current.start)
+	bytes := current.bytes.Load()
+	line := fmt.Sprintf("%d files, %d bytes in %.1fs (%s)", current.files.Load(), bytes, elapsed.Seconds(), Rate(bytes, elapsed))
+	if path, _ := current.current.Load().(string); path != "" {
+		line += fmt.Sprintf(", current '%s'", path)
+	}
+	fmt.Fprintln(w, line)
+}
+
+// Rate formats bytes per elapsed time with decimal units, as dd does.
+func Rate(bytes int64, elapsed time.Duration) string {
+	return humanize.Bytes(float64(bytes)/max(elapsed.Seconds(), 1e-9)) + "/s"
+}
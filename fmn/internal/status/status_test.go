@@ -0,0 +1,27 @@
+package status
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReport checks the SIGUSR1 report line.
+func TestReport(t *testing.T) {
+	old := current
+	defer func() { current = old }()
+	current = &job{start: time.Now().Add(-2 * time.Second)}
+
+	Begin("/src/a.txt")
+	Done(3000)
+	Begin("/src/b.txt")
+	Done(1000)
+
+	var buf bytes.Buffer
+	Report(&buf)
+	got := buf.String()
+	if !strings.HasPrefix(got, "2 files, 4000 bytes in 2.") || !strings.HasSuffix(got, " kB/s), current '/src/b.txt'\n") {
+		t.Errorf("unexpected report %q", got)
+	}
+}
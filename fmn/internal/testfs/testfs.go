@@ -0,0 +1,153 @@
+// Package testfs holds the fixtures shared by the tests of fmn and its copy
+// engine: temporary trees of files, and a filesystem that fails on demand.
+package testfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// File is a file or directory to create with SetupDir. With no Filename it
+// is the directory Path.
+type File struct {
+	Path     string
+	Filename string
+	Content  string
+	Mode     os.FileMode
+}
+
+// SetupDir creates files in a new temporary directory, and returns the
+// directory and the paths of the regular files created.
+func SetupDir(t testing.TB, files []File) (string, []string) {
+	t.Helper()
+	dir := t.TempDir()
+	paths := []string{}
+
+	for _, f := range files {
+		if f.Filename != "" {
+			fullPath := filepath.Join(dir, f.Path, f.Filename)
+			if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+				t.Fatalf("Failed to create directory for %s: %v", fullPath, err)
+			}
+
+			mode := f.Mode
+			if mode == 0 {
+				mode = 0644
+			}
+			if err := os.WriteFile(fullPath, []byte(f.Content), mode); err != nil {
+				t.Fatalf("Failed to create file %s: %v", fullPath, err)
+			}
+			paths = append(paths, fullPath)
+		} else if f.Path != "" {
+			dirPath := filepath.Join(dir, f.Path)
+			if err := os.MkdirAll(dirPath, 0755); err != nil {
+				t.Fatalf("Failed to create directory %s: %v", dirPath, err)
+			}
+		}
+	}
+	return dir, paths
+}
+
+// SkipIfRoot skips tests that rely on permission bits, which root ignores.
+func SkipIfRoot(t testing.TB) {
+	t.Helper()
+	if os.Geteuid() == 0 {
+		t.Skip("permission bits are not enforced for root")
+	}
+}
+
+// FS is the filesystem FaultFS wraps: copyfs.OSFS, whose methods it lists
+// so this package does not depend on the one it tests.
+type FS interface {
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Open(name string) (fs.File, error)
+	Create(name string) (io.WriteCloser, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	Remove(name string) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Link(oldname, newname string) error
+	Rename(oldpath, newpath string) error
+	Readlink(name string) (string, error)
+	Chown(name string, uid, gid int) error
+	Symlink(oldname, newname string) error
+}
+
+// FaultFS wraps a filesystem and injects errors for chosen operations.
+// Keys of Fail are "<op> <path>", e.g. "open /tmp/x/file.txt".
+type FaultFS struct {
+	FS
+	Fail        map[string]error
+	CorruptRead map[string]bool // paths whose reads fail part way through
+}
+
+func (f FaultFS) check(op, name string) error {
+	return f.Fail[op+" "+name]
+}
+
+func (f FaultFS) Stat(name string) (fs.FileInfo, error) {
+	if err := f.check("stat", name); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return f.FS.Stat(name)
+}
+
+func (f FaultFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := f.check("readdir", name); err != nil {
+		return nil, &fs.PathError{Op: "readdirent", Path: name, Err: err}
+	}
+	return f.FS.ReadDir(name)
+}
+
+func (f FaultFS) Open(name string) (fs.File, error) {
+	if err := f.check("open", name); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	file, err := f.FS.Open(name)
+	if err == nil && f.CorruptRead[name] {
+		return corruptFile{file}, nil
+	}
+	if err == nil && f.check("readdir", name) != nil {
+		return faultDir{file.(fs.ReadDirFile), name, f.check("readdir", name)}, nil
+	}
+	return file, err
+}
+
+func (f FaultFS) Create(name string) (io.WriteCloser, error) {
+	if err := f.check("create", name); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f.FS.Create(name)
+}
+
+func (f FaultFS) Chmod(name string, mode fs.FileMode) error {
+	if err := f.check("chmod", name); err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	return f.FS.Chmod(name, mode)
+}
+
+// corruptFile returns an I/O error on the first read.
+type corruptFile struct {
+	fs.File
+}
+
+func (corruptFile) Read([]byte) (int, error) { return 0, syscall.EIO }
+
+// faultDir is an open directory whose entries cannot be read.
+type faultDir struct {
+	fs.ReadDirFile
+	path string
+	err  error
+}
+
+func (d faultDir) ReadDir(int) ([]fs.DirEntry, error) {
+	return nil, &fs.PathError{Op: "readdirent", Path: d.path, Err: d.err}
+}
@@ -0,0 +1,65 @@
+// Package timefmt prints timestamps in the layout chosen with -time-format.
+package timefmt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// defaultTimeLayout is how timestamps are printed unless -time-format says
+// otherwise.
+const defaultTimeLayout = "2006-01-02 15:04:05 -0700"
+
+// timePresets are the named layouts accepted by -time-format. Those named
+// after ls --time-style are there for scripts written against ls.
+var timePresets = map[string]string{
+	"default":  defaultTimeLayout,
+	"iso":      "2006-01-02T15:04:05-0700",
+	"full-iso": "2006-01-02 15:04:05.000000000 -0700",
+	"rfc3339":  time.RFC3339,
+}
+
+// layoutProbe is formatted with custom layouts to check they hold at least
+// one element of the reference time. None of its fields match the reference
+// time's, so no element can format as itself.
+var layoutProbe = time.Date(1999, time.December, 31, 23, 59, 58, 0, time.UTC)
+
+// Layout is a flag.Value holding the -time-format shared by every
+// command that prints timestamps: a preset name, "unix" for seconds since the
+// epoch, or a Go reference layout such as "02 Jan 06 15:04".
+type Layout string
+
+func (f *Layout) String() string {
+	if f == nil {
+		return ""
+	}
+	return string(*f)
+}
+
+func (f *Layout) Set(s string) error {
+	if s == "" {
+		return errors.New("empty time format")
+	}
+	// A layout such as "YYYY-MM-DD" would be printed literally for every time
+	if _, preset := timePresets[s]; !preset && s != "unix" && layoutProbe.Format(s) == s {
+		return fmt.Errorf("'%s' is not a preset and has no elements of the reference time Mon Jan 2 15:04:05 MST 2006", s)
+	}
+	*f = Layout(s)
+	return nil
+}
+
+// Format renders t in the selected format.
+func (f Layout) Format(t time.Time) string {
+	if f == "" {
+		return t.Format(defaultTimeLayout)
+	}
+	if f == "unix" {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	if layout, ok := timePresets[string(f)]; ok {
+		return t.Format(layout)
+	}
+	return t.Format(string(f))
+}
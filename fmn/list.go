@@ -1,59 +1,701 @@
 package main
 
 import (
+	"cmp"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"yanmifeakeju/fmn/copyfs"
+	"yanmifeakeju/fmn/internal/humanize"
+)
+
+// listBatchSize is the number of directory entries read at a time, which
+// bounds the memory a listing needs however large the directory is.
+const listBatchSize = 256
+
+// statWorkers bounds how many arguments listFiles stats at once, which pays
+// off for many paths on a high-latency filesystem.
+const statWorkers = 16
+
+// listWorkers bounds how many directories a recursive listing reads at once.
+const listWorkers = 16
+
+// listReadAhead is how many directories per worker a recursive listing may
+// read before they are printed.
+const listReadAhead = 4
+
+// Keys accepted by ls -sort.
+const (
+	sortName = "name"
+	sortSize = "size"
+	sortTime = "time"
+	sortExt  = "ext"
 )
 
 // listFiles lists the contents of the given directories and files.
 // For directories, it prints the directory name followed by a colon and lists all files.
 // For regular files, it prints the file path directly.
 // Blank lines are printed between different items for readability.
-func listFiles(_ command, directories []string) error {
-	// Pre-validate all paths first
-	srcInfos := make([]os.FileInfo, len(directories))
-	for i, src := range directories {
-		srcInfo, err := os.Stat(src)
-		if err != nil {
-			return fmt.Errorf("cannot stat '%s': %w", src, err)
-		}
+func listFiles(cmd command, directories []string) error {
+	if cmd.stdio == nil {
+		cmd.stdio = stdIO()
+	}
+	fsys := cmd.filesystem()
 
-		srcInfos[i] = srcInfo
+	// Pre-validate all paths first. Like ls, a symlink argument is listed as
+	// the link itself unless -L asks to follow it.
+	lstat := fsys.Lstat
+	if cmd.dereference {
+		lstat = fsys.Stat
+	}
+	srcInfos, err := statPaths(directories, lstat)
+	if err != nil {
+		return err
 	}
 
 	var hasErrors bool
+	var listed int         // paths printed successfully
 	needsBlankLine := true // track printing lines between directories
 	for i, path := range directories {
-		if i > 0 && needsBlankLine {
-			fmt.Fprintln(console.Out) // Blank line between directories
+		if i > 0 && needsBlankLine && !cmd.jsonl && !cmd.count {
+			fmt.Fprintln(cmd.stdio.Out) // Blank line between directories
 		}
 
 		info := srcInfos[i]
 
 		if !info.IsDir() {
-			printPath(path)
+			printEntry(cmd, path, path, fs.FileInfoToDirEntry(info))
 			needsBlankLine = true // Files should have blank lines after them
+			listed++
 			continue
 		}
 
-		fmt.Fprintf(console.Out, "%s:\n", path)
-
-		files, err := os.ReadDir(path)
-		if err != nil {
-			errorLogger.Printf("Error reading %s: %v", path, err)
-			hasErrors = true
+		if cmd.tree {
+			ok, failed := printTree(cmd, path, info)
+			hasErrors = hasErrors || failed
+			if ok {
+				listed++
+			}
 			continue
 		}
 
-		for _, f := range files {
-			printPath(f.Name())
+		if !cmd.jsonl && !cmd.plan && !cmd.count {
+			fmt.Fprintf(cmd.stdio.Out, "%s:\n", path)
+		}
+
+		if cmd.recursive {
+			ok, failed := listTree(cmd, path, listWorkers)
+			hasErrors = hasErrors || failed
+			if !ok {
+				continue
+			}
+		} else if err := listDirectory(cmd, path); err != nil {
+			logListError(cmd, copyfs.NewFileError("read directory", path, err))
+			hasErrors = true
+			continue
 		}
 
 		needsBlankLine = true // Directories should have blank lines after them
+		listed++
 	}
 
 	if hasErrors {
-		return fmt.Errorf("some directories could not be read")
+		err := errors.New("some directories could not be read")
+		if listed > 0 {
+			return &copyfs.PartialError{Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// listDirectory prints the names in the directory at path. Unsorted entries
+// are printed as they are read, in directory order; sorting has to read the
+// whole directory first. Under -count only the number of entries that would
+// have been printed is.
+func listDirectory(cmd command, path string) error {
+	fsys := cmd.filesystem()
+	if cmd.count {
+		var n int
+		err := streamDir(fsys, path, func(f fs.DirEntry) {
+			if !cmd.hidden(f) {
+				n++
+			}
+		})
+		if err == nil {
+			printCount(cmd, path, n)
+		}
+		return err
+	}
+	printDotEntries(cmd, path)
+	var totals listTotals
+	if cmd.nameOrder == nil {
+		err := streamDir(fsys, path, func(f fs.DirEntry) {
+			if !cmd.hidden(f) {
+				printEntry(cmd, f.Name(), filepath.Join(path, f.Name()), f)
+				totals.add(f)
+			}
+		})
+		if err == nil {
+			totals.print(cmd)
+		}
+		return err
+	}
+
+	entries, err := readDirEntries(cmd, path)
+	if err != nil {
+		return err
+	}
+	for _, f := range entries {
+		printEntry(cmd, f.Name(), filepath.Join(path, f.Name()), f)
+		totals.add(f)
+	}
+	totals.print(cmd)
+	return nil
+}
+
+// listTotals adds up the entries listed in a directory for ls -summary.
+type listTotals struct {
+	bytes int64 // size of the regular files
+	files int   // entries other than directories
+	dirs  int
+}
+
+// add counts the listed entry d.
+func (t *listTotals) add(d fs.DirEntry) {
+	if d.IsDir() {
+		t.dirs++
+		return
+	}
+	t.files++
+	if d.Type().IsRegular() {
+		if info, err := d.Info(); err == nil {
+			t.bytes += info.Size()
+		}
+	}
+}
+
+// print writes the footer after a directory's entries when -summary asks
+// for one, e.g. "total: 1234 bytes (3 files, 1 directories)".
+func (t *listTotals) print(cmd command) {
+	if !cmd.summary {
+		return
+	}
+	size := fmt.Sprintf("%d bytes", t.bytes)
+	if cmd.humanize {
+		size = humanize.Size(t.bytes)
+	}
+	fmt.Fprintf(cmd.stdio.Out, "total: %s (%d files, %d directories)\n", size, t.files, t.dirs)
+}
+
+// readDirEntries reads the whole directory at path, leaving out hidden
+// entries and sorted when the command asks for an order. On error it
+// returns the entries read before it.
+func readDirEntries(cmd command, path string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	err := streamDir(cmd.filesystem(), path, func(f fs.DirEntry) {
+		if !cmd.hidden(f) {
+			entries = append(entries, f)
+		}
+	})
+	if cmd.nameOrder != nil {
+		sortEntries(cmd, path, entries)
+	}
+	return entries, err
+}
+
+// sortItem is a directory entry with the info it is sorted by.
+type sortItem struct {
+	d    fs.DirEntry
+	info fs.FileInfo // nil when not needed or not readable
+}
+
+// sortEntries orders the entries of the directory at dir by cmd.sortBy and
+// then by name, the whole order reversed under -r. As in ls, size sorts
+// largest first and time newest first. Entries whose info cannot be read
+// are logged as a warning and go last, rather than failing the listing.
+// Under -group-directories-first directories come before everything else,
+// with each group sorted as usual; -r does not swap the groups.
+func sortEntries(cmd command, dir string, entries []fs.DirEntry) {
+	needInfo := cmd.sortBy == sortSize || cmd.sortBy == sortTime
+	items := make([]sortItem, len(entries))
+	for i, d := range entries {
+		items[i].d = d
+		if !needInfo {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			cmd.stdio.Log.Printf("warning: cannot stat '%s': %v", filepath.Join(dir, d.Name()), err)
+			continue
+		}
+		items[i].info = info
+	}
+
+	slices.SortFunc(items, func(a, b sortItem) int {
+		if cmd.groupDirs && a.d.IsDir() != b.d.IsDir() {
+			if a.d.IsDir() {
+				return -1
+			}
+			return 1
+		}
+		if needInfo && (a.info == nil) != (b.info == nil) {
+			if a.info == nil {
+				return 1
+			}
+			return -1
+		}
+		n := compareEntries(cmd, a, b)
+		if cmd.reverse {
+			n = -n
+		}
+		return n
+	})
+	for i, item := range items {
+		entries[i] = item.d
+	}
+}
+
+// compareEntries compares two entries by cmd.sortBy, then by name.
+func compareEntries(cmd command, a, b sortItem) int {
+	var n int
+	switch {
+	case a.info == nil || b.info == nil:
+	case cmd.sortBy == sortSize:
+		n = cmp.Compare(b.info.Size(), a.info.Size())
+	case cmd.sortBy == sortTime:
+		n = b.info.ModTime().Compare(a.info.ModTime())
+	}
+	if n == 0 && cmd.sortBy == sortExt {
+		n = cmd.nameOrder(filepath.Ext(a.d.Name()), filepath.Ext(b.d.Name()))
+	}
+	if n == 0 {
+		n = cmd.nameOrder(a.d.Name(), b.d.Name())
+	}
+	return n
+}
+
+// dirListing is one directory of a recursive listing. ready is closed once
+// the directory has been read and its subdirectories scheduled.
+type dirListing struct {
+	path    string
+	entries []fs.DirEntry
+	err     error
+	subdirs []*dirListing
+	ready   chan struct{}
+	started bool // taken by a worker; guarded by treeReader.mu
+}
+
+// treeReader reads the directories of a recursive listing with a fixed pool
+// of workers. Reads run ahead of printing, but at most limit directories are
+// read and not yet printed, so a huge tree is not buffered whole. The
+// directory the printer waits for is read first, whatever the limit, so
+// printing never stalls behind directories it needs later.
+type treeReader struct {
+	cmd     command
+	mu      sync.Mutex
+	cond    sync.Cond
+	pending []*dirListing // scheduled for reading, the next in print order last
+	wanted  *dirListing   // the directory the printer waits for
+	ahead   int           // directories being read or read but not yet printed
+	limit   int
+	done    bool
+}
+
+// work reads the directories handed out by next until the listing is done.
+func (t *treeReader) work() {
+	for {
+		l := t.next()
+		if l == nil {
+			return
+		}
+		l.entries, l.err = readDirEntries(t.cmd, l.path)
+		for _, d := range l.entries {
+			if d.IsDir() {
+				l.subdirs = append(l.subdirs, &dirListing{path: filepath.Join(l.path, d.Name()), ready: make(chan struct{})})
+			}
+		}
+
+		// Pushed last to first, so they are read in the order they are printed
+		t.mu.Lock()
+		for _, sub := range slices.Backward(l.subdirs) {
+			t.pending = append(t.pending, sub)
+		}
+		t.cond.Broadcast()
+		t.mu.Unlock()
+		close(l.ready)
+	}
+}
+
+// next returns the directory to read next, waiting while the printer is too
+// far behind, or nil once the listing is done.
+func (t *treeReader) next() *dirListing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for !t.done {
+		if l := t.wanted; l != nil && !l.started {
+			return t.start(l)
+		}
+		for t.ahead < t.limit && len(t.pending) > 0 {
+			l := t.pending[len(t.pending)-1]
+			t.pending = t.pending[:len(t.pending)-1]
+			if !l.started {
+				return t.start(l)
+			}
+		}
+		t.cond.Wait()
 	}
 	return nil
 }
+
+func (t *treeReader) start(l *dirListing) *dirListing {
+	l.started = true
+	t.ahead++
+	return l
+}
+
+// wait blocks until l has been read, asking for it first if no worker has
+// taken it yet.
+func (t *treeReader) wait(l *dirListing) {
+	t.mu.Lock()
+	if !l.started {
+		t.wanted = l
+		t.cond.Broadcast()
+	}
+	t.mu.Unlock()
+	<-l.ready
+}
+
+// printed records that a directory was printed, making room to read ahead.
+func (t *treeReader) printed() {
+	t.mu.Lock()
+	t.ahead--
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// stop lets the workers return.
+func (t *treeReader) stop() {
+	t.mu.Lock()
+	t.done = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// listTree lists the directory at root and every directory below it,
+// depth-first like ls -R, each under its own "path:" header. Directories are
+// read concurrently by a pool of workers goroutines, which hides the latency
+// of a network filesystem, but each one's entries are buffered and printed in
+// a fixed order: a directory before its subdirectories, and those in the
+// order they are listed, so the output is the same from one run to the next.
+// Symlinks to directories are not followed. A directory that cannot be read
+// is logged in its place and the rest of the tree is still listed. Under
+// -plan or -count each directory gets a single line instead. listTree reports whether
+// root itself was read and whether any directory failed.
+func listTree(cmd command, root string, workers int) (ok, failed bool) {
+	tree := &dirListing{path: root, ready: make(chan struct{})}
+	t := &treeReader{cmd: cmd, pending: []*dirListing{tree}, limit: workers * listReadAhead}
+	t.cond.L = &t.mu
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.work()
+		}()
+	}
+	defer wg.Wait()
+	defer t.stop()
+
+	var print func(l *dirListing)
+	print = func(l *dirListing) {
+		t.wait(l)
+		if cmd.plan || cmd.count {
+			failed = !printPlan(cmd, l) || failed
+			t.printed()
+			for _, sub := range l.subdirs {
+				print(sub)
+			}
+			return
+		}
+		if l.path != root && !cmd.jsonl {
+			fmt.Fprintf(cmd.stdio.Out, "\n%s:\n", l.path)
+		}
+		printDotEntries(cmd, l.path)
+		var totals listTotals
+		for _, f := range l.entries {
+			printEntry(cmd, f.Name(), filepath.Join(l.path, f.Name()), f)
+			totals.add(f)
+		}
+		if l.err != nil {
+			logListError(cmd, copyfs.NewFileError("read directory", l.path, l.err))
+			failed = true
+		} else {
+			totals.print(cmd)
+		}
+		l.entries = nil // printed, so let them go
+		t.printed()
+		for _, sub := range l.subdirs {
+			print(sub)
+		}
+	}
+
+	print(tree)
+	return tree.err == nil, failed
+}
+
+// printPlan prints the line ls -R -plan shows for the directory l: its path
+// and the number of files listed in it, without the files themselves. Under
+// -count the line has every entry listed instead, directories too. It
+// reports whether the directory could be read.
+func printPlan(cmd command, l *dirListing) bool {
+	var totals listTotals
+	for _, f := range l.entries {
+		totals.add(f)
+	}
+	l.entries = nil
+	if l.err != nil {
+		logListError(cmd, copyfs.NewFileError("read directory", l.path, l.err))
+		return false
+	}
+	if cmd.count {
+		printCount(cmd, l.path, totals.files+totals.dirs)
+	} else {
+		fmt.Fprintf(cmd.stdio.Out, "%s (%d files)\n", l.path, totals.files)
+	}
+	return true
+}
+
+// printCount prints the line ls -count shows for the directory at path.
+func printCount(cmd command, path string, n int) {
+	fmt.Fprintf(cmd.stdio.Out, "%s: %d\n", path, n)
+}
+
+// logListError reports a directory that could not be listed, as a JSON line
+// under -jsonl and on stderr otherwise.
+func logListError(cmd command, err error) {
+	if cmd.jsonl {
+		printErrorLine(cmd.stdio.Out, err)
+	} else {
+		cmd.stdio.Log.Println(err)
+	}
+}
+
+// hidden reports whether the entry d is left out of listings: dotfiles are,
+// unless -a or -A asks for them, and so are names matching an -exclude
+// pattern and, under -ext, files with another extension.
+func (c command) hidden(d fs.DirEntry) bool {
+	name := d.Name()
+	if !c.all && strings.HasPrefix(name, ".") || copyfs.MatchesAny(name, c.exclude) {
+		return true
+	}
+	return len(c.extensions) > 0 && !d.IsDir() &&
+		!slices.Contains(c.extensions, strings.ToLower(filepath.Ext(name)))
+}
+
+// parseExtensions parses the comma-separated -ext list into lowercase
+// extensions with their leading dot, so "go,.MD" gives ".go" and ".md".
+func parseExtensions(list string) ([]string, error) {
+	var exts []string
+	for ext := range strings.SplitSeq(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts = append(exts, ext)
+	}
+	if len(exts) == 0 {
+		return nil, copyfs.NewUsageError("no extensions in -ext '%s'", list)
+	}
+	return exts, nil
+}
+
+// namedEntry is a directory entry listed under another name.
+type namedEntry struct {
+	fs.DirEntry
+	name string
+}
+
+func (e namedEntry) Name() string { return e.name }
+
+// printDotEntries lists the "." and ".." entries of the directory at path
+// under -a. They don't come from reading the directory, so they are made up
+// from its info and its parent's.
+func printDotEntries(cmd command, path string) {
+	if !cmd.dotDirs {
+		return
+	}
+	for _, name := range []string{".", ".."} {
+		info, err := cmd.filesystem().Stat(filepath.Join(path, name))
+		if err != nil {
+			continue // e.g. the parent of an archive's root
+		}
+		printEntry(cmd, name, filepath.Join(path, name), namedEntry{fs.FileInfoToDirEntry(info), name})
+	}
+}
+
+// printEntry prints one listed entry: its name, after an icon under -icons,
+// or a JSON object describing the entry at path under -jsonl.
+func printEntry(cmd command, name, path string, d fs.DirEntry) {
+	if cmd.jsonl {
+		printEntryJSON(cmd.stdio.Out, path, d)
+		return
+	}
+	printPath(cmd.stdio.Out, entryLabel(cmd, name, d))
+}
+
+// entryLabel decorates the name of a listed entry with its -icons icon and
+// its -F type indicator.
+func entryLabel(cmd command, name string, d fs.DirEntry) string {
+	if cmd.icons {
+		name = fileIcon(d) + " " + name
+	}
+	if cmd.classify {
+		name += classifySuffix(d)
+	}
+	return name
+}
+
+// classifySuffix returns the ls -F indicator for an entry: "/" for
+// directories, "@" for symlinks, "|" for FIFOs and "*" for executable files.
+func classifySuffix(d fs.DirEntry) string {
+	switch t := d.Type(); {
+	case t.IsDir():
+		return "/"
+	case t&fs.ModeSymlink != 0:
+		return "@"
+	case t&fs.ModeNamedPipe != 0:
+		return "|"
+	case !t.IsRegular():
+		return ""
+	}
+	if info, err := d.Info(); err == nil && info.Mode()&0111 != 0 {
+		return "*"
+	}
+	return ""
+}
+
+// listEntry is one line of ls -jsonl output.
+type listEntry struct {
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	Modified time.Time `json:"modified"`
+}
+
+// printEntryJSON writes the entry at path to w as a single line of JSON, so
+// a consumer can process a listing while it is still being produced.
+func printEntryJSON(w io.Writer, path string, d fs.DirEntry) {
+	info, err := d.Info()
+	if err != nil {
+		printErrorLine(w, copyfs.NewFileError("stat", path, err))
+		return
+	}
+
+	entryType := "file"
+	switch {
+	case info.IsDir():
+		entryType = "dir"
+	case info.Mode()&fs.ModeSymlink != 0:
+		entryType = "symlink"
+	case !info.Mode().IsRegular():
+		entryType = "other"
+	}
+
+	json.NewEncoder(w).Encode(listEntry{
+		Path:     path,
+		Name:     d.Name(),
+		Type:     entryType,
+		Size:     info.Size(),
+		Mode:     info.Mode().String(),
+		Modified: info.ModTime(),
+	})
+}
+
+// printErrorLine reports err as a JSON line in the -jsonl output stream w.
+func printErrorLine(w io.Writer, err error) {
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Path  string `json:"path"`
+	}{err.Error(), errorPath(err)})
+}
+
+// statPaths stats paths concurrently with up to statWorkers workers and
+// returns the infos in the order of paths. When stats fail, the error names
+// the first failing path in that order, as a sequential loop would.
+func statPaths(paths []string, statFn func(string) (fs.FileInfo, error)) ([]os.FileInfo, error) {
+	infos := make([]os.FileInfo, len(paths))
+	errs := make([]error, len(paths))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(statWorkers, len(paths)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				infos[i], errs[i] = statFn(paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, copyfs.NewFileError("stat", paths[i], err)
+		}
+	}
+	return infos, nil
+}
+
+// streamDir calls fn for each entry of the directory at path, in the order
+// the filesystem returns them. Entries are read listBatchSize at a time, so
+// the whole directory is never held in memory.
+func streamDir(fsys copyfs.ReadFS, path string, fn func(fs.DirEntry)) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		// The filesystem cannot read in batches, so fall back to reading everything
+		entries, err := fsys.ReadDir(path)
+		for _, entry := range entries {
+			fn(entry)
+		}
+		return err
+	}
+
+	for {
+		entries, err := dir.ReadDir(listBatchSize)
+		for _, entry := range entries {
+			fn(entry)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
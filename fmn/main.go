@@ -1,114 +1,832 @@
-// Package main implements fmn, a simple file management tool for listing and copying files.
-// It provides functionality similar to basic ls and cp commands with additional features
-// like dry-run mode, interactive prompts, and verbose output.
+// Package main implements fmn, a simple file management tool for listing, copying and
+// restoring files. Each operation is a subcommand (fmn ls, fmn cp, fmn restore) with its
+// own flags, similar to basic ls and cp commands with additional features like dry-run
+// mode, interactive prompts, and verbose output.
 package main
 
 import (
+	"archive/zip"
+	"compress/gzip"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"yanmifeakeju/fmn/copyfs"
+	"yanmifeakeju/fmn/internal/humanize"
+	"yanmifeakeju/fmn/internal/prompt"
+	"yanmifeakeju/fmn/internal/status"
+	"yanmifeakeju/fmn/internal/timefmt"
+	"yanmifeakeju/fmn/version"
 )
 
-// console provides global access to I/O streams for input, output, and error logging
-var console = struct {
+// IO holds the streams an operation reads from and writes to, and the logger
+// for its error messages. main passes the process's own; tests and programs
+// embedding fmn can pass theirs.
+type IO struct {
 	In  io.Reader
 	Out io.Writer
 	Err io.Writer
-}{
-	In:  os.Stdin,
-	Out: os.Stdout,
-	Err: os.Stderr,
+	Log *log.Logger // writes error messages to Err with consistent formatting
+}
+
+// newIO returns an IO reading from in and writing to out and errOut.
+func newIO(in io.Reader, out, errOut io.Writer) *IO {
+	return &IO{In: in, Out: out, Err: errOut, Log: log.New(errOut, "fmn: ", 0)}
 }
 
-// errorLogger writes error messages to stderr with consistent formatting
-var errorLogger = log.New(console.Err, "fmn: ", 0)
+// stdIO returns an IO on stdin, stdout and stderr. Every write to stdout and
+// stderr is atomic, so operations that spread work across goroutines can
+// share them without mangling each other's lines.
+func stdIO() *IO {
+	return newIO(os.Stdin, newSyncWriter(os.Stdout), newSyncWriter(os.Stderr))
+}
 
-// command holds the configuration flags for the file management operations.
-// It contains options for both copy and list operations.
+// command holds the configuration flags for the list operation. Copies and
+// moves are configured with copyfs.Options instead.
 type command struct {
-	// Copy options
-	copy        bool
-	recursive   bool
-	force       bool
-	interactive bool
-	verbose     bool
-	dryRun      bool
+	recursive bool // list subdirectories too (-R)
+
+	// Follow symlinks instead of treating them as files of their own
+	dereference bool
+
+	// Skip entries whose name matches one of these globs (-exclude)
+	exclude []string
+	// List only files with one of these lowercase extensions (-ext)
+	extensions []string
+
+	nameOrder func(a, b string) int // sorts entries by name; nil streams them unsorted (-U)
+	sortBy    string                // what entries are sorted by before the name (-sort)
+	reverse   bool                  // reverse the sort order (-r)
+	groupDirs bool                  // list directories before files (-group-directories-first)
+	all       bool                  // list dotfiles too (-a, -A)
+	dotDirs   bool                  // also list the . and .. entries (-a)
+	humanize  bool                  // print sizes as 1.2K, 3.4M, ... (-h)
+	summary   bool                  // print a total after each directory (-summary)
+	tree      bool                  // draw directories as an indented tree (-tree)
+	plan      bool                  // with -R, print only the directories entered (-plan)
+	count     bool                  // print how many entries each directory lists instead of them (-count)
+	icons     bool                  // prefix entries with an icon for their type
+	classify  bool                  // append a type indicator to names (-F)
+	jsonl     bool                  // print one JSON object per entry
+
+	// Filesystem the listing reads; nil means the real OS
+	fsys copyfs.ReadFS
+
+	// Streams the operation reads from and writes to; nil means stdIO
+	stdio *IO
+}
+
+// filesystem returns the filesystem c lists.
+func (c command) filesystem() copyfs.ReadFS {
+	if c.fsys == nil {
+		return copyfs.OSFS{}
+	}
+	return c.fsys
+}
+
+// copyOptions returns the copyfs options for a copy or move that runs under
+// ctx on stdio.
+func copyOptions(ctx context.Context, stdio *IO) copyfs.Options {
+	return copyfs.Options{Context: ctx, Stdin: stdio.In, Stdout: stdio.Out, Stderr: stdio.Err, Log: stdio.Log}
+}
+
+// verboseFlag is a counting flag.Value. Every occurrence on the command line
+// raises the level by step, so "-v -v" and "-vv" both end up at level 2.
+type verboseFlag struct {
+	level *int
+	step  int
+}
+
+func (f verboseFlag) String() string {
+	if f.level == nil {
+		return "0"
+	}
+	return strconv.Itoa(*f.level)
+}
+
+func (f verboseFlag) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		// Accept an explicit level too, e.g. -v=3 or "v": 3 in a config file.
+		level, convErr := strconv.Atoi(s)
+		if convErr != nil || level < 0 {
+			return err
+		}
+		*f.level = level
+		return nil
+	}
+	if on {
+		*f.level += f.step
+	} else {
+		*f.level = 0
+	}
+	return nil
+}
+
+func (f verboseFlag) IsBoolFlag() bool { return true }
+
+// promptAnswer is a flag.Value naming the default answer of a prompt.
+type promptAnswer bool
+
+func (a *promptAnswer) String() string {
+	if a != nil && bool(*a) {
+		return "overwrite"
+	}
+	return "skip"
+}
+
+func (a *promptAnswer) Set(s string) error {
+	switch s {
+	case "skip":
+		*a = false
+	case "overwrite":
+		*a = true
+	default:
+		return errors.New("use skip or overwrite")
+	}
+	return nil
+}
+
+// sizeFlag is a flag.Value for a byte count written like 512, 1.5K or 2M.
+type sizeFlag int64
+
+func (f *sizeFlag) String() string {
+	if f == nil {
+		return "0"
+	}
+	return humanize.Size(int64(*f))
+}
+
+func (f *sizeFlag) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*f = sizeFlag(n)
+	return nil
+}
+
+// addPromptFlags defines the flags that control overwrite prompts.
+func addPromptFlags(fs *flag.FlagSet, opts *prompt.Options) {
+	fs.DurationVar(&opts.Timeout, "prompt-timeout", 0, "Stop waiting for an answer after `duration` and use the default")
+	fs.Var((*promptAnswer)(&opts.Answer), "prompt-default", "Answer used on timeout or end of input: skip or overwrite")
+}
+
+// stringList is a flag.Value that collects every occurrence of a repeatable
+// flag, e.g. "-exclude '*.tmp' -exclude '*.log'".
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// subcommand describes one of fmn's subcommands. run defines the
+// subcommand's flags on fs, parses args and performs the operation on
+// stdio, giving up once ctx is canceled.
+type subcommand struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, stdio *IO, fs *flag.FlagSet, cfg config, args []string) error
+}
+
+// subcommands lists everything fmn can do, in the order shown by --help.
+var subcommands = []subcommand{
+	{"ls", "[options] [path...]", "Lists the contents of one or more paths (defaults to current directory)", runList},
+	{"cp", "[options] <source...> <destination>", "Copies files and directories (to sftp://[user@]host/path, or to and from s3://bucket/prefix)", runCopy},
+	{"mv", "[options] <source...> <destination>", "Moves or renames files and directories", runMove},
+	{"stat", "[options] <path...>", "Prints detailed information about files", runStat},
+	{"find", "[options] [root...]", "Prints the paths under each root (default .) that match all predicates", runFind},
+	{"sum", "[options] <path...>", "Prints or checks checksums in the format of sha256sum", runSum},
+	{"diff", "[options] <dirA> <dirB>", "Compares two directory trees and reports the differences", runDiff},
+	{"archive", "-archive <dir> [options]", "Archives a directory tree as one .gz file per file, for restore", runArchive},
+	{"restore", "-archive <dir> [options]", "Restores files from a directory of .gz, .bz2, .xz, .zst, .tar.gz and .zip archives", runRestore},
 }
 
 func main() {
+	stdio := stdIO()
+
 	// --- Custom Usage Message ---
+	flag.CommandLine.SetOutput(stdio.Err)
 	flag.Usage = func() {
-		// Use the standard error output defined in our console struct
-		w := console.Err
+		w := stdio.Err
 
 		// Program description
 		fmt.Fprintf(w, "fmn is a simple file management tool.\n\n")
+		fmt.Fprintf(w, "Usage: fmn [options] <command> [arguments]\n\n")
 
-		// Usage for the default (list) command
-		fmt.Fprintf(w, "Usage: fmn [options] [path...]\n")
-		fmt.Fprintf(w, "Lists the contents of one or more paths (defaults to current directory).\n\n")
-
-		// Usage for the copy command
-		fmt.Fprintf(w, "Usage: fmn -copy [options] <source> <destination>\n")
-		fmt.Fprintf(w, "       fmn -copy [options] <source...> <directory>\n")
-		fmt.Fprintf(w, "Copies files and directories.\n\n")
+		// One line per subcommand
+		fmt.Fprintf(w, "Commands:\n")
+		for _, sub := range subcommands {
+			fmt.Fprintf(w, "  %-9s%s\n", sub.name, sub.summary)
+		}
+		fmt.Fprintf(w, "\nRun 'fmn <command> -h' for the options of a command.\n\n")
 
-		// Print the list of available flags
+		// Print the list of global flags
 		fmt.Fprintf(w, "Options:\n")
 		flag.PrintDefaults()
+
+		// Document the exit codes for scripts
+		fmt.Fprintf(w, "\nExit status:\n")
+		fmt.Fprintf(w, "  %d  success\n", exitOK)
+		fmt.Fprintf(w, "  %d  general error, or partial success (some paths failed)\n", exitError)
+		fmt.Fprintf(w, "  %d  usage error (bad flags or arguments)\n", exitUsage)
+		fmt.Fprintf(w, "  %d  permission error that stopped the operation\n", exitPermission)
 	}
 
-	// Copy options
-	copy := flag.Bool("copy", false, "Enable copying")
-	recursive := flag.Bool("r", false, "Copy files recursively")
-	force := flag.Bool("f", false, "Force overwrite of existing files")
-	interactive := flag.Bool("i", false, "Prompt before overwrite")
-	verbose := flag.Bool("v", false, "Enable verbose output")
-	dryRun := flag.Bool("dry-run", false, "Show what would be copied without actually copying")
+	// Global options
+	configPath := flag.String("config", "", "Read default flag values from JSON `file` (default ~/"+defaultConfigName+")")
+	errorFormat := flag.String("error-format", errorFormatText, "Print errors as `text` or json")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
 
 	flag.Parse()
 
-	cmd := command{
-		copy:        *copy,
-		recursive:   *recursive,
-		force:       *force,
-		interactive: *interactive,
-		verbose:     *verbose,
-		dryRun:      *dryRun,
+	// kill -USR1 prints how far a long copy or restore has got
+	watchStatusSignal(func() { status.Report(stdio.Err) })
+
+	if *showVersion {
+		fmt.Fprintf(stdio.Out, "fmn %s\n", version.String())
+		return
+	}
+
+	if *errorFormat != errorFormatText && *errorFormat != errorFormatJSON {
+		stdio.Log.Printf("invalid error format '%s' (use text or json)", *errorFormat)
+		os.Exit(exitUsage)
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	name := flag.Arg(0)
+	if name == "help" {
+		flag.Usage()
+		return
+	}
+
+	sub, ok := findSubcommand(name)
+	if !ok {
+		reportError(stdio, copyfs.NewUsageError("unknown command '%s'", name), *errorFormat, exitUsage)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	// Ctrl-C stops a long copy or restore between reads, without leaving a
+	// half-written file behind; a second one kills fmn as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	context.AfterFunc(ctx, stop)
+
+	// Config values become flag defaults that the command line overrides
+	cfg, err := loadConfig(*configPath)
+	if err == nil {
+		err = sub.run(ctx, stdio, newFlagSet(stdio, sub), cfg, flag.Args()[1:])
 	}
+	stop()
+	if err != nil {
+		code := exitCode(err)
+		reportError(stdio, err, *errorFormat, code)
+		os.Exit(code)
+	}
+}
 
-	// Get remaining args as paths to process (files or directories)
-	dirs := flag.Args()
+// findSubcommand looks up a subcommand by name.
+func findSubcommand(name string) (subcommand, bool) {
+	for _, sub := range subcommands {
+		if sub.name == name {
+			return sub, true
+		}
+	}
+	return subcommand{}, false
+}
 
-	if err := run(cmd, dirs); err != nil {
-		errorLogger.Println(err)
-		os.Exit(1)
+// newFlagSet creates the flag set for a subcommand, with a usage message on
+// stdio's stderr in the same layout as the top-level help.
+func newFlagSet(stdio *IO, sub subcommand) *flag.FlagSet {
+	fs := flag.NewFlagSet(sub.name, flag.ExitOnError)
+	fs.SetOutput(stdio.Err)
+	fs.Usage = func() {
+		fmt.Fprintf(stdio.Err, "Usage: fmn %s %s\n", sub.name, sub.args)
+		fmt.Fprintf(stdio.Err, "%s.\n\n", sub.summary)
+		fmt.Fprintf(stdio.Err, "Options:\n")
+		fs.PrintDefaults()
 	}
+	return fs
 }
 
-func run(cmd command, directories []string) error {
-	if cmd.copy {
-		if len(directories) == 0 {
-			return errors.New("copy requires at least one source path")
+// parseFlags parses args into fs and then fills in the config defaults for
+// the flags args did not set.
+func parseFlags(fs *flag.FlagSet, cfg config, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return cfg.apply(fs)
+}
+
+// runList implements "fmn ls".
+func runList(_ context.Context, stdio *IO, fs *flag.FlagSet, cfg config, args []string) error {
+	cmd := command{stdio: stdio}
+
+	fs.BoolVar(&cmd.dereference, "L", false, "Follow symlinks given as arguments and list what they point to")
+	fs.BoolVar(&cmd.recursive, "R", false, "List subdirectories recursively")
+	sortLocale := fs.String("sort-locale", "", "Sort entries by name using the collation rules of `locale` (e.g. en, fr, sv)")
+	byteOrder := fs.Bool("byte-order", false, "Sort entries by name in plain byte order, independent of locale")
+	fs.StringVar(&cmd.sortBy, "sort", "", "Sort entries by `key`: name, size (largest first), time (newest first) or ext")
+	fs.BoolVar(&cmd.reverse, "r", false, "Reverse the sort order")
+	fs.BoolVar(&cmd.groupDirs, "group-directories-first", false, "List directories before files, each group sorted on its own")
+	unsorted := fs.Bool("U", false, "Do not sort: stream entries in directory order, which keeps memory flat for huge directories")
+	all := fs.Bool("a", false, "List entries starting with a dot, including . and ..")
+	almostAll := fs.Bool("A", false, "List entries starting with a dot, except . and ..")
+	fs.Var((*stringList)(&cmd.exclude), "exclude", "Leave out entries matching `glob` (repeatable)")
+	ext := fs.String("ext", "", "List only files with one of the comma-separated `extensions`, e.g. .go,.md")
+	fs.BoolVar(&cmd.tree, "tree", false, "Show directories as an indented tree")
+	fs.BoolVar(&cmd.plan, "plan", false, "With -R, print only the directories that would be entered and how many files each holds")
+	fs.BoolVar(&cmd.count, "count", false, "Print the number of entries listed in each directory instead of their names")
+	fs.BoolVar(&cmd.summary, "summary", false, "Print the total size and number of files and directories after each directory")
+	fs.BoolVar(&cmd.humanize, "h", false, "Print sizes in human-readable units (1.2K, 3.4M, 5.6G)")
+	fs.BoolVar(&cmd.classify, "F", false, "Append an indicator to names: / for directories, * for executables, @ for symlinks, | for FIFOs")
+	icons := fs.Bool("icons", false, "Prefix entries with an icon for their type (only when writing to a terminal)")
+	fs.BoolVar(&cmd.jsonl, "jsonl", false, "Stream one JSON object per entry, one per line")
+	fromZip := fs.String("from-zip", "", "List paths inside the zip archive `file` instead of the filesystem")
+
+	if err := parseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if *unsorted && (cmd.sortBy != "" || cmd.reverse || cmd.groupDirs || *sortLocale != "" || *byteOrder) {
+		return copyfs.NewUsageError("-U cannot be combined with -sort, -r, -group-directories-first, -sort-locale or -byte-order")
+	}
+	switch cmd.sortBy {
+	case "":
+		if cmd.reverse {
+			cmd.sortBy = sortName // like ls -r, reverse the name order
+		}
+	case sortName, sortSize, sortTime, sortExt:
+	default:
+		return copyfs.NewUsageError("invalid sort key '%s' (use name, size, time or ext)", cmd.sortBy)
+	}
+
+	if cmd.tree && cmd.jsonl {
+		return copyfs.NewUsageError("-tree and -jsonl cannot be combined")
+	}
+	if cmd.plan && !cmd.recursive {
+		return copyfs.NewUsageError("-plan requires -R")
+	}
+	if cmd.plan && (cmd.tree || cmd.jsonl || cmd.summary) {
+		return copyfs.NewUsageError("-plan cannot be combined with -tree, -jsonl or -summary")
+	}
+	if cmd.summary && cmd.jsonl {
+		return copyfs.NewUsageError("-summary and -jsonl cannot be combined")
+	}
+	if cmd.count && (cmd.plan || cmd.tree || cmd.jsonl || cmd.summary) {
+		return copyfs.NewUsageError("-count cannot be combined with -plan, -tree, -jsonl or -summary")
+	}
+	if *ext != "" {
+		exts, err := parseExtensions(*ext)
+		if err != nil {
+			return err
+		}
+		cmd.extensions = exts
+	}
+
+	// Names sort with Unicode collation unless another order is asked for;
+	// only -U leaves them unsorted
+	if *sortLocale != "" && *byteOrder {
+		return copyfs.NewUsageError("-sort-locale and -byte-order cannot be combined")
+	}
+	if !*unsorted {
+		order, err := nameOrder(*sortLocale, *byteOrder)
+		if err != nil {
+			return err
+		}
+		cmd.nameOrder = order
+	}
+	cmd.icons = *icons && isTerminal(stdio.Out)
+	cmd.all = *all || *almostAll
+	cmd.dotDirs = *all
+
+	if *fromZip != "" {
+		zr, err := zip.OpenReader(*fromZip)
+		if err != nil {
+			return copyfs.NewFileError("open archive", *fromZip, err)
+		}
+		defer zr.Close()
+		cmd.fsys = copyfs.IOFS{FS: zr}
+	}
+
+	return run(cmd, fs.Args())
+}
+
+// runCopy implements "fmn cp".
+func runCopy(ctx context.Context, stdio *IO, fs *flag.FlagSet, cfg config, args []string) error {
+	opts := copyOptions(ctx, stdio)
+
+	fs.BoolVar(&opts.Recursive, "r", false, "Copy files recursively")
+	depth := fs.Int("depth", -1, "Copy only `N` levels below each source directory; 0 copies just its immediate children, -1 everything. Deeper directories are not created")
+	fs.BoolVar(&opts.KeepGoing, "k", false, "Keep going: copy the rest of a directory after an entry fails, and report the failures at the end")
+	fs.BoolVar(&opts.KeepGoing, "continue", false, "Same as -k")
+	fs.BoolVar(&opts.OneFileSystem, "x", false, "Stay on the source's filesystem: skip directories on other devices")
+	fs.BoolVar(&opts.OneFileSystem, "one-file-system", false, "Same as -x")
+	fs.BoolVar(&opts.Force, "f", false, "Force overwrite of existing files")
+	fs.BoolVar(&opts.Interactive, "i", false, "Prompt before overwrite: y, n, a for all the rest, q to quit")
+	fs.BoolVar(&opts.NoClobber, "n", false, "Never overwrite existing files, skipping them without error")
+	fs.BoolVar(&opts.Update, "u", false, "Only replace destination files older than their source, or missing")
+	fs.Var(verboseFlag{&opts.Verbose, 1}, "v", "Enable verbose output (repeat for more detail)")
+	fs.Var(verboseFlag{&opts.Verbose, 2}, "vv", "Enable debug output (byte counts, skip reasons, stat calls)")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Show what would be copied without actually copying")
+	fs.BoolVar(&opts.PrintScript, "print-script", false, "Print the equivalent shell commands instead of copying")
+	fs.BoolVar(&opts.Preserve, "p", false, "Preserve the owner and group of copied files, where permitted")
+	fs.BoolVar(&opts.Preserve, "preserve", false, "Same as -p")
+	fs.BoolVar(&opts.Xattrs, "xattrs", false, "Copy the extended attributes of files, where supported")
+	fs.BoolVar(&opts.Parents, "parents", false, "Create the destination directory, and any missing parents, if it does not exist")
+	fs.BoolVar(&opts.Parents, "create-dest", false, "Same as -parents")
+	fs.BoolVar(&opts.CheckPerms, "check-perms", false, "Check that sources are readable and the destination writable, without copying")
+	progress := fs.Bool("progress", false, "Show a progress bar for each large file on stderr when it is a terminal")
+	fs.Int64Var(&opts.ProgressMin, "progress-min", copyfs.DefaultProgressMin, "Only show -progress for files of at least `bytes`")
+	fs.StringVar(&opts.Reflink, "reflink", copyfs.ReflinkAuto, "Clone files copy-on-write where the filesystem supports it: `when` auto, always (or fail) or never")
+	fs.StringVar(&opts.Sparse, "sparse", copyfs.SparseAuto, "Leave holes for zero blocks: `when` auto (if the source has holes), always or never")
+	fs.IntVar(&opts.BufferSize, "buffer", 0, "Copy with a buffer of `bytes` instead of one sized to each file")
+	fs.Var((*stringList)(&opts.Exclude), "exclude", "Skip files and directories matching `glob` (repeatable)")
+	fs.Var((*sizeFlag)(&opts.MinSize), "min-size", "Skip files smaller than `size`, e.g. 100K")
+	fs.Var((*sizeFlag)(&opts.MaxSize), "max-size", "Skip files larger than `size`, e.g. 1.5G")
+	fs.Var((*timeBound)(&opts.Newer), "newer", "Only copy files modified after `time`, in RFC3339 or as the time of a file")
+	fs.Var((*timeBound)(&opts.Older), "older", "Only copy files modified before `time`, in RFC3339 or as the time of a file")
+	fs.BoolVar(&opts.Backup, "b", false, "Back up each file that would be overwritten, as its name with the -S suffix")
+	fs.StringVar(&opts.Suffix, "S", "~", "Append `suffix` to the name of backups made by -b")
+	fs.StringVar(&opts.Trash, "trash", "", "Move files that would be overwritten into `dir`, keeping their relative paths")
+	fs.BoolVar(&opts.Verify, "verify", false, "Read each copied file back and compare its checksum with the source")
+	fs.BoolVar(&opts.SkipIdentical, "skip-identical", false, "Skip files whose destination already has the same content")
+	fs.BoolVar(&opts.Transactional, "transactional", false, "Undo every change if any part of the copy fails")
+	fs.BoolVar(&opts.Dedup, "dedup", false, "Hard-link files whose content was already copied instead of copying them again")
+	fs.BoolVar(&opts.HardLinks, "H", false, "Preserve hard links between source files instead of copying each link's data")
+	addTimeFormatFlag(fs, &opts.TimeFormat)
+	fs.BoolVar(&opts.FollowSymlinks, "L", false, "Follow symlinks: copy what they point to instead of recreating them, and write through a symlink at the destination")
+	addPromptFlags(fs, &opts.Prompt)
+	filesFrom := fs.String("files-from", "", "Also copy the paths listed in `file`, one per line (- for stdin)")
+	filesFrom0 := fs.String("files-from0", "", "Like -files-from, but paths in `file` are separated by NUL bytes")
+	reportSkips := fs.Bool("report-skips", false, "Print the skipped files, grouped by reason, at the end")
+
+	if err := parseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	opts.Dereference = opts.FollowSymlinks
+	if *depth < -1 {
+		return copyfs.NewUsageError("invalid depth %d", *depth)
+	}
+	opts.MaxDepth = *depth + 1
+	if opts.Backup && opts.Suffix == "" {
+		return copyfs.NewUsageError("-S needs a non-empty suffix")
+	}
+	if opts.Backup && opts.Trash != "" {
+		return copyfs.NewUsageError("-b and -trash cannot be combined")
+	}
+	if opts.KeepGoing && opts.Transactional {
+		return copyfs.NewUsageError("-k and -transactional cannot be combined")
+	}
+	if opts.MaxSize > 0 && opts.MinSize > opts.MaxSize {
+		return copyfs.NewUsageError("-min-size is larger than -max-size")
+	}
+	if !opts.Newer.IsZero() && !opts.Older.IsZero() && !opts.Newer.Before(opts.Older) {
+		return copyfs.NewUsageError("-newer is not before -older, so no file can match")
+	}
+	switch opts.Reflink {
+	case copyfs.ReflinkAuto, copyfs.ReflinkAlways, copyfs.ReflinkNever:
+	default:
+		return copyfs.NewUsageError("invalid -reflink mode '%s' (use auto, always or never)", opts.Reflink)
+	}
+	switch opts.Sparse {
+	case copyfs.SparseAuto, copyfs.SparseAlways, copyfs.SparseNever:
+	default:
+		return copyfs.NewUsageError("invalid -sparse mode '%s' (use auto, always or never)", opts.Sparse)
+	}
+	if opts.BufferSize < 0 {
+		return copyfs.NewUsageError("invalid buffer size %d", opts.BufferSize)
+	}
+	if *filesFrom != "" && *filesFrom0 != "" {
+		return copyfs.NewUsageError("-files-from and -files-from0 cannot be combined")
+	}
+	listFile, nul := *filesFrom, false
+	if *filesFrom0 != "" {
+		listFile, nul = *filesFrom0, true
+	}
+
+	paths := fs.Args()
+	if listFile != "" {
+		if listFile == "-" && opts.Interactive {
+			return copyfs.NewUsageError("cannot combine -i with a source list on stdin")
+		}
+		if len(paths) == 0 {
+			return copyfs.NewUsageError("copy requires a destination")
 		}
 
-		if len(directories) == 1 {
-			directories = append(directories, ".") // Add default destination
+		sources, err := readSourceList(stdio.In, listFile, nul)
+		if err != nil {
+			return err
+		}
+		if len(sources) == 0 {
+			return copyfs.NewUsageError("no source paths in '%s'", listFile)
 		}
 
-		if directories[0] == directories[len(directories)-1] {
-			return errors.New("cannot copy a path to itself") // Quick catch for . . or file to file
+		// Listed sources go after the positional ones; the destination stays last
+		dest := paths[len(paths)-1]
+		paths = append(append(paths[:len(paths)-1:len(paths)-1], sources...), dest)
+	}
+
+	if *reportSkips {
+		opts.Skips = &copyfs.SkipReport{}
+	}
+	// The summary would end up in the data copied to stdout
+	if opts.Verbose >= copyfs.VerboseFiles && !opts.PrintScript && (len(paths) == 0 || paths[len(paths)-1] != copyfs.StdioPath) {
+		opts.Stats = &copyfs.Stats{}
+	}
+	if *progress && isTerminal(stdio.Err) {
+		opts.Progress = copyfs.NewProgressPrinter(stdio.Err)
+	}
+	if opts.PrintScript {
+		printScriptHeader(stdio.Out)
+	}
+	err := copyPaths(opts, paths)
+	opts.Stats.Print(stdio.Out, opts.DryRun)
+	opts.Skips.Print(stdio.Err)
+	return err
+}
+
+// runMove implements "fmn mv".
+func runMove(ctx context.Context, stdio *IO, fs *flag.FlagSet, cfg config, args []string) error {
+	opts := copyOptions(ctx, stdio)
+
+	fs.BoolVar(&opts.Force, "f", false, "Force overwrite of existing files")
+	fs.BoolVar(&opts.Interactive, "i", false, "Prompt before overwrite: y, n, a for all the rest, q to quit")
+	fs.BoolVar(&opts.NoClobber, "n", false, "Never overwrite existing files, skipping them without error")
+	fs.BoolVar(&opts.Update, "u", false, "Only replace destination files older than their source, or missing")
+	fs.Var(verboseFlag{&opts.Verbose, 1}, "v", "Enable verbose output (repeat for more detail)")
+	fs.Var(verboseFlag{&opts.Verbose, 2}, "vv", "Enable debug output")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Show what would be moved without actually moving")
+	fs.BoolVar(&opts.PrintScript, "print-script", false, "Print the equivalent shell commands instead of moving")
+	addPromptFlags(fs, &opts.Prompt)
+
+	if err := parseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+	if opts.PrintScript {
+		printScriptHeader(stdio.Out)
+	}
+	return movePaths(opts, fs.Args())
+}
+
+// runStat implements "fmn stat".
+func runStat(_ context.Context, stdio *IO, fs *flag.FlagSet, cfg config, args []string) error {
+	asJSON := fs.Bool("json", false, "Print the information as JSON")
+	var tf timefmt.Layout
+	addTimeFormatFlag(fs, &tf)
+
+	if err := parseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return copyfs.NewUsageError("stat requires at least one path")
+	}
+
+	return statFiles(stdio, fs.Args(), *asJSON, tf)
+}
+
+// runFind implements "fmn find".
+func runFind(_ context.Context, stdio *IO, fs *flag.FlagSet, cfg config, args []string) error {
+	var opts findOptions
+
+	fs.StringVar(&opts.name, "name", "", "Only match names matching `glob`")
+	fs.StringVar(&opts.fileType, "type", "", "Only match files (f) or directories (d)")
+	fs.DurationVar(&opts.newerThan, "newer-than", 0, "Only match paths modified within `duration` (e.g. 24h)")
+	fs.BoolVar(&opts.null, "0", false, "Separate paths with NUL instead of newline")
+
+	if err := parseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if opts.fileType != "" && opts.fileType != "f" && opts.fileType != "d" {
+		return copyfs.NewUsageError("invalid type '%s' (use f or d)", opts.fileType)
+	}
+
+	roots := fs.Args()
+	if len(roots) == 0 {
+		roots = []string{"."} // Default to current directory
+	}
+
+	return findFiles(stdio, roots, opts)
+}
+
+// runSum implements "fmn sum".
+func runSum(_ context.Context, stdio *IO, fs *flag.FlagSet, cfg config, args []string) error {
+	algo := fs.String("algo", "sha256", "Hash `algorithm`: md5, sha1, sha256 or sha512")
+	check := fs.String("check", "", "Verify the files listed in `manifest` (- for stdin)")
+	recursive := fs.Bool("r", false, "Hash the files in directories recursively")
+
+	if err := parseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if *check != "" {
+		return checkManifest(stdio, *check, *algo)
+	}
+
+	if fs.NArg() == 0 {
+		return copyfs.NewUsageError("sum requires at least one path")
+	}
+
+	return sumFiles(stdio, fs.Args(), *algo, *recursive)
+}
+
+// runDiff implements "fmn diff".
+func runDiff(_ context.Context, stdio *IO, fs *flag.FlagSet, cfg config, args []string) error {
+	asJSON := fs.Bool("json", false, "Print the differences as JSON")
+
+	if err := parseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		return copyfs.NewUsageError("diff requires exactly two directories")
+	}
+
+	return diffDirectories(stdio, fs.Arg(0), fs.Arg(1), *asJSON)
+}
+
+// runArchive implements "fmn archive".
+func runArchive(_ context.Context, stdio *IO, fs *flag.FlagSet, cfg config, args []string) error {
+	var opts archiveOptions
+
+	sourceDir := fs.String("source", ".", "Directory tree to archive")
+	archiveDir := fs.String("archive", "", "Archive directory to write the .gz files to")
+	fs.Var((*stringList)(&opts.include), "include", "Only archive files matching `glob` (repeatable)")
+	fs.Var((*stringList)(&opts.exclude), "exclude", "Skip files and directories matching `glob` (repeatable)")
+	fs.IntVar(&opts.level, "level", gzip.DefaultCompression, "Compression `level` from 1 (fastest) to 9 (best), -1 for the gzip default")
+
+	if err := parseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if *archiveDir == "" {
+		fs.Usage()
+		return copyfs.NewUsageError("-archive flag is required")
+	}
+
+	return archive(stdio, *sourceDir, *archiveDir, opts)
+}
+
+// runRestore implements "fmn restore".
+func runRestore(ctx context.Context, stdio *IO, fs *flag.FlagSet, cfg config, args []string) error {
+	archiveDir := fs.String("archive", "", "Archive directory to restore from")
+	destDir := fs.String("dest", ".", "Destination directory")
+	opts := restoreOptions{ctx: ctx, stdio: stdio}
+	fs.BoolVar(&opts.list, "list", false, "List files that would be restored")
+	fs.BoolVar(&opts.printScript, "print-script", false, "Print the equivalent shell commands instead of restoring")
+	fs.BoolVar(&opts.force, "force", false, "Overwrite existing files without asking")
+	fs.BoolVar(&opts.onlyChanged, "skip-unchanged", false, "Leave files that already hold the archived data and modification time alone")
+	fs.BoolVar(&opts.newer, "newer", false, "Only restore files that are missing or older than the archived ones, replacing those without asking")
+	fs.Var(verboseFlag{&opts.verbose, 1}, "v", "Report the files -newer skips")
+	fs.BoolVar(&opts.keepGoing, "continue", false, "Keep going past files that cannot be restored, and report the failures at the end")
+	fs.IntVar(&opts.jobs, "j", 1, "Restore up to `N` files at once")
+	fs.BoolVar(&opts.verify, "verify", false, "Check each restored file against the SHA-256 in a .sha256 file next to its archive, if there is one")
+	mode := fs.String("mode", "", "Give restored files whose archive records no permissions the `octal` mode, e.g. 755, instead of 644")
+	fs.BoolVar(&opts.stdout, "stdout", false, "Write the restored data to stdout instead of files")
+	fs.BoolVar(&opts.concat, "concat", false, "With -stdout, write every matching file one after another")
+	fs.StringVar(&opts.pattern, "pattern", "", "Only restore files whose name matches the `glob`")
+	addTimeFormatFlag(fs, &opts.timeFormat)
+	addPromptFlags(fs, &opts.prompt)
+	reportSkips := fs.Bool("report-skips", false, "Print the skipped files, grouped by reason, at the end")
+
+	if err := parseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if *archiveDir == "" {
+		fs.Usage()
+		return copyfs.NewUsageError("-archive flag is required")
+	}
+
+	if opts.jobs < 1 {
+		return copyfs.NewUsageError("invalid number of jobs %d", opts.jobs)
+	}
+	if opts.stdout && (opts.list || opts.printScript) {
+		return copyfs.NewUsageError("-stdout cannot be combined with -list or -print-script")
+	}
+	if opts.concat && !opts.stdout {
+		return copyfs.NewUsageError("-concat requires -stdout")
+	}
+	if opts.pattern != "" {
+		if opts.printScript {
+			return copyfs.NewUsageError("-pattern cannot be combined with -print-script")
 		}
+		if err := checkPatterns([]string{opts.pattern}); err != nil {
+			return err
+		}
+	}
+	if *mode != "" {
+		m, err := strconv.ParseUint(*mode, 8, 32)
+		if err != nil || m == 0 || m > 0777 {
+			return copyfs.NewUsageError("invalid mode '%s' (use octal permissions such as 755)", *mode)
+		}
+		opts.mode = os.FileMode(m)
+	}
+	if *reportSkips {
+		opts.skips = &copyfs.SkipReport{}
+	}
+	if opts.printScript {
+		printScriptHeader(stdio.Out)
+	}
+	err := restore(*archiveDir, *destDir, opts)
+	opts.skips.Print(stdio.Err)
+	return err
+}
 
-		return copyFile(cmd, directories)
+// run performs the list operation described by cmd on the given paths.
+func run(cmd command, directories []string) error {
+	if cmd.stdio == nil {
+		cmd.stdio = stdIO()
+	}
+	if err := checkPatterns(cmd.exclude); err != nil {
+		return err
 	}
 
 	if len(directories) == 0 {
 		directories = []string{"."} // Default to current directory
 	}
 
+	directories, err := expandGlobs(cmd.fsys, nil, directories)
+	if err != nil {
+		return err
+	}
 	return listFiles(cmd, directories)
 }
+
+// copyPaths copies the sources in paths to the destination that is last, or
+// to the current directory when there is only one path. Glob patterns in the
+// sources are expanded and URLs connect to remote filesystems before
+// copyfs.Copy takes over.
+func copyPaths(opts copyfs.Options, paths []string) error {
+	if len(paths) == 0 {
+		return copyfs.NewUsageError("copy requires at least one source path")
+	}
+	if len(paths) == 1 {
+		paths = append(paths, ".") // Add default destination
+	}
+	last := len(paths) - 1
+	if paths[last] != "" && copyfs.SamePath(paths[0], paths[last]) {
+		return copyfs.NewUsageError("cannot copy a path to itself") // Quick catch for . . or file to file
+	}
+	if err := checkPatterns(opts.Exclude); err != nil {
+		return err
+	}
+
+	// Only the sources are patterns; the destination is taken as written
+	sources, err := expandGlobs(opts.FS, debugOutput(opts), paths[:last])
+	if err != nil {
+		return err
+	}
+	paths, closeRemotes, err := openRemotes(&opts, append(sources, paths[last]))
+	if err != nil {
+		return err
+	}
+	defer closeRemotes()
+	return copyfs.Copy(opts, paths)
+}
+
+// movePaths moves the sources in paths to the destination that is last,
+// after expanding glob patterns in the sources.
+func movePaths(opts copyfs.Options, paths []string) error {
+	if len(paths) < 2 {
+		return copyfs.NewUsageError("move requires a source and a destination")
+	}
+	last := len(paths) - 1
+	sources, err := expandGlobs(opts.FS, debugOutput(opts), paths[:last])
+	if err != nil {
+		return err
+	}
+	return copyfs.Move(opts, append(sources, paths[last]))
+}
+
+// debugOutput returns where diagnostics for opts go: stderr at debug
+// verbosity (-vv), and nowhere otherwise.
+func debugOutput(opts copyfs.Options) io.Writer {
+	if opts.Verbose >= copyfs.VerboseDebug {
+		return opts.Stderr
+	}
+	return nil
+}
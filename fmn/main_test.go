@@ -1,13 +1,37 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/sftp"
+
+	"yanmifeakeju/fmn/copyfs"
+	"yanmifeakeju/fmn/internal/testfs"
+	"yanmifeakeju/fmn/internal/timefmt"
 )
 
 // TestList is a table-driven test for the list functionality.
@@ -23,13 +47,14 @@ func TestList(t *testing.T) {
 		wantOutputContains    []string
 		wantOutputNotContains []string
 		wantErrLogContains    string
+		needsPermissions      bool // relies on permission bits, which root ignores
 	}{
 		{
 			name: "List single directory with files",
 			setup: func(t *testing.T) []string {
-				testDir1, _ = setupTestDirWithFiles(t, []testFile{
-					{filename: "file1.txt"},
-					{filename: "file2.txt"},
+				testDir1, _ = testfs.SetupDir(t, []testfs.File{
+					{Filename: "file1.txt"},
+					{Filename: "file2.txt"},
 				})
 				return []string{testDir1}
 			},
@@ -42,7 +67,7 @@ func TestList(t *testing.T) {
 		{
 			name: "List single file",
 			setup: func(t *testing.T) []string {
-				_, files := setupTestDirWithFiles(t, []testFile{{filename: "file1.txt"}})
+				_, files := testfs.SetupDir(t, []testfs.File{{Filename: "file1.txt"}})
 				testFile1 = files[0]
 				return []string{testFile1}
 			},
@@ -52,9 +77,9 @@ func TestList(t *testing.T) {
 		{
 			name: "List mixed files and directories",
 			setup: func(t *testing.T) []string {
-				testDir1, _ = setupTestDirWithFiles(t, []testFile{{filename: "dir1file.txt"}})
-				testDir2, _ = setupTestDirWithFiles(t, []testFile{{filename: "dir2file.txt"}})
-				_, files := setupTestDirWithFiles(t, []testFile{{filename: "standalone.txt"}})
+				testDir1, _ = testfs.SetupDir(t, []testfs.File{{Filename: "dir1file.txt"}})
+				testDir2, _ = testfs.SetupDir(t, []testfs.File{{Filename: "dir2file.txt"}})
+				_, files := testfs.SetupDir(t, []testfs.File{{Filename: "standalone.txt"}})
 				testFile1 = files[0]
 				return []string{testDir1, testFile1, testDir2}
 			},
@@ -66,6 +91,32 @@ func TestList(t *testing.T) {
 				"dir2file.txt",
 			},
 		},
+		{
+			name: "Symlink to directory is listed as a link",
+			setup: func(t *testing.T) []string {
+				testDir1, _ = testfs.SetupDir(t, []testfs.File{{Filename: "inside.txt"}})
+				testFile1 = filepath.Join(t.TempDir(), "link")
+				if err := os.Symlink(testDir1, testFile1); err != nil {
+					t.Fatalf("Failed to create symlink: %v", err)
+				}
+				return []string{testFile1}
+			},
+			wantOutputContains:    []string{testFile1},
+			wantOutputNotContains: []string{":", "inside.txt"},
+		},
+		{
+			name: "Symlink to directory is followed with -L",
+			setup: func(t *testing.T) []string {
+				testDir1, _ = testfs.SetupDir(t, []testfs.File{{Filename: "inside.txt"}})
+				testFile1 = filepath.Join(t.TempDir(), "link")
+				if err := os.Symlink(testDir1, testFile1); err != nil {
+					t.Fatalf("Failed to create symlink: %v", err)
+				}
+				return []string{testFile1}
+			},
+			cmd:                command{dereference: true},
+			wantOutputContains: []string{"inside.txt"},
+		},
 		{
 			name: "Error on non-existent file",
 			setup: func(t *testing.T) []string {
@@ -77,7 +128,7 @@ func TestList(t *testing.T) {
 		{
 			name: "Error on directory with no read permission",
 			setup: func(t *testing.T) []string {
-				testDir1, _ = setupTestDirWithFiles(t, []testFile{{filename: "file.txt"}})
+				testDir1, _ = testfs.SetupDir(t, []testfs.File{{Filename: "file.txt"}})
 				// Change permissions to be non-readable
 				if err := os.Chmod(testDir1, 0300); err != nil {
 					t.Fatalf("Failed to change permissions: %v", err)
@@ -91,28 +142,25 @@ func TestList(t *testing.T) {
 			wantErrContains:    "some directories could not be read",
 			wantOutputContains: []string{fmt.Sprintf("%s:", testDir1)}, // Still prints the header
 			wantErrLogContains: "permission denied",
+			needsPermissions:   true,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// --- Setup ---
-			oldConsole := console
-			oldLogger := errorLogger
-			defer func() {
-				console = oldConsole
-				errorLogger = oldLogger
-			}()
+			if tc.needsPermissions {
+				testfs.SkipIfRoot(t)
+			}
 
+			// --- Setup ---
 			var outBuf, errBuf bytes.Buffer
-			console.Out = &outBuf
-			console.Err = &errBuf
-			errorLogger = log.New(&errBuf, "fmn: ", 0)
+			cmd := tc.cmd
+			cmd.stdio = newIO(nil, &outBuf, &errBuf)
 
 			args := tc.setup(t)
 
 			// --- Execute ---
-			err := run(tc.cmd, args)
+			err := run(cmd, args)
 
 			// --- Assert ---
 			output := outBuf.String()
@@ -147,277 +195,2189 @@ func TestList(t *testing.T) {
 	}
 }
 
-// TestCopy is a table-driven test for the copy functionality, covering various
-// scenarios including force and interactive modes.
-func TestCopy(t *testing.T) {
+// TestNameOrder checks the collation used to sort names in listings.
+func TestNameOrder(t *testing.T) {
+	names := []string{"zebra", "éclair", "Émile", "eagle", "apple", "öl", "ol"}
+
 	testCases := []struct {
-		name            string
-		cmd             command
-		setup           func(t *testing.T) (srcPaths []string, destPath string)
-		userInput       string // For interactive tests
-		wantErr         bool
-		wantErrContains string
-		wantContent     map[string]string // map[filepath]content
-		wantNoContent   []string          // list of filepaths that should NOT exist
+		name      string
+		locale    string
+		byteOrder bool
+		want      []string
+		wantErr   bool
 	}{
-		// --- Success Cases ---
-		{
-			name: "Copy single file to directory",
-			cmd:  command{copy: true},
-			setup: func(t *testing.T) (srcPaths []string, destPath string) {
-				_, srcFiles := setupTestDirWithFiles(t, []testFile{
-					{filename: "file1.txt", content: "test content"},
-				})
-				destDir, _ := setupTestDirWithFiles(t, []testFile{})
-				return srcFiles, destDir
-			},
-			wantErr: false,
-			wantContent: map[string]string{
-				"file1.txt": "test content",
-			},
-		},
-		{
-			name: "Copy multiple files to directory",
-			cmd:  command{copy: true},
-			setup: func(t *testing.T) (srcPaths []string, destPath string) {
-				_, srcFiles := setupTestDirWithFiles(t, []testFile{
-					{filename: "file1.txt", content: "content1"},
-					{filename: "file2.txt", content: "content2"},
-				})
-				destDir, _ := setupTestDirWithFiles(t, []testFile{})
-				return srcFiles, destDir
-			},
-			wantErr: false,
-			wantContent: map[string]string{
-				"file1.txt": "content1",
-				"file2.txt": "content2",
-			},
-		},
-		{
-			name: "Recursive copy",
-			cmd:  command{copy: true, recursive: true},
-			setup: func(t *testing.T) (srcPaths []string, destPath string) {
-				srcDir, _ := setupTestDirWithFiles(t, []testFile{
-					{path: "src", filename: "root.txt", content: "root"},
-					{path: "src/subdir", filename: "sub.txt", content: "sub"},
-				})
-				destDir, _ := setupTestDirWithFiles(t, []testFile{})
-				return []string{filepath.Join(srcDir, "src")}, destDir
-			},
-			wantErr: false,
-			wantContent: map[string]string{
-				"root.txt":       "root",
-				"subdir/sub.txt": "sub",
-			},
-		},
-		// --- Overwrite Logic ---
-		{
-			name: "Overwrite with force",
-			cmd:  command{copy: true, force: true},
-			setup: func(t *testing.T) (srcPaths []string, destPath string) {
-				_, srcFiles := setupTestDirWithFiles(t, []testFile{
-					{filename: "file.txt", content: "new content"},
-				})
-				destDir, _ := setupTestDirWithFiles(t, []testFile{
-					{filename: "file.txt", content: "old content"},
-				})
-				return srcFiles, destDir
-			},
-			wantErr: false,
-			wantContent: map[string]string{
-				"file.txt": "new content",
-			},
-		},
-		{
-			name: "Overwrite interactive - yes",
-			cmd:  command{copy: true, interactive: true},
-			setup: func(t *testing.T) (srcPaths []string, destPath string) {
-				_, srcFiles := setupTestDirWithFiles(t, []testFile{
-					{filename: "file.txt", content: "new content"},
-				})
-				destDir, _ := setupTestDirWithFiles(t, []testFile{
-					{filename: "file.txt", content: "old content"},
-				})
-				return srcFiles, destDir
-			},
-			userInput: "y",
-			wantErr:   false,
-			wantContent: map[string]string{
-				"file.txt": "new content",
-			},
-		},
-		{
-			name: "Overwrite interactive - no",
-			cmd:  command{copy: true, interactive: true},
-			setup: func(t *testing.T) (srcPaths []string, destPath string) {
-				_, srcFiles := setupTestDirWithFiles(t, []testFile{
-					{filename: "file.txt", content: "new content"},
-				})
-				destDir, _ := setupTestDirWithFiles(t, []testFile{
-					{filename: "file.txt", content: "old content"},
-				})
-				return srcFiles, destDir
-			},
-			userInput: "n",
-			wantErr:   false,
-			wantContent: map[string]string{
-				"file.txt": "old content",
-			},
-		},
-		// --- Error Cases ---
-		{
-			name: "Fail on overwrite by default",
-			cmd:  command{copy: true},
-			setup: func(t *testing.T) (srcPaths []string, destPath string) {
-				_, srcFiles := setupTestDirWithFiles(t, []testFile{
-					{filename: "file.txt", content: "new content"},
-				})
-				destDir, _ := setupTestDirWithFiles(t, []testFile{
-					{filename: "file.txt", content: "old content"},
-				})
-				return srcFiles, destDir
-			},
-			wantErr:         true,
-			wantErrContains: "already exists",
-			wantContent: map[string]string{
-				"file.txt": "old content",
-			},
-		},
-		{
-			name: "Source does not exist",
-			cmd:  command{copy: true},
-			setup: func(t *testing.T) (srcPaths []string, destPath string) {
-				destDir, _ := setupTestDirWithFiles(t, []testFile{})
-				return []string{"nonexistent.txt"}, destDir
-			},
-			wantErr:         true,
-			wantErrContains: "cannot stat source",
-		},
-		{
-			name: "Copy directory without recursive flag",
-			cmd:  command{copy: true},
-			setup: func(t *testing.T) (srcPaths []string, destPath string) {
-				srcDir, _ := setupTestDirWithFiles(t, []testFile{
-					{path: "src", filename: "file.txt", content: "content"},
-				})
-				destDir, _ := setupTestDirWithFiles(t, []testFile{})
-				return []string{filepath.Join(srcDir, "src")}, destDir
-			},
-			wantErr:         true,
-			wantErrContains: "omitting directory",
-		},
-		{
-			name: "Multiple files to non-directory destination",
-			cmd:  command{copy: true},
-			setup: func(t *testing.T) (srcPaths []string, destPath string) {
-				_, srcFiles := setupTestDirWithFiles(t, []testFile{
-					{filename: "file1.txt", content: "content1"},
-					{filename: "file2.txt", content: "content2"},
-				})
-				_, destFile := setupTestDirWithFiles(t, []testFile{
-					{filename: "dest.txt", content: "existing"},
-				})
-				return srcFiles, destFile[0]
-			},
-			wantErr:         true,
-			wantErrContains: "is not a directory",
-		},
+		{name: "Root collation", want: []string{"apple", "eagle", "éclair", "Émile", "ol", "öl", "zebra"}},
+		{name: "Swedish sorts ö after z", locale: "sv", want: []string{"apple", "eagle", "éclair", "Émile", "ol", "zebra", "öl"}},
+		{name: "Byte order", byteOrder: true, want: []string{"apple", "eagle", "ol", "zebra", "Émile", "éclair", "öl"}},
+		{name: "Invalid locale", locale: "not a locale", wantErr: true},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// --- Setup ---
-			oldConsole := console
-			defer func() { console = oldConsole }()
+			order, err := nameOrder(tc.locale, tc.byteOrder)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("did not expect an error, but got: %v", err)
+			}
+
+			got := slices.Clone(names)
+			slices.SortFunc(got, order)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestListDefaultOrder checks that plain "fmn ls" sorts names with Unicode
+// collation, so accented names sit next to their unaccented forms.
+func TestListDefaultOrder(t *testing.T) {
+	names := []string{"zebra", "éclair", "eagle", "apple", "öl", "ol"}
+	var files []testfs.File
+	for _, name := range names {
+		files = append(files, testfs.File{Filename: name})
+	}
+	dir, _ := testfs.SetupDir(t, files)
+
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+	sub, _ := findSubcommand("ls")
+	if err := sub.run(context.Background(), stdio, newFlagSet(stdio, sub), config{}, []string{dir}); err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	got := strings.Split(strings.TrimSpace(outBuf.String()), "\n")[1:]
+	if want := []string{"apple", "eagle", "éclair", "ol", "öl", "zebra"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestListUnsorted checks that -U lists every entry without sorting, and
+// that it refuses the flags that need a sort.
+func TestListUnsorted(t *testing.T) {
+	var files []testfs.File
+	for i := range 50 {
+		files = append(files, testfs.File{Filename: fmt.Sprintf("file%02d", i)})
+	}
+	dir, _ := testfs.SetupDir(t, files)
 
-			var inBuf, outBuf bytes.Buffer
-			console.Out = &outBuf
-			console.Err = &outBuf
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+	sub, _ := findSubcommand("ls")
+	if err := sub.run(context.Background(), stdio, newFlagSet(stdio, sub), config{}, []string{"-U", dir}); err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	got := strings.Split(strings.TrimSpace(outBuf.String()), "\n")[1:]
+	if slices.Sort(got); len(got) != len(files) || got[0] != "file00" || got[len(got)-1] != "file49" {
+		t.Errorf("expected all %d files, got %v", len(files), got)
+	}
+
+	for _, arg := range []string{"-r", "-sort=size", "-group-directories-first", "-byte-order"} {
+		err := sub.run(context.Background(), stdio, newFlagSet(stdio, sub), config{}, []string{"-U", arg, dir})
+		if exitCode(err) != exitUsage {
+			t.Errorf("-U %s: expected a usage error, got %v", arg, err)
+		}
+	}
+}
+
+// TestListSort checks the -sort keys and -r on one directory.
+func TestListSort(t *testing.T) {
+	dir, files := testfs.SetupDir(t, []testfs.File{
+		{Filename: "b.txt", Content: "12345"},
+		{Filename: "a.go", Content: "1"},
+		{Filename: "c.md", Content: "123"},
+	})
+	base := time.Now()
+	for i, path := range files {
+		mtime := base.Add(time.Duration(i) * time.Hour) // b.txt oldest, c.md newest
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-			if tc.userInput != "" {
-				inBuf.WriteString(tc.userInput + "\n")
-				console.In = &inBuf
+	testCases := []struct {
+		sortBy  string
+		reverse bool
+		want    []string
+	}{
+		{sortName, false, []string{"a.go", "b.txt", "c.md"}},
+		{sortName, true, []string{"c.md", "b.txt", "a.go"}},
+		{sortSize, false, []string{"b.txt", "c.md", "a.go"}},
+		{sortTime, false, []string{"c.md", "a.go", "b.txt"}},
+		{sortTime, true, []string{"b.txt", "a.go", "c.md"}},
+		{sortExt, false, []string{"a.go", "c.md", "b.txt"}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s reverse=%v", tc.sortBy, tc.reverse), func(t *testing.T) {
+			var outBuf bytes.Buffer
+			cmd := command{sortBy: tc.sortBy, reverse: tc.reverse, nameOrder: strings.Compare}
+			cmd.stdio = newIO(nil, &outBuf, io.Discard)
+			if err := listFiles(cmd, []string{dir}); err != nil {
+				t.Fatalf("list failed: %v", err)
+			}
+			got := strings.Split(strings.TrimSpace(outBuf.String()), "\n")[1:]
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
 			}
+		})
+	}
+}
 
-			srcPaths, destPath := tc.setup(t)
-			args := append(srcPaths, destPath)
+// TestListGroupDirectoriesFirst checks that -group-directories-first lists
+// directories before files, and that -r and -sort only reorder each group.
+func TestListGroupDirectoriesFirst(t *testing.T) {
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "1"},
+		{Path: "b"},
+		{Filename: "c.txt", Content: "123"},
+		{Path: "d"},
+	})
 
-			// --- Execute ---
-			err := run(tc.cmd, args)
+	testCases := []struct {
+		name string
+		cmd  command
+		want []string
+	}{
+		{"Name", command{groupDirs: true}, []string{"b", "d", "a.txt", "c.txt"}},
+		{"Reverse", command{groupDirs: true, reverse: true, sortBy: sortName}, []string{"d", "b", "c.txt", "a.txt"}},
+		{"Size", command{groupDirs: true, sortBy: sortSize}, []string{"b", "d", "c.txt", "a.txt"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var outBuf bytes.Buffer
+			tc.cmd.stdio = newIO(nil, &outBuf, io.Discard)
+			tc.cmd.nameOrder = strings.Compare
+			if err := listFiles(tc.cmd, []string{dir}); err != nil {
+				t.Fatalf("list failed: %v", err)
+			}
+			got := strings.Split(strings.TrimSpace(outBuf.String()), "\n")[1:]
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
 
-			// --- Assert ---
-			if tc.wantErr {
-				if err == nil {
-					t.Errorf("expected an error, but got nil")
-				} else if tc.wantErrContains != "" && !strings.Contains(err.Error(), tc.wantErrContains) {
-					t.Errorf("expected error to contain %q, got %q", tc.wantErrContains, err.Error())
-				}
-			} else if err != nil {
-				t.Errorf("did not expect an error, but got: %v", err)
+// TestListHidden checks that dotfiles are only listed with -a or -A, and
+// that -a adds . and .. to every directory.
+func TestListHidden(t *testing.T) {
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "visible.txt"},
+		{Filename: ".hidden"},
+		{Path: ".dotdir", Filename: "inner.txt"},
+		{Path: "onlyhidden", Filename: ".secret"},
+	})
+	onlyHidden := filepath.Join(dir, "onlyhidden")
+
+	testCases := []struct {
+		name string
+		cmd  command
+		want string
+	}{
+		{"Default", command{recursive: true},
+			dir + ":\nonlyhidden\nvisible.txt\n\n" + onlyHidden + ":\n"},
+		{"Almost all", command{recursive: true, all: true},
+			dir + ":\n.dotdir\n.hidden\nonlyhidden\nvisible.txt\n\n" +
+				filepath.Join(dir, ".dotdir") + ":\ninner.txt\n\n" + onlyHidden + ":\n.secret\n"},
+		{"All", command{all: true, dotDirs: true},
+			dir + ":\n.\n..\n.dotdir\n.hidden\nonlyhidden\nvisible.txt\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var outBuf bytes.Buffer
+			tc.cmd.stdio = newIO(nil, &outBuf, io.Discard)
+			tc.cmd.nameOrder = strings.Compare
+			if err := listFiles(tc.cmd, []string{dir}); err != nil {
+				t.Fatalf("list failed: %v", err)
+			}
+			if outBuf.String() != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", outBuf.String(), tc.want)
 			}
+		})
+	}
+}
 
-			// Verify content of files that should exist
-			for file, expectedContent := range tc.wantContent {
-				fullPath := filepath.Join(destPath, file)
-				content, err := os.ReadFile(fullPath)
-				if err != nil {
-					t.Errorf("could not read expected file '%s': %v", fullPath, err)
-					continue
-				}
-				if string(content) != expectedContent {
-					t.Errorf("content mismatch for '%s': got %q, want %q", file, string(content), expectedContent)
-				}
+// TestListTree checks the connectors of ls -tree, and that a symlink back
+// to an ancestor is marked instead of followed under -L.
+func TestListTree(t *testing.T) {
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "top.txt"},
+		{Path: "a", Filename: "one.txt"},
+		{Path: filepath.Join("a", "b"), Filename: "two.txt"},
+	})
+	if err := os.Symlink(dir, filepath.Join(dir, "a", "loop")); err != nil {
+		t.Skipf("cannot create symlink: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		cmd  command
+		want string
+	}{
+		{"Plain", command{tree: true},
+			dir + "\n" +
+				"├── a\n" +
+				"│   ├── b\n" +
+				"│   │   └── two.txt\n" +
+				"│   ├── loop\n" +
+				"│   └── one.txt\n" +
+				"└── top.txt\n"},
+		{"Follow", command{tree: true, dereference: true},
+			dir + "\n" +
+				"├── a\n" +
+				"│   ├── b\n" +
+				"│   │   └── two.txt\n" +
+				"│   ├── loop [loop]\n" +
+				"│   └── one.txt\n" +
+				"└── top.txt\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var outBuf bytes.Buffer
+			tc.cmd.stdio = newIO(nil, &outBuf, io.Discard)
+			tc.cmd.nameOrder = strings.Compare
+			if err := listFiles(tc.cmd, []string{dir}); err != nil {
+				t.Fatalf("list failed: %v", err)
 			}
+			if outBuf.String() != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", outBuf.String(), tc.want)
+			}
+		})
+	}
+}
 
-			// Verify files that should NOT exist
-			for _, file := range tc.wantNoContent {
-				fullPath := filepath.Join(destPath, file)
-				if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
-					t.Errorf("file '%s' should not exist, but it does", fullPath)
-				}
+// TestListClassify checks the ls -F indicators, for directory entries and
+// for a file given as an argument.
+func TestListClassify(t *testing.T) {
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+
+	mapFS := fstest.MapFS{
+		"dir/file.txt": {Data: []byte("x"), Mode: 0644},
+		"dir/run.sh":   {Data: []byte("x"), Mode: 0755},
+		"dir/link":     {Data: []byte("file.txt"), Mode: fs.ModeSymlink | 0777},
+		"dir/pipe":     {Mode: fs.ModeNamedPipe | 0644},
+		"dir/sub/a":    {Data: []byte("x")},
+	}
+	cmd := command{fsys: copyfs.IOFS{FS: mapFS}, classify: true, nameOrder: strings.Compare, stdio: stdio}
+	if err := listFiles(cmd, []string{"dir", "dir/run.sh"}); err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	want := "dir:\nfile.txt\nlink@\npipe|\nrun.sh*\nsub/\n\ndir/run.sh*\n"
+	if outBuf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", outBuf.String(), want)
+	}
+}
+
+func TestExpandGlobs(t *testing.T) {
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.go"},
+		{Filename: "b.go"},
+		{Filename: "notes.txt"},
+		{Filename: "x[1]"},
+	})
+	in := func(name string) string { return filepath.Join(dir, name) }
+
+	got, err := expandGlobs(nil, nil, []string{in("*.go"), in("notes.txt"), in("x[1]")})
+	if err != nil {
+		t.Fatalf("expand failed: %v", err)
+	}
+	want := []string{in("a.go"), in("b.go"), in("notes.txt"), in("x[1]")}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, err = expandGlobs(nil, nil, []string{in("*.rs")})
+	if !errors.Is(err, errNoMatch) {
+		t.Errorf("expected a no-match error, got %v", err)
+	}
+}
+
+// TestListSummary checks that each directory argument gets its own total.
+func TestListSummary(t *testing.T) {
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "12345"},
+		{Path: "sub", Filename: "b.txt", Content: strings.Repeat("x", 2048)},
+		{Path: filepath.Join("sub", "deeper"), Filename: "c.txt"},
+	})
+	sub := filepath.Join(dir, "sub")
+
+	testCases := []struct {
+		name string
+		cmd  command
+		want string
+	}{
+		{"Bytes", command{summary: true},
+			dir + ":\na.txt\nsub\ntotal: 5 bytes (1 files, 1 directories)\n\n" +
+				sub + ":\nb.txt\ndeeper\ntotal: 2048 bytes (1 files, 1 directories)\n"},
+		{"Human", command{summary: true, humanize: true},
+			dir + ":\na.txt\nsub\ntotal: 5 (1 files, 1 directories)\n\n" +
+				sub + ":\nb.txt\ndeeper\ntotal: 2.0K (1 files, 1 directories)\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var outBuf bytes.Buffer
+			tc.cmd.stdio = newIO(nil, &outBuf, io.Discard)
+			tc.cmd.nameOrder = strings.Compare
+			if err := listFiles(tc.cmd, []string{dir, sub}); err != nil {
+				t.Fatalf("list failed: %v", err)
+			}
+			if outBuf.String() != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", outBuf.String(), tc.want)
 			}
 		})
 	}
 }
 
-type testFile struct {
-	path     string
-	filename string
-	content  string
-	mode     os.FileMode
+// TestListPlan checks that -R -plan prints each directory entered with its
+// file count, honouring -exclude, and none of the files.
+func TestListPlan(t *testing.T) {
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt"},
+		{Filename: "b.txt"},
+		{Path: "sub", Filename: "c.txt"},
+		{Path: "skip", Filename: "d.txt"},
+	})
+
+	cmd := command{recursive: true, plan: true, exclude: []string{"skip"}, nameOrder: strings.Compare, stdio: stdio}
+	if err := listFiles(cmd, []string{dir}); err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	want := dir + " (2 files)\n" + filepath.Join(dir, "sub") + " (1 files)\n"
+	if outBuf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", outBuf.String(), want)
+	}
 }
 
-func setupTestDirWithFiles(t *testing.T, files []testFile) (string, []string) {
-	t.Helper()
-	dir := t.TempDir()
-	paths := []string{}
+// TestListCount checks that -count prints the number of entries each
+// directory lists, after -ext and -exclude, with and without -R.
+func TestListCount(t *testing.T) {
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.go"},
+		{Filename: "b.txt"},
+		{Filename: ".hidden"},
+		{Path: "sub", Filename: "c.go"},
+		{Path: "skip", Filename: "d.go"},
+	})
+	sub := filepath.Join(dir, "sub")
+
+	testCases := []struct {
+		name string
+		cmd  command
+		args []string
+		want string
+	}{
+		{"Plain", command{count: true}, []string{dir, sub},
+			dir + ": 4\n" + sub + ": 1\n"},
+		{"Filtered", command{count: true, extensions: []string{".go"}, exclude: []string{"skip"}}, []string{dir},
+			dir + ": 2\n"},
+		{"Recursive", command{count: true, recursive: true, exclude: []string{"skip"}, nameOrder: strings.Compare}, []string{dir},
+			dir + ": 3\n" + sub + ": 1\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var outBuf bytes.Buffer
+			tc.cmd.stdio = newIO(nil, &outBuf, io.Discard)
+			if err := listFiles(tc.cmd, tc.args); err != nil {
+				t.Fatalf("list failed: %v", err)
+			}
+			if outBuf.String() != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", outBuf.String(), tc.want)
+			}
+		})
+	}
+}
+
+// TestListExtensions checks -ext parsing and filtering: extensions match
+// case-insensitively, directories are kept, and a directory with no match
+// still gets its header.
+func TestListExtensions(t *testing.T) {
+	exts, err := parseExtensions(" go, .MD,")
+	if err != nil || !slices.Equal(exts, []string{".go", ".md"}) {
+		t.Fatalf("parseExtensions: got %v, %v", exts, err)
+	}
+	if _, err := parseExtensions(","); err == nil {
+		t.Errorf("expected an error for an empty list")
+	}
+
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "main.go"},
+		{Filename: "README.MD"},
+		{Filename: "notes.txt"},
+		{Path: "pkg", Filename: "data.json"},
+	})
+	pkg := filepath.Join(dir, "pkg")
+
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+	cmd := command{extensions: exts, nameOrder: strings.Compare, stdio: stdio}
+	if err := listFiles(cmd, []string{dir, pkg}); err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	want := dir + ":\nREADME.MD\nmain.go\npkg\n\n" + pkg + ":\n"
+	if outBuf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", outBuf.String(), want)
+	}
+}
+
+// brokenEntry is a directory entry whose info cannot be read.
+type brokenEntry struct {
+	fs.DirEntry
+	name string
+}
+
+func (e brokenEntry) Name() string               { return e.name }
+func (e brokenEntry) Info() (fs.FileInfo, error) { return nil, fs.ErrNotExist }
+
+// TestSortEntriesInfoError checks that entries without info sort last with
+// a warning, even in reverse.
+func TestSortEntriesInfoError(t *testing.T) {
+	var errBuf bytes.Buffer
+	stdio := newIO(nil, io.Discard, &errBuf)
+
+	mapFS := fstest.MapFS{"a": {Data: []byte("1")}, "b": {Data: []byte("12")}}
+	for _, reverse := range []bool{false, true} {
+		errBuf.Reset()
+		entries, _ := fs.ReadDir(mapFS, ".")
+		entries = append([]fs.DirEntry{brokenEntry{name: "gone"}}, entries...)
+		sortEntries(command{sortBy: sortSize, reverse: reverse, nameOrder: strings.Compare, stdio: stdio}, "dir", entries)
+
+		if entries[2].Name() != "gone" {
+			t.Errorf("reverse=%v: expected the broken entry last, got %s first", reverse, entries[0].Name())
+		}
+		if !strings.Contains(errBuf.String(), "warning: cannot stat '"+filepath.Join("dir", "gone")+"'") {
+			t.Errorf("expected a warning, got %q", errBuf.String())
+		}
+	}
+}
+
+// TestListIcons checks the icon printed for each kind of entry with -icons.
+func TestListIcons(t *testing.T) {
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Path: "sub"},
+		{Filename: "main.go"},
+		{Filename: "backup.TAR"},
+		{Filename: "run", Mode: 0755},
+		{Filename: "notes"},
+	})
+	if err := os.Symlink("notes", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	if err := listFiles(command{icons: true, stdio: stdio}, []string{dir}); err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
 
-	for _, f := range files {
-		// Set default content if empty, so we can create an empty file vs a directory
-		if f.filename != "" && f.content == "" {
-			f.content = ""
+	for _, want := range []string{
+		iconDirectory + " sub\n",
+		"💻 main.go\n",
+		"📦 backup.TAR\n",
+		iconExecutable + " run\n",
+		iconFile + " notes\n",
+		iconSymlink + " link\n",
+	} {
+		if !strings.Contains(outBuf.String(), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, outBuf.String())
 		}
+	}
 
-		if f.filename != "" {
-			fullPath := filepath.Join(dir, f.path, f.filename)
-			if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-				t.Fatalf("Failed to create directory for %s: %v", fullPath, err)
-			}
+	if isTerminal(&outBuf) {
+		t.Error("a buffer is not a terminal")
+	}
+}
+
+// TestListJSONL checks that -jsonl prints one object per entry and reports
+// unreadable directories as error lines in the same stream.
+func TestListJSONL(t *testing.T) {
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+
+	dir, files := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "hello"},
+		{Path: "sub"},
+	})
+	locked, _ := testfs.SetupDir(t, []testfs.File{{Filename: "hidden.txt"}})
+	fsys := testfs.FaultFS{FS: copyfs.OSFS{}, Fail: map[string]error{"readdir " + locked: fs.ErrPermission}}
+
+	err := listFiles(command{jsonl: true, fsys: fsys, stdio: stdio}, []string{dir, files[0], locked})
+	if exitCode(err) != exitPartial {
+		t.Errorf("expected a partial failure, got %v", err)
+	}
 
-			mode := f.mode
-			if mode == 0 {
-				mode = 0644
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(outBuf.String()), "\n") {
+		var obj struct {
+			listEntry
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			t.Fatalf("line %q is not JSON: %v", line, err)
+		}
+		switch {
+		case obj.Error != "":
+			got = append(got, "error "+obj.Path)
+		case obj.Type == "file":
+			got = append(got, fmt.Sprintf("file %s %s %d", obj.Name, obj.Path, obj.Size))
+		default:
+			got = append(got, fmt.Sprintf("%s %s %s", obj.Type, obj.Name, obj.Path))
+		}
+	}
+
+	want := []string{
+		"dir sub " + filepath.Join(dir, "sub"),
+		"file a.txt " + files[0] + " 5",
+		"file a.txt " + files[0] + " 5",
+		"error " + locked,
+	}
+	if len(got) == len(want) {
+		slices.Sort(got[:2]) // entries of a directory come in directory order
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got lines:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestListFS lists from io/fs filesystems: an fstest.MapFS and a zip archive.
+func TestListFS(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "backup.zip")
+	f, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"a.txt", "docs/b.txt", "docs/c.txt"} {
+		if _, err := zw.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	mapFS := fstest.MapFS{
+		"a.txt":      {Data: []byte("alpha")},
+		"docs/b.txt": {Data: []byte("bravo")},
+		"docs/c.txt": {Data: []byte("charlie")},
+	}
+
+	for name, fsys := range map[string]fs.FS{"MapFS": mapFS, "zip": zr} {
+		t.Run(name, func(t *testing.T) {
+			var outBuf bytes.Buffer
+			cmd := command{fsys: copyfs.IOFS{FS: fsys}, nameOrder: strings.Compare}
+			cmd.stdio = newIO(nil, &outBuf, io.Discard)
+			if err := listFiles(cmd, []string{".", "docs", "/a.txt"}); err != nil {
+				t.Fatalf("list failed: %v", err)
 			}
-			if err := os.WriteFile(fullPath, []byte(f.content), mode); err != nil {
-				t.Fatalf("Failed to create file %s: %v", fullPath, err)
+			want := ".:\na.txt\ndocs\n\ndocs:\nb.txt\nc.txt\n\n/a.txt\n"
+			if outBuf.String() != want {
+				t.Errorf("got %q, want %q", outBuf.String(), want)
 			}
-			paths = append(paths, fullPath)
-		} else if f.path != "" {
-			dirPath := filepath.Join(dir, f.path)
-			if err := os.MkdirAll(dirPath, 0755); err != nil {
-				t.Fatalf("Failed to create directory %s: %v", dirPath, err)
+
+			err := listFiles(cmd, []string{"missing"})
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected a not-exist error, got %v", err)
 			}
-		}
+		})
+	}
+}
+
+// TestListRecursive checks that ls -R lists every directory depth-first in a
+// stable order, logging an unreadable one in its place and carrying on.
+func TestListRecursive(t *testing.T) {
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "top.txt"},
+		{Path: "a", Filename: "a1.txt"},
+		{Path: "a/deep", Filename: "d1.txt"},
+		{Path: "b/locked", Filename: "hidden.txt"},
+		{Path: "c"},
+	})
+	locked := filepath.Join(dir, "b", "locked")
+	fsys := testfs.FaultFS{FS: copyfs.OSFS{}, Fail: map[string]error{"readdir " + locked: fs.ErrPermission}}
+	cmd := command{recursive: true, nameOrder: strings.Compare, fsys: fsys}
+
+	var outBuf, errBuf bytes.Buffer
+	cmd.stdio = newIO(nil, &outBuf, &errBuf)
+	err := listFiles(cmd, []string{dir})
+	if exitCode(err) != exitPartial {
+		t.Errorf("expected a partial failure, got %v", err)
+	}
+	if !strings.Contains(errBuf.String(), locked) {
+		t.Errorf("expected error log to name %s, got:\n%s", locked, errBuf.String())
+	}
+
+	want := dir + ":\na\nb\nc\ntop.txt\n" +
+		"\n" + filepath.Join(dir, "a") + ":\na1.txt\ndeep\n" +
+		"\n" + filepath.Join(dir, "a", "deep") + ":\nd1.txt\n" +
+		"\n" + filepath.Join(dir, "b") + ":\nlocked\n" +
+		"\n" + locked + ":\n" +
+		"\n" + filepath.Join(dir, "c") + ":\n"
+	if outBuf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", outBuf.String(), want)
+	}
+
+	// Reading one directory at a time gives the same output
+	var serialBuf bytes.Buffer
+	cmd.stdio = newIO(nil, &serialBuf, io.Discard)
+	fmt.Fprintf(&serialBuf, "%s:\n", dir)
+	listTree(cmd, dir, 1)
+	if serialBuf.String() != outBuf.String() {
+		t.Errorf("serial listing differs:\n%s", serialBuf.String())
+	}
+}
+
+// concurrencyFS records the most Opens in flight at once, and the most
+// goroutines seen while one was, on a filesystem with latency.
+type concurrencyFS struct {
+	copyfs.OSFS
+	mu                  *sync.Mutex
+	open, maxOpen, maxG *int
+}
+
+func (f concurrencyFS) Open(name string) (fs.File, error) {
+	f.mu.Lock()
+	*f.open++
+	*f.maxOpen = max(*f.maxOpen, *f.open)
+	*f.maxG = max(*f.maxG, runtime.NumGoroutine())
+	f.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	f.mu.Lock()
+	*f.open--
+	f.mu.Unlock()
+	return f.OSFS.Open(name)
+}
+
+// TestListRecursiveWorkers checks that ls -R reads a wide tree with no more
+// goroutines than its workers, and prints it as a serial listing would.
+func TestListRecursiveWorkers(t *testing.T) {
+	var files []testfs.File
+	for i := range 60 {
+		files = append(files, testfs.File{Path: filepath.Join(fmt.Sprintf("dir%02d", i), "sub"), Filename: "file.txt"})
+	}
+	dir, _ := testfs.SetupDir(t, files)
+
+	const workers = 4
+	var mu sync.Mutex
+	var open, maxOpen, maxG int
+	fsys := concurrencyFS{mu: &mu, open: &open, maxOpen: &maxOpen, maxG: &maxG}
+
+	var outBuf, serialBuf bytes.Buffer
+	before := runtime.NumGoroutine()
+	cmd := command{recursive: true, fsys: fsys, stdio: newIO(nil, &outBuf, io.Discard)}
+	if ok, failed := listTree(cmd, dir, workers); !ok || failed {
+		t.Fatal("listing failed")
+	}
+	if maxOpen > workers {
+		t.Errorf("read %d directories at once, want at most %d", maxOpen, workers)
+	}
+	if extra := maxG - before; extra > workers {
+		t.Errorf("listing ran %d extra goroutines, want at most %d", extra, workers)
+	}
+
+	cmd.stdio = newIO(nil, &serialBuf, io.Discard)
+	listTree(cmd, dir, 1)
+	if serialBuf.String() != outBuf.String() {
+		t.Errorf("parallel listing differs from the serial one:\n%s", outBuf.String())
+	}
+}
+
+// TestListRecursiveUnreadable checks that ls -R carries on past nested
+// directories it cannot read and ends with the usual summary error.
+func TestListRecursiveUnreadable(t *testing.T) {
+	testfs.SkipIfRoot(t)
+
+	var outBuf, errBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, &errBuf)
+
+	dir, _ := testfs.SetupDir(t, []testfs.File{
+		{Path: "a/locked", Filename: "hidden.txt"},
+		{Path: "b/locked", Filename: "hidden.txt"},
+		{Path: "c", Filename: "visible.txt"},
+	})
+	for _, sub := range []string{"a", "b"} {
+		locked := filepath.Join(dir, sub, "locked")
+		if err := os.Chmod(locked, 0000); err != nil {
+			t.Fatalf("Failed to change permissions: %v", err)
+		}
+		t.Cleanup(func() { os.Chmod(locked, 0755) })
+	}
+
+	err := listFiles(command{recursive: true, stdio: stdio}, []string{dir})
+	if err == nil || err.Error() != "some directories could not be read" {
+		t.Errorf("expected the summary error, got %v", err)
+	}
+	if got := strings.Count(errBuf.String(), "permission denied"); got != 2 {
+		t.Errorf("expected 2 permission errors logged, got:\n%s", errBuf.String())
+	}
+	if !strings.Contains(outBuf.String(), "visible.txt") {
+		t.Errorf("expected the readable directory to be listed, got:\n%s", outBuf.String())
+	}
+}
+
+// latencyFS adds a fixed delay to every Open, like a network mount.
+type latencyFS struct {
+	copyfs.OSFS
+	delay time.Duration
+}
+
+func (f latencyFS) Open(name string) (fs.File, error) {
+	time.Sleep(f.delay)
+	return f.OSFS.Open(name)
+}
+
+// BenchmarkListRecursive lists a synthetic deep tree on a filesystem with
+// latency, reading one directory at a time and listWorkers at a time.
+func BenchmarkListRecursive(b *testing.B) {
+	root := b.TempDir()
+	var mkTree func(dir string, depth int)
+	mkTree = func(dir string, depth int) {
+		for i := range 5 {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), nil, 0644); err != nil {
+				b.Fatal(err)
+			}
+			if depth > 0 {
+				sub := filepath.Join(dir, fmt.Sprintf("dir%d", i))
+				if err := os.Mkdir(sub, 0755); err != nil {
+					b.Fatal(err)
+				}
+				mkTree(sub, depth-1)
+			}
+		}
+	}
+	mkTree(root, 3)
+
+	stdio := newIO(nil, io.Discard, io.Discard)
+	cmd := command{recursive: true, fsys: latencyFS{delay: 200 * time.Microsecond}, stdio: stdio}
+	for _, workers := range []int{1, listWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for b.Loop() {
+				if ok, failed := listTree(cmd, root, workers); !ok || failed {
+					b.Fatal("listing failed")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkListLargeDirectory compares streaming a huge directory with
+// reading it whole first; run with -benchmem to see the difference in memory.
+func BenchmarkListLargeDirectory(b *testing.B) {
+	dir := b.TempDir()
+	for i := range 20000 {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%05d.txt", i)), nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	stdio := newIO(nil, io.Discard, io.Discard)
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := listFiles(command{stdio: stdio}, []string{dir}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("collect", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, entry := range entries {
+				printPath(io.Discard, entry.Name())
+			}
+		}
+	})
+}
+
+// TestStatPaths checks that concurrent stats keep the argument order and
+// report the first failing argument.
+func TestStatPaths(t *testing.T) {
+	paths := make([]string, 100)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("path%02d", i)
+	}
+
+	// Later paths answer sooner, so results arrive out of order
+	statFn := func(fail ...string) func(string) (fs.FileInfo, error) {
+		return func(name string) (fs.FileInfo, error) {
+			var i int
+			fmt.Sscanf(name, "path%d", &i)
+			time.Sleep(time.Duration(len(paths)-i) * 10 * time.Microsecond)
+			for _, f := range fail {
+				if name == f {
+					return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+				}
+			}
+			return fakeFileInfo{name: name}, nil
+		}
+	}
+
+	infos, err := statPaths(paths, statFn())
+	if err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
+	for i, info := range infos {
+		if info.Name() != paths[i] {
+			t.Fatalf("info %d is for %q, want %q", i, info.Name(), paths[i])
+		}
+	}
+
+	_, err = statPaths(paths, statFn("path70", "path30"))
+	if err == nil || !strings.Contains(err.Error(), "'path30'") {
+		t.Errorf("expected an error naming path30, got %v", err)
+	}
+}
+
+// fakeFileInfo is a minimal fs.FileInfo for tests that never touch disk.
+type fakeFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (f fakeFileInfo) Name() string { return f.name }
+
+// TestExclude checks that -exclude patterns accumulate, and that they leave
+// entries out of listings and copies, whole directories included.
+func TestExclude(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "keep.txt"},
+		{Filename: "scratch.tmp"},
+		{Filename: "app.log"},
+		{Path: "cache", Filename: "data.txt"},
+		{Path: "sub", Filename: "more.tmp"},
+		{Path: "sub", Filename: "more.txt"},
+	})
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var exclude []string
+	fs.Var((*stringList)(&exclude), "exclude", "")
+	if err := fs.Parse([]string{"-exclude", "*.tmp", "-exclude", "*.log", "-exclude", "cache"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(exclude) != 3 {
+		t.Fatalf("expected the patterns to accumulate, got %v", exclude)
+	}
+
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+	if err := run(command{exclude: exclude, nameOrder: strings.Compare, stdio: stdio}, []string{srcDir}); err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if want := srcDir + ":\nkeep.txt\nsub\n"; outBuf.String() != want {
+		t.Errorf("list got:\n%s\nwant:\n%s", outBuf.String(), want)
+	}
+
+	destDir := t.TempDir()
+	opts := copyfs.Options{Recursive: true, Exclude: exclude, Skips: &copyfs.SkipReport{}}
+	if err := copyPaths(opts, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	for rel, want := range map[string]bool{
+		"keep.txt": true, "sub/more.txt": true,
+		"scratch.tmp": false, "app.log": false, "cache": false, "sub/more.tmp": false,
+	} {
+		_, err := os.Lstat(filepath.Join(destDir, filepath.FromSlash(rel)))
+		if got := err == nil; got != want {
+			t.Errorf("%s copied: got %v, want %v", rel, got, want)
+		}
+	}
+	if n := len(opts.Skips.Paths(copyfs.SkipExcluded)); n != 4 {
+		t.Errorf("expected 4 excluded paths, got %d", n)
+	}
+
+	if err := run(command{exclude: []string{"[a-"}}, []string{srcDir}); err == nil {
+		t.Errorf("expected an error for a malformed pattern")
+	}
+}
+
+// TestVerboseFlag checks that -v and -vv accumulate into a single level.
+func TestVerboseFlag(t *testing.T) {
+	testCases := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"Not set", []string{}, 0},
+		{"Single -v", []string{"-v"}, 1},
+		{"Repeated -v", []string{"-v", "-v"}, 2},
+		{"Short -vv", []string{"-vv"}, 2},
+		{"Mixed -vv -v", []string{"-vv", "-v"}, 3},
+		{"Explicit false resets", []string{"-vv", "-v=false"}, 0},
+		{"Explicit level", []string{"-v=3"}, 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var level int
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.Var(verboseFlag{&level, 1}, "v", "")
+			fs.Var(verboseFlag{&level, 2}, "vv", "")
+
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			if level != tc.want {
+				t.Errorf("expected level %d, got %d", tc.want, level)
+			}
+		})
+	}
+}
+
+// TestConfig checks loading a config file and layering command-line flags on top.
+func TestConfig(t *testing.T) {
+	testCases := []struct {
+		name            string
+		content         string // config file content; empty means no file
+		explicit        bool   // pass the path explicitly instead of relying on the default
+		args            []string
+		wantErr         bool
+		wantErrContains string
+		wantUsage       bool // the error is a usage error, exiting 2
+		wantForce       bool
+		wantVerbose     int
+		wantDryRun      bool
+		wantExclude     []string
+	}{
+		{
+			name:        "Config sets defaults",
+			content:     `{"cp": {"f": true, "v": 2}}`,
+			explicit:    true,
+			wantForce:   true,
+			wantVerbose: 2,
+		},
+		{
+			name:        "Command line overrides config",
+			content:     `{"cp": {"f": true, "dry-run": true}}`,
+			explicit:    true,
+			args:        []string{"-f=false"},
+			wantForce:   false,
+			wantDryRun:  true,
+			wantVerbose: 0,
+		},
+		{
+			name:        "Command line counting flag replaces config",
+			content:     `{"cp": {"v": 2}}`,
+			explicit:    true,
+			args:        []string{"-v"},
+			wantVerbose: 1,
+		},
+		{
+			name:        "Alias on the command line replaces config",
+			content:     `{"cp": {"v": 1, "force": true}}`,
+			explicit:    true,
+			args:        []string{"-vv", "-f=false"},
+			wantVerbose: 2,
+		},
+		{
+			name:        "Command line repeatable flag replaces config",
+			content:     `{"cp": {"exclude": ["*.tmp", "*.log"]}}`,
+			explicit:    true,
+			args:        []string{"-exclude", "*.bak"},
+			wantExclude: []string{"*.bak"},
+		},
+		{
+			name:        "Repeatable flag from config",
+			content:     `{"cp": {"exclude": ["*.tmp", "*.log"]}}`,
+			explicit:    true,
+			wantExclude: []string{"*.tmp", "*.log"},
+		},
+		{
+			name:        "Global section applies where the flag exists",
+			content:     `{"global": {"archive": "backups", "v": 1}, "cp": {"f": true}}`,
+			explicit:    true,
+			wantForce:   true,
+			wantVerbose: 1,
+		},
+		{
+			name:        "Command section overrides the global one",
+			content:     `{"global": {"v": 1}, "cp": {"v": 2}}`,
+			explicit:    true,
+			wantVerbose: 2,
+		},
+		{
+			name:     "Other commands' sections are left alone",
+			content:  `{"ls": {"r": true, "newer": "2024-01-01T00:00:00Z"}, "restore": {"f": true}}`,
+			explicit: true,
+		},
+		{
+			name:            "Unknown flag in the command's section",
+			content:         `{"cp": {"archive": "backups"}}`,
+			explicit:        true,
+			wantErr:         true,
+			wantErrContains: "'cp' has no flag 'archive'",
+			wantUsage:       true,
+		},
+		{
+			name:            "Unknown section",
+			content:         `{"copy": {"f": true}}`,
+			explicit:        true,
+			wantErr:         true,
+			wantErrContains: "unknown section 'copy'",
+			wantUsage:       true,
+		},
+		{
+			name:        "Missing default config is ignored",
+			explicit:    false,
+			args:        []string{"-v"},
+			wantVerbose: 1,
+		},
+		{
+			name:            "Missing explicit config is an error",
+			explicit:        true,
+			wantErr:         true,
+			wantErrContains: "cannot read config",
+		},
+		{
+			name:            "Malformed config",
+			content:         `{"cp": {"f": }}`,
+			explicit:        true,
+			wantErr:         true,
+			wantErrContains: "invalid config",
+			wantUsage:       true,
+		},
+		{
+			name:            "Bad value for a known flag",
+			content:         `{"cp": {"f": "maybe"}}`,
+			explicit:        true,
+			wantErr:         true,
+			wantErrContains: "custom.json': invalid value for 'f'",
+			wantUsage:       true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+
+			path := filepath.Join(home, "custom.json")
+			if tc.content != "" {
+				if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+					t.Fatalf("Failed to write config: %v", err)
+				}
+			}
+			if !tc.explicit {
+				path = ""
+			}
+
+			var verbose int
+			var exclude []string
+			fs := flag.NewFlagSet("cp", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			force := fs.Bool("f", false, "")
+			fs.BoolVar(force, "force", false, "")
+			dryRun := fs.Bool("dry-run", false, "")
+			fs.Var(verboseFlag{&verbose, 1}, "v", "")
+			fs.Var(verboseFlag{&verbose, 2}, "vv", "")
+			fs.Var((*stringList)(&exclude), "exclude", "")
+
+			cfg, err := loadConfig(path)
+			if err == nil {
+				err = parseFlags(fs, cfg, tc.args)
+			}
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, but got nil")
+				} else if !strings.Contains(err.Error(), tc.wantErrContains) {
+					t.Errorf("expected error to contain %q, got %q", tc.wantErrContains, err.Error())
+				}
+				if got := exitCode(err) == exitUsage; got != tc.wantUsage {
+					t.Errorf("usage error: got %v, want %v (%v)", got, tc.wantUsage, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("did not expect an error, but got: %v", err)
+			}
+
+			if *force != tc.wantForce {
+				t.Errorf("force: got %v, want %v", *force, tc.wantForce)
+			}
+			if *dryRun != tc.wantDryRun {
+				t.Errorf("dry-run: got %v, want %v", *dryRun, tc.wantDryRun)
+			}
+			if verbose != tc.wantVerbose {
+				t.Errorf("verbose: got %d, want %d", verbose, tc.wantVerbose)
+			}
+			if !slices.Equal(exclude, tc.wantExclude) {
+				t.Errorf("exclude: got %v, want %v", exclude, tc.wantExclude)
+			}
+		})
+	}
+}
+
+// TestSubcommands checks that subcommands are found by name and parse their
+// own flags on top of the config defaults.
+func TestSubcommands(t *testing.T) {
+	for _, name := range []string{"ls", "cp", "restore"} {
+		if _, ok := findSubcommand(name); !ok {
+			t.Errorf("subcommand %q not found", name)
+		}
+	}
+	if _, ok := findSubcommand("-copy"); ok {
+		t.Errorf("unexpected subcommand for %q", "-copy")
+	}
+
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+
+	_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "new content"}})
+	destDir, _ := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "old content"}})
+
+	// The config forces the overwrite, the command line turns on verbose output.
+	sub, _ := findSubcommand("cp")
+	cfg := config{sections: map[string]configSection{"cp": {"f": []byte("true")}}}
+	args := []string{"-v", srcFiles[0], destDir}
+	if err := sub.run(context.Background(), stdio, newFlagSet(stdio, sub), cfg, args); err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(destDir, "file.txt"))
+	if err != nil || string(content) != "new content" {
+		t.Errorf("expected file to be overwritten, got %q (err: %v)", content, err)
+	}
+	if !strings.Contains(outBuf.String(), "->") {
+		t.Errorf("expected verbose output, got %q", outBuf.String())
+	}
+}
+
+// TestFilesFrom checks that cp copies the sources listed with -files-from
+// and -files-from0.
+func TestFilesFrom(t *testing.T) {
+	srcDir, srcFiles := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "a"},
+		{Filename: "b.txt", Content: "b"},
+		{Filename: "c.txt", Content: "c"},
+		{Filename: "new\nline.txt", Content: "d"},
+	})
+	list := "# sources\n" + srcFiles[1] + "\r\n\n" + srcFiles[2] + "\n"
+
+	testCases := []struct {
+		name    string
+		args    func(listFile string) []string
+		stdin   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "List file plus positional source",
+			args: func(listFile string) []string { return []string{"-files-from", listFile, srcFiles[0]} },
+			want: []string{"a.txt", "b.txt", "c.txt"},
+		},
+		{
+			name:  "List read from stdin",
+			args:  func(string) []string { return []string{"-files-from", "-"} },
+			stdin: list,
+			want:  []string{"b.txt", "c.txt"},
+		},
+		{
+			name:  "NUL separated list keeps newlines in names",
+			args:  func(string) []string { return []string{"-files-from0", "-"} },
+			stdin: "\x00" + srcFiles[0] + "\x00\x00" + srcFiles[3] + "\x00",
+			want:  []string{"a.txt", "new\nline.txt"},
+		},
+		{
+			name:    "Both list flags",
+			args:    func(l string) []string { return []string{"-files-from", l, "-files-from0", l} },
+			wantErr: true,
+		},
+		{
+			name:    "Missing list file",
+			args:    func(string) []string { return []string{"-files-from", filepath.Join(srcDir, "missing")} },
+			wantErr: true,
+		},
+		{
+			name:    "Interactive with list on stdin",
+			args:    func(string) []string { return []string{"-i", "-files-from", "-"} },
+			stdin:   list,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stdio := newIO(strings.NewReader(tc.stdin), io.Discard, io.Discard)
+
+			listFile := filepath.Join(t.TempDir(), "sources.txt")
+			if err := os.WriteFile(listFile, []byte(list), 0644); err != nil {
+				t.Fatal(err)
+			}
+			destDir, _ := testfs.SetupDir(t, []testfs.File{})
+
+			sub, _ := findSubcommand("cp")
+			err := sub.run(context.Background(), stdio, newFlagSet(stdio, sub), config{}, append(tc.args(listFile), destDir))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("did not expect an error, but got: %v", err)
+			}
+
+			entries, _ := os.ReadDir(destDir)
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("copied %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestCopyReportSkips checks the summary printed by cp -report-skips.
+func TestCopyReportSkips(t *testing.T) {
+	var errBuf bytes.Buffer
+	stdio := newIO(strings.NewReader("n\n"), io.Discard, &errBuf)
+
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: ".fmnignore", Content: "*.tmp\n"},
+		{Filename: "keep.txt", Content: "new"},
+		{Filename: "scratch.tmp", Content: "tmp"},
+	})
+	destDir, _ := testfs.SetupDir(t, []testfs.File{{Filename: "keep.txt", Content: "old"}})
+
+	sub, _ := findSubcommand("cp")
+	args := []string{"-r", "-i", "-report-skips", srcDir + string(filepath.Separator) + ".", destDir}
+	if err := sub.run(context.Background(), stdio, newFlagSet(stdio, sub), config{}, args); err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
+
+	report := errBuf.String()[strings.Index(errBuf.String(), "Skipped files:"):]
+	want := "Skipped files:\n" +
+		"  overwrite declined (1):\n    " + filepath.Join(destDir, "keep.txt") + "\n" +
+		"  matched .fmnignore (1):\n    " + filepath.Join(srcDir, "scratch.tmp") + "\n"
+	if report != want {
+		t.Errorf("got report:\n%s\nwant:\n%s", report, want)
+	}
+}
+
+// TestParseSize checks the byte counts accepted by -min-size and -max-size.
+func TestParseSize(t *testing.T) {
+	testCases := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"512", 512, false},
+		{"1k", 1024, false},
+		{"1.5K", 1536, false},
+		{"2MB", 2 << 20, false},
+		{"1G", 1 << 30, false},
+		{"", 0, true},
+		{"K", 0, true},
+		{"-1", 0, true},
+		{"12X", 0, true},
+		{"8E", 0, true},
+	}
+	for _, tc := range testCases {
+		got, err := parseSize(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d, error: %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+// TestReportError checks the text and JSON error formats.
+func TestReportError(t *testing.T) {
+	statErr := &os.PathError{Op: "stat", Path: "missing.txt", Err: os.ErrNotExist}
+
+	testCases := []struct {
+		name     string
+		err      error
+		format   string
+		code     int
+		wantText string
+		wantPath string
+		wantDest string
+	}{
+		{
+			name:     "Text format",
+			err:      &copyfs.FileError{Op: "stat source", Path: "missing.txt", Err: statErr},
+			format:   errorFormatText,
+			wantText: "fmn: cannot stat source 'missing.txt': stat missing.txt: file does not exist\n",
+		},
+		{
+			name:     "JSON with FileError",
+			err:      fmt.Errorf("wrapped: %w", &copyfs.FileError{Op: "stat source", Path: "a.txt", Err: statErr}),
+			format:   errorFormatJSON,
+			code:     1,
+			wantPath: "a.txt",
+		},
+		{
+			name:     "JSON with a failed copy",
+			err:      &copyfs.FileError{Op: "create", Path: "a.txt", Dest: "b.txt", Err: fs.ErrPermission},
+			format:   errorFormatJSON,
+			code:     4,
+			wantPath: "a.txt",
+			wantDest: "b.txt",
+		},
+		{
+			name:     "JSON with PathError",
+			err:      statErr,
+			format:   errorFormatJSON,
+			code:     1,
+			wantPath: "missing.txt",
+		},
+		{
+			name:   "JSON without a path",
+			err:    errors.New("unknown command 'x'"),
+			format: errorFormatJSON,
+			code:   2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var errBuf bytes.Buffer
+			reportError(newIO(nil, io.Discard, &errBuf), tc.err, tc.format, tc.code)
+
+			if tc.format == errorFormatText {
+				if errBuf.String() != tc.wantText {
+					t.Errorf("got %q, want %q", errBuf.String(), tc.wantText)
+				}
+				return
+			}
+
+			var got struct {
+				Error string `json:"error"`
+				Path  string `json:"path"`
+				Dest  string `json:"dest"`
+				Code  int    `json:"code"`
+			}
+			if err := json.Unmarshal(errBuf.Bytes(), &got); err != nil {
+				t.Fatalf("output is not JSON: %v\n%s", err, errBuf.String())
+			}
+			if got.Error != tc.err.Error() || got.Path != tc.wantPath || got.Dest != tc.wantDest || got.Code != tc.code {
+				t.Errorf("got %+v, want error %q, path %q, dest %q, code %d", got, tc.err.Error(), tc.wantPath, tc.wantDest, tc.code)
+			}
+		})
+	}
+}
+
+// TestStatFiles checks the text and JSON output of fmn stat.
+func TestStatFiles(t *testing.T) {
+	_, files := testfs.SetupDir(t, []testfs.File{
+		{Filename: "script.sh", Content: "#!/bin/sh\n", Mode: 0755},
+	})
+	path := files[0]
+	if err := os.Chmod(path, 0755); err != nil { // undo the umask
+		t.Fatalf("Failed to change permissions: %v", err)
+	}
+
+	t.Run("Text", func(t *testing.T) {
+		var outBuf bytes.Buffer
+		if err := statFiles(newIO(nil, &outBuf, io.Discard), []string{path}, false, ""); err != nil {
+			t.Fatalf("did not expect an error, but got: %v", err)
+		}
+		for _, want := range []string{"File: " + path, "Size: 10", "(0755/-rwxr-xr-x)", "Modify: "} {
+			if !strings.Contains(outBuf.String(), want) {
+				t.Errorf("expected output to contain %q. Got:\n%s", want, outBuf.String())
+			}
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		var outBuf bytes.Buffer
+		err := statFiles(newIO(nil, &outBuf, io.Discard), []string{path, "nonexistent"}, true, "")
+		if exitCode(err) != exitPartial {
+			t.Errorf("expected a partial failure, got %v", err)
+		}
+
+		var stats []fileStat
+		if err := json.Unmarshal(outBuf.Bytes(), &stats); err != nil {
+			t.Fatalf("output is not JSON: %v\n%s", err, outBuf.String())
+		}
+		if len(stats) != 1 {
+			t.Fatalf("expected 1 entry, got %d", len(stats))
+		}
+		st := stats[0]
+		if st.Name != path || st.Size != 10 || st.Octal != "0755" || st.Mode != "-rwxr-xr-x" {
+			t.Errorf("unexpected stat %+v", st)
+		}
+		if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+			if st.Inode == 0 || st.Links != 1 {
+				t.Errorf("expected inode and link count, got %+v", st)
+			}
+		}
+	})
+}
+
+// TestListFileError checks that a listing failure carries the operation,
+// path and reason, as copy failures do.
+func TestListFileError(t *testing.T) {
+	err := run(command{stdio: newIO(nil, io.Discard, io.Discard)}, []string{"nonexistent"})
+
+	var fileErr *copyfs.FileError
+	if !errors.As(err, &fileErr) {
+		t.Fatalf("expected a *FileError, got %T: %v", err, err)
+	}
+	if fileErr.Op != "stat" || fileErr.Path != "nonexistent" {
+		t.Errorf("got op %q path %q, want op %q path %q", fileErr.Op, fileErr.Path, "stat", "nonexistent")
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected error to wrap %v, got %v", fs.ErrNotExist, err)
+	}
+	if strings.Count(err.Error(), "nonexistent") != 1 {
+		t.Errorf("expected the path once in %q", err.Error())
+	}
+}
+
+// TestTimeFormat checks the presets and layouts accepted by -time-format.
+func TestTimeFormat(t *testing.T) {
+	ts := time.Date(2024, time.March, 5, 14, 7, 9, 0, time.FixedZone("", 3600))
+
+	testCases := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"Default", "", "2024-03-05 14:07:09 +0100"},
+		{"Default preset", "default", "2024-03-05 14:07:09 +0100"},
+		{"ISO", "iso", "2024-03-05T14:07:09+0100"},
+		{"Full ISO", "full-iso", "2024-03-05 14:07:09.000000000 +0100"},
+		{"RFC 3339", "rfc3339", "2024-03-05T14:07:09+01:00"},
+		{"Unix", "unix", "1709644029"},
+		{"Go layout", "02 Jan 06 15:04", "05 Mar 24 14:07"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			var tf timefmt.Layout
+			addTimeFormatFlag(fs, &tf)
+			if tc.value != "" {
+				if err := fs.Parse([]string{"-time-format", tc.value}); err != nil {
+					t.Fatalf("did not expect an error, but got: %v", err)
+				}
+			}
+
+			if got := tf.Format(ts); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// A layout with nothing to substitute is rejected, under either name
+	for _, name := range []string{"time-format", "time-style"} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		var tf timefmt.Layout
+		addTimeFormatFlag(fs, &tf)
+		if err := fs.Parse([]string{"-" + name, "YYYY-MM-DD"}); err == nil {
+			t.Errorf("-%s: expected an error for a layout without elements", name)
+		}
+	}
+}
+
+// TestTimeBound checks that -newer and -older accept RFC3339 times and
+// reference files, and nothing else.
+func TestTimeBound(t *testing.T) {
+	_, files := testfs.SetupDir(t, []testfs.File{{Filename: "ref.txt"}})
+	mtime := time.Date(2024, time.June, 2, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(files[0], mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	var bound timeBound
+	if err := bound.Set("2024-06-01T18:00:00Z"); err != nil {
+		t.Fatalf("RFC3339 time rejected: %v", err)
+	}
+	if want := time.Date(2024, time.June, 1, 18, 0, 0, 0, time.UTC); !time.Time(bound).Equal(want) {
+		t.Errorf("got %v, want %v", time.Time(bound), want)
+	}
+	if err := bound.Set(files[0]); err != nil {
+		t.Fatalf("reference file rejected: %v", err)
+	}
+	if !time.Time(bound).Equal(mtime) {
+		t.Errorf("got %v, want the reference file's %v", time.Time(bound), mtime)
+	}
+	if err := new(timeBound).Set("yesterday"); err == nil {
+		t.Error("expected an error for a time that is neither RFC3339 nor a file")
+	}
+}
+
+// TestFind checks the find predicates and output separators.
+func TestFind(t *testing.T) {
+	testCases := []struct {
+		name      string
+		opts      findOptions
+		wantPaths []string // relative to the test root, which is always excluded
+		wantSep   string
+	}{
+		{
+			name:      "Name glob",
+			opts:      findOptions{name: "*.go"},
+			wantPaths: []string{"main.go", "old.go", "sub/util.go"},
+		},
+		{
+			name:      "Directories only",
+			opts:      findOptions{fileType: "d", name: "sub*"},
+			wantPaths: []string{"sub"},
+		},
+		{
+			name:      "Files only",
+			opts:      findOptions{fileType: "f"},
+			wantPaths: []string{"README.md", "main.go", "old.go", "sub/util.go"},
+		},
+		{
+			name:      "Newer than",
+			opts:      findOptions{fileType: "f", newerThan: time.Hour},
+			wantPaths: []string{"README.md", "main.go", "sub/util.go"},
+		},
+		{
+			name:      "NUL separated",
+			opts:      findOptions{name: "*.md", null: true},
+			wantPaths: []string{"README.md"},
+			wantSep:   "\x00",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var outBuf bytes.Buffer
+
+			root, _ := testfs.SetupDir(t, []testfs.File{
+				{Filename: "main.go"},
+				{Filename: "old.go"},
+				{Filename: "README.md"},
+				{Path: "sub", Filename: "util.go"},
+			})
+			old := time.Now().Add(-48 * time.Hour)
+			if err := os.Chtimes(filepath.Join(root, "old.go"), old, old); err != nil {
+				t.Fatalf("Failed to set times: %v", err)
+			}
+
+			if err := findFiles(newIO(nil, &outBuf, io.Discard), []string{root}, tc.opts); err != nil {
+				t.Fatalf("did not expect an error, but got: %v", err)
+			}
+
+			sep := tc.wantSep
+			if sep == "" {
+				sep = "\n"
+			}
+			var want string
+			for _, p := range tc.wantPaths {
+				want += filepath.Join(root, p) + sep
+			}
+			if outBuf.String() != want {
+				t.Errorf("got %q, want %q", outBuf.String(), want)
+			}
+		})
+	}
+}
+
+// TestSum checks checksum output and manifest verification.
+func TestSum(t *testing.T) {
+	const helloSHA256 = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+
+	dir, files := testfs.SetupDir(t, []testfs.File{
+		{Filename: "hello.txt", Content: "hello\n"},
+		{Path: "sub", Filename: "other.txt", Content: "other"},
+	})
+
+	t.Run("Single file", func(t *testing.T) {
+		var outBuf bytes.Buffer
+		if err := sumFiles(newIO(nil, &outBuf, io.Discard), files[:1], "sha256", false); err != nil {
+			t.Fatalf("did not expect an error, but got: %v", err)
+		}
+		if want := helloSHA256 + "  " + files[0] + "\n"; outBuf.String() != want {
+			t.Errorf("got %q, want %q", outBuf.String(), want)
+		}
+	})
+
+	t.Run("Directory requires -r", func(t *testing.T) {
+		err := sumFiles(newIO(nil, io.Discard, io.Discard), []string{dir}, "sha256", false)
+		if !errors.Is(err, copyfs.ErrOmitDirectory) {
+			t.Errorf("expected errOmitDirectory, got %v", err)
+		}
+	})
+
+	t.Run("Recursive", func(t *testing.T) {
+		var outBuf bytes.Buffer
+		if err := sumFiles(newIO(nil, &outBuf, io.Discard), []string{dir}, "md5", true); err != nil {
+			t.Fatalf("did not expect an error, but got: %v", err)
+		}
+		if lines := strings.Count(outBuf.String(), "\n"); lines != 2 {
+			t.Errorf("expected 2 lines, got %d:\n%s", lines, outBuf.String())
+		}
+	})
+
+	t.Run("Unknown algorithm", func(t *testing.T) {
+		err := sumFiles(newIO(nil, io.Discard, io.Discard), files, "crc64", false)
+		if exitCode(err) != exitUsage {
+			t.Errorf("expected a usage error, got %v", err)
+		}
+	})
+
+	t.Run("Check manifest", func(t *testing.T) {
+		var outBuf bytes.Buffer
+		manifest := strings.Join([]string{
+			helloSHA256 + "  " + files[0],
+			helloSHA256 + " *" + files[1],
+			helloSHA256 + "  " + filepath.Join(dir, "missing.txt"),
+		}, "\n")
+		stdio := newIO(strings.NewReader(manifest), &outBuf, io.Discard)
+
+		err := checkManifest(stdio, "-", "sha256")
+		if err == nil {
+			t.Fatalf("expected an error, but got nil")
+		}
+		for _, want := range []string{
+			files[0] + ": OK",
+			files[1] + ": FAILED",
+			"missing.txt: MISSING",
+		} {
+			if !strings.Contains(outBuf.String(), want) {
+				t.Errorf("expected output to contain %q. Got:\n%s", want, outBuf.String())
+			}
+		}
+		for _, want := range []string{"1 computed checksum(s) did NOT match", "1 listed file(s) are missing"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("expected error to contain %q, got %q", want, err.Error())
+			}
+		}
+	})
+}
+
+// TestDiffTrees checks how two trees are classified.
+func TestDiffTrees(t *testing.T) {
+	a, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "same.txt", Content: "same"},
+		{Filename: "size.txt", Content: "short"},
+		{Filename: "content.txt", Content: "aaaa"},
+		{Filename: "only-a.txt", Content: "a"},
+		{Path: "gone", Filename: "deep.txt", Content: "a"},
+		{Filename: "kind", Content: "file"},
+	})
+	b, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "same.txt", Content: "same"},
+		{Filename: "size.txt", Content: "much longer"},
+		{Filename: "content.txt", Content: "bbbb"},
+		{Filename: "only-b.txt", Content: "b"},
+		{Path: "kind", Filename: "nested.txt", Content: "dir"},
+	})
+
+	d, err := diffTrees(copyfs.OSFS{}, a, b)
+	if err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
+
+	want := treeDiff{
+		OnlyA:     []string{"gone", "only-a.txt"},
+		OnlyB:     []string{filepath.Join("kind", "nested.txt"), "only-b.txt"},
+		Differ:    []string{"content.txt", "kind", "size.txt"},
+		Identical: 1,
+	}
+	if fmt.Sprint(d) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", d, want)
+	}
+
+	// Identical trees produce no error from the subcommand
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+
+	if err := diffDirectories(stdio, a, a, true); err != nil {
+		t.Errorf("did not expect an error comparing a tree with itself, got: %v", err)
+	}
+	if !strings.Contains(outBuf.String(), `"identical": 6`) {
+		t.Errorf("unexpected JSON output:\n%s", outBuf.String())
+	}
+	if err := diffDirectories(stdio, a, b, false); !errors.Is(err, errTreesDiffer) {
+		t.Errorf("expected errTreesDiffer, got %v", err)
+	}
+}
+
+// TestExitCode checks how errors are classified into exit codes.
+func TestExitCode(t *testing.T) {
+	permErr := &os.PathError{Op: "open", Path: "secret", Err: os.ErrPermission}
+
+	testCases := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"Success", nil, exitOK},
+		{"General error", errors.New("boom"), exitError},
+		{"Usage error", copyfs.NewUsageError("copy requires at least one source path"), exitUsage},
+		{"Permission error", &copyfs.FileError{Op: "stat source", Path: "secret", Err: permErr}, exitPermission},
+		{"Partial success is a minor problem", &copyfs.PartialError{Err: errors.New("some directories could not be read")}, exitError},
+		{"Wrapped usage error", fmt.Errorf("cp: %w", copyfs.NewUsageError("bad")), exitUsage},
+		{"Partial success past a permission error", &copyfs.PartialError{Err: permErr}, exitPartial},
+		{"Entries skipped past a permission error", &copyfs.EntryErrors{Path: "dir", Count: 1, Err: permErr}, exitPartial},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exitCode(tc.err); got != tc.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestRunExitCodes checks the exit codes produced by real operations.
+func TestRunExitCodes(t *testing.T) {
+	testCases := []struct {
+		name  string
+		setup func(t *testing.T) []string
+		want  int
+	}{
+		{
+			name: "Copy without sources is a usage error",
+			setup: func(t *testing.T) []string {
+				return nil
+			},
+			want: exitUsage,
+		},
+		{
+			name: "Copy to an empty destination is a usage error",
+			setup: func(t *testing.T) []string {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "content"}})
+				return []string{srcFiles[0], ""}
+			},
+			want: exitUsage,
+		},
+		{
+			name: "Copy with one missing source is a partial success",
+			setup: func(t *testing.T) []string {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "content"}})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				return []string{srcFiles[0], "nonexistent.txt", destDir}
+			},
+			want: exitPartial,
+		},
+		{
+			name: "Copy with every source missing is a general error",
+			setup: func(t *testing.T) []string {
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				return []string{"nonexistent.txt", destDir}
+			},
+			want: exitError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := copyfs.Options{Stdout: io.Discard, Stderr: io.Discard}
+			if got := exitCode(copyPaths(opts, tc.setup(t))); got != tc.want {
+				t.Errorf("got exit code %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// newTestSFTPFS returns an sftpFS talking to an in-process SFTP server over
+// a pipe, so the remote backend can be tested without SSH.
+func newTestSFTPFS(t *testing.T) *sftpFS {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &sftpFS{client: client}
+	t.Cleanup(func() {
+		remote.Close()
+		server.Close()
+	})
+	return remote
+}
+
+// TestSFTPDestination copies through the SFTP backend and checks that the
+// overwrite rules still apply on the remote side.
+func TestSFTPDestination(t *testing.T) {
+	var outBuf bytes.Buffer
+
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "alpha", Mode: 0600},
+		{Path: "sub", Filename: "b.txt", Content: "beta"},
+	})
+	destDir := t.TempDir()
+	remote := newTestSFTPFS(t)
+
+	opts := copyfs.Options{Recursive: true, Verbose: copyfs.VerboseFiles, DestFS: remote, Stdout: &outBuf, Stderr: io.Discard}
+	if err := copyPaths(opts, []string{srcDir, destDir}); err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
+	for name, want := range map[string]string{"a.txt": "alpha", filepath.Join("sub", "b.txt"): "beta"} {
+		if content, err := os.ReadFile(filepath.Join(destDir, name)); err != nil || string(content) != want {
+			t.Errorf("%s: got %q (err: %v), want %q", name, content, err, want)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(destDir, "a.txt")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 to be preserved, got %v (err: %v)", info.Mode(), err)
+	}
+	if !strings.Contains(outBuf.String(), "a.txt' -> '") {
+		t.Errorf("expected verbose output, got %q", outBuf.String())
+	}
+
+	// A second copy without -f must refuse to overwrite the remote files
+	opts.Verbose = 0
+	err := copyPaths(opts, []string{srcDir, destDir})
+	if !errors.Is(err, copyfs.ErrExists) {
+		t.Errorf("expected %v, got %v", copyfs.ErrExists, err)
+	}
+}
+
+// memS3 is an in-memory object store implementing s3API.
+type memS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memS3) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &s3types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data))), LastModified: aws.Time(time.Now())}, nil
+}
+
+func (m *memS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (m *memS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[aws.ToString(in.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *memS3) DeleteObject(_ context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, aws.ToString(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *memS3) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix, delim := aws.ToString(in.Prefix), aws.ToString(in.Delimiter)
+
+	out := &s3.ListObjectsV2Output{}
+	seen := make(map[string]bool)
+	for _, key := range slices.Sorted(maps.Keys(m.objects)) {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delim); delim != "" && i >= 0 {
+			if p := prefix + rest[:i+1]; !seen[p] {
+				seen[p] = true
+				out.CommonPrefixes = append(out.CommonPrefixes, s3types.CommonPrefix{Prefix: aws.String(p)})
+			}
+			continue
+		}
+		out.Contents = append(out.Contents, s3types.Object{Key: aws.String(key), Size: aws.Int64(int64(len(m.objects[key])))})
+		if in.MaxKeys != nil && len(out.Contents) >= int(*in.MaxKeys) {
+			break
+		}
+	}
+	return out, nil
+}
+
+// TestS3Copy copies a tree into an in-memory bucket and back out again.
+func TestS3Copy(t *testing.T) {
+	srcDir, _ := testfs.SetupDir(t, []testfs.File{
+		{Filename: "a.txt", Content: "alpha"},
+		{Path: "sub", Filename: "b.txt", Content: "beta"},
+	})
+	store := &memS3{objects: map[string][]byte{}}
+	bucket := &s3FS{client: store, bucket: "bucket"}
+
+	// Upload; the trailing slash makes the new prefix a directory
+	upload := copyfs.Options{Recursive: true, DestFS: bucket}
+	if err := copyPaths(upload, []string{srcDir, "/backup/"}); err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
+	for key, want := range map[string]string{"backup/a.txt": "alpha", "backup/sub/b.txt": "beta"} {
+		if got := string(store.objects[key]); got != want {
+			t.Errorf("object %s = %q, want %q", key, got, want)
+		}
+	}
+
+	// Existing objects are not overwritten without -f
+	if err := copyPaths(upload, []string{srcDir, "/backup/"}); !errors.Is(err, copyfs.ErrExists) {
+		t.Errorf("expected %v, got %v", copyfs.ErrExists, err)
+	}
+
+	// Download
+	destDir := t.TempDir()
+	download := copyfs.Options{Recursive: true, FS: bucket, DestFS: copyfs.OSFS{}}
+	if err := copyPaths(download, []string{"/backup", destDir}); err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
+	for name, want := range map[string]string{"a.txt": "alpha", filepath.Join("sub", "b.txt"): "beta"} {
+		if content, err := os.ReadFile(filepath.Join(destDir, name)); err != nil || string(content) != want {
+			t.Errorf("%s: got %q (err: %v), want %q", name, content, err, want)
+		}
+	}
+}
+
+// TestOpenRemote checks how destinations are recognized as remote.
+func TestOpenRemote(t *testing.T) {
+	if _, ok := parseRemote("dir/file.txt"); ok {
+		t.Error("a plain path is not remote")
+	}
+
+	u, ok := parseRemote("ftp://host/path")
+	if !ok {
+		t.Fatal("expected ftp://host/path to be remote")
+	}
+	if _, err := openRemote(u); exitCode(err) != exitUsage {
+		t.Errorf("expected a usage error for an unsupported scheme, got %v", err)
+	}
+
+	u, _ = parseRemote("sftp://user@host")
+	if got := remotePath(u); got != "." {
+		t.Errorf("remotePath = %q, want %q", got, ".")
+	}
+}
+
+// overlapWriter fails the test if two writes are ever in progress at once.
+type overlapWriter struct {
+	t      *testing.T
+	active atomic.Int32
+	buf    bytes.Buffer
+}
+
+func (w *overlapWriter) Write(p []byte) (int, error) {
+	if w.active.Add(1) != 1 {
+		w.t.Errorf("concurrent write detected")
+	}
+	defer w.active.Add(-1)
+	time.Sleep(time.Microsecond) // widen the window for overlapping writes
+	return w.buf.Write(p)
+}
+
+// TestSyncWriter checks that concurrent writers produce whole lines.
+func TestSyncWriter(t *testing.T) {
+	target := &overlapWriter{t: t}
+	w := newSyncWriter(target)
+
+	if newSyncWriter(w) != w {
+		t.Errorf("expected an existing syncWriter to be reused")
+	}
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 10 {
+				fmt.Fprintf(w, "worker %d line %d\n", i, j)
+			}
+		}()
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSpace(target.buf.String()), "\n")
+	if len(lines) != 200 {
+		t.Fatalf("expected 200 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "worker ") {
+			t.Errorf("mangled line %q", line)
+		}
+	}
+}
+
+// errReadOnlyFS stands in for EROFS, which not every platform defines.
+var errReadOnlyFS = errors.New("read-only file system")
+
+// TestFaultInjection uses faultFS to exercise error paths that are hard to
+// provoke with real files.
+func TestFaultInjection(t *testing.T) {
+	testCases := []struct {
+		name               string
+		copy               bool
+		setup              func(t *testing.T) (fsys testfs.FaultFS, args []string)
+		wantErrContains    string
+		wantErrIs          error
+		wantErrLogContains string
+		wantCode           int
+	}{
+		{
+			name: "List unreadable directory",
+			setup: func(t *testing.T) (testfs.FaultFS, []string) {
+				dir, _ := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt"}})
+				fsys := testfs.FaultFS{FS: copyfs.OSFS{}, Fail: map[string]error{"readdir " + dir: fs.ErrPermission}}
+				return fsys, []string{dir}
+			},
+			wantErrContains:    "some directories could not be read",
+			wantErrLogContains: "permission denied",
+			wantCode:           exitError,
+		},
+		{
+			name: "List partly unreadable arguments",
+			setup: func(t *testing.T) (testfs.FaultFS, []string) {
+				dir1, _ := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt"}})
+				dir2, _ := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt"}})
+				fsys := testfs.FaultFS{FS: copyfs.OSFS{}, Fail: map[string]error{"readdir " + dir2: fs.ErrPermission}}
+				return fsys, []string{dir1, dir2}
+			},
+			wantErrContains: "some directories could not be read",
+			wantCode:        exitPartial,
+		},
+		{
+			name: "Copy source that cannot be opened",
+			copy: true,
+			setup: func(t *testing.T) (testfs.FaultFS, []string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "content"}})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				fsys := testfs.FaultFS{FS: copyfs.OSFS{}, Fail: map[string]error{"open " + srcFiles[0]: fs.ErrPermission}}
+				return fsys, []string{srcFiles[0], destDir}
+			},
+			wantErrIs: fs.ErrPermission,
+			wantCode:  exitPermission,
+		},
+		{
+			name: "Copy with a corrupt read",
+			copy: true,
+			setup: func(t *testing.T) (testfs.FaultFS, []string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "content"}})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				fsys := testfs.FaultFS{FS: copyfs.OSFS{}, CorruptRead: map[string]bool{srcFiles[0]: true}}
+				return fsys, []string{srcFiles[0], destDir}
+			},
+			wantErrIs: syscall.EIO,
+			wantCode:  exitError,
+		},
+		{
+			name: "Copy into a destination that cannot be created",
+			copy: true,
+			setup: func(t *testing.T) (testfs.FaultFS, []string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "content"}})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				target := filepath.Join(destDir, "file.txt")
+				fsys := testfs.FaultFS{FS: copyfs.OSFS{}, Fail: map[string]error{"create " + target: fs.ErrPermission}}
+				return fsys, []string{srcFiles[0], destDir}
+			},
+			wantErrIs: fs.ErrPermission,
+			wantCode:  exitPermission,
+		},
+		{
+			name: "Copy where the mode cannot be preserved",
+			copy: true,
+			setup: func(t *testing.T) (testfs.FaultFS, []string) {
+				_, srcFiles := testfs.SetupDir(t, []testfs.File{{Filename: "file.txt", Content: "content"}})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				target := filepath.Join(destDir, "file.txt")
+				fsys := testfs.FaultFS{FS: copyfs.OSFS{}, Fail: map[string]error{"chmod " + target: errReadOnlyFS}}
+				return fsys, []string{srcFiles[0], destDir}
+			},
+			wantErrIs: errReadOnlyFS,
+			wantCode:  exitError,
+		},
+		{
+			name: "Recursive copy with an unreadable subdirectory",
+			copy: true,
+			setup: func(t *testing.T) (testfs.FaultFS, []string) {
+				srcDir, _ := testfs.SetupDir(t, []testfs.File{
+					{Path: "src/sub", Filename: "file.txt", Content: "content"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				sub := filepath.Join(srcDir, "src", "sub")
+				fsys := testfs.FaultFS{FS: copyfs.OSFS{}, Fail: map[string]error{"readdir " + sub: fs.ErrPermission}}
+				return fsys, []string{filepath.Join(srcDir, "src"), destDir}
+			},
+			wantErrIs: fs.ErrPermission,
+			wantCode:  exitPartial,
+		},
+		{
+			name: "Recursive copy logs each unreadable entry and carries on",
+			copy: true,
+			setup: func(t *testing.T) (testfs.FaultFS, []string) {
+				srcDir, _ := testfs.SetupDir(t, []testfs.File{
+					{Path: "src/a", Filename: "file.txt", Content: "content"},
+					{Path: "src/b", Filename: "file.txt", Content: "content"},
+					{Path: "src", Filename: "secret.txt", Content: "content"},
+				})
+				destDir, _ := testfs.SetupDir(t, []testfs.File{})
+				fsys := testfs.FaultFS{FS: copyfs.OSFS{}, Fail: map[string]error{
+					"readdir " + filepath.Join(srcDir, "src", "a"):       fs.ErrPermission,
+					"open " + filepath.Join(srcDir, "src", "secret.txt"): fs.ErrPermission,
+				}}
+				return fsys, []string{filepath.Join(srcDir, "src"), destDir}
+			},
+			wantErrContains:    "2 entries under",
+			wantErrLogContains: "secret.txt",
+			wantErrIs:          fs.ErrPermission,
+			wantCode:           exitPartial,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var outBuf, errBuf bytes.Buffer
+			fsys, args := tc.setup(t)
+			var err error
+			if tc.copy {
+				opts := copyfs.Options{Recursive: true, FS: fsys, Stdout: &outBuf, Stderr: &errBuf}
+				err = copyPaths(opts, args)
+			} else {
+				err = run(command{fsys: fsys, stdio: newIO(nil, &outBuf, &errBuf)}, args)
+			}
+			if err == nil {
+				t.Fatalf("expected an error, but got nil")
+			}
+			if tc.wantErrContains != "" && !strings.Contains(err.Error(), tc.wantErrContains) {
+				t.Errorf("expected error to contain %q, got %q", tc.wantErrContains, err.Error())
+			}
+			if tc.wantErrIs != nil && !errors.Is(err, tc.wantErrIs) {
+				t.Errorf("expected error to wrap %v, got %v", tc.wantErrIs, err)
+			}
+			if tc.wantErrLogContains != "" && !strings.Contains(errBuf.String(), tc.wantErrLogContains) {
+				t.Errorf("expected error log to contain %q, got:\n%s", tc.wantErrLogContains, errBuf.String())
+			}
+			if got := exitCode(err); got != tc.wantCode {
+				t.Errorf("got exit code %d, want %d", got, tc.wantCode)
+			}
+		})
 	}
-	return dir, paths
 }
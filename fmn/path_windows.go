@@ -0,0 +1,28 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is the length at which Win32 APIs start rejecting paths that lack
+// the \\?\ prefix. Directories are limited to 12 characters less, leaving
+// room for an 8.3 file name.
+const maxPath = 260 - 12
+
+// longPath returns path in the \\?\ form Windows needs for paths longer than
+// MAX_PATH. Shorter paths, and paths that cannot be made absolute, are
+// returned unchanged.
+func longPath(path string) string {
+	if len(path) < maxPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:] // \\server\share\... becomes \\?\UNC\server\share\...
+	}
+	return `\\?\` + abs
+}
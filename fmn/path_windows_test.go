@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestLongPath checks that only paths beyond MAX_PATH get the \\?\ prefix.
+func TestLongPath(t *testing.T) {
+	deep := `C:\` + strings.Repeat(`nested\`, 40) + "file.txt"
+
+	testCases := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"Short path", `C:\data\file.txt`, `C:\data\file.txt`},
+		{"Deep path", deep, `\\?\` + deep},
+		{"Already prefixed", `\\?\` + deep, `\\?\` + deep},
+		{"UNC path", `\\server\share\` + deep[3:], `\\?\UNC\server\share\` + deep[3:]},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := longPath(tc.path); got != tc.want {
+				t.Errorf("longPath(%q) = %q, want %q", tc.path, got, tc.want)
+			}
+		})
+	}
+}
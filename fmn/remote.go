@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"yanmifeakeju/fmn/copyfs"
+)
+
+// remoteFS is a filesystem on another machine. It holds a connection, which
+// Close releases once the operation is done.
+type remoteFS interface {
+	copyfs.WriteFS
+	io.Closer
+}
+
+// parseRemote reports whether path is a URL naming a remote location, such as
+// sftp://user@host/path, rather than a local path.
+func parseRemote(path string) (*url.URL, bool) {
+	if !strings.Contains(path, "://") {
+		return nil, false
+	}
+	u, err := url.Parse(path)
+	if err != nil || u.Scheme == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+// openRemote connects to the filesystem named by u.
+func openRemote(u *url.URL) (remoteFS, error) {
+	switch u.Scheme {
+	case "sftp":
+		return dialSFTP(u)
+	case "s3":
+		return dialS3(u)
+	default:
+		return nil, copyfs.NewUsageError("unsupported location '%s' (use sftp:// or s3://)", u.Redacted())
+	}
+}
+
+// remoteSources returns the paths of sources on the filesystem of first,
+// which all of them must share.
+func remoteSources(first *url.URL, sources []string) ([]string, error) {
+	paths := make([]string, len(sources))
+	for i, src := range sources {
+		u, ok := parseRemote(src)
+		if !ok || u.Scheme != first.Scheme || u.Host != first.Host {
+			return nil, copyfs.NewUsageError("all sources must be on %s://%s", first.Scheme, first.Host)
+		}
+		paths[i] = remotePath(u)
+	}
+	return paths, nil
+}
+
+// remotePath returns the path u names on its filesystem.
+func remotePath(u *url.URL) string {
+	if u.Path == "" {
+		return "."
+	}
+	return u.Path
+}
+
+// openRemotes connects to the filesystems named by URLs among paths, the
+// sources followed by the destination, and points opts at them. It returns
+// the paths on those filesystems, and a function that disconnects once the
+// copy is done.
+func openRemotes(opts *copyfs.Options, paths []string) (_ []string, closeAll func(), err error) {
+	var remotes []remoteFS
+	closeAll = func() {
+		for _, remote := range remotes {
+			remote.Close()
+		}
+	}
+	defer func() {
+		if err != nil {
+			closeAll()
+		}
+	}()
+	last := len(paths) - 1
+	sources, dest := paths[:last:last], paths[last]
+
+	// Sources given as a URL such as s3://bucket/prefix are copied from there
+	if u, ok := parseRemote(sources[0]); ok {
+		remotePaths, err := remoteSources(u, sources)
+		if err != nil {
+			return nil, nil, err
+		}
+		remote, err := openRemote(u)
+		if err != nil {
+			return nil, nil, err
+		}
+		remotes = append(remotes, remote)
+		// The destination keeps its own filesystem
+		if opts.DestFS == nil {
+			opts.DestFS = opts.FS
+		}
+		if opts.DestFS == nil {
+			opts.DestFS = copyfs.OSFS{}
+		}
+		opts.FS, sources = remote, remotePaths
+	}
+
+	// A destination URL such as sftp://host/path copies to another machine
+	if u, ok := parseRemote(dest); ok {
+		remote, err := openRemote(u)
+		if err != nil {
+			return nil, nil, err
+		}
+		remotes = append(remotes, remote)
+		opts.DestFS, dest = remote, remotePath(u)
+	}
+	return append(sources, dest), closeAll, nil
+}
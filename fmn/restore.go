@@ -0,0 +1,1040 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"cmp"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"yanmifeakeju/fmn/copyfs"
+	"yanmifeakeju/fmn/internal/ctxio"
+	"yanmifeakeju/fmn/internal/humanize"
+	"yanmifeakeju/fmn/internal/prompt"
+	"yanmifeakeju/fmn/internal/status"
+	"yanmifeakeju/fmn/internal/timefmt"
+)
+
+// restoreOptions holds the settings for the restore subcommand.
+type restoreOptions struct {
+	list        bool               // only report what would be restored
+	printScript bool               // print the equivalent shell commands instead of restoring
+	force       bool               // overwrite existing files without asking
+	prompt      prompt.Options     // how to ask before overwriting
+	skips       *copyfs.SkipReport // records skipped files when -report-skips is set
+	timeFormat  timefmt.Layout     // how progress messages print timestamps
+	stats       *restoreStats      // counts what was restored; set by restore
+	jobs        int                // files restored at once (-j)
+	mode        os.FileMode        // permissions for files whose archive records none (-mode); 0 for 0644
+	verify      bool               // check restored data against .sha256 sidecar files
+	stdout      bool               // write the data to stdout instead of files
+	concat      bool               // let -stdout write more than one file
+	pattern     string             // only restore files whose name matches this glob
+	found       *[]string          // collects the files that would be restored, instead of restoring
+	onlyChanged bool               // leave files that already hold the archived data alone
+	newer       bool               // only replace files older than the archived ones
+	verbose     int                // at copyfs.VerboseFiles, also report the files -newer skips
+	keepGoing   bool               // restore the other files past ones that fail
+
+	// Cancels the restore, as Ctrl-C does; nil never cancels
+	ctx context.Context
+	// Streams the restore reads from and writes to; nil means stdIO
+	stdio *IO
+}
+
+// restoreStats counts what a restore did, for the summary printed at the end.
+// It is updated from any worker.
+type restoreStats struct {
+	mu       sync.Mutex
+	restored int   // files and symlinks written
+	skipped  int   // existing files left alone
+	bytes    int64 // bytes written
+}
+
+// add records a restored file of n bytes.
+func (s *restoreStats) add(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restored++
+	s.bytes += n
+}
+
+// skip records an existing file that was left alone.
+func (s *restoreStats) skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped++
+}
+
+// print writes the end-of-run summary, e.g.
+// "Summary: 3 restored (1.2 kB written), 1 skipped as existing".
+func (s *restoreStats) print(w io.Writer) {
+	fmt.Fprintf(w, "Summary: %d restored (%s written), %d skipped as existing\n", s.restored, humanize.Bytes(float64(s.bytes)), s.skipped)
+}
+
+// restore walks archiveDir and decompresses every .gz, .bz2, .xz and .zst
+// file it finds into the matching relative location under destDir, naming
+// each file after the original name stored in its gzip header, or the
+// archive's name without the extension. A .tar.gz, .tgz or .zip file is
+// unpacked there instead, each entry restored under its path in the archive.
+// With opts.list set it only reports what would be restored, and with
+// opts.printScript it prints the shell commands that would restore the
+// files; without opts.force it asks before overwriting existing files. With
+// opts.jobs above 1 that many files are restored at once.
+func restore(archiveDir, destDir string, opts restoreOptions) error {
+	if opts.stdio == nil {
+		opts.stdio = stdIO()
+	}
+	if d, err := os.Stat(archiveDir); err != nil || !d.IsDir() {
+		if err != nil {
+			return copyfs.NewFileError("open archive directory", archiveDir, err)
+		}
+		return &copyfs.FileError{Op: "open archive directory", Path: archiveDir, Err: copyfs.ErrNotDirectory}
+	}
+
+	if d, err := os.Stat(destDir); err != nil || !d.IsDir() {
+		if err != nil {
+			return copyfs.NewFileError("open destination directory", destDir, err)
+		}
+		return &copyfs.FileError{Op: "open destination directory", Path: destDir, Err: copyfs.ErrNotDirectory}
+	}
+
+	opts.stats = &restoreStats{}
+
+	// Collect the files first, so they can be shared out to workers
+	var paths []string
+	err := filepath.Walk(archiveDir, func(path string, info os.FileInfo, err error) error {
+		if err := opts.context().Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return copyfs.NewFileError("read", path, err)
+		}
+		if !info.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Files written to stdout one after another would be mixed together
+	// unless asked for, so count them first
+	if opts.stdout && !opts.concat {
+		var found []string
+		probe := opts
+		probe.found = &found
+		probe.skips = nil // recorded by the pass that writes
+		for _, path := range paths {
+			if err := restoreFile(path, archiveDir, destDir, probe, nil); err != nil {
+				return err
+			}
+		}
+		if len(found) > 1 {
+			return copyfs.NewUsageError("%d files match; use -concat to write them all to stdout", len(found))
+		}
+	}
+
+	// Listing, scripts and stdout keep their order, so they are never parallel
+	if opts.jobs <= 1 || opts.list || opts.printScript || opts.stdout {
+		scriptDirs := make(map[string]bool) // directories the script already creates
+		var failed []error
+		for _, path := range paths {
+			if err := opts.context().Err(); err != nil {
+				failed = append(failed, err)
+				break
+			}
+			err := restoreFile(path, archiveDir, destDir, opts, scriptDirs)
+			if err == nil {
+				continue
+			}
+			if !opts.keepGoing || errors.Is(err, context.Canceled) {
+				failed = []error{err}
+				break
+			}
+			opts.stdio.Log.Println(err)
+			opts.skips.Add(copyfs.SkipCorrupt, path)
+			failed = append(failed, err)
+		}
+		err = opts.failures(archiveDir, failed)
+	} else {
+		err = restoreParallel(paths, archiveDir, destDir, opts)
+	}
+
+	if !opts.list && !opts.printScript && !opts.stdout {
+		opts.stats.print(opts.stdio.Err)
+	}
+	return err
+}
+
+// restoreParallel restores the files in paths with up to opts.jobs workers.
+// A failure does not stop the other files; all failures are returned
+// together. Overwrite prompts are asked one at a time, and os.MkdirAll
+// tolerates workers creating the same directories at once.
+func restoreParallel(paths []string, archiveDir, destDir string, opts restoreOptions) error {
+	var mu sync.Mutex
+	var errs []error
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range min(opts.jobs, len(paths)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				if opts.context().Err() != nil {
+					continue // drain the queue without starting more files
+				}
+				if err := restoreFile(path, archiveDir, destDir, opts, nil); err != nil {
+					mu.Lock()
+					if opts.keepGoing {
+						opts.stdio.Log.Println(err)
+						opts.skips.Add(copyfs.SkipCorrupt, path)
+					}
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, path := range paths {
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+	if err := opts.context().Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return opts.failures(archiveDir, errs)
+}
+
+// restoreFile restores the archive at path, found under archiveDir, to the
+// matching location under destDir. scriptDirs records the directories a
+// -print-script run has already created. Under -verify a file whose data
+// does not match its archive's checksum sidecar is removed and reported.
+func restoreFile(path, archiveDir, destDir string, opts restoreOptions, scriptDirs map[string]bool) error {
+	// Tarballs and zip files hold a whole tree; other .gz files a single file
+	if isTarball(path) || strings.EqualFold(filepath.Ext(path), ".zip") {
+		relDir, err := filepath.Rel(archiveDir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if isTarball(path) {
+			return restoreTar(path, filepath.Join(destDir, relDir), opts)
+		}
+		return restoreZip(path, filepath.Join(destDir, relDir), opts)
+	}
+
+	// Other files are a single compressed file each, perhaps with a
+	// checksum next to them
+	if filepath.Ext(path) == sidecarExt {
+		return nil
+	}
+	dec, ok := decompressors[filepath.Ext(path)]
+	if !ok {
+		opts.skips.Add(copyfs.SkipNotArchive, path)
+		return nil
+	}
+
+	relDir, err := filepath.Rel(archiveDir, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	sf, err := os.Open(path)
+	if err != nil {
+		return copyfs.NewFileError("open", path, err)
+	}
+
+	defer sf.Close()
+
+	content, meta, err := dec.open(sf)
+	if err != nil {
+		return copyfs.NewFileError("read archive", path, err)
+	}
+
+	defer func() { content.Close() }()
+	name, modTime := meta.name, meta.modTime
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	// The stored name comes from the archive, so it must not climb out
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return &copyfs.FileError{Op: "restore", Path: path, Err: errUnsafePath}
+	}
+
+	// The mode recorded by archive wins, then -mode; without either new
+	// files get 0644 less the umask, and existing ones keep theirs
+	mode := cmp.Or(meta.mode, opts.mode)
+
+	// Deep trees can exceed MAX_PATH on Windows, so the file is written
+	// through its long form; messages still show the readable path.
+	dest := filepath.Join(destDir, relDir, name)
+	target := longPath(dest)
+
+	if !opts.selected(dest) {
+		return nil
+	}
+	if opts.found != nil {
+		*opts.found = append(*opts.found, dest)
+		return nil
+	}
+
+	// The list is the data output, so it goes to stdout; progress goes to stderr.
+	if opts.list {
+		fmt.Fprintf(opts.stdio.Out, "Would restore: %s -> %s\n", path, dest)
+		return nil
+	}
+
+	if opts.printScript {
+		if dir := filepath.Dir(dest); !scriptDirs[dir] {
+			fmt.Fprintf(opts.stdio.Out, "mkdir -p -- %s\n", copyfs.ShellQuote(dir))
+			scriptDirs[dir] = true
+		}
+		fmt.Fprintf(opts.stdio.Out, "%s -c -- %s > %s\n", dec.tool, copyfs.ShellQuote(path), copyfs.ShellQuote(dest))
+		if mode != 0 {
+			fmt.Fprintf(opts.stdio.Out, "chmod %o -- %s\n", mode, copyfs.ShellQuote(dest))
+		}
+		if !modTime.IsZero() {
+			fmt.Fprintf(opts.stdio.Out, "touch -t %s -- %s\n", modTime.Local().Format("200601021504.05"), copyfs.ShellQuote(dest))
+		}
+		return nil
+	}
+
+	var want string // checksum of the restored data, under -verify
+	if opts.verify {
+		if want, err = readSidecar(path); err != nil {
+			return err
+		}
+	}
+	if opts.stdout {
+		return restoreToStdout(opts, path, content, want)
+	}
+
+	// Comparing reads the data, so a file that differs is decompressed again
+	if opts.onlyChanged {
+		same, err := unchanged(copyfs.OSFS{}, target, -1, modTime, content)
+		if err != nil {
+			return copyfs.NewFileError("compare", dest, err)
+		}
+		if same {
+			fmt.Fprintf(opts.stdio.Err, "Unchanged: %s\n", dest)
+			opts.skips.Add(copyfs.SkipIdentical, dest)
+			opts.stats.skip()
+			return nil
+		}
+		content.Close()
+		if _, err := sf.Seek(0, io.SeekStart); err != nil {
+			return copyfs.NewFileError("read archive", path, err)
+		}
+		if content, _, err = dec.open(sf); err != nil {
+			return copyfs.NewFileError("read archive", path, err)
+		}
+	}
+
+	if opts.notNewer(target, dest, modTime) {
+		return nil
+	}
+
+	// The file is written through an os.Root for destDir, so a symlink
+	// already there cannot lead the write out of it
+	if err := os.MkdirAll(longPath(destDir), 0755); err != nil {
+		return copyfs.NewFileError("create directory", destDir, err)
+	}
+	root, err := os.OpenRoot(longPath(destDir))
+	if err != nil {
+		return copyfs.NewFileError("open", destDir, err)
+	}
+	defer root.Close()
+	rel := filepath.Join(relDir, filepath.FromSlash(name))
+
+	// Check if file exists and ask for confirmation; -newer has already
+	// decided to replace it
+	if !opts.force && !opts.newer {
+		if _, err := root.Stat(rel); err == nil {
+			if !askConfirmation(opts.stdio, fmt.Sprintf("File %s already exists. Overwrite? (y/N): ", dest), opts.prompt) {
+				fmt.Fprintf(opts.stdio.Err, "Skipped: %s\n", dest)
+				opts.skips.Add(copyfs.SkipDeclined, dest)
+				opts.stats.skip()
+				return nil
+			}
+		}
+	}
+
+	if err := mkdirAllIn(root, filepath.Dir(rel)); err != nil {
+		return copyfs.NewFileError("create directory", filepath.Dir(dest), err)
+	}
+
+	df, err := root.OpenFile(rel, os.O_CREATE|os.O_RDWR|os.O_TRUNC, cmp.Or(mode, 0644))
+	if err != nil {
+		return copyfs.NewFileError("create", dest, err)
+	}
+
+	defer df.Close()
+
+	// The data is hashed as it is written, so verifying needs no second read
+	var w io.Writer = df
+	var sum hash.Hash
+	if want != "" {
+		sum = sha256.New()
+		w = io.MultiWriter(df, sum)
+	}
+
+	status.Begin(path)
+	n, err := io.Copy(w, ctxio.NewReader(opts.context(), content))
+	if err != nil {
+		df.Close()
+		opts.discardCanceled(target, dest, err)
+		return copyfs.NewFileError("restore", path, err)
+	}
+	if sum != nil && hex.EncodeToString(sum.Sum(nil)) != want {
+		df.Close()
+		err := &copyfs.FileError{Op: "verify", Path: dest, Err: errSidecarMismatch}
+		if rmErr := root.Remove(rel); rmErr != nil {
+			return errors.Join(err, copyfs.NewFileError("remove corrupt file", dest, rmErr))
+		}
+		return err
+	}
+	status.Done(n)
+	opts.stats.add(n)
+
+	// Set the mode exactly, past the umask and on files that existed
+	if mode != 0 {
+		if err := df.Chmod(mode); err != nil {
+			return copyfs.NewFileError("set mode of", dest, err)
+		}
+	}
+
+	// Preserve timestamp from gzip header if available
+	if !modTime.IsZero() {
+		if err := os.Chtimes(target, modTime, modTime); err != nil {
+			// Don't fail if we can't set timestamp, just warn
+			fmt.Fprintf(opts.stdio.Err, "Warning: Could not preserve timestamp for %s: %v\n", dest, err)
+		}
+	}
+
+	if modTime.IsZero() {
+		fmt.Fprintf(opts.stdio.Err, "Restored: %s\n", dest)
+	} else {
+		fmt.Fprintf(opts.stdio.Err, "Restored: %s (modified %s)\n", dest, opts.timeFormat.Format(modTime))
+	}
+	return nil
+}
+
+// context returns the context the restore runs under.
+func (opts restoreOptions) context() context.Context {
+	if opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
+}
+
+// discardCanceled removes the partly restored file at target when err
+// is the restore being canceled, so an interrupted run leaves no half-written
+// files.
+func (opts restoreOptions) discardCanceled(target, dest string, err error) {
+	if !errors.Is(err, context.Canceled) {
+		return
+	}
+	if rmErr := os.Remove(target); rmErr != nil {
+		opts.stdio.Log.Println(copyfs.NewFileError("remove partial file", dest, rmErr))
+	}
+}
+
+// failures combines the errors of the files that could not be restored.
+// Under -continue each was logged as it happened, so they are summed up as
+// EntryErrors.
+func (opts restoreOptions) failures(archiveDir string, errs []error) error {
+	switch {
+	case len(errs) == 0:
+		return nil
+	case !opts.keepGoing && len(errs) == 1:
+		return errs[0]
+	case !opts.keepGoing:
+		return errors.Join(errs...)
+	}
+	return &copyfs.EntryErrors{Path: archiveDir, Count: len(errs), Err: errors.Join(errs...)}
+}
+
+// notNewer reports, for -newer, whether the file at target exists and is not
+// older than modTime, so restoring over it is skipped. An archive that records
+// no time is always restored.
+func (opts restoreOptions) notNewer(target, dest string, modTime time.Time) bool {
+	if !opts.newer || modTime.IsZero() {
+		return false
+	}
+	info, err := os.Lstat(target)
+	if err != nil || info.ModTime().Before(modTime) {
+		return false
+	}
+	if opts.verbose >= copyfs.VerboseFiles {
+		fmt.Fprintf(opts.stdio.Err, "Skipped: %s (not older than the archive)\n", dest)
+	}
+	opts.skips.Add(copyfs.SkipNotNewer, dest)
+	opts.stats.skip()
+	return true
+}
+
+// unchanged reports whether the file name in fsys already holds the data
+// read from content and, when the archive records them, its size and
+// modification time. Those are checked first, so most changed files are not
+// read at all. A nil content trusts them alone, for archive members whose
+// data can be read only once; then a time must be recorded.
+func unchanged(fsys copyfs.ReadFS, name string, size int64, modTime time.Time, content io.Reader) (bool, error) {
+	info, err := fsys.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() || !modTime.IsZero() && !info.ModTime().Equal(modTime) || size >= 0 && info.Size() != size {
+		return false, nil
+	}
+	if content == nil {
+		return !modTime.IsZero(), nil
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return sameData(content, f)
+}
+
+// selected reports whether the file restored to dest is picked by -pattern,
+// which is matched against its name.
+func (opts restoreOptions) selected(dest string) bool {
+	if opts.pattern == "" {
+		return true
+	}
+	ok, _ := filepath.Match(opts.pattern, filepath.Base(dest))
+	return ok
+}
+
+// restoreToStdout writes the decompressed content of the archive at path to
+// stdout, for restore -stdout. With want set, the data must have that
+// SHA-256 checksum; as it has already been written, a mismatch can only be
+// reported.
+func restoreToStdout(opts restoreOptions, path string, content io.Reader, want string) error {
+	var w io.Writer = opts.stdio.Out
+	sum := sha256.New()
+	if want != "" {
+		w = io.MultiWriter(w, sum)
+	}
+	status.Begin(path)
+	n, err := io.Copy(w, ctxio.NewReader(opts.context(), content))
+	if err != nil {
+		return copyfs.NewFileError("restore", path, err)
+	}
+	if want != "" && hex.EncodeToString(sum.Sum(nil)) != want {
+		return &copyfs.FileError{Op: "verify", Path: path, Err: errSidecarMismatch}
+	}
+	status.Done(n)
+	return nil
+}
+
+// sidecarExt is the extension of the file next to an archive that holds the
+// SHA-256 checksum of its decompressed data, for restore -verify.
+const sidecarExt = ".sha256"
+
+// readSidecar returns the checksum in the sidecar of the archive at path,
+// or "" if it has none. The sidecar holds the hex digest, alone or as the
+// first field of a line in the format of sha256sum.
+func readSidecar(path string) (string, error) {
+	data, err := os.ReadFile(path + sidecarExt)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", copyfs.NewFileError("read checksum", path+sidecarExt, err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || len(fields[0]) != hex.EncodedLen(sha256.Size) {
+		return "", &copyfs.FileError{Op: "read checksum", Path: path + sidecarExt, Err: errMalformedSidecar}
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// decompressor restores files compressed in one format.
+type decompressor struct {
+	tool string // command that decompresses with -c, for -print-script
+	// open starts decompressing r, until content is closed. meta holds the
+	// name, modification time and mode of the file as far as the format
+	// records them; the rest are zero.
+	open func(r io.Reader) (content io.ReadCloser, meta archiveEntry, err error)
+}
+
+// decompressors maps the extensions restore handles to their formats. Files
+// in formats that do not record their original name are restored under
+// the archive's name without the extension.
+var decompressors = map[string]decompressor{
+	".gz": {"gunzip", func(r io.Reader) (io.ReadCloser, archiveEntry, error) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, archiveEntry{}, err
+		}
+		mode, _ := extraMode(zr.Extra)
+		return zr, archiveEntry{name: zr.Name, modTime: zr.ModTime, mode: mode}, nil
+	}},
+	".bz2": {"bunzip2", func(r io.Reader) (io.ReadCloser, archiveEntry, error) {
+		return io.NopCloser(bzip2.NewReader(r)), archiveEntry{}, nil
+	}},
+	".xz": {"unxz", func(r io.Reader) (io.ReadCloser, archiveEntry, error) {
+		xr, err := xz.NewReader(r)
+		return io.NopCloser(xr), archiveEntry{}, err
+	}},
+	".zst": {"unzstd", func(r io.Reader) (io.ReadCloser, archiveEntry, error) {
+		// The decoder runs goroutines, which only Close stops
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, archiveEntry{}, err
+		}
+		return zr.IOReadCloser(), archiveEntry{}, nil
+	}},
+}
+
+// isTarball reports whether the file at path is a gzip-compressed tar
+// archive, judging by its name.
+func isTarball(path string) bool {
+	name := strings.ToLower(filepath.Base(path))
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// archiveEntry is one file, directory or symlink in a tar or zip archive.
+type archiveEntry struct {
+	name     string      // slash-separated path inside the archive
+	mode     fs.FileMode // type and permission bits
+	modTime  time.Time
+	size     int64                         // length of a regular file's data
+	linkname string                        // target of a symlink
+	open     func() (io.ReadCloser, error) // contents of a regular file
+}
+
+// restoreTar unpacks the .tar.gz archive at path into destDir. Entries other
+// than directories, regular files and symlinks are skipped.
+func restoreTar(path, destDir string, opts restoreOptions) error {
+	sf, err := os.Open(path)
+	if err != nil {
+		return copyfs.NewFileError("open", path, err)
+	}
+	defer sf.Close()
+
+	zr, err := gzip.NewReader(sf)
+	if err != nil {
+		return copyfs.NewFileError("read archive", path, err)
+	}
+	defer zr.Close()
+
+	if opts.printScript {
+		fmt.Fprintf(opts.stdio.Out, "mkdir -p -- %s\n", copyfs.ShellQuote(destDir))
+		fmt.Fprintf(opts.stdio.Out, "tar -xzf %s -C %s\n", copyfs.ShellQuote(path), copyfs.ShellQuote(destDir))
+		return nil
+	}
+
+	tr := tar.NewReader(zr)
+	next := func() (*archiveEntry, error) {
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				return nil, err
+			}
+			switch hdr.Typeflag {
+			case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+				return &archiveEntry{
+					name:     hdr.Name,
+					mode:     hdr.FileInfo().Mode(),
+					modTime:  hdr.ModTime,
+					size:     hdr.Size,
+					linkname: hdr.Linkname,
+					open:     func() (io.ReadCloser, error) { return io.NopCloser(tr), nil },
+				}, nil
+			}
+			opts.skips.Add(copyfs.SkipEntryType, path+":"+hdr.Name)
+		}
+	}
+	return extractEntries(path, destDir, opts, next)
+}
+
+// restoreZip unpacks the .zip archive at path into destDir.
+func restoreZip(path, destDir string, opts restoreOptions) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return copyfs.NewFileError("read archive", path, err)
+	}
+	defer zr.Close()
+
+	if opts.printScript {
+		fmt.Fprintf(opts.stdio.Out, "mkdir -p -- %s\n", copyfs.ShellQuote(destDir))
+		fmt.Fprintf(opts.stdio.Out, "unzip -o %s -d %s\n", copyfs.ShellQuote(path), copyfs.ShellQuote(destDir))
+		return nil
+	}
+
+	files := zr.File
+	next := func() (*archiveEntry, error) {
+		for len(files) > 0 {
+			f := files[0]
+			files = files[1:]
+			entry := &archiveEntry{name: f.Name, mode: f.Mode(), modTime: f.Modified, size: int64(f.UncompressedSize64), open: f.Open}
+			switch {
+			case entry.mode.IsDir(), entry.mode.IsRegular():
+				return entry, nil
+			case entry.mode&fs.ModeSymlink != 0:
+				// Zip stores a symlink's target as its contents
+				target, err := readZipLink(f)
+				if err != nil {
+					return nil, err
+				}
+				entry.linkname = target
+				return entry, nil
+			}
+			opts.skips.Add(copyfs.SkipEntryType, path+":"+f.Name)
+		}
+		return nil, io.EOF
+	}
+	return extractEntries(path, destDir, opts, next)
+}
+
+// readZipLink returns the target of the symlink stored as f.
+func readZipLink(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	target, err := io.ReadAll(rc)
+	return string(target), err
+}
+
+// extractEntries restores the entries next returns, until io.EOF, from the
+// archive at path into destDir, with their recorded modes and modification
+// times. Entries whose path, or symlinks whose target, would leave destDir
+// are refused, guarding against archives crafted to overwrite files
+// elsewhere. Everything is written through an os.Root for destDir, so not
+// even a chain of symlinks that each look harmless can lead a write out of
+// it. Directories get their permissions last, so read-only ones can still be
+// filled.
+func extractEntries(path, destDir string, opts restoreOptions, next func() (*archiveEntry, error)) error {
+	var root *os.Root
+	if opts.found == nil && !opts.list && !opts.stdout {
+		if err := os.MkdirAll(longPath(destDir), 0755); err != nil {
+			return copyfs.NewFileError("create directory", destDir, err)
+		}
+		var err error
+		if root, err = os.OpenRoot(longPath(destDir)); err != nil {
+			return copyfs.NewFileError("open", destDir, err)
+		}
+		defer root.Close()
+	}
+
+	var dirs []*archiveEntry // applied once everything inside is written
+	for {
+		entry, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return copyfs.NewFileError("read archive", path, err)
+		}
+
+		name := filepath.FromSlash(strings.TrimSuffix(entry.name, "/"))
+		if !filepath.IsLocal(name) {
+			return &copyfs.FileError{Op: "restore", Path: path + ":" + entry.name, Err: errUnsafePath}
+		}
+		// A link out of destDir would let later entries be written through it
+		if entry.mode&fs.ModeSymlink != 0 && !localLink(name, entry.linkname) {
+			return &copyfs.FileError{Op: "restore", Path: path + ":" + entry.name, Err: errUnsafePath}
+		}
+		dest := filepath.Join(destDir, name)
+		target := longPath(dest)
+
+		// A pattern picks files; their directories are created as needed
+		if opts.pattern != "" && (entry.mode.IsDir() || !opts.selected(dest)) {
+			continue
+		}
+		if opts.found != nil {
+			*opts.found = append(*opts.found, dest)
+			continue
+		}
+		if opts.list {
+			fmt.Fprintf(opts.stdio.Out, "Would restore: %s:%s -> %s\n", path, entry.name, dest)
+			continue
+		}
+		if opts.stdout {
+			if !entry.mode.IsRegular() {
+				continue
+			}
+			src, err := entry.open()
+			if err != nil {
+				return copyfs.NewFileError("read archive", path+":"+entry.name, err)
+			}
+			err = restoreToStdout(opts, path+":"+entry.name, src, "")
+			src.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.mode.IsDir() {
+			if err := mkdirAllIn(root, name); err != nil {
+				return copyfs.NewFileError("create directory", dest, err)
+			}
+			dirs = append(dirs, entry)
+			continue
+		}
+
+		// Members are read once, so unlike a bare compressed file they are
+		// judged by their recorded size and time
+		if opts.onlyChanged && entry.mode.IsRegular() {
+			same, err := unchanged(copyfs.IOFS{FS: root.FS()}, name, entry.size, entry.modTime, nil)
+			if err != nil {
+				return copyfs.NewFileError("compare", dest, err)
+			}
+			if same {
+				fmt.Fprintf(opts.stdio.Err, "Unchanged: %s\n", dest)
+				opts.skips.Add(copyfs.SkipIdentical, dest)
+				opts.stats.skip()
+				continue
+			}
+		}
+		if opts.notNewer(target, dest, entry.modTime) {
+			continue
+		}
+		if _, err := root.Lstat(name); err == nil && !opts.force && !opts.newer {
+			if !askConfirmation(opts.stdio, fmt.Sprintf("File %s already exists. Overwrite? (y/N): ", dest), opts.prompt) {
+				fmt.Fprintf(opts.stdio.Err, "Skipped: %s\n", dest)
+				opts.skips.Add(copyfs.SkipDeclined, dest)
+				opts.stats.skip()
+				continue
+			}
+		}
+		if err := mkdirAllIn(root, filepath.Dir(name)); err != nil {
+			return copyfs.NewFileError("create directory", filepath.Dir(dest), err)
+		}
+
+		// The link is created in the directory its parent really is, after
+		// the links already on disk are followed, and must point inside root
+		// from there
+		if entry.mode&fs.ModeSymlink != 0 {
+			parent, err := linkParentIn(root, destDir, name, entry.linkname)
+			if err != nil {
+				return &copyfs.FileError{Op: "restore", Path: path + ":" + entry.name, Err: err}
+			}
+			link := filepath.Join(parent, filepath.Base(name))
+			root.Remove(link)
+			if err := os.Symlink(entry.linkname, longPath(filepath.Join(destDir, link))); err != nil {
+				return copyfs.NewFileError("create symlink", dest, err)
+			}
+			fmt.Fprintf(opts.stdio.Err, "Restored: %s -> %s\n", dest, entry.linkname)
+			opts.stats.add(0)
+			continue
+		}
+
+		n, err := extractFile(opts, root, name, entry, path, dest)
+		if err != nil {
+			return err
+		}
+		opts.stats.add(n)
+		fmt.Fprintf(opts.stdio.Err, "Restored: %s (modified %s)\n", dest, opts.timeFormat.Format(entry.modTime))
+	}
+
+	// Deepest first, so setting a directory's time is not undone by
+	// restoring the permissions of one inside it
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entry := dirs[i]
+		name := filepath.FromSlash(strings.TrimSuffix(entry.name, "/"))
+		dest := filepath.Join(destDir, name)
+		target := longPath(dest)
+		// A later entry may have replaced the directory with a symlink
+		if info, err := root.Lstat(name); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := os.Chmod(target, entry.mode.Perm()); err != nil {
+			return copyfs.NewFileError("set mode of", dest, err)
+		}
+		if err := os.Chtimes(target, entry.modTime, entry.modTime); err != nil {
+			fmt.Fprintf(opts.stdio.Err, "Warning: Could not preserve timestamp for %s: %v\n", dest, err)
+		}
+	}
+	return nil
+}
+
+// extractFile writes the regular file entry of the archive at path to name
+// in root, shown as dest, with its recorded mode and modification time, and
+// returns the number of bytes written.
+func extractFile(opts restoreOptions, root *os.Root, name string, entry *archiveEntry, archive, dest string) (int64, error) {
+	src, err := entry.open()
+	if err != nil {
+		return 0, copyfs.NewFileError("read archive", archive+":"+entry.name, err)
+	}
+	defer src.Close()
+
+	target := longPath(dest)
+	mode := entry.mode.Perm()
+	df, err := root.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return 0, copyfs.NewFileError("create", dest, err)
+	}
+
+	status.Begin(archive + ":" + entry.name)
+	n, err := io.Copy(df, ctxio.NewReader(opts.context(), src))
+	if err != nil {
+		df.Close()
+		opts.discardCanceled(target, dest, err)
+		return 0, copyfs.NewFileError("restore", archive+":"+entry.name, err)
+	}
+	status.Done(n)
+	// An existing file keeps its old mode on open, so set it explicitly
+	if err := df.Chmod(mode); err != nil {
+		df.Close()
+		return 0, copyfs.NewFileError("set mode of", dest, err)
+	}
+	if err := df.Close(); err != nil {
+		return 0, copyfs.NewFileError("write", dest, err)
+	}
+	if err := os.Chtimes(target, entry.modTime, entry.modTime); err != nil {
+		fmt.Fprintf(opts.stdio.Err, "Warning: Could not preserve timestamp for %s: %v\n", dest, err)
+	}
+	return n, nil
+}
+
+// mkdirAllIn is os.MkdirAll for the directory name inside root: it fails
+// rather than follow a symlink out of root.
+func mkdirAllIn(root *os.Root, name string) error {
+	info, err := root.Stat(name)
+	switch {
+	case err == nil && info.IsDir():
+		return nil
+	case err == nil:
+		return &fs.PathError{Op: "mkdir", Path: name, Err: copyfs.ErrNotDirectory}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+	if err := mkdirAllIn(root, filepath.Dir(name)); err != nil {
+		return err
+	}
+	err = root.Mkdir(name, 0755)
+	if errors.Is(err, fs.ErrExist) {
+		// Another worker may have just created it, which os.MkdirAll allows too
+		if info, statErr := root.Stat(name); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// localLink reports whether a symlink at name, relative to the destination,
+// pointing at linkname stays inside the destination as far as the names
+// alone tell. Its target may only climb before it descends: a ".." after a
+// name would depend on what that name turns out to be on disk.
+func localLink(name, linkname string) bool {
+	if filepath.IsAbs(filepath.FromSlash(linkname)) || filepath.VolumeName(filepath.FromSlash(linkname)) != "" {
+		return false
+	}
+	descended := false
+	for _, elem := range strings.Split(filepath.ToSlash(linkname), "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if descended {
+				return false
+			}
+		default:
+			descended = true
+		}
+	}
+	return filepath.IsLocal(filepath.Join(filepath.Dir(name), filepath.FromSlash(linkname)))
+}
+
+// linkParentIn returns the directory inside root, the os.Root for destDir,
+// that the parent of the symlink name really is once the links on disk are
+// followed. It fails with errUnsafePath when the link's target, linkname,
+// resolves out of root from there.
+func linkParentIn(root *os.Root, destDir, name, linkname string) (string, error) {
+	parent, err := resolveIn(root, destDir, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(parent, filepath.FromSlash(linkname))
+	if !localLink(filepath.Join(parent, filepath.Base(name)), linkname) {
+		return "", errUnsafePath
+	}
+	// Whatever exists below the target must resolve inside root too
+	if _, err := root.Stat(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", errUnsafePath
+	}
+	return parent, nil
+}
+
+// maxLinks is how many symlinks resolveIn follows before giving up, as the
+// operating system does with ELOOP.
+const maxLinks = 40
+
+// resolveIn returns the path of name inside root, the os.Root for destDir,
+// with every symlink along it followed, so that the result names no link.
+// It fails with errUnsafePath if the path leads out of root.
+func resolveIn(root *os.Root, destDir, name string) (string, error) {
+	resolved := ""
+	pending := strings.Split(name, string(filepath.Separator))
+	for links := 0; len(pending) > 0; {
+		elem := pending[0]
+		pending = pending[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "" {
+				return "", errUnsafePath
+			}
+			if resolved = filepath.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, elem)
+		info, err := root.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxLinks {
+			return "", errUnsafePath
+		}
+		// Nothing in resolved is a link, so next is read where it really is
+		linkname, err := os.Readlink(longPath(filepath.Join(destDir, next)))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(linkname) || filepath.VolumeName(linkname) != "" {
+			return "", errUnsafePath
+		}
+		pending = append(strings.Split(linkname, string(filepath.Separator)), pending...)
+	}
+	if resolved == "" {
+		return ".", nil
+	}
+	return resolved, nil
+}
@@ -0,0 +1,1168 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"yanmifeakeju/fmn/copyfs"
+	"yanmifeakeju/fmn/internal/prompt"
+)
+
+// Test the restore function with real files
+func TestRestore(t *testing.T) {
+	// Setup the test directories
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+
+	// create test data
+	createTestGzFile(t, archiveDir, "test1.txt", "Hello World")
+
+	// create subdirectory instructure in the archive
+	subArchiveDir := filepath.Join(archiveDir, "subdir")
+	createTestGzFile(t, subArchiveDir, "test2.txt", "Hello Subdir")
+
+	t.Run("List mode", func(t *testing.T) {
+		err := restore(archiveDir, destDir, restoreOptions{list: true})
+		if err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+
+		// Verify files were NOT actually restored
+		if _, err := os.Stat(filepath.Join(destDir, "test1.txt")); err == nil {
+			t.Error("File should not exist in list mode")
+		}
+	})
+
+	t.Run("Actual Restore", func(t *testing.T) {
+		// force=true to skip prompts
+		if err := restore(archiveDir, destDir, restoreOptions{force: true}); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+
+		content1, err := os.ReadFile(filepath.Join(destDir, "test1.txt"))
+		if err != nil {
+			t.Fatalf("Failed to read restored file: %v", err)
+		}
+
+		if string(content1) != "Hello World" {
+			t.Errorf("Expected 'Hello World', got %q", string(content1))
+		}
+
+		content2, err := os.ReadFile(filepath.Join(destDir, "subdir", "test2.txt"))
+		if err != nil {
+			t.Fatalf("Failed to read restored file: %v", err)
+		}
+
+		if string(content2) != "Hello Subdir" {
+			t.Errorf("Expected 'Hello Subdir', got %q", string(content2))
+		}
+
+	})
+
+}
+
+// TestRestoreSummary checks the counts printed after a restore, with files
+// that already existed counted apart from those restored.
+func TestRestoreSummary(t *testing.T) {
+	var errBuf bytes.Buffer
+	stdio := newIO(strings.NewReader("n\n"), io.Discard, &errBuf)
+
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "a.txt", "Hello World")
+	createTestGzFile(t, archiveDir, "b.txt", "Hello")
+	createTestGzFile(t, archiveDir, "c.txt", "existing")
+	if err := os.WriteFile(filepath.Join(destDir, "c.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(archiveDir, destDir, restoreOptions{stdio: stdio}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	want := "Summary: 2 restored (16 B written), 1 skipped as existing\n"
+	if !strings.HasSuffix(errBuf.String(), want) {
+		t.Errorf("got %q, want it to end with %q", errBuf.String(), want)
+	}
+}
+
+// TestRestoreParallel checks that -j restores every file, prompting for
+// existing ones one at a time, and returns the failures of all workers.
+func TestRestoreParallel(t *testing.T) {
+	stdio := newIO(strings.NewReader("y\nn\n"), io.Discard, newSyncWriter(io.Discard))
+
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	want := make(map[string]string)
+	for i := range 20 {
+		name := filepath.Join(fmt.Sprintf("dir%d", i%3), fmt.Sprintf("file%d.txt", i))
+		want[name] = fmt.Sprintf("content %d", i)
+		createTestGzFile(t, filepath.Join(archiveDir, filepath.Dir(name)), filepath.Base(name), want[name])
+	}
+	for _, name := range []string{filepath.Join("dir0", "file0.txt"), filepath.Join("dir1", "file1.txt")} {
+		if err := os.MkdirAll(filepath.Join(destDir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(destDir, name), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := restoreOptions{jobs: 4, stdio: stdio}
+	if err := restore(archiveDir, destDir, opts); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	var kept int
+	for name, content := range want {
+		got, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if string(got) == "old" {
+			kept++
+		} else if string(got) != content {
+			t.Errorf("%s: got %q, want %q", name, got, content)
+		}
+	}
+	if kept != 1 {
+		t.Errorf("expected one declined overwrite, got %d", kept)
+	}
+
+	// Corrupt archives fail on their own while the rest are restored
+	for _, name := range []string{"bad1.txt.gz", "bad2.txt.gz"} {
+		if err := os.WriteFile(filepath.Join(archiveDir, name), []byte("not gzip"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := restore(archiveDir, setUpTestDir(t), restoreOptions{jobs: 4, force: true})
+	var fileErr *copyfs.FileError
+	if !errors.As(err, &fileErr) || strings.Count(err.Error(), "bad") != 2 {
+		t.Errorf("expected both corrupt archives to be reported, got %v", err)
+	}
+}
+
+// TestRestoreMode checks that permissions recorded by archive are restored,
+// and that -mode applies to files whose archive records none.
+func TestRestoreMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no Unix permissions")
+	}
+	sourceDir := setUpTestDir(t)
+	archiveDir := setUpTestDir(t)
+	if err := os.WriteFile(filepath.Join(sourceDir, "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(sourceDir, "run.sh"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive(newIO(nil, io.Discard, io.Discard), sourceDir, archiveDir, archiveOptions{level: gzip.DefaultCompression}); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	var xzBuf bytes.Buffer
+	xw, err := xz.NewWriter(&xzBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Close()
+	if err := os.WriteFile(filepath.Join(archiveDir, "tool.xz"), xzBuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := setUpTestDir(t)
+	if err := restore(archiveDir, destDir, restoreOptions{force: true, mode: 0700}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for name, want := range map[string]os.FileMode{"run.sh": 0750, "tool": 0700} {
+		info, err := os.Stat(filepath.Join(destDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s: mode %v, want %v", name, info.Mode().Perm(), want)
+		}
+	}
+}
+
+// TestRestoreVerify checks that -verify accepts data matching a .sha256
+// sidecar, and removes and reports a file that does not match.
+func TestRestoreVerify(t *testing.T) {
+	// The failing file sorts last, as restore stops at the first failure
+	archiveDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "good.txt", "Hello World")
+	createTestGzFile(t, archiveDir, "zbad.txt", "Hello World")
+	createTestGzFile(t, archiveDir, "unchecked.txt", "Hello World")
+	sum := sha256.Sum256([]byte("Hello World"))
+	sidecars := map[string]string{
+		"good.txt.gz.sha256": hex.EncodeToString(sum[:]) + "  good.txt\n",
+		"zbad.txt.gz.sha256": strings.Repeat("0", 64) + "\n",
+	}
+	for name, content := range sidecars {
+		if err := os.WriteFile(filepath.Join(archiveDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	destDir := setUpTestDir(t)
+	skips := &copyfs.SkipReport{}
+	err := restore(archiveDir, destDir, restoreOptions{force: true, verify: true, skips: skips})
+	if !errors.Is(err, errSidecarMismatch) {
+		t.Fatalf("expected errSidecarMismatch, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "zbad.txt")); !os.IsNotExist(err) {
+		t.Errorf("the file that failed verification was kept")
+	}
+	for _, name := range []string{"good.txt", "unchecked.txt"} {
+		if _, err := os.Stat(filepath.Join(destDir, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if len(skips.Paths(copyfs.SkipNotArchive)) > 0 {
+		t.Errorf("sidecars reported as skipped: %v", skips.Paths(copyfs.SkipNotArchive))
+	}
+}
+
+// TestRestoreSkipUnchanged checks that -skip-unchanged leaves files holding
+// the archived data alone and still rewrites those that differ.
+func TestRestoreSkipUnchanged(t *testing.T) {
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "same.txt", "Hello World")
+	createTestGzFile(t, archiveDir, "changed.txt", "Hello World")
+	createTestGzFile(t, archiveDir, "longer.txt", "Hello")
+	if err := restore(archiveDir, destDir, restoreOptions{force: true}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	// Same size and time, different bytes; and a file with extra data
+	changed := filepath.Join(destDir, "changed.txt")
+	info, err := os.Stat(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(changed, []byte("Hello Earth"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(changed, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	longer := filepath.Join(destDir, "longer.txt")
+	info, err = os.Stat(longer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(longer, []byte("Hello, again"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(longer, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	skips := &copyfs.SkipReport{}
+	if err := restore(archiveDir, destDir, restoreOptions{force: true, onlyChanged: true, skips: skips}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if got := skips.Paths(copyfs.SkipIdentical); len(got) != 1 || filepath.Base(got[0]) != "same.txt" {
+		t.Errorf("expected only same.txt skipped, got %v", got)
+	}
+	for name, want := range map[string]string{"changed.txt": "Hello World", "longer.txt": "Hello"} {
+		data, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: got %q, want %q", name, data, want)
+		}
+	}
+}
+
+// TestRestoreArchiveSkipUnchanged checks that -skip-unchanged leaves tar and
+// zip members alone when the file on disk has their size and time.
+func TestRestoreArchiveSkipUnchanged(t *testing.T) {
+	mtime := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+	for name, create := range map[string]func(t *testing.T, dir string){
+		"tar": func(t *testing.T, dir string) {
+			createTestTarGz(t, filepath.Join(dir, "bundle.tar.gz"), []*tar.Header{
+				{Typeflag: tar.TypeReg, Name: "same.txt", Mode: 0644, ModTime: mtime, Size: 5},
+				{Typeflag: tar.TypeReg, Name: "edited.txt", Mode: 0644, ModTime: mtime, Size: 5},
+			})
+		},
+		"zip": func(t *testing.T, dir string) {
+			createTestZip(t, filepath.Join(dir, "bundle.zip"), map[string]string{"same.txt": "hello", "edited.txt": "hello"}, mtime)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			archiveDir := setUpTestDir(t)
+			destDir := setUpTestDir(t)
+			create(t, archiveDir)
+			if err := restore(archiveDir, destDir, restoreOptions{force: true}); err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+			edited := filepath.Join(destDir, "edited.txt")
+			if err := os.WriteFile(edited, []byte("hello, edited"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(edited, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			var stderr bytes.Buffer
+			skips := &copyfs.SkipReport{}
+			opts := restoreOptions{force: true, onlyChanged: true, skips: skips, stdio: newIO(nil, io.Discard, &stderr)}
+			if err := restore(archiveDir, destDir, opts); err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+			if got := skips.Paths(copyfs.SkipIdentical); len(got) != 1 || filepath.Base(got[0]) != "same.txt" {
+				t.Errorf("expected only same.txt skipped, got %v", got)
+			}
+			if !strings.Contains(stderr.String(), "Unchanged: ") {
+				t.Errorf("expected the skip to be reported, got %q", stderr.String())
+			}
+			if data, err := os.ReadFile(edited); err != nil || string(data) != "hello" {
+				t.Errorf("edited.txt: got %q (err: %v), want %q", data, err, "hello")
+			}
+		})
+	}
+}
+
+// TestRestoreNewer checks that -newer restores missing files and replaces
+// older ones without asking, but leaves files that are not older alone.
+func TestRestoreNewer(t *testing.T) {
+	var errBuf bytes.Buffer
+	stdio := newIO(strings.NewReader(""), io.Discard, &errBuf)
+
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "missing.txt", "archived")
+	createTestGzFile(t, archiveDir, "older.txt", "archived")
+	createTestGzFile(t, archiveDir, "newer.txt", "archived")
+	for name, age := range map[string]time.Duration{"older.txt": -time.Hour, "newer.txt": time.Hour} {
+		path := filepath.Join(destDir, name)
+		if err := os.WriteFile(path, []byte("local"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	skips := &copyfs.SkipReport{}
+	if err := restore(archiveDir, destDir, restoreOptions{newer: true, verbose: copyfs.VerboseFiles, skips: skips, stdio: stdio}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for name, want := range map[string]string{"missing.txt": "archived", "older.txt": "archived", "newer.txt": "local"} {
+		data, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: got %q, want %q", name, data, want)
+		}
+	}
+	if got := skips.Paths(copyfs.SkipNotNewer); len(got) != 1 {
+		t.Errorf("expected one file skipped as not newer, got %v", got)
+	}
+	if !strings.Contains(errBuf.String(), "newer.txt (not older than the archive)") {
+		t.Errorf("-v did not report the skipped file:\n%s", errBuf.String())
+	}
+}
+
+// TestRestoreVerboseConfig checks that restore accepts the counting "v"
+// that a config file shared with cp and mv sets.
+func TestRestoreVerboseConfig(t *testing.T) {
+	var errBuf bytes.Buffer
+	stdio := newIO(strings.NewReader(""), io.Discard, &errBuf)
+
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "newer.txt", "archived")
+	path := filepath.Join(destDir, "newer.txt")
+	if err := os.WriteFile(path, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, _ := findSubcommand("restore")
+	cfg := config{sections: map[string]configSection{globalSection: {"v": []byte("2")}}}
+	args := []string{"-archive", archiveDir, "-dest", destDir, "-newer"}
+	if err := sub.run(context.Background(), stdio, newFlagSet(stdio, sub), cfg, args); err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
+	if !strings.Contains(errBuf.String(), "newer.txt (not older than the archive)") {
+		t.Errorf("config verbosity did not report the skipped file:\n%s", errBuf.String())
+	}
+}
+
+// TestRestoreContinue checks that -continue restores the readable files
+// past a corrupt one and reports the failure at the end.
+func TestRestoreContinue(t *testing.T) {
+	var errBuf bytes.Buffer
+	stdio := newIO(nil, io.Discard, &errBuf)
+
+	archiveDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "a.txt", "first")
+	createTestGzFile(t, archiveDir, "c.txt", "third")
+	if err := os.WriteFile(filepath.Join(archiveDir, "b.txt.gz"), []byte("not gzip data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := setUpTestDir(t)
+	if err := restore(archiveDir, destDir, restoreOptions{force: true, stdio: stdio}); err == nil {
+		t.Fatal("expected the corrupt file to stop the restore")
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "c.txt")); !os.IsNotExist(err) {
+		t.Errorf("files after the corrupt one restored without -continue")
+	}
+
+	skips := &copyfs.SkipReport{}
+	err := restore(archiveDir, destDir, restoreOptions{force: true, keepGoing: true, skips: skips, stdio: stdio})
+	var entryErr *copyfs.EntryErrors
+	if !errors.As(err, &entryErr) || entryErr.Count != 1 {
+		t.Fatalf("expected one failure reported, got %v", err)
+	}
+	for _, name := range []string{"a.txt", "c.txt"} {
+		if _, err := os.Stat(filepath.Join(destDir, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if !strings.Contains(errBuf.String(), "b.txt.gz") {
+		t.Errorf("the corrupt file was not logged:\n%s", errBuf.String())
+	}
+	if got := skips.Paths(copyfs.SkipCorrupt); len(got) != 1 {
+		t.Errorf("expected the corrupt file in the skip report, got %v", got)
+	}
+}
+
+// TestRestoreCancel checks that a canceled restore stops with
+// context.Canceled before restoring anything.
+func TestRestoreCancel(t *testing.T) {
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "a.txt", "first")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, jobs := range []int{1, 4} {
+		err := restore(archiveDir, destDir, restoreOptions{force: true, jobs: jobs, ctx: ctx})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("jobs=%d: expected context.Canceled, got %v", jobs, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a file was restored after the restore was canceled")
+	}
+}
+
+// TestRestoreUnsafeName checks that a .gz file whose stored name climbs out
+// of the destination is rejected instead of restored there.
+func TestRestoreUnsafeName(t *testing.T) {
+	archiveDir := setUpTestDir(t)
+	destDir := filepath.Join(setUpTestDir(t), "a", "b")
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(archiveDir, "evil.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	zw.Name = "../../etc/evil"
+	io.WriteString(zw, "evil")
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := restore(archiveDir, destDir, restoreOptions{force: true}); !errors.Is(err, errUnsafePath) {
+		t.Fatalf("expected errUnsafePath, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "..", "..", "etc", "evil")); !os.IsNotExist(err) {
+		t.Errorf("file written outside the destination")
+	}
+}
+
+// TestRestoreThroughSymlink checks that a .gz file whose stored name passes
+// through a symlink already in the destination is not written where the
+// link points, outside the destination.
+func TestRestoreThroughSymlink(t *testing.T) {
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	outside := setUpTestDir(t)
+	if err := os.Symlink(outside, filepath.Join(destDir, "l")); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	f, err := os.Create(filepath.Join(archiveDir, "evil.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	zw.Name = "l/evil"
+	io.WriteString(zw, "evil")
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := restore(archiveDir, destDir, restoreOptions{force: true}); err == nil {
+		t.Error("expected the write through the symlink to be refused")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+		t.Errorf("file written outside the destination")
+	}
+}
+
+// TestRestoreStdout checks that -stdout writes the matching file's data to
+// stdout without creating files, and needs -concat for several matches.
+func TestRestoreStdout(t *testing.T) {
+	var out bytes.Buffer
+	stdio := newIO(nil, &out, io.Discard)
+
+	archiveDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "a.txt", "first\n")
+	createTestGzFile(t, archiveDir, "b.txt", "second\n")
+	createTestGzFile(t, archiveDir, "c.log", "third\n")
+	destDir := setUpTestDir(t)
+
+	if err := restore(archiveDir, destDir, restoreOptions{stdout: true, pattern: "b.txt", stdio: stdio}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if out.String() != "second\n" {
+		t.Errorf("expected the data of b.txt, got %q", out.String())
+	}
+	if entries, _ := os.ReadDir(destDir); len(entries) > 0 {
+		t.Errorf("-stdout created %d files", len(entries))
+	}
+
+	out.Reset()
+	err := restore(archiveDir, destDir, restoreOptions{stdout: true, pattern: "*.txt", stdio: stdio})
+	var usage *copyfs.UsageError
+	if !errors.As(err, &usage) {
+		t.Fatalf("expected a usage error for several matches, got %v", err)
+	}
+	if out.Len() > 0 {
+		t.Errorf("data written despite the error: %q", out.String())
+	}
+
+	if err := restore(archiveDir, destDir, restoreOptions{stdout: true, concat: true, pattern: "*.txt", stdio: stdio}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if out.String() != "first\nsecond\n" {
+		t.Errorf("expected both files in order, got %q", out.String())
+	}
+}
+
+// TestRestoreReportSkips checks that declined and non-archive files are
+// recorded for -report-skips.
+func TestRestoreReportSkips(t *testing.T) {
+	var errBuf bytes.Buffer
+	stdio := newIO(strings.NewReader("n\n"), io.Discard, &errBuf)
+
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "test1.txt", "Hello World")
+	if err := os.WriteFile(filepath.Join(archiveDir, "notes.txt"), []byte("plain"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(destDir, "test1.txt"), []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	skips := &copyfs.SkipReport{}
+	if err := restore(archiveDir, destDir, restoreOptions{skips: skips, stdio: stdio}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	errBuf.Reset()
+	skips.Print(&errBuf)
+
+	want := "Skipped files:\n" +
+		"  not an archive (1):\n    " + filepath.Join(archiveDir, "notes.txt") + "\n" +
+		"  overwrite declined (1):\n    " + filepath.Join(destDir, "test1.txt") + "\n"
+	if errBuf.String() != want {
+		t.Errorf("got report:\n%s\nwant:\n%s", errBuf.String(), want)
+	}
+}
+
+// TestRestoreStdoutReportSkips checks that the pass counting the files for
+// -stdout does not report the skipped ones a second time.
+func TestRestoreStdoutReportSkips(t *testing.T) {
+	var outBuf, errBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, &errBuf)
+
+	archiveDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "test1.txt", "Hello World")
+	if err := os.WriteFile(filepath.Join(archiveDir, "notes.txt"), []byte("plain"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, _ := findSubcommand("restore")
+	args := []string{"-archive", archiveDir, "-stdout", "-report-skips"}
+	if err := sub.run(context.Background(), stdio, newFlagSet(stdio, sub), config{}, args); err != nil {
+		t.Fatalf("did not expect an error, but got: %v", err)
+	}
+	if outBuf.String() != "Hello World" {
+		t.Errorf("got %q on stdout, want %q", outBuf.String(), "Hello World")
+	}
+	want := "Skipped files:\n" +
+		"  not an archive (1):\n    " + filepath.Join(archiveDir, "notes.txt") + "\n"
+	if errBuf.String() != want {
+		t.Errorf("got report:\n%s\nwant:\n%s", errBuf.String(), want)
+	}
+}
+
+// TestRestoreDecompressors checks that .bz2, .xz and .zst files are restored under
+// the archive name without the extension, as they store no original name.
+func TestRestoreDecompressors(t *testing.T) {
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+
+	// bzip2-compressed "Hello bzip2\n"; the standard library can only read bzip2
+	bz2 := []byte{
+		0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x55, 0xb7, 0xc1, 0x31, 0x00, 0x00,
+		0x01, 0xdd, 0x80, 0x00, 0x10, 0x40, 0x00, 0x10, 0x00, 0x00, 0x40, 0x12, 0x24, 0xc0, 0x10, 0x20,
+		0x00, 0x31, 0x00, 0xd3, 0x4d, 0x04, 0x00, 0x1e, 0xa3, 0xef, 0x44, 0xd1, 0xa2, 0x07, 0x8b, 0xb9,
+		0x22, 0x9c, 0x28, 0x48, 0x2a, 0xdb, 0xe0, 0x98, 0x80,
+	}
+	if err := os.WriteFile(filepath.Join(archiveDir, "a.txt.bz2"), bz2, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var xzBuf bytes.Buffer
+	xw, err := xz.NewWriter(&xzBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(xw, "Hello xz\n")
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(archiveDir, "b.log.xz"), xzBuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zst := zw.EncodeAll([]byte("Hello zstd\n"), nil)
+	if err := os.WriteFile(filepath.Join(archiveDir, "c.md.zst"), zst, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(archiveDir, destDir, restoreOptions{force: true}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for name, want := range map[string]string{"a.txt": "Hello bzip2\n", "b.log": "Hello xz\n", "c.md": "Hello zstd\n"} {
+		content, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil || string(content) != want {
+			t.Errorf("%s: got %q (err: %v), want %q", name, content, err, want)
+		}
+	}
+}
+
+// TestRestoreTar checks that a .tar.gz archive is unpacked with the paths,
+// modes and times of its entries, and that entries leaving the destination
+// are refused.
+func TestRestoreTar(t *testing.T) {
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	mtime := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+	createTestTarGz(t, filepath.Join(archiveDir, "sub", "bundle.tar.gz"), []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "docs/", Mode: 0700, ModTime: mtime},
+		{Typeflag: tar.TypeReg, Name: "docs/readme.txt", Mode: 0600, ModTime: mtime, Size: 5},
+		{Typeflag: tar.TypeSymlink, Name: "docs/link", Linkname: "readme.txt", ModTime: mtime},
+	})
+
+	if err := restore(archiveDir, destDir, restoreOptions{force: true}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	docs := filepath.Join(destDir, "sub", "docs")
+	content, err := os.ReadFile(filepath.Join(docs, "link"))
+	if err != nil || string(content) != "hello" {
+		t.Errorf("got %q (err: %v), want %q", content, err, "hello")
+	}
+	for path, want := range map[string]os.FileMode{docs: 0700, filepath.Join(docs, "readme.txt"): 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runtime.GOOS != "windows" && info.Mode().Perm() != want {
+			t.Errorf("%s: mode %v, want %v", path, info.Mode().Perm(), want)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: modified %v, want %v", path, info.ModTime(), mtime)
+		}
+	}
+
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "../escape.txt", Mode: 0644, Size: 5},
+		{Typeflag: tar.TypeSymlink, Name: "out", Linkname: "../.."},
+	} {
+		evilDir := setUpTestDir(t)
+		createTestTarGz(t, filepath.Join(evilDir, "evil.tgz"), []*tar.Header{hdr})
+		if err := restore(evilDir, destDir, restoreOptions{force: true}); !errors.Is(err, errUnsafePath) {
+			t.Errorf("%s: expected errUnsafePath, got %v", hdr.Name, err)
+		}
+	}
+}
+
+// TestRestoreTarSymlinkChain checks that a chain of symlinks, each of which
+// stays inside the destination on its own, cannot lead a later entry or
+// another link out of it.
+func TestRestoreTarSymlinkChain(t *testing.T) {
+	for _, chain := range symlinkChains {
+		t.Run(chain.name, func(t *testing.T) {
+			parent := setUpTestDir(t)
+			destDir := filepath.Join(parent, "dest")
+			if err := os.Mkdir(destDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			archiveDir := setUpTestDir(t)
+			var hdrs []*tar.Header
+			for _, link := range chain.links {
+				hdrs = append(hdrs, &tar.Header{Typeflag: tar.TypeSymlink, Name: link[0], Linkname: link[1]})
+			}
+			hdrs = append(hdrs, &tar.Header{Typeflag: tar.TypeReg, Name: chain.file, Mode: 0644, Size: 5})
+			createTestTarGz(t, filepath.Join(archiveDir, "evil.tgz"), hdrs)
+
+			checkSymlinkChain(t, restore(archiveDir, destDir, restoreOptions{force: true}), parent, chain.escape)
+		})
+	}
+}
+
+// symlinkChains are archives of symlinks that each look harmless by name,
+// followed by a file written through them. escape is where, relative to the
+// directory above the destination, the chain would lead.
+var symlinkChains = []struct {
+	name   string
+	links  [][2]string // name and target
+	file   string
+	escape string
+}{
+	{"Climb through a link", [][2]string{{"a", "."}, {"b", "a/.."}}, "b/escaped.txt", "escaped.txt"},
+	{"Link inside a link", [][2]string{{"s", "."}, {"s/l", "../outside"}}, "l/escaped.txt", "outside"},
+}
+
+// checkSymlinkChain checks the outcome of restoring one of symlinkChains
+// into the dest directory of parent: the restore fails as unsafe and
+// nothing at escape was reached.
+func checkSymlinkChain(t *testing.T, err error, parent, escape string) {
+	t.Helper()
+	if !errors.Is(err, errUnsafePath) {
+		t.Errorf("expected errUnsafePath, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(parent, escape)); err == nil {
+		t.Error("the archive wrote outside the destination")
+	}
+	entries, _ := os.ReadDir(filepath.Join(parent, "dest"))
+	for _, entry := range entries {
+		if target, err := os.Readlink(filepath.Join(parent, "dest", entry.Name())); err == nil && strings.HasPrefix(target, "..") {
+			t.Errorf("the archive left %s pointing out of the destination at %s", entry.Name(), target)
+		}
+	}
+}
+
+// TestRestoreZip checks that .zip archives are unpacked keeping their
+// directory structure and times, and that zip-slip entries are refused.
+func TestRestoreZip(t *testing.T) {
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	mtime := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+	createTestZip(t, filepath.Join(archiveDir, "bundle.zip"), map[string]string{
+		"top.txt":        "top",
+		"nested/a/b.txt": "deep",
+	}, mtime)
+
+	t.Run("List mode", func(t *testing.T) {
+		if err := restore(archiveDir, destDir, restoreOptions{list: true}); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(destDir, "top.txt")); err == nil {
+			t.Error("File should not exist in list mode")
+		}
+	})
+
+	t.Run("Actual Restore", func(t *testing.T) {
+		if err := restore(archiveDir, destDir, restoreOptions{force: true}); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		for rel, want := range map[string]string{"top.txt": "top", "nested/a/b.txt": "deep"} {
+			path := filepath.Join(destDir, filepath.FromSlash(rel))
+			content, err := os.ReadFile(path)
+			if err != nil || string(content) != want {
+				t.Errorf("%s: got %q (err: %v), want %q", rel, content, err, want)
+			}
+			if info, err := os.Stat(path); err == nil && !info.ModTime().Equal(mtime) {
+				t.Errorf("%s: modified %v, want %v", rel, info.ModTime(), mtime)
+			}
+		}
+	})
+
+	t.Run("Zip slip", func(t *testing.T) {
+		for _, name := range []string{"../escape.txt", "/abs.txt", "a/../../escape.txt"} {
+			evilDir := setUpTestDir(t)
+			createTestZip(t, filepath.Join(evilDir, "evil.zip"), map[string]string{name: "x"}, mtime)
+			if err := restore(evilDir, destDir, restoreOptions{force: true}); !errors.Is(err, errUnsafePath) {
+				t.Errorf("%s: expected errUnsafePath, got %v", name, err)
+			}
+		}
+	})
+}
+
+// TestRestoreZipSymlinkChain checks that a zip cannot write outside the
+// destination through a chain of symlinks either.
+func TestRestoreZipSymlinkChain(t *testing.T) {
+	for _, chain := range symlinkChains {
+		t.Run(chain.name, func(t *testing.T) {
+			parent := setUpTestDir(t)
+			destDir := filepath.Join(parent, "dest")
+			if err := os.Mkdir(destDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			archiveDir := setUpTestDir(t)
+			file, err := os.Create(filepath.Join(archiveDir, "evil.zip"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			zw := zip.NewWriter(file)
+			entries := slices.Concat(chain.links, [][2]string{{chain.file, "x"}})
+			for i, entry := range entries {
+				hdr := &zip.FileHeader{Name: entry[0], Method: zip.Store}
+				hdr.SetMode(fs.ModeSymlink | 0777)
+				if i == len(entries)-1 {
+					hdr.SetMode(0644)
+				}
+				w, err := zw.CreateHeader(hdr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.WriteString(w, entry[1])
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+
+			checkSymlinkChain(t, restore(archiveDir, destDir, restoreOptions{force: true}), parent, chain.escape)
+		})
+	}
+}
+
+// createTestZip writes a .zip file at path holding files, keyed by their
+// path in the archive, all modified at mtime.
+func createTestZip(t *testing.T, path string, files map[string]string, mtime time.Time) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+	for name, content := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: mtime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTestTarGz writes a .tar.gz file at path holding the entries in
+// headers. Regular files hold the first Size bytes of "hello".
+func createTestTarGz(t *testing.T, path string, headers []*tar.Header) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	zw := gzip.NewWriter(file)
+	tw := tar.NewWriter(zw)
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := io.WriteString(tw, "hello"[:hdr.Size]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRestorePrintScript runs the script printed by restore -print-script.
+func TestRestorePrintScript(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to run the script")
+	}
+
+	var outBuf bytes.Buffer
+	stdio := newIO(nil, &outBuf, io.Discard)
+
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "it's a file.txt", "Hello World")
+
+	if err := restore(archiveDir, destDir, restoreOptions{printScript: true, stdio: stdio}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if entries, _ := os.ReadDir(destDir); len(entries) > 0 {
+		t.Fatalf("expected nothing to be restored, found %d entries", len(entries))
+	}
+
+	if out, err := exec.Command(sh, "-c", outBuf.String()).CombinedOutput(); err != nil {
+		t.Fatalf("script failed: %v\n%s\nscript:\n%s", err, out, outBuf.String())
+	}
+	content, err := os.ReadFile(filepath.Join(destDir, "it's a file.txt"))
+	if err != nil || string(content) != "Hello World" {
+		t.Errorf("got %q (err: %v), want %q", content, err, "Hello World")
+	}
+}
+
+// TestRestoreOutputStreams checks that only list output goes to stdout while
+// progress messages go to stderr, so stdout stays clean for pipelines.
+func TestRestoreOutputStreams(t *testing.T) {
+	archiveDir := setUpTestDir(t)
+	destDir := setUpTestDir(t)
+	createTestGzFile(t, archiveDir, "test1.txt", "Hello World")
+
+	testCases := []struct {
+		name    string
+		list    bool
+		wantOut string
+		wantErr string
+	}{
+		{"List mode", true, "Would restore:", ""},
+		{"Restore mode", false, "", "Restored:"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var outBuf, errBuf bytes.Buffer
+			stdio := newIO(nil, &outBuf, &errBuf)
+
+			if err := restore(archiveDir, destDir, restoreOptions{list: tc.list, force: true, stdio: stdio}); err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+
+			if !strings.Contains(outBuf.String(), tc.wantOut) || (tc.wantOut == "" && outBuf.Len() > 0) {
+				t.Errorf("unexpected stdout %q, want %q", outBuf.String(), tc.wantOut)
+			}
+			if !strings.Contains(errBuf.String(), tc.wantErr) || (tc.wantErr == "" && errBuf.Len() > 0) {
+				t.Errorf("unexpected stderr %q, want %q", errBuf.String(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestAskConfirmation(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected bool
+	}{
+		{"Yes lowercase", "y\n", true},
+		{"Yes uppercase", "Y\n", true},
+		{"Yes full world", "yes\n", true},
+		{"Yes full word uppercase", "YES\n", true},
+		{"No lowercase", "n\n", false},
+		{"No full word", "\no", false},
+		{"Empty input", "\n", false},
+		{"With spaces", "  y\n", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Run(tc.name, func(t *testing.T) {
+				reader := strings.NewReader(tc.input)
+				result := askConfirmation(newIO(reader, io.Discard, io.Discard), "Test prompt: ", prompt.Options{})
+				if result != tc.expected {
+					t.Errorf("Expected %v, got %v for input %q", tc.expected, result, tc.input)
+				}
+			})
+		})
+	}
+}
+
+// setupTestDir creates a temporary directory for testing with automatic cleanup
+func setUpTestDir(t *testing.T) string {
+	return t.TempDir()
+}
+
+// createTestGzFile createa a gzipped file with the given content
+func createTestGzFile(t *testing.T, dir, filename, content string) {
+	fullPath := filepath.Join(dir, filename+".gz")
+
+	// Create directory if needed
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		t.Fatalf("Failed to created dir for %s: %v", fullPath, err)
+	}
+
+	file, err := os.Create(fullPath)
+	if err != nil {
+		t.Fatalf("Failed to created file %s: %v", fullPath, err)
+	}
+
+	defer file.Close()
+
+	zw := gzip.NewWriter(file)
+	zw.Name = filename
+	zw.ModTime = time.Now()
+
+	if _, err := io.WriteString(zw, content); err != nil {
+		t.Fatalf("Failed to write content to %s: %v", fullPath, err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close gzip writer for %s: %v", fullPath, err)
+	}
+
+}
+
+// TestArchive checks that archive writes .gz files that restore can read back.
+func TestArchive(t *testing.T) {
+	testCases := []struct {
+		name            string
+		opts            archiveOptions
+		wantErr         bool
+		wantErrContains string
+		wantRestored    map[string]string // map[relative path]content
+		wantNotRestored []string
+	}{
+		{
+			name: "Round trip",
+			opts: archiveOptions{level: gzip.DefaultCompression},
+			wantRestored: map[string]string{
+				"a.txt":       "alpha",
+				"b.log":       "bravo",
+				"sub/c.txt":   "charlie",
+				"cache/d.txt": "delta",
+			},
+		},
+		{
+			name: "Include and exclude filters",
+			opts: archiveOptions{
+				include: []string{"*.txt"},
+				exclude: []string{"cache"},
+				level:   gzip.BestCompression,
+			},
+			wantRestored: map[string]string{
+				"a.txt":     "alpha",
+				"sub/c.txt": "charlie",
+			},
+			wantNotRestored: []string{"b.log", "cache/d.txt"},
+		},
+		{
+			name:            "Invalid level",
+			opts:            archiveOptions{level: 42},
+			wantErr:         true,
+			wantErrContains: "invalid compression level",
+		},
+		{
+			name:            "Invalid pattern",
+			opts:            archiveOptions{exclude: []string{"[a-"}},
+			wantErr:         true,
+			wantErrContains: "invalid pattern",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stdio := newIO(nil, io.Discard, io.Discard)
+
+			sourceDir := setUpTestDir(t)
+			files := map[string]string{
+				"a.txt":       "alpha",
+				"b.log":       "bravo",
+				"sub/c.txt":   "charlie",
+				"cache/d.txt": "delta",
+			}
+			for name, content := range files {
+				path := filepath.Join(sourceDir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatalf("Failed to create dir for %s: %v", path, err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatalf("Failed to write %s: %v", path, err)
+				}
+			}
+
+			// Put the archive inside the source to check it is not archived itself.
+			archiveDir := filepath.Join(sourceDir, "archive")
+			err := archive(stdio, sourceDir, archiveDir, tc.opts)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, but got nil")
+				} else if !strings.Contains(err.Error(), tc.wantErrContains) {
+					t.Errorf("expected error to contain %q, got %q", tc.wantErrContains, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Archive failed: %v", err)
+			}
+
+			destDir := setUpTestDir(t)
+			if err := restore(archiveDir, destDir, restoreOptions{force: true, stdio: stdio}); err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+
+			for name, want := range tc.wantRestored {
+				content, err := os.ReadFile(filepath.Join(destDir, name))
+				if err != nil {
+					t.Errorf("Failed to read restored file %s: %v", name, err)
+					continue
+				}
+				if string(content) != want {
+					t.Errorf("Expected %q for %s, got %q", want, name, string(content))
+				}
+			}
+
+			for _, name := range tc.wantNotRestored {
+				if _, err := os.Stat(filepath.Join(destDir, name)); err == nil {
+					t.Errorf("File %s should not have been archived", name)
+				}
+			}
+
+			if _, err := os.Stat(filepath.Join(destDir, "archive")); err == nil {
+				t.Errorf("Archive directory should not have been archived into itself")
+			}
+		})
+	}
+}
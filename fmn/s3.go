@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// s3API is the part of the S3 client that s3FS uses, so tests can supply an
+// in-memory store.
+type s3API interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+// s3FS presents an S3 bucket as a filesystem. Each file is an object keyed
+// by its slash-separated path; directories are the key prefixes in between
+// and exist as long as some object lies below them. Objects have no modes or
+// settable times, so Chmod and Chtimes do nothing and MkdirAll has nothing
+// to create.
+type s3FS struct {
+	client s3API
+	bucket string
+}
+
+// dialS3 returns the bucket named by u, e.g. s3://bucket/prefix/, using the
+// credentials and region of the standard AWS environment and config files.
+func dialS3(u *url.URL) (*s3FS, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &s3FS{client: s3.NewFromConfig(cfg), bucket: u.Host}, nil
+}
+
+// key converts a path built by the copy code into an object key.
+func (s *s3FS) key(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// s3PathError converts an S3 error into a *fs.PathError, mapping missing
+// objects and denied access to the fs errors the copy code checks for.
+func s3PathError(op, name string, err error) error {
+	var notFound *types.NotFound
+	var noSuchKey *types.NoSuchKey
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &notFound), errors.As(err, &noSuchKey):
+		err = fs.ErrNotExist
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied":
+		err = fs.ErrPermission
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (s *s3FS) Stat(name string) (fs.FileInfo, error) {
+	// The bucket itself, and prefixes given with a trailing slash as in
+	// s3://bucket/prefix/, are directories even before anything lies below
+	key := s.key(name)
+	if key == "" || strings.HasSuffix(filepath.ToSlash(name), "/") {
+		return s3FileInfo{name: path.Base("/" + key), dir: true}, nil
+	}
+
+	head, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return s3FileInfo{name: path.Base(key), size: aws.ToInt64(head.ContentLength), modTime: aws.ToTime(head.LastModified)}, nil
+	}
+	if pathErr := s3PathError("stat", name, err); !errors.Is(pathErr, fs.ErrNotExist) {
+		return nil, pathErr
+	}
+
+	// Not an object, but it is a directory if anything lies below it
+	list, err := s.client.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(key + "/"),
+		MaxKeys: aws.Int32(1),
+	})
+	if err != nil {
+		return nil, s3PathError("stat", name, err)
+	}
+	if len(list.Contents) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return s3FileInfo{name: path.Base(key), dir: true}, nil
+}
+
+// Lstat is Stat; object storage has no symlinks.
+func (s *s3FS) Lstat(name string) (fs.FileInfo, error) { return s.Stat(name) }
+
+func (s *s3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	prefix := s.key(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var entries []fs.DirEntry
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	for {
+		list, err := s.client.ListObjectsV2(context.Background(), input)
+		if err != nil {
+			return nil, s3PathError("readdir", name, err)
+		}
+		for _, p := range list.CommonPrefixes {
+			dir := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(p.Prefix), prefix), "/")
+			entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{name: dir, dir: true}))
+		}
+		for _, obj := range list.Contents {
+			file := strings.TrimPrefix(aws.ToString(obj.Key), prefix)
+			if file == "" {
+				continue // a marker object for the directory itself
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{name: file, size: aws.ToInt64(obj.Size), modTime: aws.ToTime(obj.LastModified)}))
+		}
+		if !aws.ToBool(list.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = list.NextContinuationToken
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (s *s3FS) Open(name string) (fs.File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return s3File{info: info, body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+
+	obj, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return nil, s3PathError("open", name, err)
+	}
+	return s3File{info: info, body: obj.Body}, nil
+}
+
+// Create returns a writer that uploads the object when it is closed. The
+// data is staged in a temporary file so the upload has a known length.
+func (s *s3FS) Create(name string) (io.WriteCloser, error) {
+	tmp, err := os.CreateTemp("", "fmn-s3-*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Upload{fsys: s, name: name, tmp: tmp}, nil
+}
+
+func (s *s3FS) MkdirAll(path string, perm fs.FileMode) error { return nil }
+
+func (s *s3FS) Remove(name string) error {
+	_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return s3PathError("remove", name, err)
+	}
+	return nil
+}
+
+func (s *s3FS) Chmod(name string, mode fs.FileMode) error { return nil }
+
+func (s *s3FS) Chtimes(name string, atime, mtime time.Time) error { return nil }
+
+// Close does nothing; the S3 client holds no connection of its own.
+func (s *s3FS) Close() error { return nil }
+
+// s3Upload stages the data written to a new object in a temporary file.
+type s3Upload struct {
+	fsys *s3FS
+	name string
+	tmp  *os.File
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) { return u.tmp.Write(p) }
+
+// Close uploads the staged data and removes the temporary file.
+func (u *s3Upload) Close() error {
+	defer os.Remove(u.tmp.Name())
+	defer u.tmp.Close()
+
+	if _, err := u.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := u.fsys.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(u.fsys.bucket),
+		Key:    aws.String(u.fsys.key(u.name)),
+		Body:   u.tmp,
+	})
+	if err != nil {
+		return s3PathError("upload", u.name, err)
+	}
+	return nil
+}
+
+// s3File is an object opened for reading.
+type s3File struct {
+	info fs.FileInfo
+	body io.ReadCloser
+}
+
+func (f s3File) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f s3File) Read(p []byte) (int, error) { return f.body.Read(p) }
+func (f s3File) Close() error               { return f.body.Close() }
+
+// s3FileInfo describes an object or a key prefix.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i s3FileInfo) Name() string       { return i.name }
+func (i s3FileInfo) Size() int64        { return i.size }
+func (i s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i s3FileInfo) IsDir() bool        { return i.dir }
+func (i s3FileInfo) Sys() any           { return nil }
+
+func (i s3FileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
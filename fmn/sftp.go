@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"yanmifeakeju/fmn/copyfs"
+)
+
+// sftpFS is a remote filesystem reached over SSH. Paths are converted to
+// slash form, since the copy code builds them with filepath.
+type sftpFS struct {
+	client *sftp.Client
+	conn   *ssh.Client // nil when the client runs over another transport
+}
+
+// dialSFTP connects to the host in u, e.g. sftp://user@host:2222/path.
+// The host key must be listed in ~/.ssh/known_hosts. Authentication uses the
+// password in the URL if there is one, then the SSH agent, then the default
+// unencrypted keys in ~/.ssh.
+func dialSFTP(u *url.URL) (*sftpFS, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	knownHosts := filepath.Join(home, ".ssh", "known_hosts")
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, copyfs.NewFileError("read known hosts", knownHosts, err)
+	}
+
+	name := u.User.Username()
+	if name == "" {
+		if current, err := user.Current(); err == nil {
+			name = current.Username
+		}
+	}
+
+	config := &ssh.ClientConfig{
+		User:            name,
+		Auth:            sshAuthMethods(u, home),
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to '%s': %w", addr, err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot start sftp on '%s': %w", addr, err)
+	}
+	return &sftpFS{client: client, conn: conn}, nil
+}
+
+// sshAuthMethods lists the ways dialSFTP tries to log in.
+func sshAuthMethods(u *url.URL, home string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if password, ok := u.User.Password(); ok {
+		methods = append(methods, ssh.Password(password))
+	}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		key, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(key); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods
+}
+
+func (s *sftpFS) Stat(name string) (fs.FileInfo, error) {
+	return s.client.Stat(filepath.ToSlash(name))
+}
+
+func (s *sftpFS) Lstat(name string) (fs.FileInfo, error) {
+	return s.client.Lstat(filepath.ToSlash(name))
+}
+
+func (s *sftpFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := s.client.ReadDir(filepath.ToSlash(name))
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorted by name, like os.ReadDir
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (s *sftpFS) Open(name string) (fs.File, error) {
+	return s.client.Open(filepath.ToSlash(name))
+}
+
+func (s *sftpFS) Create(name string) (io.WriteCloser, error) {
+	return s.client.Create(filepath.ToSlash(name))
+}
+
+// MkdirAll creates path with the server's default permissions; perm is
+// ignored, as SFTP has no portable way to apply it to parents only.
+func (s *sftpFS) MkdirAll(path string, perm fs.FileMode) error {
+	return s.client.MkdirAll(filepath.ToSlash(path))
+}
+
+func (s *sftpFS) Remove(name string) error {
+	return s.client.Remove(filepath.ToSlash(name))
+}
+
+func (s *sftpFS) Rename(oldpath, newpath string) error {
+	return s.client.PosixRename(filepath.ToSlash(oldpath), filepath.ToSlash(newpath))
+}
+
+func (s *sftpFS) Readlink(name string) (string, error) {
+	return s.client.ReadLink(filepath.ToSlash(name))
+}
+
+func (s *sftpFS) Symlink(oldname, newname string) error {
+	return s.client.Symlink(oldname, filepath.ToSlash(newname))
+}
+
+func (s *sftpFS) Chown(name string, uid, gid int) error {
+	return s.client.Chown(filepath.ToSlash(name), uid, gid)
+}
+
+func (s *sftpFS) Chmod(name string, mode fs.FileMode) error {
+	return s.client.Chmod(filepath.ToSlash(name), mode)
+}
+
+func (s *sftpFS) Chtimes(name string, atime, mtime time.Time) error {
+	return s.client.Chtimes(filepath.ToSlash(name), atime, mtime)
+}
+
+// Close ends the SFTP session and the SSH connection under it.
+func (s *sftpFS) Close() error {
+	err := s.client.Close()
+	if s.conn != nil {
+		err = errors.Join(err, s.conn.Close())
+	}
+	return err
+}
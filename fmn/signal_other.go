@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// watchStatusSignal does nothing; there is no SIGUSR1 outside Unix.
+func watchStatusSignal(report func()) {}
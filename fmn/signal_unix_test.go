@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestStatusSignal checks that SIGUSR1 triggers the status report.
+func TestStatusSignal(t *testing.T) {
+	reported := make(chan struct{}, 1)
+	watchStatusSignal(func() { reported <- struct{}{} })
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reported:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no report after SIGUSR1")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"yanmifeakeju/fmn/copyfs"
+	"yanmifeakeju/fmn/internal/timefmt"
+)
+
+// fileStat is the detailed information about one file printed by fmn stat.
+// Fields that need platform support (blocks, owner, inode, ...) are left at
+// their zero value where the platform doesn't provide them.
+type fileStat struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Blocks   int64     `json:"blocks"`
+	Mode     string    `json:"mode"`
+	Octal    string    `json:"octal"`
+	UID      uint32    `json:"uid"`
+	User     string    `json:"user,omitempty"`
+	GID      uint32    `json:"gid"`
+	Group    string    `json:"group,omitempty"`
+	Accessed time.Time `json:"accessed"`
+	Modified time.Time `json:"modified"`
+	Changed  time.Time `json:"changed"`
+	Inode    uint64    `json:"inode"`
+	Links    uint64    `json:"links"`
+}
+
+// statFiles prints detailed information about each path to stdio, like stat(1).
+// Symlinks are described themselves rather than followed. With asJSON the
+// output is a JSON array with one object per path.
+func statFiles(stdio *IO, paths []string, asJSON bool, tf timefmt.Layout) error {
+	var stats []fileStat
+	var errs []error
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			errs = append(errs, copyfs.NewFileError("stat", path, err))
+			continue
+		}
+		stats = append(stats, newFileStat(path, info))
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(stdio.Out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(stats); err != nil {
+			return err
+		}
+	} else {
+		for _, st := range stats {
+			printFileStat(stdio.Out, st, tf)
+		}
+	}
+
+	if len(errs) > 0 && len(stats) > 0 {
+		return &copyfs.PartialError{Err: errors.Join(errs...)}
+	}
+	return errors.Join(errs...)
+}
+
+// newFileStat collects the portable fields from info and lets the platform
+// fill in the rest.
+func newFileStat(path string, info fs.FileInfo) fileStat {
+	st := fileStat{
+		Name:     path,
+		Size:     info.Size(),
+		Mode:     info.Mode().String(),
+		Octal:    fmt.Sprintf("%04o", octalMode(info.Mode())),
+		Accessed: info.ModTime(),
+		Modified: info.ModTime(),
+		Changed:  info.ModTime(),
+	}
+	sysFileStat(info, &st)
+
+	if u, err := user.LookupId(strconv.FormatUint(uint64(st.UID), 10)); err == nil {
+		st.User = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.FormatUint(uint64(st.GID), 10)); err == nil {
+		st.Group = g.Name
+	}
+	return st
+}
+
+// octalMode converts a FileMode to the traditional Unix permission bits,
+// including setuid, setgid and sticky.
+func octalMode(mode fs.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// printFileStat writes st to w in a layout similar to GNU stat, with
+// timestamps rendered by tf.
+func printFileStat(w io.Writer, st fileStat, tf timefmt.Layout) {
+	fmt.Fprintf(w, "  File: %s\n", st.Name)
+	fmt.Fprintf(w, "  Size: %-12d Blocks: %-10d Links: %d\n", st.Size, st.Blocks, st.Links)
+	fmt.Fprintf(w, " Inode: %d\n", st.Inode)
+	fmt.Fprintf(w, "Access: (%s/%s)  Uid: (%d/%s)  Gid: (%d/%s)\n",
+		st.Octal, st.Mode, st.UID, st.User, st.GID, st.Group)
+	fmt.Fprintf(w, "Access: %s\n", tf.Format(st.Accessed))
+	fmt.Fprintf(w, "Modify: %s\n", tf.Format(st.Modified))
+	fmt.Fprintf(w, "Change: %s\n", tf.Format(st.Changed))
+}
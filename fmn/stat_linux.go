@@ -0,0 +1,22 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// sysFileStat fills the fields of st that come from the Linux stat structure.
+func sysFileStat(info fs.FileInfo, st *fileStat) {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	st.Blocks = int64(sys.Blocks)
+	st.UID = sys.Uid
+	st.GID = sys.Gid
+	st.Inode = uint64(sys.Ino)
+	st.Links = uint64(sys.Nlink)
+	st.Accessed = time.Unix(sys.Atim.Unix())
+	st.Changed = time.Unix(sys.Ctim.Unix())
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package main
+
+import "io/fs"
+
+// sysFileStat is a no-op on platforms without a Unix stat structure; only
+// the portable fields of st are reported.
+func sysFileStat(info fs.FileInfo, st *fileStat) {}
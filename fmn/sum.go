@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"yanmifeakeju/fmn/copyfs"
+)
+
+// sumFiles prints "<hash>  <path>" for each path to stdio, in the format of
+// sha256sum and friends. Directories are hashed file by file when recursive
+// is set and rejected otherwise.
+func sumFiles(stdio *IO, paths []string, algo string, recursive bool) error {
+	if _, err := copyfs.NewHash(algo); err != nil {
+		return err
+	}
+
+	fsys := copyfs.OSFS{}
+	var errs []error
+	var summed int
+	sum := func(path string) {
+		digest, err := copyfs.HashFile(fsys, path, algo)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		fmt.Fprintf(stdio.Out, "%s  %s\n", digest, path)
+		summed++
+	}
+
+	for _, path := range paths {
+		info, err := fsys.Stat(path)
+		if err != nil {
+			errs = append(errs, copyfs.NewFileError("stat", path, err))
+			continue
+		}
+
+		if !info.IsDir() {
+			sum(path)
+			continue
+		}
+
+		if !recursive {
+			errs = append(errs, &copyfs.FileError{Op: "hash", Path: path, Err: copyfs.ErrOmitDirectory})
+			continue
+		}
+
+		err = copyfs.WalkDir(fsys, path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				errs = append(errs, copyfs.NewFileError("read", p, err))
+				return nil
+			}
+			if d.Type().IsRegular() {
+				sum(p)
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 && summed > 0 {
+		return &copyfs.PartialError{Err: errors.Join(errs...)}
+	}
+	return errors.Join(errs...)
+}
+
+// checkManifest verifies the files listed in a "<hash>  <path>" manifest,
+// printing OK, FAILED or MISSING for each to stdio. A manifest of "-" is read
+// from stdio's input.
+func checkManifest(stdio *IO, manifest, algo string) error {
+	if _, err := copyfs.NewHash(algo); err != nil {
+		return err
+	}
+
+	r := stdio.In
+	if manifest != "-" {
+		f, err := os.Open(manifest)
+		if err != nil {
+			return copyfs.NewFileError("open manifest", manifest, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var failed, missing, malformed int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		// "<hash>  <path>", or "<hash> *<path>" for files hashed in binary mode
+		want, path, ok := strings.Cut(line, " ")
+		if !ok || len(path) < 2 || (path[0] != ' ' && path[0] != '*') {
+			malformed++
+			continue
+		}
+		path = path[1:]
+
+		got, err := copyfs.HashFile(copyfs.OSFS{}, path, algo)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			fmt.Fprintf(stdio.Out, "%s: MISSING\n", path)
+			missing++
+		case err != nil:
+			fmt.Fprintf(stdio.Out, "%s: FAILED open or read\n", path)
+			failed++
+		case !strings.EqualFold(got, want):
+			fmt.Fprintf(stdio.Out, "%s: FAILED\n", path)
+			failed++
+		default:
+			fmt.Fprintf(stdio.Out, "%s: OK\n", path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return copyfs.NewFileError("read manifest", manifest, err)
+	}
+
+	var errs []error
+	if malformed > 0 {
+		errs = append(errs, fmt.Errorf("%d line(s) are improperly formatted", malformed))
+	}
+	if failed > 0 {
+		errs = append(errs, fmt.Errorf("%d computed checksum(s) did NOT match", failed))
+	}
+	if missing > 0 {
+		errs = append(errs, fmt.Errorf("%d listed file(s) are missing", missing))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"yanmifeakeju/fmn/internal/timefmt"
+)
+
+// timeBound is a flag.Value for a modification time bound, written as an
+// RFC3339 time or as the path of a file whose modification time is used,
+// like find -newer.
+type timeBound time.Time
+
+func (b *timeBound) String() string {
+	if b == nil || time.Time(*b).IsZero() {
+		return ""
+	}
+	return time.Time(*b).Format(time.RFC3339)
+}
+
+func (b *timeBound) Set(s string) error {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		*b = timeBound(t)
+		return nil
+	}
+	info, err := os.Stat(s)
+	if err != nil {
+		return fmt.Errorf("'%s' is neither an RFC3339 time such as 2006-01-02T15:04:05Z nor an existing file", s)
+	}
+	*b = timeBound(info.ModTime())
+	return nil
+}
+
+// addTimeFormatFlag defines the -time-format flag, and -time-style as its
+// ls spelling.
+func addTimeFormatFlag(fs *flag.FlagSet, f *timefmt.Layout) {
+	fs.Var(f, "time-format", "Print timestamps as `layout`: default, iso, full-iso, rfc3339, unix or a Go reference layout")
+	fs.Var(f, "time-style", "Print timestamps as `layout`; same as -time-format")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"yanmifeakeju/fmn/copyfs"
+)
+
+// Connectors drawn by ls -tree.
+const (
+	treeBranch   = "├── "
+	treeLast     = "└── "
+	treeVertical = "│   "
+	treeBlank    = "    "
+)
+
+// printTree prints the directory at root, described by rootInfo, as an
+// indented tree like tree(1), with root as the label of the first line.
+// Entries are filtered and sorted as in a plain listing. Under -L symlinks to
+// directories are followed, and one leading back to a directory already on
+// the current path is marked [loop] instead of being entered again. A
+// directory that cannot be read is logged and the rest of the tree is still
+// printed. Under -summary one total for the whole tree follows it.
+// printTree reports whether root itself was read and whether any
+// directory failed.
+func printTree(cmd command, root string, rootInfo os.FileInfo) (ok, failed bool) {
+	printPath(cmd.stdio.Out, root)
+	var totals listTotals
+
+	var walk func(dir, prefix string, ancestors []os.FileInfo) error
+	walk = func(dir, prefix string, ancestors []os.FileInfo) error {
+		entries, err := readDirEntries(cmd, dir)
+		if err != nil {
+			logListError(cmd, copyfs.NewFileError("read directory", dir, err))
+			failed = true
+		}
+
+		for i, d := range entries {
+			connector, indent := treeBranch, treeVertical
+			if i == len(entries)-1 {
+				connector, indent = treeLast, treeBlank
+			}
+			name := entryLabel(cmd, d.Name(), d)
+
+			path := filepath.Join(dir, d.Name())
+			info, isDir := treeDirInfo(cmd, path, d)
+			if isDir && slices.ContainsFunc(ancestors, func(a os.FileInfo) bool { return copyfs.IsSameFile(a, info) }) {
+				fmt.Fprintf(cmd.stdio.Out, "%s%s%s [loop]\n", prefix, connector, name)
+				continue
+			}
+			fmt.Fprintf(cmd.stdio.Out, "%s%s%s\n", prefix, connector, name)
+			totals.add(d)
+			if isDir {
+				walk(path, prefix+indent, append(ancestors[:len(ancestors):len(ancestors)], info))
+			}
+		}
+		return err
+	}
+
+	ok = walk(root, "", []os.FileInfo{rootInfo}) == nil
+	totals.print(cmd)
+	return ok, failed
+}
+
+// treeDirInfo reports whether the entry d at path is a directory the tree
+// descends into, with its info for loop detection. Symlinks only count,
+// as the directory they point to, under -L.
+func treeDirInfo(cmd command, path string, d fs.DirEntry) (os.FileInfo, bool) {
+	if d.Type()&fs.ModeSymlink != 0 && cmd.dereference {
+		info, err := cmd.filesystem().Stat(path)
+		return info, err == nil && info.IsDir()
+	}
+	if !d.IsDir() {
+		return nil, false
+	}
+	info, _ := d.Info()
+	return info, true
+}
@@ -0,0 +1,37 @@
+// Package version holds the build metadata printed by fmn --version. The
+// values are injected at build time, e.g.
+//
+//	go build -ldflags "-X yanmifeakeju/fmn/version.Version=v1.2.0 -X yanmifeakeju/fmn/version.Commit=$(git rev-parse --short HEAD)"
+//
+// The Makefile's build target sets all three.
+package version
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build metadata, overridden with -ldflags -X.
+var (
+	Version = "dev"
+	Commit  = "none"
+	Date    = "unknown"
+)
+
+// String returns the version, commit and build date on one line. When the
+// commit or date weren't injected, it falls back to the VCS information the
+// Go toolchain embeds in the binary, if any.
+func String() string {
+	commit, date := Commit, Date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "none":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && date == "unknown":
+				date = setting.Value
+			}
+		}
+	}
+	return fmt.Sprintf("%s (commit %s, built %s)", Version, commit, date)
+}
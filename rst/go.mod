@@ -1,3 +0,0 @@
-module yanmifeakeju/rst
-
-go 1.24.5